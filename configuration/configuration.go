@@ -19,11 +19,14 @@
 package configuration
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"flag"
-	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/andmarios/bashistdb/llog"
 )
@@ -39,50 +42,254 @@ const (
 var (
 	// These are used as actual flagvars
 	database      = os.Getenv("HOME") + "/.bashistdb.sqlite3"
+	dbPerm        = "0600"
+	dbMode        = os.FileMode(0600) // dbPerm, parsed
+	readOnlySet   = false
+	keyHostSet    = false
+	rejectsFile   = ""
+	maxCmdBytes   = 0
+	slowQuery     = 250 * time.Millisecond
+	policyFile    = ""
+	hooksFile     = ""
+	upstream      = ""
+	gzipSet       = false
+	syncSet       = false
+	displayTZ     = "Local"
+	displayFormat = "2006-01-02 15:04:05"
 	versionSet    = false
 	verbosity     = 0
-	user          = os.Getenv("USER")
-	host, _       = os.Hostname()
+	quietSet      = false
+	debugSet      = false
+	user          = detected.user
+	host          = detected.host
 	serverSet     = false
 	remote        = os.Getenv("BASHISTDB_REMOTE")
 	port          = os.Getenv("BASHISTDB_PORT")
 	passphrase    = os.Getenv("BASHISTDB_KEY")
+	keySalt       = os.Getenv("BASHISTDB_KEY_SALT")
+	authMode      = os.Getenv("BASHISTDB_AUTH_MODE")
+	keyFile       = os.Getenv("BASHISTDB_KEY_FILE")
+	profile       = os.Getenv("BASHISTDB_PROFILE")
+	oldKeys       stringList
+	userKeys      stringList
 	format        = FORMAT_DEFAULT
+	timeLayout    = ""
 	helpSet       = false
 	globalSet     = false
 	writeconfSet  = false
 	setupSet      = false
 	topk          = 20
 	lastk         = 20
+	maxK          = 10000
+	limit         = 0
+	offset        = 0
+	sortOrder     = SORT_DESC
+	excludeCmd    = ""
+	excludeUser   = ""
+	excludeHost   = ""
 	localSet      = false
 	uniqueSet     = false
+	distinctSet   = false
 	usersSet      = false
+	bySourceSet   = false
+	source        = ""
 	row           = 0
 	delRows       = ""
 	regexSet      = false
 	afterContent  = 5
 	beforeContent = 5
 	content       = 5
+	logFile       = ""
+	logJSONSet    = false
+	logSyslogSet  = false
+	afterCommand  = ""
+	beforeCommand = ""
+	window        = 300
+	onThisDaySet  = false
+	chainsSet     = false
+	ngram         = 2
+	top           = 20
+	infoSet       = false
+	sudoStatsSet  = false
+	recurringSet  = false
+	prefixesSet   = false
+	cdStatsSet    = false
+	editorsSet    = false
+	gitStatsSet   = false
+	prefixLen     = 10
+	minOccurrence = 5
+	aliasesSet    = false
+	minCount      = 10
+	backgroundSet = false
+	pipelinesSet  = false
+	redirectsSet  = false
+	reportSet     = false
+	report        = ""
+	recentHostSet = false
+	recentUserSet = false
+	inactiveSet   = false
+	auditSet      = false
+	auditRules    = ""
+	auditDisable  = ""
+	annotate      = ""
+	note          = ""
+	listAnnotSet  = false
+	followSet     = false
+	flushCacheSet = false
+	rotateKey     = ""
+	rotateKeyFile = ""
+	rotateKeySet  = false
+	rotateGrace   = 24 * time.Hour
+	cacheTTL      = 30 * time.Second
+	queryLogSet   = false
+	auditLogSet   = false
+	auditSumSet   = false
+	dateFrom      = ""
+	dateTo        = ""
+	queryLogKeep  = 720 * time.Hour
+	multi         = ""
+	watch         = time.Duration(0)
+	noClearSet    = false
+	record        = ""
+	decay         = "90d"
+	since         = "7d"
+	tagCommand    = ""
+	tagName       = ""
+	filterTag     = ""
+	listTagsSet   = false
+	statusSet     = false
+	checkSet      = false
+	archive       = ""
+	renameHost    = ""
+	renameUser    = ""
+	dryRunSet     = false
+	normalizeSet  = false
+	stripDomains  = ""
+	normExistSet  = false
+	olderThan     = "90d"
+	suggest       = ""
+	favorite      = ""
+	unfavorite    = ""
+	listFavSet    = false
+	inclFavSet    = false
+	highlightMark = ""
+	anonymize     = ""
+	anonSalt      = ""
+	explainSet    = false
+	caseSensSet   = false
+	fuzzySet      = false
+	top24hSet     = false
+	undoImport    = "last"
+	listImpSet    = false
+	listProfSet   = false
+	topWeekSet    = false
+	colorSet      = false
+	noColorSet    = false
+	queryUser     = ""
+	queryHost     = ""
+	envUsageSet   = false
+	sessionsSet   = false
+	sessionShow   = 0
+	sessionGap    = 30
+	trend         = ""
+	bucket        = BUCKET_MONTH
 	// Custom Flags that need custom (non-flag package code) to parse and set. //
 	// These are not parsed from flags but we set them with flag.Visit
 	userSet          = false
+	sinceSet         = false
+	dateFromSet      = false
+	dateToSet        = false
 	hostSet          = false
 	remoteSet        = false
 	topkSet          = false
 	lastkSet         = false
+	limitSet         = false
 	rowSet           = false
 	delRowsSet       = false
 	afterContentSet  = false
 	beforeContentSet = false
 	contentSet       = false
+	afterCommandSet  = false
+	beforeCommandSet = false
+	queryUserSet     = false
+	queryHostSet     = false
+	trendSet         = false
+	sessionShowSet   = false
+	annotateSet      = false
+	noteSet          = false
+	decaySet         = false
+	tagSet           = false
+	tagNameSet       = false
+	undoImportSet    = false
+	archiveSet       = false
+	olderSet         = false
+	renameHostSet    = false
+	renameUserSet    = false
+	filterTagSet     = false
+	suggestSet       = false
+	favoriteSet      = false
+	unfavoriteSet    = false
+	multiSet         = false
+	recordSet        = false
+	keySet           = false
 	// These are set with manual searches
-	querySet = false
-	stdinSet = false
+	querySet       = false
+	stdinSet       = false
+	stdoutTerminal = false
 	// Vars below can not be overriden by user
 	confFile      = os.Getenv("HOME") + "/.bashistdb.conf"
 	foundConfFile = false
+	detected      = detectIdentity()
 )
 
+// stringList is a flag that may be set many times.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// parseDays parses a duration given in days (90d) or as a Go duration
+// (720h). Durations that aren't positive are an error.
+func parseDays(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+	if strings.HasSuffix(s, "d") {
+		var days float64
+		days, err = strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		d = time.Duration(days * float64(24*time.Hour))
+	} else {
+		d, err = time.ParseDuration(s)
+	}
+	if err == nil && d <= 0 {
+		err = errors.New("not positive")
+	}
+	return d, err
+}
+
+// parseDate parses a date (2015-10-12), in local time, or an RFC3339 time.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// parseHalfLife parses a half-life given in days (90d) or as a Go duration
+// (720h).
+func parseHalfLife(s string) (time.Duration, error) {
+	d, err := parseDays(s)
+	if err != nil {
+		return 0, errors.New("Could not parse half-life for -decay, use something like 90d: " + s)
+	}
+	return d, nil
+}
+
 // Set visited flags so we may have boolean expression criteria
 func setVisitedFlags(f *flag.Flag) {
 	switch f.Name {
@@ -92,10 +299,18 @@ func setVisitedFlags(f *flag.Flag) {
 		hostSet = true
 	case "r", "remote":
 		remoteSet = true
+	case "k", "key":
+		keySet = true
 	case "topk":
 		topkSet = true
 	case "lastk", "tail":
 		lastkSet = true
+	case "rotate-key", "rotate-key-file":
+		rotateKeySet = true
+	case "report":
+		reportSet = true
+	case "limit":
+		limitSet = true
 	case "row":
 		rowSet = true
 	case "del":
@@ -106,6 +321,56 @@ func setVisitedFlags(f *flag.Flag) {
 		beforeContentSet = true
 	case "C":
 		contentSet = true
+	case "query-user":
+		queryUserSet = true
+	case "query-host":
+		queryHostSet = true
+	case "trend":
+		trendSet = true
+	case "session-show":
+		sessionShowSet = true
+	case "annotate":
+		annotateSet = true
+	case "note":
+		noteSet = true
+	case "decay":
+		decaySet = true
+	case "since":
+		sinceSet = true
+	case "from":
+		dateFromSet = true
+	case "to":
+		dateToSet = true
+	case "tag":
+		tagSet = true
+	case "tag-name":
+		tagNameSet = true
+	case "filter-tag":
+		filterTagSet = true
+	case "suggest":
+		suggestSet = true
+	case "favorite":
+		favoriteSet = true
+	case "unfavorite":
+		unfavoriteSet = true
+	case "multi":
+		multiSet = true
+	case "record":
+		recordSet = true
+	case "undo-import":
+		undoImportSet = true
+	case "archive":
+		archiveSet = true
+	case "older":
+		olderSet = true
+	case "rename-host":
+		renameHostSet = true
+	case "rename-user":
+		renameUserSet = true
+	case "after":
+		afterCommandSet = true
+	case "before":
+		beforeCommandSet = true
 	}
 }
 
@@ -125,6 +390,11 @@ func parseCustomFlags() {
 	if (stats.Mode() & os.ModeCharDevice) != os.ModeCharDevice {
 		stdinSet = true
 	}
+
+	// Detect if our output goes to a terminal, for -color's default.
+	if stats, err := os.Stdout.Stat(); err == nil {
+		stdoutTerminal = (stats.Mode() & os.ModeCharDevice) == os.ModeCharDevice
+	}
 }
 
 // checkFlagCombination checks if non-compatible flags were used
@@ -143,10 +413,88 @@ func checkFlagCombination() error {
 		return errors.New("Incompatible options: -lastk and -topk.")
 	}
 
-	if topkSet && uniqueSet {
+	if (topkSet && topk <= 0) || (lastkSet && lastk <= 0) {
+		return errors.New("Invalid K for -topk or -lastk, it must be positive.")
+	}
+
+	if (limitSet && limit <= 0) || offset < 0 {
+		return errors.New("Invalid -limit or -offset, -limit must be positive and -offset can't be negative.")
+	}
+
+	if limitSet && (topkSet || lastkSet) {
+		return errors.New("Incompatible options: -limit is the K of -topk and -lastk, use one of them.")
+	}
+
+	if keySet && keyFile != "" {
+		return errors.New("Incompatible options: -key and -key-file.")
+	}
+
+	if maxCmdBytes < 0 {
+		return errors.New("Invalid -max-command-bytes, it can't be negative: " + strconv.Itoa(maxCmdBytes))
+	}
+
+	perm, err := strconv.ParseUint(dbPerm, 8, 32)
+	if err != nil || perm > 0777 || perm&0600 != 0600 {
+		return errors.New("Invalid -db-perm, it is an octal mode like 0600, that lets you read and write: " + dbPerm)
+	}
+	dbMode = os.FileMode(perm)
+
+	if strings.ContainsAny(profile, " \t\n") {
+		return errors.New("Invalid -profile, it can't have spaces: " + profile)
+	}
+
+	if slowQuery < 0 {
+		return errors.New("Invalid -slow-query, it can't be negative: " + slowQuery.String())
+	}
+
+	if maxK <= 0 {
+		return errors.New("Invalid -max-k, it must be positive: " + strconv.Itoa(maxK))
+	}
+
+	if top24hSet && topWeekSet {
+		return errors.New("Incompatible options: -top-24h and -top-week.")
+	}
+
+	if (top24hSet || topWeekSet) && decaySet {
+		return errors.New("Incompatible options: -decay and one of -top-24h, -top-week.")
+	}
+
+	if (topkSet || top24hSet || topWeekSet) && uniqueSet {
 		return errors.New("Incompatible options: -topk and -unique.")
 	}
 
+	if decaySet && !topkSet {
+		return errors.New("Incompatible options: -decay works only with -topk.")
+	}
+
+	if sinceSet && !recentHostSet && !recentUserSet && !inactiveSet && !auditLogSet {
+		return errors.New("Incompatible options: -since works only with -recent-hosts, -recent-users, -inactive-users and -audit-log.")
+	}
+
+	if (dateFromSet || dateToSet) && !auditSumSet {
+		return errors.New("Incompatible options: -from and -to work only with -audit-summary.")
+	}
+
+	if olderSet && !archiveSet {
+		return errors.New("Incompatible options: -older works only with -archive.")
+	}
+
+	if dryRunSet && !renameHostSet && !renameUserSet && !normExistSet {
+		return errors.New("Incompatible options: -dry-run works only with -rename-host, -rename-user and -normalize-existing.")
+	}
+
+	if stripDomains != "" && !normalizeSet {
+		return errors.New("Incompatible options: -strip-domains works only with -normalize.")
+	}
+
+	if normExistSet && !normalizeSet {
+		return errors.New("Incompatible options: -normalize-existing needs -normalize, it gives names the spelling it imports them with.")
+	}
+
+	if normalizeSet && Mode == MODE_CLIENT {
+		return errors.New("Incompatible options: -normalize works only with a database, in local or server mode.")
+	}
+
 	if rowSet && (lastkSet || topkSet) {
 		return errors.New("Incompatible options: -rows and one of -lastk, -topk")
 	}
@@ -164,17 +512,260 @@ func checkFlagCombination() error {
 	}
 
 	if regexSet && (lastkSet || topkSet || rowSet || usersSet || delRowsSet) {
-		Log.Info.Println("R(egexp) flag works only for simple queries. For other types it works as an exact match flag.")
+		Log.Warn.Println("R(egexp) flag works only for simple queries. For other types it works as an exact match flag.")
 	}
 
 	if uniqueSet && (afterContentSet || beforeContentSet || contentSet) {
-		Log.Info.Println("u(nique) flag doesn't work with content, before, after search")
+		Log.Warn.Println("u(nique) flag doesn't work with content, before, after search")
 	}
 
 	if (afterContentSet || beforeContentSet || contentSet) && (lastkSet || topkSet || rowSet || usersSet || delRowsSet) {
 		return errors.New("Incompatible options: content search (-A, -B, -C) and a non standard query")
 	}
 
+	if afterCommandSet && beforeCommandSet {
+		return errors.New("Incompatible options: -after and -before.")
+	}
+
+	if keyHostSet && readOnlySet {
+		return errors.New("Incompatible options: -key-includes-host changes the database, it can't work with -readonly.")
+	}
+
+	if annotateSet != noteSet {
+		return errors.New("Incompatible options: -annotate and -note go together.")
+	}
+
+	if tagSet != tagNameSet {
+		return errors.New("Incompatible options: -tag and -tag-name go together.")
+	}
+
+	if distinctSet && QParams.Type != QUERY && QParams.Type != QUERY_LASTK {
+		return errors.New("Incompatible options: -distinct works only with searches and -lastk.")
+	}
+
+	if excludeCmd != "" || excludeUser != "" || excludeHost != "" {
+		switch {
+		case QParams.Type == QUERY && fuzzySet:
+			return errors.New("Incompatible options: -exclude-cmd, -exclude-user and -exclude-host with -fuzzy.")
+		case QParams.Type == QUERY, QParams.Type == QUERY_LASTK, QParams.Type == QUERY_TOPK,
+			QParams.Type == QUERY_TOPK_24H, QParams.Type == QUERY_TOPK_WEEK:
+		default:
+			return errors.New("Incompatible options: -exclude-cmd, -exclude-user and -exclude-host work only with searches, -topk and -lastk.")
+		}
+		if followSet {
+			return errors.New("Incompatible options: -exclude-cmd, -exclude-user and -exclude-host with -follow.")
+		}
+	}
+
+	if sortOrder != SORT_ASC && sortOrder != SORT_DESC {
+		return errors.New("Invalid -sort, it must be asc or desc: " + sortOrder)
+	}
+
+	if sortOrder == SORT_ASC {
+		switch QParams.Type {
+		case QUERY_LASTK, QUERY_TOPK, QUERY_TOPK_24H, QUERY_TOPK_WEEK:
+		default:
+			return errors.New("Incompatible options: -sort works only with -topk and -lastk.")
+		}
+		if followSet {
+			return errors.New("Incompatible options: -sort with -follow.")
+		}
+	}
+
+	if limitSet || offset != 0 {
+		switch QParams.Type {
+		case QUERY, QUERY_LASTK, QUERY_TOPK, QUERY_TOPK_24H, QUERY_TOPK_WEEK:
+		default:
+			return errors.New("Incompatible options: -limit and -offset work only with searches, -topk and -lastk.")
+		}
+		if followSet {
+			return errors.New("Incompatible options: -limit and -offset with -follow.")
+		}
+	}
+
+	if fuzzySet && (QParams.Type != QUERY || regexSet || !querySet) {
+		return errors.New("Incompatible options: -fuzzy works only with a plain search for a query term.")
+	}
+
+	if inclFavSet && format != FORMAT_BASH_HISTORY {
+		return errors.New("Incompatible options: -include-favorites works only with -format " + FORMAT_BASH_HISTORY + ".")
+	}
+
+	if highlightMark != "" {
+		if format != FORMAT_BASH_HISTORY || !querySet {
+			return errors.New("Incompatible options: -highlight works only with -format " + FORMAT_BASH_HISTORY + " and a query term.")
+		}
+		// A newline would break the restore format.
+		if strings.Count(highlightMark, "%s") != 1 || strings.Contains(highlightMark, "\n") {
+			return errors.New("Invalid -highlight, it needs a single %s and no newlines.")
+		}
+	}
+
+	if anonymize != "" {
+		for _, a := range strings.Split(anonymize, ",") {
+			if a != ANON_USERS && a != ANON_HOSTS && a != ANON_ARGS {
+				return errors.New("Invalid -anonymize, it is a list of users, hosts and args: " + anonymize)
+			}
+		}
+		if (QParams.Type != QUERY && QParams.Type != QUERY_LASTK) || fuzzySet || followSet ||
+			(format != FORMAT_JSON && format != FORMAT_NDJSON && format != FORMAT_EXPORT) {
+			return errors.New("Incompatible options: -anonymize works only with searches and -lastk, with -format " +
+				FORMAT_JSON + ", " + FORMAT_NDJSON + " or " + FORMAT_EXPORT + ".")
+		}
+	}
+
+	if caseSensSet {
+		switch QParams.Type {
+		case QUERY, QUERY_CONTENT, QUERY_LASTK, QUERY_TOPK, QUERY_TOPK_24H, QUERY_TOPK_WEEK:
+		default:
+			return errors.New("Incompatible options: -case-sensitive works only with searches, -topk and -lastk.")
+		}
+		if fuzzySet || followSet {
+			return errors.New("Incompatible options: -case-sensitive with -fuzzy or -follow.")
+		}
+	}
+
+	if explainSet && (Operation != OP_QUERY || QParams.Writes() || followSet) {
+		return errors.New("Incompatible options: -explain works only with queries that don't change the database.")
+	}
+
+	if anonSalt != "" && anonymize == "" {
+		return errors.New("Incompatible options: -anonymize-salt goes with -anonymize.")
+	}
+
+	if countSet(queryTypeFlags()...) > 1 {
+		return errors.New("Incompatible options: more than one type of query")
+	}
+
+	if querySet && countSet(afterCommandSet, beforeCommandSet, chainsSet, sudoStatsSet, trendSet, envUsageSet, sessionsSet, sessionShowSet, backgroundSet, auditSet,
+		recurringSet, prefixesSet, cdStatsSet, editorsSet, gitStatsSet, annotateSet, listAnnotSet, tagSet, listTagsSet, statusSet, checkSet, suggestSet,
+		favoriteSet, unfavoriteSet, listFavSet, aliasesSet, undoImportSet, listImpSet, queryLogSet, auditLogSet, auditSumSet, recentHostSet, recentUserSet, inactiveSet, archiveSet, listProfSet,
+		renameHostSet, renameUserSet, normExistSet) > 0 {
+		return errors.New("Incompatible options: query term combined with a type of query that doesn't take one")
+	}
+
+	if followSet && countSet(queryTypeFlags()...) > 0 {
+		return errors.New("Incompatible options: -follow with other type of query")
+	}
+
+	if checkSet && Mode != MODE_LOCAL {
+		return errors.New("Incompatible options: -check works only in local mode.")
+	}
+
+	if archiveSet && Mode != MODE_LOCAL {
+		return errors.New("Incompatible options: -archive works only in local mode.")
+	}
+
+	if normExistSet && Mode != MODE_LOCAL {
+		return errors.New("Incompatible options: -normalize-existing works only in local mode.")
+	}
+
+	if auditLogSet && Mode != MODE_LOCAL {
+		return errors.New("Incompatible options: -audit-log works only in local mode, on the server's database.")
+	}
+
+	if auditSumSet && Mode != MODE_LOCAL {
+		return errors.New("Incompatible options: -audit-summary works only in local mode, on the server's database.")
+	}
+
+	if followSet && Mode == MODE_LOCAL {
+		return errors.New("Incompatible options: -follow needs a server to connect to (-r).")
+	}
+
+	if flushCacheSet && (followSet || countSet(queryTypeFlags()...) > 0) {
+		return errors.New("Incompatible options: -flush-cache with other type of query")
+	}
+
+	if flushCacheSet && Mode != MODE_CLIENT {
+		return errors.New("Incompatible options: -flush-cache needs a server to connect to (-r).")
+	}
+
+	if rotateKeySet && (querySet || followSet || flushCacheSet || countSet(queryTypeFlags()...) > 0) {
+		return errors.New("Incompatible options: -rotate-key with other type of query")
+	}
+
+	if rotateKeySet && Mode != MODE_CLIENT {
+		return errors.New("Incompatible options: -rotate-key needs a server to connect to (-r).")
+	}
+
+	if rotateKey != "" && rotateKeyFile != "" {
+		return errors.New("Incompatible options: -rotate-key and -rotate-key-file.")
+	}
+
+	if rotateKeySet && rotateKey == "" && rotateKeyFile == "" {
+		return errors.New("Invalid -rotate-key, the passphrase is empty.")
+	}
+
+	if rotateGrace < 0 {
+		return errors.New("Invalid -key-rotation-grace, it can't be negative: " + rotateGrace.String())
+	}
+
+	if multiSet && (querySet || followSet || flushCacheSet || rotateKeySet || countSet(queryTypeFlags()...) > 0) {
+		return errors.New("Incompatible options: -multi with other type of query")
+	}
+
+	if multiSet && Mode != MODE_CLIENT {
+		return errors.New("Incompatible options: -multi needs a server to connect to (-r).")
+	}
+
+	if recordSet && (querySet || followSet || flushCacheSet || multiSet || rotateKeySet || countSet(queryTypeFlags()...) > 0) {
+		return errors.New("Incompatible options: -record with other type of query")
+	}
+
+	if recordSet && record == "" {
+		return errors.New("Invalid -record, the command is empty.")
+	}
+
+	if len(userKeys) > 0 && Mode != MODE_SERVER {
+		return errors.New("Incompatible options: -user-key is for the server.")
+	}
+
+	if policyFile != "" && Mode != MODE_SERVER {
+		return errors.New("Incompatible options: -policy is for the server.")
+	}
+
+	if hooksFile != "" && Mode != MODE_SERVER {
+		return errors.New("Incompatible options: -hooks is for the server.")
+	}
+
+	if upstream != "" && Mode != MODE_SERVER {
+		return errors.New("Incompatible options: -upstream is for the server.")
+	}
+
+	if watch < 0 {
+		return errors.New("Invalid -watch, it can't be negative: " + watch.String())
+	}
+
+	if watch > 0 && Mode != MODE_CLIENT {
+		return errors.New("Incompatible options: -watch needs a server to connect to (-r).")
+	}
+
+	if watch > 0 {
+		watchable := (Operation == OP_QUERY || Operation == OP_MULTI_QUERY) && !QParams.Writes()
+		for _, qp := range Queries {
+			watchable = watchable && !qp.Writes()
+		}
+		if !watchable {
+			return errors.New("Incompatible options: -watch works only with queries that don't change the database.")
+		}
+	}
+
+	if syncSet && (Mode != MODE_CLIENT || Operation != OP_IMPORT) {
+		return errors.New("Incompatible options: -sync works only for imports in client mode (-r).")
+	}
+
+	if noClearSet && watch == 0 {
+		return errors.New("Incompatible options: -no-clear goes with -watch.")
+	}
+
+	if cacheTTL < 0 {
+		return errors.New("Invalid -cache-ttl, it can't be negative: " + cacheTTL.String())
+	}
+
+	if queryLogKeep < 0 {
+		return errors.New("Invalid -querylog-retention, it can't be negative: " + queryLogKeep.String())
+	}
+
 	// Check mode-operation incompatibility
 	if Mode == MODE_SERVER && QParams.Type != QUERY_DEMO {
 		return errors.New("Incompatible options: asked for server mode and other functions.\n\n")
@@ -182,15 +773,60 @@ func checkFlagCombination() error {
 	return nil
 }
 
+// queryTypeFlags returns the flags that select a type of query. Only one of
+// them may be set.
+func queryTypeFlags() []bool {
+	return []bool{lastkSet, topkSet || top24hSet || topWeekSet, usersSet, bySourceSet, rowSet, delRowsSet,
+		afterContentSet || beforeContentSet || contentSet,
+		afterCommandSet || beforeCommandSet, onThisDaySet, chainsSet, infoSet,
+		sudoStatsSet, trendSet, envUsageSet, sessionsSet || sessionShowSet,
+		backgroundSet, pipelinesSet, redirectsSet, reportSet, recentHostSet, recentUserSet, inactiveSet, auditSet, recurringSet, prefixesSet, cdStatsSet, editorsSet, gitStatsSet, annotateSet, listAnnotSet, tagSet, filterTagSet,
+		listTagsSet, statusSet, checkSet, suggestSet, favoriteSet, unfavoriteSet, listFavSet, aliasesSet,
+		undoImportSet, listImpSet, queryLogSet, auditLogSet, auditSumSet, archiveSet, listProfSet, renameHostSet, renameUserSet, normExistSet}
+}
+
+// countSet returns how many of flags are set.
+func countSet(flags ...bool) int {
+	n := 0
+	for _, f := range flags {
+		if f {
+			n++
+		}
+	}
+	return n
+}
+
 // Sets Operation Query Parameters
 func setOpAndQParams() error {
 	var err error
 	// Determine operation (used in local and client mode)
 	switch {
-	case topkSet:
+	case followSet:
+		Operation = OP_FOLLOW
+		QParams.Type = QUERY
+	case flushCacheSet:
+		Operation = OP_FLUSH_CACHE
+	case rotateKeySet:
+		Operation = OP_ROTATE_KEY
+	case multiSet:
+		Operation = OP_MULTI_QUERY
+	case recordSet:
+		Operation = OP_RECORD
+	case topkSet || top24hSet || topWeekSet:
 		Operation = OP_QUERY
 		QParams.Type = QUERY_TOPK
 		QParams.Kappa = topk
+		switch {
+		case top24hSet:
+			QParams.Type = QUERY_TOPK_24H
+		case topWeekSet:
+			QParams.Type = QUERY_TOPK_WEEK
+		}
+		if decaySet {
+			if QParams.HalfLife, err = parseHalfLife(decay); err != nil {
+				return err
+			}
+		}
 	case lastkSet:
 		Operation = OP_QUERY
 		QParams.Type = QUERY_LASTK
@@ -198,6 +834,9 @@ func setOpAndQParams() error {
 	case usersSet:
 		Operation = OP_QUERY
 		QParams.Type = QUERY_USERS
+	case bySourceSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_BY_SOURCE
 	case afterContentSet, beforeContentSet, contentSet:
 		Operation = OP_QUERY
 		QParams.Type = QUERY_CONTENT
@@ -210,6 +849,161 @@ func setOpAndQParams() error {
 		if contentSet {
 			QParams.AfterContent, QParams.BeforeContent = content, content
 		}
+	case sessionShowSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_SESSION_SHOW
+		QParams.Kappa = sessionShow
+		QParams.Gap = sessionGap
+	case sessionsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_SESSIONS
+		QParams.Gap = sessionGap
+	case envUsageSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_ENV_USAGE
+	case trendSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_TREND
+		QParams.Bucket = bucket
+	case annotateSet:
+		Operation = OP_QUERY
+		QParams.Type = ANNOTATE
+		QParams.Note = note
+	case listAnnotSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_ANNOTATIONS
+	case tagSet:
+		Operation = OP_QUERY
+		QParams.Type = TAG
+		QParams.Tag = tagName
+	case filterTagSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_TAG
+		QParams.Tag = filterTag
+	case listTagsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_TAGS
+	case auditSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_AUDIT
+		if auditDisable != "" {
+			QParams.AuditDisable = strings.Split(auditDisable, ",")
+		}
+		if auditRules != "" {
+			QParams.AuditRules, err = readAuditRules(auditRules)
+			if err != nil {
+				return err
+			}
+		}
+	case backgroundSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_BACKGROUND_STATS
+	case sudoStatsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_SUDO_STATS
+		QParams.Kappa = topk
+	case pipelinesSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_PIPELINES
+		QParams.Kappa = top
+	case redirectsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_REDIRECTIONS
+		QParams.Kappa = top
+	case reportSet:
+		if report != REPORT_FRECENT {
+			return errors.New("Invalid -report, the only report is " + REPORT_FRECENT + ": " + report)
+		}
+		Operation = OP_QUERY
+		QParams.Type = QUERY_FRECENT
+		QParams.Kappa = top
+	case recentHostSet, recentUserSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_RECENT_HOSTS
+		if recentUserSet {
+			QParams.Type = QUERY_RECENT_USERS
+		}
+		d, err := parseDays(since)
+		if err != nil {
+			return errors.New("Could not parse -since, use something like 7d: " + since)
+		}
+		QParams.DateFrom = time.Now().Add(-d).Truncate(time.Second)
+	case inactiveSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_INACTIVE_USERS
+		// Dormant accounts are a matter of months, not of the week
+		// -recent-users looks back.
+		inactive := "90d"
+		if sinceSet {
+			inactive = since
+		}
+		d, err := parseDays(inactive)
+		if err != nil {
+			return errors.New("Could not parse -since, use something like 90d: " + inactive)
+		}
+		QParams.DateFrom = time.Now().Add(-d).Truncate(time.Second)
+	case favoriteSet:
+		Operation = OP_QUERY
+		QParams.Type = FAVORITE
+	case unfavoriteSet:
+		Operation = OP_QUERY
+		QParams.Type = UNFAVORITE
+	case listFavSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_FAVORITES
+	case suggestSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_SUGGEST
+		QParams.Kappa = top
+	case statusSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_STATUS
+	case checkSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_CHECK
+	case infoSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_INFO
+	case cdStatsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_CD_STATS
+		QParams.Kappa = top
+	case editorsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_EDITOR_STATS
+		QParams.Kappa = top
+	case gitStatsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_GIT_STATS
+	case prefixesSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_COMMON_PREFIXES
+		QParams.Kappa = top
+		QParams.PrefixLen = prefixLen
+	case recurringSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_RECURRING
+		QParams.MinOccurrences = minOccurrence
+	case aliasesSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_ALIASES
+		QParams.MinOccurrences = minCount
+	case chainsSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_CHAINS
+		QParams.Kappa = top
+		QParams.NGram = ngram
+	case onThisDaySet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_ON_THIS_DAY
+		// The client's day, so it works remotely too.
+		QParams.Day = time.Now().Format("2006-01-02")
+	case afterCommandSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_AFTER
+	case beforeCommandSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_BEFORE
 	case querySet: // We have non-flag arguments -> it is a query
 		Operation = OP_QUERY
 		QParams.Type = QUERY
@@ -224,6 +1018,86 @@ func setOpAndQParams() error {
 		if err != nil {
 			return err
 		}
+	case undoImportSet:
+		Operation = OP_QUERY
+		QParams.Type = UNDO_IMPORT
+		// Kappa is the batch, 0 for our most recent one.
+		if undoImport != "last" {
+			QParams.Kappa, err = strconv.Atoi(undoImport)
+			if err != nil || QParams.Kappa < 1 {
+				return errors.New("Invalid -undo-import: expected an import id or 'last'.")
+			}
+		}
+	case archiveSet:
+		Operation = OP_QUERY
+		QParams.Type = ARCHIVE
+		QParams.Archive = archive
+		d, err := parseDays(olderThan)
+		if err != nil || d <= 0 {
+			return errors.New("Could not parse -older, use something like 90d: " + olderThan)
+		}
+		QParams.DateTo = time.Now().Add(-d).Truncate(time.Second)
+	case renameHostSet, renameUserSet:
+		Operation = OP_QUERY
+		QParams.Type = RENAME_HOST
+		name, rename := "-rename-host", renameHost
+		if renameUserSet {
+			QParams.Type = RENAME_USER
+			name, rename = "-rename-user", renameUser
+		}
+		i := strings.Index(rename, "=")
+		if i <= 0 || i == len(rename)-1 || rename[:i] == rename[i+1:] {
+			return errors.New("Invalid " + name + ", use OLD=NEW with two different names.")
+		}
+		QParams.RenameFrom, QParams.RenameTo = rename[:i], rename[i+1:]
+		QParams.DryRun = dryRunSet
+	case normExistSet:
+		Operation = OP_QUERY
+		QParams.Type = NORMALIZE_EXISTING
+		QParams.DryRun = dryRunSet
+	case listImpSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_IMPORTS
+		QParams.Kappa = top
+	case queryLogSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_QUERYLOG
+		QParams.Kappa = top
+	case auditLogSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_AUDIT_LOG
+		QParams.Kappa = top
+		if sinceSet {
+			d, err := parseDays(since)
+			if err != nil {
+				return errors.New("Could not parse -since, use something like 7d: " + since)
+			}
+			QParams.DateFrom = time.Now().Add(-d).Truncate(time.Second)
+		}
+	case auditSumSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_AUDIT_SUMMARY
+		var err error
+		if dateFromSet {
+			if QParams.DateFrom, err = parseDate(dateFrom); err != nil {
+				return errors.New("Could not parse -from, use a date like 2015-10-12: " + dateFrom)
+			}
+		}
+		if dateToSet {
+			if QParams.DateTo, err = parseDate(dateTo); err != nil {
+				return errors.New("Could not parse -to, use a date like 2015-10-12: " + dateTo)
+			}
+			// A date is its whole day.
+			if _, err := time.Parse("2006-01-02", dateTo); err == nil {
+				QParams.DateTo = QParams.DateTo.AddDate(0, 0, 1)
+			}
+			if !QParams.DateTo.After(QParams.DateFrom) {
+				return errors.New("Invalid -to, it is before -from.")
+			}
+		}
+	case listProfSet:
+		Operation = OP_QUERY
+		QParams.Type = QUERY_PROFILES
 	case stdinSet:
 		Operation = OP_IMPORT
 	default: // Demo mode
@@ -231,10 +1105,31 @@ func setOpAndQParams() error {
 		QParams.Type = QUERY_DEMO
 	}
 
-	if availableFormats[format] { // Query uses output format
+	switch {
+	case Operation == OP_IMPORT: // Import uses input format
+		QParams.Format = FORMAT_DEFAULT
+		switch {
+		case availableImportFormats[format]:
+			Format = format
+		case format == FORMAT_DEFAULT:
+			Format = IMPORT_BASH
+		case format == FORMAT_JSON: // Import statistics as JSON
+			Format = IMPORT_BASH
+			QParams.Format = FORMAT_JSON
+		default:
+			return errors.New("The specified import format doesn't exist: " + format)
+		}
+		if timeLayout != "" && Format != IMPORT_BASH {
+			return errors.New("Option -time-layout is for bash history, other formats have their own times.")
+		}
+	case timeLayout != "":
+		return errors.New("Option -time-layout is for importing history.")
+	case Operation == OP_FOLLOW && format == FORMAT_DEFAULT: // Show when and where commands are run
+		QParams.Format = FORMAT_LOG
+	case availableFormats[format]: // Query uses output format
 		QParams.Format = format
-	} else {
-		Log.Info.Println("The specified format doesn't exist. Reverting to default:", FORMAT_DEFAULT)
+	default:
+		Log.Warn.Println("The specified format doesn't exist. Reverting to default:", FORMAT_DEFAULT)
 		QParams.Format = FORMAT_DEFAULT
 	}
 
@@ -245,14 +1140,22 @@ func setOpAndQParams() error {
 		QParams.Unique = false
 	}
 
-	QParams.User = user
-	if usersSet && !userSet { // simple users query should be global
-		QParams.User = "%"
+	// Queries search across all users and hosts, unless asked otherwise.
+	// The detected user and host are our identity for imports, they should
+	// not leak into queries. If set explicitly, they double as search terms,
+	// but -query-user and -query-host take precedence.
+	QParams.User, QParams.Host = "%", "%"
+	if userSet {
+		QParams.User = user
 	}
-
-	QParams.Host = host
-	if usersSet && !hostSet { // simple users query should be global
-		QParams.Host = "%"
+	if hostSet {
+		QParams.Host = host
+	}
+	if queryUserSet {
+		QParams.User = queryUser
+	}
+	if queryHostSet {
+		QParams.Host = queryHost
 	}
 
 	// Check for global (search) flag
@@ -272,6 +1175,76 @@ func setOpAndQParams() error {
 		QParams.Command = "%" + strings.Join(flag.Args(), " ") + "%" // Grep like behaviour
 	}
 
+	// After and before queries search for the exact command given to them.
+	switch {
+	case afterCommandSet:
+		QParams.Command = afterCommand
+	case beforeCommandSet:
+		QParams.Command = beforeCommand
+	case trendSet:
+		QParams.Command = trend
+	case annotateSet:
+		// Annotations and tags belong to us, not to a search.
+		QParams.Command = annotate
+		QParams.User, QParams.Host = user, host
+	case tagSet:
+		QParams.Command = tagCommand
+		QParams.User, QParams.Host = user, host
+	case suggestSet:
+		// Suggestions come from our own history.
+		QParams.Command = suggest
+		QParams.User, QParams.Host = user, host
+	case favoriteSet:
+		QParams.Command = favorite
+		QParams.User, QParams.Host = user, host
+	case undoImportSet:
+		// We only undo our own imports.
+		QParams.User, QParams.Host = user, host
+	case unfavoriteSet:
+		QParams.Command = unfavorite
+		QParams.User, QParams.Host = user, host
+	}
+	// -limit is K for -topk and -lastk, and the most rows searches return.
+	if limitSet {
+		QParams.Kappa = limit
+	}
+	QParams.Offset = offset
+	QParams.ExcludeCommand, QParams.ExcludeUser, QParams.ExcludeHost = excludeCmd, excludeUser, excludeHost
+	if sortOrder == SORT_ASC {
+		QParams.SortOrder = SORT_ASC
+	}
+	QParams.IncludeFavorites = inclFavSet
+	QParams.Highlight = highlightMark
+	QParams.Explain = explainSet
+	QParams.CaseSensitive = caseSensSet
+	if anonymize != "" {
+		QParams.Anonymize = strings.Split(anonymize, ",")
+		QParams.AnonymizeSalt = anonSalt
+		if anonSalt == "" {
+			// Names differ from export to export, but stay hidden.
+			salt := make([]byte, 16)
+			if _, err = rand.Read(salt); err != nil {
+				return err
+			}
+			QParams.AnonymizeSalt = hex.EncodeToString(salt)
+		}
+	}
+	QParams.Fuzzy = fuzzySet
+	QParams.Distinct = distinctSet
+	QParams.Window = window
+	QParams.Source = source
+
+	if multiSet {
+		// Queries in the file start from the defaults of the flags.
+		base := QParams
+		base.Kappa, base.NGram, base.Gap = top, ngram, sessionGap
+		base.PrefixLen, base.MinOccurrences, base.Bucket = prefixLen, minOccurrence, bucket
+		base.Day = time.Now().Format("2006-01-02")
+		if Queries, err = readQueries(multi, base); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -279,13 +1252,26 @@ func setOpAndQParams() error {
 func setParseFlags() {
 	// flagVars, we keep actual documentation separated
 	flag.StringVar(&database, "db", database, "Database file")
+	flag.StringVar(&dbPerm, "db-perm", dbPerm, "octal permissions of a new database file")
+	flag.BoolVar(&readOnlySet, "readonly", readOnlySet, "open database read-only")
+	flag.BoolVar(&readOnlySet, "read-only", readOnlySet, "same as -readonly")
+	flag.BoolVar(&keyHostSet, "key-includes-host", keyHostSet, "rebuild database to keep same commands at same time from different hosts")
+	flag.StringVar(&rejectsFile, "rejects", rejectsFile, "append lines that couldn't be imported to file")
+	flag.IntVar(&maxCmdBytes, "max-command-bytes", maxCmdBytes, "reject imported commands longer than N bytes")
+	flag.DurationVar(&slowQuery, "slow-query", slowQuery, "log database statements slower than DURATION")
+	flag.BoolVar(&gzipSet, "gzip", gzipSet, "history to import is gzip compressed")
+	flag.BoolVar(&syncSet, "sync", syncSet, "send only history the server doesn't have")
 	flag.BoolVar(&versionSet, "V", versionSet, "Show version.")
 	flag.IntVar(&verbosity, "v", verbosity, "verbosity level")
 	flag.IntVar(&verbosity, "verbose", verbosity, "verbosity level")
+	flag.BoolVar(&quietSet, "quiet", quietSet, "log errors only, in server mode too")
+	flag.BoolVar(&debugSet, "debug", debugSet, "log debug messages too")
 	flag.StringVar(&user, "U", user, "custom username")
 	flag.StringVar(&user, "user", user, "custom username")
 	flag.StringVar(&host, "H", host, "custom hostname")
 	flag.StringVar(&host, "host", host, " custom hostname")
+	flag.StringVar(&queryUser, "query-user", queryUser, "username to search for")
+	flag.StringVar(&queryHost, "query-host", queryHost, "hostname to search for")
 	flag.BoolVar(&serverSet, "s", serverSet, "run as server")
 	flag.BoolVar(&serverSet, "server", serverSet, "run as server")
 	flag.StringVar(&remote, "r", remote, "run as client, connect to SERVER")
@@ -294,8 +1280,21 @@ func setParseFlags() {
 	flag.StringVar(&port, "port", port, "port")
 	flag.StringVar(&passphrase, "k", passphrase, "passphrase")
 	flag.StringVar(&passphrase, "key", passphrase, "passphrase")
+	flag.Var(&oldKeys, "old-key", "old passphrase the server still accepts")
+	flag.StringVar(&keySalt, "key-salt", keySalt, "file with the salt to derive keys from passphrases with")
+	flag.StringVar(&keyFile, "key-file", keyFile, "file with the key, instead of -key")
+	flag.StringVar(&authMode, "auth-mode", authMode, "protect network messages with encrypt or sign")
+	flag.Var(&userKeys, "user-key", "USER:PASSPHRASE the server accepts for USER's history only")
+	flag.StringVar(&policyFile, "policy", policyFile, "file with the server's access policy")
+	flag.StringVar(&hooksFile, "hooks", hooksFile, "file with commands to watch for and what to do when imported")
+	flag.StringVar(&upstream, "upstream", upstream, "server to forward imported history to, SERVER[:PORT]")
 	flag.StringVar(&format, "f", format, "query output format")
 	flag.StringVar(&format, "format", format, "query output format")
+	flag.StringVar(&displayTZ, "tz", displayTZ, "time zone to show times in")
+	flag.BoolVar(&colorSet, "color", colorSet, "color query output")
+	flag.BoolVar(&noColorSet, "no-color", noColorSet, "don't color query output")
+	flag.StringVar(&displayFormat, "time-format", displayFormat, "layout to show times with")
+	flag.StringVar(&timeLayout, "time-layout", timeLayout, "layout of imported history's timestamps")
 	flag.BoolVar(&helpSet, "h", helpSet, "help")
 	flag.BoolVar(&helpSet, "help", helpSet, "help")
 	flag.BoolVar(&globalSet, "g", globalSet, "global: '-user % -host %'")
@@ -303,10 +1302,22 @@ func setParseFlags() {
 	flag.BoolVar(&setupSet, "init", setupSet, "set-up system to use bashistdb")
 	flag.BoolVar(&uniqueSet, "u", uniqueSet, "show unique (distinct) command lines")
 	flag.BoolVar(&uniqueSet, "unique", uniqueSet, "show unique (distinct) command lines")
+	flag.BoolVar(&distinctSet, "distinct", distinctSet, "show unique command lines with how many times they ran")
 	flag.IntVar(&topk, "topk", topk, "return K most used command lines")
 	flag.IntVar(&lastk, "lastk", lastk, "return K most recent command lines")
 	flag.IntVar(&lastk, "tail", lastk, "return K most recent command lines")
+	flag.IntVar(&maxK, "max-k", maxK, "largest K for -topk and -lastk")
+	flag.IntVar(&limit, "limit", limit, "return at most N results of searches, -topk and -lastk")
+	flag.IntVar(&offset, "offset", offset, "skip the first N results of searches, -topk and -lastk")
+	flag.StringVar(&excludeCmd, "exclude-cmd", excludeCmd, "skip command lines matching PATTERN")
+	flag.StringVar(&excludeUser, "exclude-user", excludeUser, "skip users matching PATTERN")
+	flag.StringVar(&excludeHost, "exclude-host", excludeHost, "skip hosts matching PATTERN")
+	flag.StringVar(&sortOrder, "sort", sortOrder, "order of -topk and -lastk results: asc or desc")
 	flag.BoolVar(&usersSet, "users", usersSet, "show users in database")
+	flag.BoolVar(&bySourceSet, "by-source", bySourceSet, "count commands per import source")
+	flag.StringVar(&source, "source", source, "label imported history with SOURCE, or search its commands")
+	flag.StringVar(&profile, "profile", profile, "read and write the history of profile NAME")
+	flag.BoolVar(&listProfSet, "list-profiles", listProfSet, "return the profiles and their number of commands")
 	flag.BoolVar(&localSet, "local", localSet, "force local mode")
 	flag.IntVar(&row, "row", row, "return this row")
 	flag.StringVar(&delRows, "del", delRows, "delete these rows")
@@ -314,6 +1325,93 @@ func setParseFlags() {
 	flag.IntVar(&afterContent, "A", afterContent, "return this many rows after match")
 	flag.IntVar(&beforeContent, "B", beforeContent, "return this many rows before match")
 	flag.IntVar(&content, "C", content, "return this many rows before and after match")
+	flag.StringVar(&afterCommand, "after", afterCommand, "count commands run after COMMAND")
+	flag.StringVar(&beforeCommand, "before", beforeCommand, "count commands run before COMMAND")
+	flag.IntVar(&window, "window", window, "time window in seconds for -after, -before")
+	flag.BoolVar(&onThisDaySet, "on-this-day", onThisDaySet, "what you run today in previous years")
+	flag.StringVar(&trend, "trend", trend, "usage of PATTERN over time")
+	flag.StringVar(&bucket, "bucket", bucket, "time bucket for -trend: month or week")
+	flag.BoolVar(&sessionsSet, "sessions", sessionsSet, "list sessions")
+	flag.IntVar(&sessionShow, "session-show", sessionShow, "return the commands of session N")
+	flag.IntVar(&sessionGap, "session-gap", sessionGap, "minutes of inactivity that end a session")
+	flag.BoolVar(&envUsageSet, "env-usage", envUsageSet, "return variables set inline in commands")
+	flag.BoolVar(&sudoStatsSet, "sudo-stats", sudoStatsSet, "return statistics about sudo usage")
+	flag.StringVar(&decay, "decay", decay, "rank -topk by recency with HALFLIFE")
+	flag.BoolVar(&top24hSet, "top-24h", top24hSet, "most used command lines of the last 24 hours")
+	flag.BoolVar(&topWeekSet, "top-week", topWeekSet, "most used command lines of the last week")
+	flag.BoolVar(&followSet, "follow", followSet, "stream new commands as the server receives them")
+	flag.BoolVar(&flushCacheSet, "flush-cache", flushCacheSet, "drop the server's cached query results")
+	flag.StringVar(&rotateKey, "rotate-key", rotateKey, "switch the server's passphrase to PASSPHRASE")
+	flag.StringVar(&rotateKeyFile, "rotate-key-file", rotateKeyFile, "switch the server's key to the one in FILE, instead of -rotate-key")
+	flag.DurationVar(&rotateGrace, "key-rotation-grace", rotateGrace, "how long the server accepts its old passphrase after -rotate-key")
+	flag.DurationVar(&cacheTTL, "cache-ttl", cacheTTL, "how long the server caches query results")
+	flag.BoolVar(&queryLogSet, "querylog", queryLogSet, "return the queries the server served most recently")
+	flag.BoolVar(&auditLogSet, "audit-log", auditLogSet, "return the operations the server performed most recently")
+	flag.BoolVar(&auditSumSet, "audit-summary", auditSumSet, "return a JSON report of the operations the server performed")
+	flag.StringVar(&dateFrom, "from", dateFrom, "first day of -audit-summary, e.g. 2015-10-12")
+	flag.StringVar(&dateTo, "to", dateTo, "last day of -audit-summary, e.g. 2015-10-12")
+	flag.DurationVar(&queryLogKeep, "querylog-retention", queryLogKeep, "how long the server keeps its query log")
+	flag.StringVar(&multi, "multi", multi, "run the queries in FILE with one request")
+	flag.StringVar(&record, "record", record, "add COMMAND, as run now")
+	flag.DurationVar(&watch, "watch", watch, "re-run the query every DURATION")
+	flag.BoolVar(&noClearSet, "no-clear", noClearSet, "don't clear the screen between -watch runs")
+	flag.StringVar(&tagCommand, "tag", tagCommand, "tag COMMAND")
+	flag.StringVar(&tagName, "tag-name", tagName, "the tag to add with -tag")
+	flag.StringVar(&filterTag, "filter-tag", filterTag, "return commands tagged with TAG")
+	flag.BoolVar(&listTagsSet, "list-tags", listTagsSet, "return your tags")
+	flag.StringVar(&annotate, "annotate", annotate, "attach a note to COMMAND")
+	flag.StringVar(&note, "note", note, "the note to attach with -annotate")
+	flag.BoolVar(&listAnnotSet, "list-annotations", listAnnotSet, "return your annotations")
+	flag.BoolVar(&auditSet, "audit", auditSet, "report dangerous commands")
+	flag.StringVar(&auditRules, "audit-rules", auditRules, "file with extra audit rules")
+	flag.StringVar(&auditDisable, "audit-disable", auditDisable, "comma separated audit rule ids to disable")
+	flag.BoolVar(&backgroundSet, "background-stats", backgroundSet, "return the programs you run in the background")
+	flag.BoolVar(&pipelinesSet, "pipelines-only", pipelinesSet, "return command lines with pipes, most pipes first")
+	flag.BoolVar(&redirectsSet, "redirections-only", redirectsSet, "return the latest command lines that redirect input or output")
+	flag.StringVar(&report, "report", report, "return a report: frecent")
+	flag.BoolVar(&recentHostSet, "recent-hosts", recentHostSet, "return the hosts that ran commands recently")
+	flag.BoolVar(&recentUserSet, "recent-users", recentUserSet, "return the users that ran commands recently")
+	flag.BoolVar(&inactiveSet, "inactive-users", inactiveSet, "return the users that haven't run commands for long")
+	flag.StringVar(&since, "since", since, "how far back -recent-hosts, -recent-users and -inactive-users look, e.g. 7d or 12h")
+	flag.BoolVar(&fuzzySet, "fuzzy", fuzzySet, "return commands close to the query term")
+	flag.StringVar(&favorite, "favorite", favorite, "bookmark COMMAND")
+	flag.StringVar(&unfavorite, "unfavorite", unfavorite, "remove COMMAND from favorites")
+	flag.BoolVar(&listFavSet, "list-favorites", listFavSet, "return your favorites")
+	flag.StringVar(&undoImport, "undo-import", undoImport, "delete the commands added by import ID, or by your last one")
+	flag.StringVar(&archive, "archive", archive, "move old commands to the archive database FILE")
+	flag.StringVar(&olderThan, "older", olderThan, "how old commands -archive moves are, e.g. 90d")
+	flag.StringVar(&renameHost, "rename-host", renameHost, "rename host OLD=NEW, merging the commands NEW has")
+	flag.StringVar(&renameUser, "rename-user", renameUser, "rename user OLD=NEW, merging the commands NEW has")
+	flag.BoolVar(&dryRunSet, "dry-run", dryRunSet, "say what -rename-host, -rename-user or -normalize-existing would change, without changing it")
+	flag.BoolVar(&normalizeSet, "normalize", normalizeSet, "lowercase the users and hosts of imported commands and queries")
+	flag.StringVar(&stripDomains, "strip-domains", stripDomains, "comma separated domains -normalize strips from hosts, e.g. local,example.com")
+	flag.BoolVar(&normExistSet, "normalize-existing", normExistSet, "give the users and hosts stored before -normalize its spelling")
+	flag.BoolVar(&listImpSet, "list-imports", listImpSet, "return recent import batches")
+	flag.BoolVar(&inclFavSet, "include-favorites", inclFavSet, "add favorites to restore output")
+	flag.BoolVar(&caseSensSet, "case-sensitive", caseSensSet, "match the case of the query term")
+	flag.BoolVar(&explainSet, "explain", explainSet, "return the SQL the query runs and its plan instead of its result")
+	flag.StringVar(&anonymize, "anonymize", anonymize, "hide users, hosts and args of exported rows")
+	flag.StringVar(&anonSalt, "anonymize-salt", anonSalt, "key of the hashes -anonymize replaces users and hosts with")
+	flag.StringVar(&highlightMark, "highlight", highlightMark, "mark matches of the query term in restore output, e.g. '>>>%s<<<'")
+	flag.StringVar(&suggest, "suggest", suggest, "suggest commands starting with PREFIX")
+	flag.BoolVar(&statusSet, "status", statusSet, "return database status")
+	flag.BoolVar(&checkSet, "check", checkSet, "check the database for corruption")
+	flag.BoolVar(&infoSet, "info", infoSet, "return count and time span of commands")
+	flag.BoolVar(&chainsSet, "chains", chainsSet, "return most common command sequences")
+	flag.IntVar(&ngram, "ngram", ngram, "length of command sequences for -chains")
+	flag.BoolVar(&recurringSet, "recurring", recurringSet, "return commands run on a regular schedule")
+	flag.IntVar(&minOccurrence, "min-occurrences", minOccurrence, "least runs of a command for -recurring")
+	flag.BoolVar(&aliasesSet, "suggest-aliases", aliasesSet, "suggest aliases for command lines you run often")
+	flag.IntVar(&minCount, "min-count", minCount, "least runs of a command line for -suggest-aliases")
+	flag.IntVar(&top, "top", top, "return this many results for -chains, -common-prefixes, -cd-stats, -editor-stats, -pipelines-only, -redirections-only, -report")
+	flag.BoolVar(&cdStatsSet, "cd-stats", cdStatsSet, "return most visited directories")
+	flag.BoolVar(&editorsSet, "editor-stats", editorsSet, "return editors you use and files you edit the most")
+	flag.BoolVar(&gitStatsSet, "git-stats", gitStatsSet, "return how many times you ran each git subcommand")
+	flag.BoolVar(&prefixesSet, "common-prefixes", prefixesSet, "return command prefixes typed with many variants")
+	flag.IntVar(&prefixLen, "prefix-len", prefixLen, "length of prefixes for -common-prefixes")
+	flag.StringVar(&logFile, "log-file", logFile, "log to file")
+	flag.BoolVar(&logJSONSet, "log-json", logJSONSet, "log in JSON lines")
+	flag.BoolVar(&logSyslogSet, "log-syslog", logSyslogSet, "log also to syslog")
 	flag.Parse()
 }
 
@@ -343,14 +1441,16 @@ func parse() error {
 		return nil
 	}
 
-	// Verbosity reaches up to 2 (DEBUG)
-	if verbosity > 2 {
-		verbosity = 2
+	// -quiet and -debug name the levels people usually want.
+	switch {
+	case quietSet && (debugSet || verbosity > llog.SILENT):
+		return errors.New("Incompatible options: -quiet with -debug or -verbose.")
+	case quietSet:
+		verbosity = llog.SILENT
+	case debugSet && verbosity < llog.DEBUG:
+		verbosity = llog.DEBUG
 	}
 
-	// Create global logger
-	Log = llog.New(verbosity)
-
 	// Determine run mode. A run mode is expected to run and then bashistdb toexit.
 	switch { // Cases are in precedence order
 	case setupSet:
@@ -360,7 +1460,7 @@ func parse() error {
 	case serverSet:
 		Mode = MODE_SERVER
 		Address = ":" + port
-		if verbosity < 1 { // Server mode sets min verbosity of 1 (INFO)
+		if verbosity < 1 && !quietSet { // Server mode sets min verbosity of 1 (INFO), unless -quiet
 			verbosity = 1
 		}
 	case remote != "" && !localSet:
@@ -370,6 +1470,19 @@ func parse() error {
 		Mode = MODE_LOCAL
 	}
 
+	// Verbosity reaches up to 3 (TRACE)
+	if verbosity > llog.TRACE {
+		verbosity = llog.TRACE
+	}
+	Verbosity = verbosity
+
+	// Create global logger
+	var err error
+	Log, err = llog.NewWithOptions(verbosity, llog.Options{File: logFile, JSON: logJSONSet, Syslog: logSyslogSet})
+	if err != nil {
+		return errors.New("Could not set up logging: " + err.Error())
+	}
+
 	if err := setOpAndQParams(); err != nil {
 		return err
 	}
@@ -380,13 +1493,13 @@ func parse() error {
 
 	// Protest about username issues.
 	if user == "" {
-		return errors.New("Couldn't read username from $USER system variable and none was provided by -user flag.")
+		return errors.New("Couldn't read username from $BASHISTDB_USER, $USER or the system and none was provided by -user flag.")
 	}
 	User = user // TODO: remove
 
 	// Protest about hostname issues.
 	if host == "" {
-		return errors.New("Couldn't get hostname from system and none was provided by -host flag.")
+		return errors.New("Couldn't get hostname from $BASHISTDB_HOST or the system and none was provided by -host flag.")
 	}
 	Hostname = host // TODO: remove
 
@@ -394,6 +1507,60 @@ func parse() error {
 
 	// Set database filename
 	Database = database
+	CacheTTL = cacheTTL
+	QueryLogKeep = queryLogKeep
+	KeyRotationGracePeriod = rotateGrace
+	MaxK = maxK
+	Watch = watch
+	Record = record
+	// Bash's history has seconds, so it matches a later import.
+	RecordTime = time.Now().Truncate(time.Second)
+	NoClear = noClearSet
+	ReadOnly = readOnlySet
+	KeyIncludesHost = keyHostSet
+	NormalizeNames = normalizeSet
+	StripDomains = nil
+	if stripDomains != "" {
+		StripDomains = strings.Split(stripDomains, ",")
+	}
+	DbPerm = dbMode
+	RejectsFile = rejectsFile
+	MaxCommandBytes = maxCmdBytes
+	SlowQuery = slowQuery
+	PolicyFile = policyFile
+	HooksFile = hooksFile
+	// The upstream listens on our port unless told otherwise.
+	Upstream = upstream
+	if upstream != "" && !strings.Contains(upstream, ":") {
+		Upstream = upstream + ":" + port
+	}
+	Gzip = gzipSet
+	Source = source
+	TimeLayout = timeLayout
+	Profile = profile
+	if Profile == "" {
+		Profile = DEFAULT_PROFILE
+	}
+	Sync = syncSet
+
+	// Set how query output shows times.
+	if DisplayTZ, err = time.LoadLocation(displayTZ); err != nil {
+		return errors.New("Unknown time zone for -tz: " + displayTZ)
+	}
+	DisplayFormat = displayFormat
+
+	// Color output to terminals, unless told otherwise. The server has no
+	// terminal to color for.
+	switch {
+	case colorSet && noColorSet:
+		return errors.New("Incompatible options: -color and -no-color")
+	case colorSet:
+		ColorOutput = true
+	case noColorSet:
+		ColorOutput = false
+	default:
+		ColorOutput = stdoutTerminal && Mode != MODE_SERVER
+	}
 
 	// When we setup the system, we should also save settings
 	if setupSet {
@@ -402,10 +1569,82 @@ func parse() error {
 
 	// Passphrase may come from environment or flag
 	if Mode == MODE_SERVER || Mode == MODE_CLIENT || writeconfSet {
-		if passphrase == "" {
-			log.Println("Using empty passphrase.")
+		if passphrase == "" && keyFile == "" {
+			Log.Warn.Println("Using empty passphrase.")
+		}
+		Passphrase, KeySaltFile, KeySalt, KeyFile = passphrase, keySalt, nil, keyFile
+		switch authMode {
+		case "", AUTH_ENCRYPT:
+			AuthMode = AUTH_ENCRYPT
+		case AUTH_SIGN:
+			AuthMode = AUTH_SIGN
+			Log.Info.Println("Signing network messages, they aren't encrypted.")
+		default:
+			return errors.New("Unknown -auth-mode, it is " + AUTH_ENCRYPT + " or " + AUTH_SIGN + ": " + authMode)
+		}
+		if keySalt != "" {
+			var err error
+			if KeySalt, err = loadSalt(keySalt); err != nil {
+				return err
+			}
+			Log.Info.Println("Deriving keys with the salt in", keySalt)
+		}
+		// A key file has the key itself, it isn't derived.
+		var err error
+		if keyFile != "" {
+			Key, err = loadKey(keyFile)
+		} else {
+			Key, err = DeriveKey(passphrase)
+		}
+		if err != nil {
+			return err
+		}
+		Keys = [][]byte{Key}
+		if rotateKeySet {
+			if AuthMode == AUTH_SIGN {
+				return errors.New("Incompatible options: -rotate-key with -auth-mode " + AUTH_SIGN + ", the passphrase would be sent unencrypted.")
+			}
+			if rotateKeyFile != "" {
+				NewKey, err = loadKey(rotateKeyFile)
+			} else {
+				NewKey, err = DeriveKey(rotateKey)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for _, k := range oldKeys {
+			key, err := DeriveKey(k)
+			if err != nil {
+				return err
+			}
+			Keys = append(Keys, key)
+		}
+		KeyUsers = make([]string, len(Keys))
+		for _, uk := range userKeys {
+			i := strings.Index(uk, ":")
+			if i <= 0 || i == len(uk)-1 {
+				return errors.New("Invalid -user-key, use USER:PASSPHRASE.")
+			}
+			// Queries match users with LIKE, wildcards would let USER
+			// read others' history.
+			if strings.ContainsAny(uk[:i], "%_") {
+				return errors.New("Invalid -user-key, USER can't have % or _.")
+			}
+			// The first key that decrypts a message is the one we take,
+			// a user key can't be an admin one too.
+			key, err := DeriveKey(uk[i+1:])
+			if err != nil {
+				return err
+			}
+			for _, k := range Keys {
+				if string(k) == string(key) {
+					return errors.New("Invalid -user-key, its passphrase is used by another key.")
+				}
+			}
+			Keys = append(Keys, key)
+			KeyUsers = append(KeyUsers, uk[:i])
 		}
-		Key = []byte(passphrase)
 	}
 
 	if writeconfSet {
@@ -434,6 +1673,14 @@ func welcomeMessages() {
 
 	Log.Info.Println("Welcome " + User + "@" + Hostname + ". Bashistdb is in " + m + " mode.")
 	Log.Debug.Println("Loaded some settings from environment. Configuration file and flags can override them.")
+	userFrom, hostFrom := detected.userFrom, detected.hostFrom
+	if userSet {
+		userFrom = "the -user flag"
+	}
+	if hostSet {
+		hostFrom = "the -host flag"
+	}
+	Log.Debug.Printf("User %s is from %s, host %s is from %s.\n", User, userFrom, Hostname, hostFrom)
 	if foundConfFile {
 		Log.Info.Println("Loaded some settings from ~/.bashistdbconf. Command line flags can override them.")
 	}
@@ -35,12 +35,17 @@ if the test passed from the codepaths you would expect.
 package configuration
 
 import (
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/andmarios/bashistdb/llog"
 )
 
 func init() {
@@ -54,14 +59,29 @@ func resetFlags(args ...string) {
 
 	// These are used as actual flagvars
 	database = "test.sqlite3"
+	readOnlySet = false
+	keyHostSet = false
+	rejectsFile = ""
+	gzipSet = false
+	bySourceSet = false
+	source = ""
+	syncSet = false
+	displayTZ = "Local"
+	displayFormat = "2006-01-02 15:04:05"
+	timeLayout = ""
 	versionSet = false
 	verbosity = 0
+	quietSet = false
+	debugSet = false
 	user = "test"
 	host = "test"
 	serverSet = false
 	remote = ""
 	port = ""
 	passphrase = ""
+	keySalt = ""
+	authMode = ""
+	keyFile = ""
 	format = FORMAT_DEFAULT
 	helpSet = false
 	globalSet = false
@@ -69,19 +89,152 @@ func resetFlags(args ...string) {
 	setupSet = false
 	topk = 20
 	lastk = 20
+	maxK = 10000
 	localSet = false
 	uniqueSet = false
+	distinctSet = false
 	usersSet = false
 	row = 0
 	regexSet = false
+	delRows = ""
+	afterContent = 5
+	beforeContent = 5
+	content = 5
+	logFile = ""
+	logJSONSet = false
+	logSyslogSet = false
+	afterCommand = ""
+	beforeCommand = ""
+	window = 300
+	onThisDaySet = false
+	chainsSet = false
+	infoSet = false
+	sudoStatsSet = false
+	backgroundSet = false
+	pipelinesSet = false
+	redirectsSet = false
+	reportSet = false
+	report = ""
+	recentHostSet = false
+	recentUserSet = false
+	inactiveSet = false
+	auditSet = false
+	auditRules = ""
+	auditDisable = ""
+	oldKeys = nil
+	userKeys = nil
+	annotate = ""
+	note = ""
+	listAnnotSet = false
+	followSet = false
+	decay = "90d"
+	since = "7d"
+	profile = ""
+	listProfSet = false
+	decaySet = false
+	tagCommand = ""
+	tagName = ""
+	filterTag = ""
+	listTagsSet = false
+	statusSet = false
+	checkSet = false
+	flushCacheSet = false
+	rotateKey = ""
+	rotateKeyFile = ""
+	rotateKeySet = false
+	rotateGrace = 24 * time.Hour
+	cacheTTL = 30 * time.Second
+	queryLogSet = false
+	auditLogSet = false
+	auditSumSet, dateFrom, dateTo, dateFromSet, dateToSet = false, "", "", false, false
+	queryLogKeep = 720 * time.Hour
+	multi = ""
+	watch = 0
+	noClearSet = false
+	record = ""
+	suggest = ""
+	suggestSet = false
+	favorite = ""
+	unfavorite = ""
+	listFavSet = false
+	inclFavSet = false
+	highlightMark = ""
+	fuzzySet = false
+	top24hSet = false
+	topWeekSet = false
+	colorSet = false
+	policyFile = ""
+	hooksFile = ""
+	upstream = ""
+	noColorSet = false
+	favoriteSet = false
+	unfavoriteSet = false
+	undoImport = "last"
+	undoImportSet = false
+	archive, olderThan = "", "90d"
+	archiveSet, olderSet = false, false
+	renameHost, renameUser = "", ""
+	renameHostSet, renameUserSet, dryRunSet = false, false, false
+	normalizeSet, stripDomains, normExistSet = false, "", false
+	listImpSet = false
+	tagSet = false
+	tagNameSet = false
+	filterTagSet = false
+	annotateSet = false
+	noteSet = false
+	queryUser = ""
+	queryHost = ""
+	envUsageSet = false
+	sessionsSet = false
+	sessionShow = 0
+	sessionGap = 30
+	sessionShowSet = false
+	trend = ""
+	bucket = BUCKET_MONTH
+	ngram = 2
+	recurringSet = false
+	prefixesSet = false
+	cdStatsSet = false
+	editorsSet = false
+	gitStatsSet = false
+	prefixLen = 10
+	minOccurrence = 5
+	aliasesSet = false
+	minCount = 10
+	top = 20
 	// Here we will store the non flag arguments //
 	// These are not parsed from flags but we set them with flag.Visit
 	userSet = false
+	sinceSet = false
 	hostSet = false
 	remoteSet = false
 	topkSet = false
 	lastkSet = false
+	limitSet = false
+	limit = 0
+	offset = 0
+	sortOrder = SORT_DESC
+	excludeCmd, excludeUser, excludeHost = "", "", ""
+	anonymize, anonSalt = "", ""
+	explainSet = false
+	caseSensSet = false
+	maxCmdBytes = 0
+	dbPerm = "0600"
+	dbMode = 0600
+	slowQuery = 250 * time.Millisecond
 	rowSet = false
+	delRowsSet = false
+	afterContentSet = false
+	beforeContentSet = false
+	contentSet = false
+	afterCommandSet = false
+	beforeCommandSet = false
+	queryUserSet = false
+	queryHostSet = false
+	trendSet = false
+	multiSet = false
+	recordSet = false
+	keySet = false
 	// These are set with manual searches
 	querySet = false
 	stdinSet = false
@@ -94,10 +247,20 @@ func resetFlags(args ...string) {
 	Operation = 0
 	Address = ""
 	Database = ""
+	ReadOnly = false
+	KeyIncludesHost = false
+	Format = ""
 	Key = []byte{}
+	Keys = nil
+	KeyUsers = nil
 	User = ""
 	Hostname = ""
 	QParams = *new(QueryParams)
+	Queries = nil
+	Watch = 0
+	Sync = false
+	Source = ""
+	NoClear = false
 }
 
 func TestParse(t *testing.T) {
@@ -115,7 +278,7 @@ func TestParse(t *testing.T) {
 	}{
 		{
 			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "10.10.0.1:4000", Database: "test.sqlite", User: "test", Hostname: "test",
-				QParams: QueryParams{Type: QUERY_DEMO, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+				QParams: QueryParams{Type: QUERY_DEMO, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
 			expect: OK,
 			input:  []string{"cmd", "-r", "10.10.0.1", "-p", "4000", "-db", "test.sqlite"},
 			test:   "Test a simple demo in remote mode: ",
@@ -154,14 +317,14 @@ func TestParse(t *testing.T) {
 		},
 		{
 			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
-				QParams: QueryParams{Type: QUERY_ROW, User: "test", Host: "test", Format: FORMAT_BASH_HISTORY, Command: "%%", Unique: true, Kappa: 500}},
+				QParams: QueryParams{Type: QUERY_ROW, User: "%", Host: "%", Format: FORMAT_BASH_HISTORY, Command: "%%", Unique: true, Kappa: 500}},
 			expect: OK,
 			input:  []string{"cmd", "-r", "localhost", "-row", "500", "-format", "restore", "-unique"},
 			test:   "Test row query: ",
 		},
 		{
 			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
-				QParams: QueryParams{Type: QUERY_ROW, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Unique: true, Kappa: 500}},
+				QParams: QueryParams{Type: QUERY_ROW, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Unique: true, Kappa: 500}},
 			expect: OK,
 			input:  []string{"cmd", "-r", "localhost", "-row", "500", "-format", "abadformat", "-unique"},
 			test:   "Test non-existant format, use default: ",
@@ -182,7 +345,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
-				QParams: QueryParams{Type: DELETE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Rows: []int{1, 3, 4, 5, 9}}},
+				QParams: QueryParams{Type: DELETE, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Rows: []int{1, 3, 4, 5, 9}}},
 			expect: OK,
 			input:  []string{"cmd", "-del", "1,3-5,9,3"},
 			test:   "Test del flag: ",
@@ -198,105 +361,1315 @@ func TestParse(t *testing.T) {
 			test:   "Test del flag with non-compatible row flag: ",
 		},
 		{
-			want:   exportedVars{Mode: MODE_HELP},
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_AFTER, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "git commit%"}},
 			expect: OK,
-			input:  []string{"cmd", "-s", "-k", "pass", "-h"},
-			test:   "Test help flag: ",
+			input:  []string{"cmd", "-after", "git commit%", "-window", "60"},
+			test:   "Test after flag: ",
 		},
-	}
-
-	// Test remote override by server (remote set by env or conf file)
-	resetFlags("cmd", "-s")
-	remote = "localhost"
-	if err := parse(); err != nil {
-		t.Fatalf("Test remote override by server failed. " + err.Error())
-	}
-
-	for _, v := range test {
-		resetFlags(v.input...)
-		err := parse()
-		switch v.expect {
-		case OK:
-			if err != nil {
-				t.Fatal(v.test + err.Error())
-			}
-			if err := compare(v.want); err != nil {
-				t.Fatal(v.test + err.Error())
-			}
-		case ER:
-			if err == nil {
-				t.Fatal(v.test + "should not get error")
-			}
-		}
-	}
-
-	PrintHelp(ioutil.Discard)
-
-}
-
-type exportedVars struct {
-	Mode      int         // Mode of operation (local, server, client, etc)
-	Operation int         // function (read, restore, et)
-	Address   string      // Address is the remote server's address for client mode or server's address for server mode
-	Database  string      // Database is the filename of the sqlite database
-	Key       []byte      // Key it the user passphrase to generate keys for net comms
-	User      string      // User is the username detected or explicitly set
-	Hostname  string      // Hostname is the hostname detected or explicitly set
-	QParams   QueryParams // Parameters to query
-}
-
-func compare(v exportedVars) error {
-	s := ""
-	if Mode != v.Mode {
-		s += fmt.Sprintf("Mode wrong. Wanted %d, got %d.\n", v.Mode, Mode)
-	}
-	if Operation != v.Operation {
-		s += fmt.Sprintf("Operation wrong. Wanted %d, got %d.\n", v.Operation, Operation)
-	}
-	if Address != v.Address {
-		s += fmt.Sprintf("Address wrong. Wanted %s, got %s.\n", v.Address, Address)
-	}
-	if Database != v.Database {
-		s += fmt.Sprintf("Database wrong. Wanted %s, got %s.\n", v.Database, Database)
-	}
-	if string(Key) != string(v.Key) {
-		s += fmt.Sprintf("Key wrong. Wanted %s, got %s.\n", string(v.Key), string(Key))
-	}
-	if User != v.User {
-		s += fmt.Sprintf("User wrong. Wanted %s, got %s.\n", v.User, User)
-	}
-	if Hostname != v.Hostname {
-		s += fmt.Sprintf("Hostname wrong. Wanted %s, got %s.\n", v.Hostname, Hostname)
-	}
-
-	if QParams.Type != v.QParams.Type {
-		s += fmt.Sprintf("QParams.Type wrong. Wanted %s, got %s.\n", v.QParams.Type, QParams.Type)
-	}
-	if QParams.Kappa != v.QParams.Kappa {
-		s += fmt.Sprintf("QParams.Kappa wrong. Wanted %d, got %d.\n", v.QParams.Kappa, QParams.Kappa)
-	}
-	if QParams.User != v.QParams.User {
-		s += fmt.Sprintf("QParams.User wrong. Wanted %s, got %s.\n", v.QParams.User, QParams.User)
-	}
-	if QParams.Host != v.QParams.Host {
-		s += fmt.Sprintf("QParams.Host wrong. Wanted %s, got %s.\n", v.QParams.Host, QParams.Host)
-	}
-
-	if QParams.Format != v.QParams.Format {
-		s += fmt.Sprintf("QParams.Format wrong. Wanted %s, got %s.\n", v.QParams.Format, QParams.Format)
-	}
-	if QParams.Command != v.QParams.Command {
-		s += fmt.Sprintf("QParams.Command wrong. Wanted %s, got %s.\n", v.QParams.Command, QParams.Command)
-	}
-	if QParams.Unique != v.QParams.Unique {
-		s += fmt.Sprintf("QParams.Unique wrong. Wanted %v, got %v.\n", v.QParams.Unique, QParams.Unique)
-	}
-	if !compareIntSlice(QParams.Rows, v.QParams.Rows) {
-		s += fmt.Sprintf("QParams.Rows wrong. Wanted %v, got %v.\n", v.QParams.Rows, QParams.Rows)
-	}
-
-	if s != "" {
-		return errors.New(s)
-	}
-	return nil
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SESSION_SHOW, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 3}},
+			expect: OK,
+			input:  []string{"cmd", "-session-show", "3", "-session-gap", "10"},
+			test:   "Test session-show flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: ANNOTATE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "make release"}},
+			expect: OK,
+			input:  []string{"cmd", "-annotate", "make release", "-note", "builds the release binary"},
+			test:   "Test annotate flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_FOLLOW, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_LOG, Command: "%git%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-follow", "git"},
+			test:   "Test follow flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_FOLLOW, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "studentbox",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "studentbox", Format: FORMAT_JSON, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-follow", "-host", "studentbox", "-format", "json"},
+			test:   "Test follow flag with host and format: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10, HalfLife: 30 * 24 * time.Hour}},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "10", "-decay", "30d"},
+			test:   "Test topk with decay: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK_24H, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 20}},
+			expect: OK,
+			input:  []string{"cmd", "-top-24h"},
+			test:   "Test top-24h flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK_WEEK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-top-week", "-topk", "5"},
+			test:   "Test top-week flag with topk: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_ALIASES, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", MinOccurrences: 3}},
+			expect: OK,
+			input:  []string{"cmd", "-suggest-aliases", "-min-count", "3"},
+			test:   "Test suggest-aliases flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5, Source: "laptop"}},
+			expect: OK,
+			input:  []string{"cmd", "-lastk", "5", "-source", "laptop"},
+			test:   "Test lastk with source: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_BY_SOURCE, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-by-source"},
+			test:   "Test by-source flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-suggest-aliases", "-topk", "5"},
+			test:   "Test suggest-aliases with topk: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-top-24h", "-top-week"},
+			test:   "Test top-24h with top-week: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-top-week", "-decay", "30d"},
+			test:   "Test top-week with decay: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-topk", "10", "-decay", "soon"},
+			test:   "Test topk with bad decay: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "10", "-decay", "30d"},
+			test:   "Test decay without topk: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-follow"},
+			test:   "Test follow flag in local mode: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_FLUSH_CACHE, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-flush-cache"},
+			test:   "Test flush-cache flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-flush-cache"},
+			test:   "Test flush-cache flag in local mode: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_ROTATE_KEY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-rotate-key", "new passphrase"},
+			test:   "Test rotate-key flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-rotate-key", "new passphrase"},
+			test:   "Test rotate-key flag in local mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-rotate-key", "new passphrase", "-auth-mode", "sign"},
+			test:   "Test rotate-key flag with signed messages: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-rotate-key", "new passphrase", "-lastk", "5"},
+			test:   "Test rotate-key flag with other type of query: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-s", "-key-rotation-grace", "-1h"},
+			test:   "Test negative key-rotation-grace: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-s", "-cache-ttl", "-1s"},
+			test:   "Test negative cache-ttl: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TAG, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%kubectl%", Tag: "devops"}},
+			expect: OK,
+			input:  []string{"cmd", "-filter-tag", "devops", "kubectl"},
+			test:   "Test filter-tag flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-tag", "make release", "-annotate", "make release", "-note", "x", "-tag-name", "build"},
+			test:   "Test tag and annotate incompatibility: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_SUGGEST, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "git ch", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-suggest", "git ch", "-top", "5"},
+			test:   "Test suggest flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: UNFAVORITE, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "make release"}},
+			expect: OK,
+			input:  []string{"cmd", "-unfavorite", "make release"},
+			test:   "Test unfavorite flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_BASH_HISTORY, Command: "%git%", Highlight: ">>>%s<<<"}},
+			expect: OK,
+			input:  []string{"cmd", "-format", "restore", "-highlight", ">>>%s<<<", "git"},
+			test:   "Test highlight flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-highlight", ">>>%s<<<", "git"},
+			test:   "Test highlight without restore format: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-format", "restore", "-highlight", ">>>%s<<<"},
+			test:   "Test highlight without a query term: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-format", "restore", "-highlight", ">>><<<", "git"},
+			test:   "Test highlight without %s: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%git%", Kappa: 100, Offset: 200}},
+			expect: OK,
+			input:  []string{"cmd", "-limit", "100", "-offset", "200", "git"},
+			test:   "Test limit and offset with a search: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 50, Offset: 50}},
+			expect: OK,
+			input:  []string{"cmd", "-lastk", "50", "-offset", "50"},
+			test:   "Test offset with lastk: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK_24H, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-top-24h", "-limit", "5"},
+			test:   "Test limit as K of top-24h: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-topk", "10", "-limit", "5"},
+			test:   "Test limit with topk K: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-offset", "-1", "git"},
+			test:   "Test negative offset: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10, SortOrder: SORT_ASC}},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "10", "-sort", "asc"},
+			test:   "Test sort asc with topk: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10}},
+			expect: OK,
+			input:  []string{"cmd", "-lastk", "10", "-sort", "desc"},
+			test:   "Test sort desc with lastk: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-max-command-bytes", "-1", "-lastk", "10"},
+			test:   "Test negative max-command-bytes: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-db-perm", "0800", "-lastk", "10"},
+			test:   "Test invalid db-perm: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-db-perm", "0400", "-lastk", "10"},
+			test:   "Test db-perm we can't write: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-slow-query", "-1s", "-lastk", "10"},
+			test:   "Test negative slow-query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%make%", ExcludeCommand: "ls%",
+					ExcludeHost: "build%"}},
+			expect: OK,
+			input:  []string{"cmd", "-exclude-cmd", "ls%", "-exclude-host", "build%", "make"},
+			test:   "Test exclude-cmd and exclude-host with search: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10, ExcludeUser: "root"}},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "10", "-exclude-user", "root"},
+			test:   "Test exclude-user with topk: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-exclude-cmd", "ls%", "-users"},
+			test:   "Test exclude-cmd with users: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-exclude-cmd", "ls%", "-fuzzy", "mkae"},
+			test:   "Test exclude-cmd with fuzzy: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "%", Format: FORMAT_JSON, Command: "%%", Kappa: 100,
+					Anonymize: []string{ANON_USERS, ANON_ARGS}, AnonymizeSalt: "team"}},
+			expect: OK,
+			input:  []string{"cmd", "-lastk", "100", "-format", "json", "-anonymize", "users,args", "-anonymize-salt", "team"},
+			test:   "Test anonymize with salt: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_EXPORT, Command: "%git%",
+					Anonymize: []string{ANON_HOSTS}, AnonymizeSalt: "random"}},
+			expect: OK,
+			input:  []string{"cmd", "-format", "export", "-anonymize", "hosts", "git"},
+			test:   "Test anonymize with random salt: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "100", "-format", "json", "-anonymize", "users,paths"},
+			test:   "Test anonymize unknown item: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "100", "-anonymize", "users"},
+			test:   "Test anonymize with default format: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "100", "-format", "json", "-anonymize-salt", "team"},
+			test:   "Test anonymize-salt without anonymize: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10, Explain: true}},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "10", "-explain"},
+			test:   "Test explain with topk: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%Make%", CaseSensitive: true}},
+			expect: OK,
+			input:  []string{"cmd", "-case-sensitive", "Make"},
+			test:   "Test case-sensitive search: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-case-sensitive", "-users"},
+			test:   "Test case-sensitive with users: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-del", "3", "-explain"},
+			test:   "Test explain with delete: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "10", "-sort", "up"},
+			test:   "Test invalid sort: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-sort", "asc", "git"},
+			test:   "Test sort with search: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-limit", "0", "git"},
+			test:   "Test zero limit: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-users", "-offset", "10"},
+			test:   "Test offset with users: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 20}, Color: true},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "20", "-color"},
+			test:   "Test color flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 20}},
+			expect: OK,
+			input:  []string{"cmd", "-topk", "20", "-no-color"},
+			test:   "Test no-color flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-topk", "20", "-color", "-no-color"},
+			test:   "Test color and no-color incompatibility: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: UNDO_IMPORT, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-undo-import", "last"},
+			test:   "Test undo-import last: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: UNDO_IMPORT, User: "test", Host: "test", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 12}},
+			expect: OK,
+			input:  []string{"cmd", "-undo-import", "12"},
+			test:   "Test undo-import id: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-undo-import", "yesterday"},
+			test:   "Test undo-import invalid id: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-undo-import", "3", "-lastk", "10"},
+			test:   "Test undo-import with other query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_IMPORTS, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-list-imports", "-top", "5"},
+			test:   "Test list-imports flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_QUERYLOG, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-querylog", "-top", "5"},
+			test:   "Test querylog flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-querylog", "git"},
+			test:   "Test querylog with query term: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-s", "-querylog-retention", "-1h"},
+			test:   "Test negative querylog-retention: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%git%", Kappa: 10, Distinct: true}},
+			expect: OK,
+			input:  []string{"cmd", "-distinct", "-lastk", "10", "git"},
+			test:   "Test distinct flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-distinct", "-topk", "10"},
+			test:   "Test distinct flag with topk: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_CHECK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-check"},
+			test:   "Test check flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-check", "-r", "localhost"},
+			test:   "Test check flag in client mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-fuzzy", "-topk", "10"},
+			test:   "Test fuzzy flag without query term: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-fuzzy", "-R", "git.*"},
+			test:   "Test fuzzy flag with regex: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-tz", "Mars/Olympus_Mons", "-lastk", "10"},
+			test:   "Test unknown time zone: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-key-includes-host", "-readonly"},
+			test:   "Test key-includes-host with readonly: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "10", "-include-favorites"},
+			test:   "Test include-favorites without restore format: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-annotate", "make release"},
+			test:   "Test annotate flag without note: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit", "-audit-rules", "/nonexistent/audit.rules"},
+			test:   "Test audit flag with missing rules file: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-sessions", "-trend", "git"},
+			test:   "Test sessions flag with non-compatible trend flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_CD_STATS, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 10}},
+			expect: OK,
+			input:  []string{"cmd", "-cd-stats", "-top", "10"},
+			test:   "Test cd-stats flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-cd-stats", "src"},
+			test:   "Test cd-stats flag with query term: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_PIPELINES, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%grep%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-pipelines-only", "-top", "5", "grep"},
+			test:   "Test pipelines-only flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-pipelines-only", "-cd-stats"},
+			test:   "Test pipelines-only flag with other type of query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_REDIRECTIONS, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 20}},
+			expect: OK,
+			input:  []string{"cmd", "-redirections-only"},
+			test:   "Test redirections-only flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-redirections-only", "-pipelines-only"},
+			test:   "Test redirections-only flag with other type of query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_FRECENT, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%make%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-report", "frecent", "-top", "5", "make"},
+			test:   "Test report frecent flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-report", "stale"},
+			test:   "Test report flag with unknown report: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-report", "frecent", "-topk", "5"},
+			test:   "Test report flag with other type of query: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-recent-hosts", "-since", "lately"},
+			test:   "Test recent-hosts flag with bad since: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "5", "-since", "7d"},
+			test:   "Test since flag without recent-hosts: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-profile", "my work", "-lastk", "5"},
+			test:   "Test profile flag with spaces: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-list-profiles", "git"},
+			test:   "Test list-profiles flag with query term: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-inactive-users", "-recent-users"},
+			test:   "Test inactive-users flag with recent-users: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-recent-hosts", "git"},
+			test:   "Test recent-hosts flag with query term: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-recent-users", "-recent-hosts"},
+			test:   "Test recent-users flag with recent-hosts: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "5", "-older", "30d"},
+			test:   "Test older flag without archive: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-archive", "old.sqlite3", "-older", "ages"},
+			test:   "Test archive flag with bad older: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-archive", "old.sqlite3", "-r", "127.0.0.1:35628"},
+			test:   "Test archive flag in client mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit-log", "-r", "127.0.0.1:35628"},
+			test:   "Test audit-log flag in client mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit-log", "-since", "lately"},
+			test:   "Test audit-log flag with bad since: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit-summary", "-r", "127.0.0.1:35628"},
+			test:   "Test audit-summary flag in client mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "5", "-from", "2015-10-12"},
+			test:   "Test from flag without audit-summary: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit-summary", "-from", "12/10/2015"},
+			test:   "Test audit-summary flag with bad from: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-audit-summary", "-from", "2015-10-12", "-to", "2015-10-11"},
+			test:   "Test audit-summary flag with to before from: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-rename-host", "debian"},
+			test:   "Test rename-host flag without new name: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-rename-user", "alice=alice"},
+			test:   "Test rename-user flag to the same name: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "5", "-dry-run"},
+			test:   "Test dry-run flag without rename: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-rename-host", "debian=web01", "-rename-user", "a=b"},
+			test:   "Test rename-host flag with rename-user: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-strip-domains", "local"},
+			test:   "Test strip-domains flag without normalize: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-normalize-existing"},
+			test:   "Test normalize-existing flag without normalize: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-normalize", "-normalize-existing", "-r", "127.0.0.1"},
+			test:   "Test normalize-existing flag in client mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-normalize", "-lastk", "5", "-r", "127.0.0.1"},
+			test:   "Test normalize flag in client mode: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_EDITOR_STATS, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 20}},
+			expect: OK,
+			input:  []string{"cmd", "-editor-stats"},
+			test:   "Test editor-stats flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-editor-stats", "-cd-stats"},
+			test:   "Test editor-stats flag with other type of query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_GIT_STATS, User: "%", Host: "%", Format: FORMAT_JSON, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-git-stats", "-format", "json"},
+			test:   "Test git-stats flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-git-stats", "commit"},
+			test:   "Test git-stats flag with query term: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_COMMON_PREFIXES, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5, PrefixLen: 4}},
+			expect: OK,
+			input:  []string{"cmd", "-common-prefixes", "-prefix-len", "4", "-top", "5"},
+			test:   "Test common-prefixes flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_RECURRING, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", MinOccurrences: 3}},
+			expect: OK,
+			input:  []string{"cmd", "-recurring", "-min-occurrences", "3"},
+			test:   "Test recurring flag: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-chains", "-info"},
+			test:   "Test two new query types incompatibility: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-env-usage", "git"},
+			test:   "Test query type without query term combined with query: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-before", "ls", "-topk", "5"},
+			test:   "Test before flag with non-compatible topk flag: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "alice", Hostname: "laptop",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "bob", Host: "server", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-U", "alice", "-H", "laptop", "-query-user", "bob", "-query-host", "server", "-lastk", "5"},
+			test:   "Test query user and host independent of import identity: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_LASTK, User: "%", Host: "server", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 5}},
+			expect: OK,
+			input:  []string{"cmd", "-query-host", "server", "-lastk", "5"},
+			test:   "Test query host with default user: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-topk", "0"},
+			test:   "Test topk with zero K: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-lastk", "-5"},
+			test:   "Test lastk with negative K: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-s", "-max-k", "0"},
+			test:   "Test max-k with zero K: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_LOCAL, Operation: OP_QUERY, Address: "", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_TOPK, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%", Kappa: 50000}},
+			expect: OK,
+			input:  []string{"cmd", "-max-k", "100", "-topk", "50000"},
+			test:   "Test topk beyond max-k, the database clamps it: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_QUERY, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{Type: QUERY_INFO, User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}, Watch: 5 * time.Second, NoClear: true},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-info", "-watch", "5s", "-no-clear"},
+			test:   "Test watch: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-info", "-watch", "5s"},
+			test:   "Test watch in local mode: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-del", "5", "-watch", "5s"},
+			test:   "Test watch with a query that changes the database: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-watch", "-5s"},
+			test:   "Test negative watch: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-no-clear"},
+			test:   "Test no-clear without watch: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-r", "localhost", "-info", "-sync"},
+			test:   "Test sync with a query: ",
+		},
+		{
+			want: exportedVars{Mode: MODE_CLIENT, Operation: OP_RECORD, Address: "localhost:25625", Database: "test.sqlite3", User: "test", Hostname: "test",
+				QParams: QueryParams{User: "%", Host: "%", Format: FORMAT_DEFAULT, Command: "%%"}},
+			expect: OK,
+			input:  []string{"cmd", "-r", "localhost", "-record", "make install"},
+			test:   "Test record: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-record", "make", "-lastk", "5"},
+			test:   "Test record with other type of query: ",
+		},
+		{
+			expect: ER,
+			input:  []string{"cmd", "-record", ""},
+			test:   "Test record with empty command: ",
+		},
+		{
+			want:   exportedVars{Mode: MODE_HELP},
+			expect: OK,
+			input:  []string{"cmd", "-s", "-k", "pass", "-h"},
+			test:   "Test help flag: ",
+		},
+	}
+
+	// Test remote override by server (remote set by env or conf file)
+	resetFlags("cmd", "-s")
+	remote = "localhost"
+	if err := parse(); err != nil {
+		t.Fatal("Test remote override by server failed. " + err.Error())
+	}
+
+	for _, v := range test {
+		resetFlags(v.input...)
+		err := parse()
+		switch v.expect {
+		case OK:
+			if err != nil {
+				t.Fatal(v.test + err.Error())
+			}
+			if err := compare(v.want); err != nil {
+				t.Fatal(v.test + err.Error())
+			}
+		case ER:
+			if err == nil {
+				t.Fatal(v.test + "should not get error")
+			}
+		}
+	}
+
+	PrintHelp(ioutil.Discard)
+
+}
+
+func TestMultiQueries(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb-queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"Type": "info"}, {"Type": "topk", "Kappa": 5, "User": "bob"}]`)
+	f.Close()
+
+	resetFlags("cmd", "-r", "localhost", "-format", "json", "-multi", f.Name())
+	if err = parse(); err != nil {
+		t.Fatal("Test multi queries: " + err.Error())
+	}
+	if Operation != OP_MULTI_QUERY {
+		t.Fatalf("Test multi queries: Operation wrong. Wanted %d, got %d.", OP_MULTI_QUERY, Operation)
+	}
+	want := []QueryParams{
+		{Type: QUERY_INFO, Kappa: 20, User: "%", Host: "%", Format: FORMAT_JSON, Command: "%%"},
+		{Type: QUERY_TOPK, Kappa: 5, User: "bob", Host: "%", Format: FORMAT_JSON, Command: "%%"},
+	}
+	if len(Queries) != len(want) {
+		t.Fatalf("Test multi queries: wanted %d queries, got %d.", len(want), len(Queries))
+	}
+	for i, w := range want {
+		q := Queries[i]
+		if q.Type != w.Type || q.Kappa != w.Kappa || q.User != w.User || q.Host != w.Host ||
+			q.Format != w.Format || q.Command != w.Command || q.Window != 300 {
+			t.Fatalf("Test multi queries: query %d wrong.\nWanted: %+v\nGot   : %+v", i+1, w, q)
+		}
+	}
+
+	resetFlags("cmd", "-multi", f.Name())
+	if err = parse(); err == nil {
+		t.Fatal("Test multi queries in local mode: should get error")
+	}
+	resetFlags("cmd", "-r", "localhost", "-multi", f.Name(), "-topk", "5")
+	if err = parse(); err == nil {
+		t.Fatal("Test multi queries with other type of query: should get error")
+	}
+
+	for _, content := range []string{`{"Type": "info"}`, `[]`, `[{"Kappa": 5}]`} {
+		ioutil.WriteFile(f.Name(), []byte(content), 0600)
+		resetFlags("cmd", "-r", "localhost", "-multi", f.Name())
+		if err = parse(); err == nil {
+			t.Fatalf("Test multi queries file %s: should get error", content)
+		}
+	}
+}
+
+func TestUserKeys(t *testing.T) {
+	resetFlags("cmd", "-s", "-k", "admin", "-old-key", "old", "-user-key", "alice:pa", "-user-key", "bob:p:b")
+	if err := parse(); err != nil {
+		t.Fatal("Test user keys: " + err.Error())
+	}
+	wantKeys := []string{"admin", "old", "pa", "p:b"}
+	wantUsers := []string{"", "", "alice", "bob"}
+	if len(Keys) != len(wantKeys) || len(KeyUsers) != len(wantUsers) {
+		t.Fatalf("Test user keys: got %d keys and %d users, wanted %d.", len(Keys), len(KeyUsers), len(wantKeys))
+	}
+	for i := range wantKeys {
+		if string(Keys[i]) != wantKeys[i] || KeyUsers[i] != wantUsers[i] {
+			t.Errorf("Test user keys: key %d wrong. Wanted %s for '%s', got %s for '%s'.",
+				i, wantKeys[i], wantUsers[i], Keys[i], KeyUsers[i])
+		}
+	}
+
+	for _, input := range [][]string{
+		{"cmd", "-s", "-k", "admin", "-user-key", "alice"},
+		{"cmd", "-s", "-k", "admin", "-user-key", ":pa"},
+		{"cmd", "-s", "-k", "admin", "-user-key", "a_ice:pa"},
+		{"cmd", "-s", "-k", "admin", "-user-key", "alice:admin"},
+		{"cmd", "-s", "-k", "admin", "-user-key", "alice:pa", "-user-key", "bob:pa"},
+		{"cmd", "-r", "localhost", "-user-key", "alice:pa"},
+		{"cmd", "-r", "localhost", "-policy", "policy.txt"},
+		{"cmd", "-r", "localhost", "-hooks", "hooks.txt"},
+		{"cmd", "-upstream", "central"},
+	} {
+		resetFlags(input...)
+		if err := parse(); err == nil {
+			t.Errorf("Test user keys %v: should get error", input[1:])
+		}
+	}
+
+	resetFlags("cmd", "-s", "-k", "admin", "-policy", "policy.txt")
+	if err := parse(); err != nil || PolicyFile != "policy.txt" {
+		t.Errorf("Test policy: wanted policy.txt, got '%s' (%v).", PolicyFile, err)
+	}
+
+	resetFlags("cmd", "-s", "-k", "admin", "-hooks", "hooks.txt")
+	if err := parse(); err != nil || HooksFile != "hooks.txt" {
+		t.Errorf("Test hooks: wanted hooks.txt, got '%s' (%v).", HooksFile, err)
+	}
+
+	resetFlags("cmd", "-s", "-k", "admin", "-p", "4000", "-upstream", "central")
+	if err := parse(); err != nil || Upstream != "central:4000" {
+		t.Errorf("Test upstream: wanted central:4000, got '%s' (%v).", Upstream, err)
+	}
+	resetFlags("cmd", "-s", "-k", "admin", "-upstream", "central:5000")
+	if err := parse(); err != nil || Upstream != "central:5000" {
+		t.Errorf("Test upstream: wanted central:5000, got '%s' (%v).", Upstream, err)
+	}
+}
+
+func TestRotateKeyFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("00112233445566778899aabbccddeeff\n")
+	f.Close()
+
+	resetFlags("cmd", "-r", "localhost", "-rotate-key-file", f.Name())
+	if err = parse(); err != nil {
+		t.Fatal("Test rotate-key-file: " + err.Error())
+	}
+	if want := "00112233445566778899aabbccddeeff"; Operation != OP_ROTATE_KEY || hex.EncodeToString(NewKey) != want {
+		t.Errorf("Test rotate-key-file: wanted operation %d with key %s, got %d with %x.", OP_ROTATE_KEY, want, Operation, NewKey)
+	}
+
+	for _, input := range [][]string{
+		{"cmd", "-r", "localhost", "-rotate-key-file", f.Name(), "-rotate-key", "new passphrase"},
+		{"cmd", "-r", "localhost", "-rotate-key-file", f.Name() + ".missing"},
+		{"cmd", "-rotate-key-file", f.Name()},
+	} {
+		resetFlags(input...)
+		if err = parse(); err == nil {
+			t.Errorf("Test rotate-key-file %v: should get error", input[1:])
+		}
+	}
+}
+
+func TestAuthMode(t *testing.T) {
+	for _, c := range []struct {
+		input []string
+		want  string
+	}{
+		{[]string{"cmd", "-s", "-k", "admin"}, AUTH_ENCRYPT},
+		{[]string{"cmd", "-s", "-k", "admin", "-auth-mode", "encrypt"}, AUTH_ENCRYPT},
+		{[]string{"cmd", "-r", "localhost", "-auth-mode", "sign"}, AUTH_SIGN},
+		{[]string{"cmd", "-s", "-k", "admin", "-auth-mode", "hmac"}, ""},
+	} {
+		resetFlags(c.input...)
+		err := parse()
+		switch {
+		case c.want == "" && err == nil:
+			t.Errorf("Test auth mode %v: should get error", c.input[1:])
+		case c.want != "" && (err != nil || AuthMode != c.want):
+			t.Errorf("Test auth mode %v: wanted %s, got %s (%v).", c.input[1:], c.want, AuthMode, err)
+		}
+	}
+}
+
+func TestTimeLayout(t *testing.T) {
+	// Queries have no history to decode.
+	resetFlags("cmd", "-time-layout", "02/01/2006 15:04", "-lastk", "5")
+	if err := parse(); err == nil {
+		t.Error("Test time layout: -time-layout with a query should get error.")
+	}
+	resetFlags("cmd", "-lastk", "5")
+	if err := parse(); err != nil || TimeLayout != "" {
+		t.Errorf("Test time layout: wanted none, got '%s' (%v).", TimeLayout, err)
+	}
+}
+
+func TestRecentHostsSince(t *testing.T) {
+	for _, c := range []struct {
+		input []string
+		ago   time.Duration
+	}{
+		{[]string{"cmd", "-recent-hosts"}, 7 * 24 * time.Hour},
+		{[]string{"cmd", "-recent-hosts", "-since", "12h"}, 12 * time.Hour},
+		{[]string{"cmd", "-recent-users", "-since", "30d"}, 30 * 24 * time.Hour},
+		{[]string{"cmd", "-inactive-users"}, 90 * 24 * time.Hour},
+		{[]string{"cmd", "-inactive-users", "-since", "180d"}, 180 * 24 * time.Hour},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test recent hosts %v: %v", c.input[1:], err)
+		}
+		want := QUERY_RECENT_HOSTS
+		switch c.input[1] {
+		case "-recent-users":
+			want = QUERY_RECENT_USERS
+		case "-inactive-users":
+			want = QUERY_INACTIVE_USERS
+		}
+		if QParams.Type != want {
+			t.Errorf("Test recent hosts %v: wanted type %s, got %s.", c.input[1:], want, QParams.Type)
+		}
+		if ago := time.Since(QParams.DateFrom); ago < c.ago || ago > c.ago+time.Minute {
+			t.Errorf("Test recent hosts %v: wanted since %v ago, got %v ago.", c.input[1:], c.ago, ago)
+		}
+	}
+}
+
+func TestArchiveOlder(t *testing.T) {
+	for _, c := range []struct {
+		input []string
+		ago   time.Duration
+	}{
+		{[]string{"cmd", "-archive", "old.sqlite3"}, 90 * 24 * time.Hour},
+		{[]string{"cmd", "-archive", "old.sqlite3", "-older", "365d"}, 365 * 24 * time.Hour},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test archive %v: %v", c.input[1:], err)
+		}
+		if QParams.Type != ARCHIVE || QParams.Archive != "old.sqlite3" || !QParams.Writes() {
+			t.Errorf("Test archive %v: wanted type %s to old.sqlite3, got %s to '%s'.", c.input[1:], ARCHIVE,
+				QParams.Type, QParams.Archive)
+		}
+		if ago := time.Since(QParams.DateTo); ago < c.ago || ago > c.ago+time.Minute {
+			t.Errorf("Test archive %v: wanted commands older than %v, got %v.", c.input[1:], c.ago, ago)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	for _, c := range []struct {
+		input    []string
+		qtype    string
+		from, to string
+		dryRun   bool
+	}{
+		{[]string{"cmd", "-rename-host", "debian=web01"}, RENAME_HOST, "debian", "web01", false},
+		{[]string{"cmd", "-rename-user", "bob=robert=", "-dry-run"}, RENAME_USER, "bob", "robert=", true},
+		{[]string{"cmd", "-rename-host", "debian=web01", "-dry-run", "-r", "127.0.0.1"}, RENAME_HOST, "debian", "web01", true},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test rename %v: %v", c.input[1:], err)
+		}
+		if QParams.Type != c.qtype || QParams.RenameFrom != c.from || QParams.RenameTo != c.to ||
+			QParams.DryRun != c.dryRun || !QParams.Writes() {
+			t.Errorf("Test rename %v: wanted %s of %s to %s (dry run %t), got %s of %s to %s (dry run %t).", c.input[1:],
+				c.qtype, c.from, c.to, c.dryRun, QParams.Type, QParams.RenameFrom, QParams.RenameTo, QParams.DryRun)
+		}
+	}
+}
+
+func TestAuditSummary(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2015, 10, d, 0, 0, 0, 0, time.Local) }
+	for _, c := range []struct {
+		input    []string
+		from, to time.Time
+	}{
+		{[]string{"cmd", "-audit-summary"}, time.Time{}, time.Time{}},
+		{[]string{"cmd", "-audit-summary", "-from", "2015-10-12", "-to", "2015-10-12"}, day(12), day(13)},
+		{[]string{"cmd", "-audit-summary", "-to", "2015-10-13T12:00:00Z"}, time.Time{}, time.Date(2015, 10, 13, 12, 0, 0, 0, time.UTC)},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test audit summary %v: %v", c.input[1:], err)
+		}
+		if QParams.Type != QUERY_AUDIT_SUMMARY || !QParams.DateFrom.Equal(c.from) || !QParams.DateTo.Equal(c.to) {
+			t.Errorf("Test audit summary %v: wanted from %v to %v, got %s from %v to %v.", c.input[1:],
+				c.from, c.to, QParams.Type, QParams.DateFrom, QParams.DateTo)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct {
+		input   []string
+		qtype   string
+		domains []string
+		dryRun  bool
+	}{
+		{[]string{"cmd", "-normalize", "-lastk", "5"}, QUERY_LASTK, nil, false},
+		{[]string{"cmd", "-normalize", "-strip-domains", "local,example.com", "-server"}, QUERY_DEMO, []string{"local", "example.com"}, false},
+		{[]string{"cmd", "-normalize", "-normalize-existing", "-dry-run"}, NORMALIZE_EXISTING, nil, true},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test normalize %v: %v", c.input[1:], err)
+		}
+		if !NormalizeNames || QParams.Type != c.qtype || strings.Join(StripDomains, ",") != strings.Join(c.domains, ",") || QParams.DryRun != c.dryRun {
+			t.Errorf("Test normalize %v: wanted %s stripping %v (dry run %t), got %s stripping %v (dry run %t).", c.input[1:],
+				c.qtype, c.domains, c.dryRun, QParams.Type, StripDomains, QParams.DryRun)
+		}
+	}
+	resetFlags("cmd")
+	if err := parse(); err != nil || NormalizeNames {
+		t.Errorf("Test normalize: names are normalized by default (%v).", err)
+	}
+}
+
+type exportedVars struct {
+	Mode      int         // Mode of operation (local, server, client, etc)
+	Operation int         // function (read, restore, et)
+	Address   string      // Address is the remote server's address for client mode or server's address for server mode
+	Database  string      // Database is the filename of the sqlite database
+	Key       []byte      // Key it the user passphrase to generate keys for net comms
+	User      string      // User is the username detected or explicitly set
+	Hostname  string      // Hostname is the hostname detected or explicitly set
+	QParams   QueryParams // Parameters to query
+	Watch     time.Duration
+	NoClear   bool
+	Color     bool
+}
+
+func compare(v exportedVars) error {
+	s := ""
+	if Mode != v.Mode {
+		s += fmt.Sprintf("Mode wrong. Wanted %d, got %d.\n", v.Mode, Mode)
+	}
+	if Operation != v.Operation {
+		s += fmt.Sprintf("Operation wrong. Wanted %d, got %d.\n", v.Operation, Operation)
+	}
+	if Address != v.Address {
+		s += fmt.Sprintf("Address wrong. Wanted %s, got %s.\n", v.Address, Address)
+	}
+	if Database != v.Database {
+		s += fmt.Sprintf("Database wrong. Wanted %s, got %s.\n", v.Database, Database)
+	}
+	if string(Key) != string(v.Key) {
+		s += fmt.Sprintf("Key wrong. Wanted %s, got %s.\n", string(v.Key), string(Key))
+	}
+	if User != v.User {
+		s += fmt.Sprintf("User wrong. Wanted %s, got %s.\n", v.User, User)
+	}
+	if Hostname != v.Hostname {
+		s += fmt.Sprintf("Hostname wrong. Wanted %s, got %s.\n", v.Hostname, Hostname)
+	}
+	if ColorOutput != v.Color {
+		s += fmt.Sprintf("ColorOutput wrong. Wanted %v, got %v.\n", v.Color, ColorOutput)
+	}
+	if Watch != v.Watch || NoClear != v.NoClear {
+		s += fmt.Sprintf("Watch wrong. Wanted %v (no clear %v), got %v (no clear %v).\n", v.Watch, v.NoClear, Watch, NoClear)
+	}
+
+	if QParams.Type != v.QParams.Type {
+		s += fmt.Sprintf("QParams.Type wrong. Wanted %s, got %s.\n", v.QParams.Type, QParams.Type)
+	}
+	if QParams.Kappa != v.QParams.Kappa {
+		s += fmt.Sprintf("QParams.Kappa wrong. Wanted %d, got %d.\n", v.QParams.Kappa, QParams.Kappa)
+	}
+	if QParams.User != v.QParams.User {
+		s += fmt.Sprintf("QParams.User wrong. Wanted %s, got %s.\n", v.QParams.User, QParams.User)
+	}
+	if QParams.Highlight != v.QParams.Highlight {
+		s += fmt.Sprintf("QParams.Highlight wrong. Wanted %s, got %s.\n", v.QParams.Highlight, QParams.Highlight)
+	}
+	if QParams.ExcludeCommand != v.QParams.ExcludeCommand || QParams.ExcludeUser != v.QParams.ExcludeUser ||
+		QParams.ExcludeHost != v.QParams.ExcludeHost {
+		s += fmt.Sprintf("QParams.Exclude* wrong. Wanted %s, %s, %s, got %s, %s, %s.\n", v.QParams.ExcludeCommand,
+			v.QParams.ExcludeUser, v.QParams.ExcludeHost, QParams.ExcludeCommand, QParams.ExcludeUser, QParams.ExcludeHost)
+	}
+	if strings.Join(QParams.Anonymize, ",") != strings.Join(v.QParams.Anonymize, ",") {
+		s += fmt.Sprintf("QParams.Anonymize wrong. Wanted %v, got %v.\n", v.QParams.Anonymize, QParams.Anonymize)
+	}
+	// A random salt is made up when none is given.
+	if (v.QParams.AnonymizeSalt == "random" && len(QParams.AnonymizeSalt) != 32) ||
+		(v.QParams.AnonymizeSalt != "random" && QParams.AnonymizeSalt != v.QParams.AnonymizeSalt) {
+		s += fmt.Sprintf("QParams.AnonymizeSalt wrong. Wanted %s, got %s.\n", v.QParams.AnonymizeSalt, QParams.AnonymizeSalt)
+	}
+	if QParams.CaseSensitive != v.QParams.CaseSensitive {
+		s += fmt.Sprintf("QParams.CaseSensitive wrong. Wanted %t, got %t.\n", v.QParams.CaseSensitive, QParams.CaseSensitive)
+	}
+	if QParams.Explain != v.QParams.Explain {
+		s += fmt.Sprintf("QParams.Explain wrong. Wanted %t, got %t.\n", v.QParams.Explain, QParams.Explain)
+	}
+	if QParams.SortOrder != v.QParams.SortOrder {
+		s += fmt.Sprintf("QParams.SortOrder wrong. Wanted %s, got %s.\n", v.QParams.SortOrder, QParams.SortOrder)
+	}
+	if QParams.Offset != v.QParams.Offset {
+		s += fmt.Sprintf("QParams.Offset wrong. Wanted %d, got %d.\n", v.QParams.Offset, QParams.Offset)
+	}
+	if QParams.Host != v.QParams.Host {
+		s += fmt.Sprintf("QParams.Host wrong. Wanted %s, got %s.\n", v.QParams.Host, QParams.Host)
+	}
+
+	if QParams.Format != v.QParams.Format {
+		s += fmt.Sprintf("QParams.Format wrong. Wanted %s, got %s.\n", v.QParams.Format, QParams.Format)
+	}
+	if QParams.Command != v.QParams.Command {
+		s += fmt.Sprintf("QParams.Command wrong. Wanted %s, got %s.\n", v.QParams.Command, QParams.Command)
+	}
+	if QParams.Unique != v.QParams.Unique {
+		s += fmt.Sprintf("QParams.Unique wrong. Wanted %v, got %v.\n", v.QParams.Unique, QParams.Unique)
+	}
+	if QParams.Distinct != v.QParams.Distinct {
+		s += fmt.Sprintf("QParams.Distinct wrong. Wanted %v, got %v.\n", v.QParams.Distinct, QParams.Distinct)
+	}
+	if QParams.Source != v.QParams.Source {
+		s += fmt.Sprintf("QParams.Source wrong. Wanted %s, got %s.\n", v.QParams.Source, QParams.Source)
+	}
+	if !compareIntSlice(QParams.Rows, v.QParams.Rows) {
+		s += fmt.Sprintf("QParams.Rows wrong. Wanted %v, got %v.\n", v.QParams.Rows, QParams.Rows)
+	}
+	if QParams.Tag != v.QParams.Tag {
+		s += fmt.Sprintf("QParams.Tag wrong. Wanted %s, got %s.\n", v.QParams.Tag, QParams.Tag)
+	}
+	if QParams.HalfLife != v.QParams.HalfLife {
+		s += fmt.Sprintf("QParams.HalfLife wrong. Wanted %v, got %v.\n", v.QParams.HalfLife, QParams.HalfLife)
+	}
+	if QParams.PrefixLen != v.QParams.PrefixLen {
+		s += fmt.Sprintf("QParams.PrefixLen wrong. Wanted %d, got %d.\n", v.QParams.PrefixLen, QParams.PrefixLen)
+	}
+	if QParams.MinOccurrences != v.QParams.MinOccurrences {
+		s += fmt.Sprintf("QParams.MinOccurrences wrong. Wanted %d, got %d.\n", v.QParams.MinOccurrences, QParams.MinOccurrences)
+	}
+
+	if s != "" {
+		return errors.New(s)
+	}
+	return nil
+}
+
+func TestProfile(t *testing.T) {
+	for _, c := range []struct {
+		input   []string
+		profile string
+		qtype   string
+	}{
+		{[]string{"cmd", "-lastk", "5"}, DEFAULT_PROFILE, QUERY_LASTK},
+		{[]string{"cmd", "-profile", "work", "-lastk", "5"}, "work", QUERY_LASTK},
+		{[]string{"cmd", "-profile", "work", "-list-profiles"}, "work", QUERY_PROFILES},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test profile %v: %v", c.input[1:], err)
+		}
+		if Profile != c.profile || QParams.Type != c.qtype {
+			t.Errorf("Test profile %v: wanted %s and type %s, got %s and type %s.", c.input[1:], c.profile, c.qtype,
+				Profile, QParams.Type)
+		}
+	}
+}
+
+func TestVerbosity(t *testing.T) {
+	for _, c := range []struct {
+		input []string
+		level int
+	}{
+		{[]string{"cmd", "-lastk", "5"}, llog.SILENT},
+		{[]string{"cmd", "-s", "-k", "admin"}, llog.INFO},
+		{[]string{"cmd", "-s", "-k", "admin", "-quiet"}, llog.SILENT},
+		{[]string{"cmd", "-lastk", "5", "-debug"}, llog.DEBUG},
+		{[]string{"cmd", "-lastk", "5", "-debug", "-v", "3"}, llog.TRACE},
+	} {
+		resetFlags(c.input...)
+		if err := parse(); err != nil {
+			t.Fatalf("Test verbosity %v: %v", c.input[1:], err)
+		}
+		if Verbosity != c.level {
+			t.Errorf("Test verbosity %v: wanted level %d, got %d.", c.input[1:], c.level, Verbosity)
+		}
+		if info := Log.Info.Writer() != ioutil.Discard; info != (c.level >= llog.INFO) {
+			t.Errorf("Test verbosity %v: wanted info logged %t, got %t.", c.input[1:], c.level >= llog.INFO, info)
+		}
+		if debug := Log.Debug.Writer() != ioutil.Discard; debug != (c.level >= llog.DEBUG) {
+			t.Errorf("Test verbosity %v: wanted debug logged %t, got %t.", c.input[1:], c.level >= llog.DEBUG, debug)
+		}
+		if Log.Writer() == ioutil.Discard || Log.Error.Writer() == ioutil.Discard {
+			t.Errorf("Test verbosity %v: fatal errors and errors should always be logged.", c.input[1:])
+		}
+	}
+
+	for _, input := range [][]string{
+		{"cmd", "-lastk", "5", "-quiet", "-debug"},
+		{"cmd", "-lastk", "5", "-quiet", "-v", "1"},
+	} {
+		resetFlags(input...)
+		if err := parse(); err == nil {
+			t.Errorf("Test verbosity %v: wanted an error.", input[1:])
+		}
+	}
 }
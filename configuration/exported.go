@@ -20,22 +20,65 @@ package configuration
 import (
 	"fmt"
 	"io"
+	"os"
+	"time"
 
 	"github.com/andmarios/bashistdb/llog"
 )
 
 // Exported fields are global settings.
 var (
-	Mode      int          // Mode of operation (local, server, client, etc)
-	Operation int          // function (read, restore, et)
-	Log       *llog.Logger // Log is the mail logger to log to
-	Address   string       // Address is the remote server's address for client mode or server's address for server mode
-	Database  string       // Database is the filename of the sqlite database
-	Key       []byte       // Key it the user passphrase to generate keys for net comms
-	User      string       // User is the username detected or explicitly set
-	Error     error        // Will contain an error message if configuration setup failed
-	Hostname  string       // Hostname is the hostname detected or explicitly set
-	QParams   QueryParams  // Parameters to query
+	Mode            int            // Mode of operation (local, server, client, etc)
+	Operation       int            // function (read, restore, et)
+	Log             *llog.Logger   // Log is the mail logger to log to
+	Verbosity       int            // Verbosity is the llog level of Log, SILENT to TRACE
+	Address         string         // Address is the remote server's address for client mode or server's address for server mode
+	Database        string         // Database is the filename of the sqlite database
+	DbPerm          os.FileMode    // DbPerm are the permissions of a Database file we create
+	CacheTTL        time.Duration  // CacheTTL is how long the server caches query results, 0 disables caching
+	QueryLogKeep    time.Duration  // QueryLogKeep is how long the server keeps its query log, 0 keeps it forever
+	MaxK            int            // MaxK is the largest K top-k and last-k queries return, larger K are clamped to it
+	ReadOnly        bool           // ReadOnly opens the database read-only, only queries work
+	KeyIncludesHost bool           // KeyIncludesHost makes host part of the history's primary key
+	NormalizeNames  bool           // NormalizeNames lowercases users and hosts and strips StripDomains from hosts
+	StripDomains    []string       // StripDomains are the domains NormalizeNames strips from hosts
+	RejectsFile     string         // RejectsFile is where to append history lines we couldn't import
+	MaxCommandBytes int            // MaxCommandBytes is the longest command we import, in bytes, 0 is no limit
+	SlowQuery       time.Duration  // SlowQuery is how long a database statement may take before it is logged, 0 logs none
+	PolicyFile      string         // PolicyFile is the server's access policy, none if empty
+	HooksFile       string         // HooksFile is the server's watchlist of commands and their actions, none if empty
+	Upstream        string         // Upstream is the address of the server the server forwards imported history to, none if empty
+	Gzip            bool           // Gzip means history to import is gzip compressed
+	Source          string         // Source is the label of the history we import, none if empty
+	Profile         string         // Profile is the history we read and write, DEFAULT_PROFILE unless set
+	Sync            bool           // Sync sends only the history the server doesn't have, for client imports
+	Format          string         // Format is the format of history to import
+	TimeLayout      string         // TimeLayout is the Go layout of imported bash history's timestamps, detected if empty
+	DisplayTZ       *time.Location // DisplayTZ is the time zone query output shows times in
+	DisplayFormat   string         // DisplayFormat is the layout query output shows times with
+	ColorOutput     bool           // ColorOutput colors query output meant to be read by people
+	Passphrase      string         // Passphrase is the user passphrase, Key is derived from it
+	KeySaltFile     string         // KeySaltFile is the file KeySalt was read from, none if empty
+	KeySalt         []byte         // KeySalt is the salt to derive keys from passphrases with, nil uses them as is
+	KeyFile         string         // KeyFile is the file Key was read from, instead of deriving it from Passphrase, none if empty
+	AuthMode        string         // AuthMode is how network messages are protected, AUTH_ENCRYPT or AUTH_SIGN
+	Key             []byte         // Key it the key to generate keys for net comms with
+	Keys            [][]byte       // Keys the server accepts, Keys[0] is Key
+	NewKey          []byte         // NewKey is the key OP_ROTATE_KEY switches the server to
+	KeyUsers        []string       // KeyUsers[i] is the user Keys[i] may act as, empty for any user
+	User            string         // User is the username detected or explicitly set
+	Error           error          // Will contain an error message if configuration setup failed
+	Hostname        string         // Hostname is the hostname detected or explicitly set
+	QParams         QueryParams    // Parameters to query
+	Watch           time.Duration  // Watch is how often the client re-runs its query, 0 runs it once
+	Record          string         // Record is the command to add with OP_RECORD
+	RecordTime      time.Time      // RecordTime is when the Record command was run
+	NoClear         bool           // NoClear keeps the output of previous runs on screen with Watch
+	Queries         []QueryParams  // Queries to send in one request, for OP_MULTI_QUERY
+
+	// KeyRotationGracePeriod is how long the server accepts its old key
+	// after a client rotates it with OP_ROTATE_KEY.
+	KeyRotationGracePeriod time.Duration
 )
 
 // Output Formats
@@ -46,11 +89,23 @@ const (
 	FORMAT_TIMESTAMP    = "timestamp"
 	FORMAT_LOG          = "log"
 	FORMAT_JSON         = "json"
+	FORMAT_NDJSON       = "ndjson"
 	FORMAT_EXPORT       = "export"
 	FORMAT_ROWS         = "rows"
 	FORMAT_DEFAULT      = FORMAT_COMMAND_LINE
 )
 
+// Import Formats
+const (
+	IMPORT_BASH   = "bash"   // history with HISTTIMEFORMAT set, or export format
+	IMPORT_SYSLOG = "syslog" // command lines logged by a shell audit hook
+)
+
+var availableImportFormats = map[string]bool{
+	IMPORT_BASH:   true,
+	IMPORT_SYSLOG: true,
+}
+
 var availableFormats = map[string]bool{
 	FORMAT_BASH_HISTORY: true,
 	FORMAT_ALL:          true,
@@ -58,6 +113,7 @@ var availableFormats = map[string]bool{
 	FORMAT_TIMESTAMP:    true,
 	FORMAT_LOG:          true,
 	FORMAT_JSON:         true,
+	FORMAT_NDJSON:       true,
 	FORMAT_EXPORT:       true,
 	FORMAT_ROWS:         true,
 }
@@ -78,40 +134,166 @@ const (
 
 // Operations, you may only add entries at the end.
 const (
-	_         = iota
-	OP_IMPORT // Import history from stdin
-	OP_QUERY  // Run a query
+	_              = iota
+	OP_IMPORT      // Import history from stdin
+	OP_QUERY       // Run a query
+	OP_FOLLOW      // Stream new history from the server
+	OP_FLUSH_CACHE // Drop the server's cached query results
+	OP_MULTI_QUERY // Run many queries in one request to the server
+	OP_RECORD      // Add a single command
+	OP_ROTATE_KEY  // Switch the server to NewKey
 )
 
 // A QueryParams contains parameters that are used to run a query.
 // Depending on query type, some fields may not be used.
 type QueryParams struct {
-	Type          string // Query type
-	Kappa         int    // If topk or lastk, we store k here
-	User          string // Search User
-	Host          string // Search Host
-	Format        string // Return format
-	Command       string // Search Term for command line field
-	Unique        bool   // Return unique command lines
-	Rows          []int  // Rowids
-	Regex         bool   // Search is a regular expression
-	AfterContent  int    // Return also this many lines after match
-	BeforeContent int    // Return also this many lines before match
+	Type             string        // Query type
+	Kappa            int           // If topk or lastk, we store k here; for searches the most rows to return, all if 0
+	Offset           int           // Rows to skip before the first one returned, for searches, topk and lastk
+	SortOrder        string        // SORT_ASC or SORT_DESC for topk and lastk, empty is SORT_DESC
+	User             string        // Search User
+	Host             string        // Search Host
+	Format           string        // Return format
+	TimeLayout       string        // Go layout of imported bash history's timestamps, detected if empty
+	Command          string        // Search Term for command line field
+	ExcludeCommand   string        // Skip command lines that match this, LIKE pattern, none if empty
+	ExcludeUser      string        // Skip users that match this, LIKE pattern, none if empty
+	ExcludeHost      string        // Skip hosts that match this, LIKE pattern, none if empty
+	Unique           bool          // Return unique command lines
+	Distinct         bool          // Return unique command lines with their latest run and count of runs
+	Rows             []int         // Rowids
+	Regex            bool          // Search is a regular expression
+	CaseSensitive    bool          // Match the case of the search term, for searches, topk and lastk
+	AfterContent     int           // Return also this many lines after match
+	BeforeContent    int           // Return also this many lines before match
+	Window           int           // Time window in seconds for after/before queries
+	Day              string        // Date (YYYY-MM-DD) for on-this-day queries
+	NGram            int           // Length of command sequences for chains queries
+	MinOccurrences   int           // Least runs of a command for recurring and aliases queries
+	PrefixLen        int           // Length of command prefixes for common prefixes queries
+	Bucket           string        // Time bucket (month, week) for trend queries
+	Gap              int           // Minutes of inactivity that end a session
+	AuditRules       []string      // Extra audit rules, as "ID REGEX" lines
+	AuditDisable     []string      // Audit rule ids to skip
+	Note             string        // Note to attach to Command
+	Tag              string        // Tag to add or to search for
+	IncludeFavorites bool          // Append favorites to restore format output
+	Highlight        string        // Mark the search term in restore format output with this, %s is the match
+	Explain          bool          // Return the SQL the query runs, with its parameters and plan, instead of its result
+	Anonymize        []string      // What to hide of rows: ANON_USERS, ANON_HOSTS, ANON_ARGS
+	AnonymizeSalt    string        // Key of the hashes anonymized users and hosts are replaced by
+	Fuzzy            bool          // Return commands close to Command instead of matching it
+	HalfLife         time.Duration // Half-life of occurrences for recency-weighted TopK, 0 for plain TopK
+	DateFrom         time.Time     // Count only commands run since DateFrom for TopK and recent hosts, zero for all
+	DateTo           time.Time     // Archive moves commands run before DateTo, the audit summary ends there
+	Archive          string        // The database file Archive moves commands to
+	RenameFrom       string        // The host or user RenameHost or RenameUser renames
+	RenameTo         string        // What RenameHost or RenameUser renames RenameFrom to
+	DryRun           bool          // Count what a rename would change, without changing it
+	Source           string        // Search only commands imported with this source, for searches and lastk
 }
 
+// Writes reports whether queries of qp's type change the database.
+func (qp QueryParams) Writes() bool {
+	switch qp.Type {
+	case DELETE, TAG, FAVORITE, UNFAVORITE, ANNOTATE, UNDO_IMPORT, ARCHIVE, RENAME_HOST, RENAME_USER, NORMALIZE_EXISTING:
+		return true
+	}
+	return false
+}
+
+// Time buckets for trend queries
+const (
+	BUCKET_MONTH = "month"
+	BUCKET_WEEK  = "week"
+)
+
+// What -anonymize may hide
+const (
+	ANON_USERS = "users" // Users, replaced by a keyed hash
+	ANON_HOSTS = "hosts" // Hosts, replaced by a keyed hash
+	ANON_ARGS  = "args"  // Command arguments, commands are cut to their first word
+)
+
+// REPORT_FRECENT is the -report of the command lines with the highest frecency.
+const REPORT_FRECENT = "frecent"
+
+// DEFAULT_PROFILE is the profile of history imported without one.
+const DEFAULT_PROFILE = "default"
+
+// How network messages are protected, the server and its clients must agree.
+const (
+	AUTH_ENCRYPT = "encrypt" // NaCl secret-key authenticated encryption
+	AUTH_SIGN    = "sign"    // HMAC-SHA256 tags only, for networks encrypted already
+)
+
+// Sort orders for topk and lastk queries
+const (
+	SORT_ASC  = "asc"  // Least used, or oldest, commands first
+	SORT_DESC = "desc" // Most used, or newest, commands first
+)
+
 // Available query types
 // Since we implement a protocol and client/server could have different versions,
 // hardcoded strings instead of Go's autoincrement is better.
 const (
-	QUERY         = "query"   // A normal search (grep)
-	QUERY_LASTK   = "lastk"   // K most recent commands
-	QUERY_TOPK    = "topk"    // K most used commands
-	QUERY_USERS   = "users"   // users@host in database
-	QUERY_CLIENTS = "clients" // unique clients connected
-	QUERY_DEMO    = "demo"    // Run some demo queries
-	QUERY_ROW     = "row"     // Return a plain single row given its rowid
-	QUERY_CONTENT = "content" // Content search (n lines before, after or both)
-	DELETE        = "delete"  // Delete rows given their rowid
+	QUERY                  = "query"           // A normal search (grep)
+	QUERY_LASTK            = "lastk"           // K most recent commands
+	QUERY_TOPK             = "topk"            // K most used commands
+	QUERY_TOPK_24H         = "topk24h"         // K most used commands of the last 24 hours
+	QUERY_TOPK_WEEK        = "topkweek"        // K most used commands of the last 7 days
+	QUERY_FRECENT          = "frecent"         // K command lines with the highest frecency
+	QUERY_USERS            = "users"           // users@host in database
+	QUERY_BY_SOURCE        = "bysource"        // Count of commands per import source
+	QUERY_CLIENTS          = "clients"         // unique clients connected
+	QUERY_DEMO             = "demo"            // Run some demo queries
+	QUERY_ROW              = "row"             // Return a plain single row given its rowid
+	QUERY_CONTENT          = "content"         // Content search (n lines before, after or both)
+	QUERY_AFTER            = "after"           // Commands that usually follow a command
+	QUERY_BEFORE           = "before"          // Commands that usually precede a command
+	QUERY_ON_THIS_DAY      = "onthisday"       // Commands run on this day in previous years
+	QUERY_CHAINS           = "chains"          // Most common N-command sequences
+	QUERY_RECURRING        = "recurring"       // Commands run on a regular schedule
+	QUERY_ALIASES          = "aliases"         // Aliases for command lines run often
+	QUERY_COMMON_PREFIXES  = "commonprefixes"  // Command prefixes with many variants
+	QUERY_CD_STATS         = "cdstats"         // Most visited directories
+	QUERY_EDITOR_STATS     = "editorstats"     // Most used editors and most edited files
+	QUERY_GIT_STATS        = "gitstats"        // Most used git subcommands
+	QUERY_INFO             = "info"            // Count and time span of commands
+	QUERY_STATUS           = "status"          // Database file, size, schema version and rows
+	QUERY_CHECK            = "check"           // Integrity check of the database
+	QUERY_SUGGEST          = "suggest"         // Likely completions of a command prefix
+	QUERY_FAVORITES        = "favorites"       // Bookmarked commands
+	QUERY_SUDO_STATS       = "sudostats"       // Most used sudo command lines and programs
+	QUERY_BACKGROUND_STATS = "backgroundstats" // Programs run in the background with &
+	QUERY_PIPELINES        = "pipelines"       // Command lines with pipes, most pipes first
+	QUERY_REDIRECTIONS     = "redirections"    // Command lines that redirect input or output
+	QUERY_RECENT_HOSTS     = "recenthosts"     // Hosts that ran commands since DateFrom
+	QUERY_RECENT_USERS     = "recentusers"     // Users that ran commands since DateFrom
+	QUERY_INACTIVE_USERS   = "inactiveusers"   // Users that ran no commands since DateFrom
+	QUERY_PROFILES         = "profiles"        // Profiles and their number of commands
+	QUERY_AUDIT            = "audit"           // Commands matching dangerous command rules
+	QUERY_TREND            = "trend"           // Usage of a command over time
+	QUERY_ENV_USAGE        = "envusage"        // Environment variables set inline in commands
+	QUERY_SESSIONS         = "sessions"        // Sessions detected from gaps between commands
+	QUERY_SESSION_SHOW     = "sessionshow"     // Commands of a single session
+	QUERY_ANNOTATIONS      = "annotations"     // Notes attached to commands
+	QUERY_TAG              = "tag"             // Commands with a tag
+	QUERY_TAGS             = "tags"            // Tags in use
+	QUERY_IMPORTS          = "imports"         // Recent import batches
+	QUERY_QUERYLOG         = "querylog"        // Recent queries served by the server
+	QUERY_AUDIT_LOG        = "auditlog"        // Recent operations the server performed, since DateFrom
+	QUERY_AUDIT_SUMMARY    = "auditsummary"    // Report of the operations the server performed from DateFrom to DateTo
+	DELETE                 = "delete"          // Delete rows given their rowid
+	TAG                    = "addtag"          // Tag a command
+	FAVORITE               = "favorite"        // Bookmark a command
+	UNFAVORITE             = "unfavorite"      // Remove a bookmark
+	ANNOTATE               = "annotate"        // Attach a note to a command
+	UNDO_IMPORT            = "undoimport"      // Delete the commands of an import batch
+	ARCHIVE                = "archive"         // Move old commands to another database
+	RENAME_HOST            = "renamehost"      // Rename a host, merging its commands into the new name's
+	RENAME_USER            = "renameuser"      // Rename a user, merging its commands into the new name's
+	NORMALIZE_EXISTING     = "normalize"       // Give stored users and hosts the spelling NormalizeNames imports them with
 )
 
 // We do this in order to be able to test the parse code (we can't test init).
@@ -138,32 +320,121 @@ and suffix. Think of it as grep.
 
 Available options:
     -db FILE
-        Path to database file. It will be created if it doesn't exist.
+        Path to database file. Imports create it if it doesn't exist.
         Current: `+database+`
+    -db-perm MODE
+        Octal permissions of the database file when it is created, and of
+        its missing directories, which also get x where the file has r.
+        Your history may have passwords, keep it for you only on shared
+        machines. Existing files keep theirs. Default: 0600
+
+    -rejects FILE
+        Append history lines that couldn't be imported to FILE, verbatim, and
+        log their line numbers and byte offsets. You may fix them and import
+        the file again.
+    -max-command-bytes N
+        Reject imported commands longer than N bytes, e.g. huge generated
+        one-liners. They count as rejected and go to the -rejects file. With
+        a server, it is the server's setting that counts. 0 is no limit.
+        Default: 0
+    -slow-query DURATION
+        Log database statements that take longer than DURATION as warnings,
+        with their parameters, long command patterns cut. Batches of imported
+        rows are logged too. -explain shows the plan of a query. 0 logs none.
+        Default: 250ms
+    -gzip
+        History to import is gzip compressed. Usually not needed, gzip input
+        is detected by its header, e.g. zcat isn't needed for:
+            bashistdb < history.gz
+    -source SOURCE
+        Label the history we import with SOURCE (e.g. laptop-backup), to tell
+        its commands apart later. Commands we already have keep their label.
+        With searches and -lastk, return only commands imported with SOURCE.
+    -profile NAME
+        Keep histories that shouldn't mix, e.g. work and personal, apart in
+        one database. Imports add to profile NAME, and every query, restore
+        and export included, sees only its history. Favorites are per
+        profile too, notes and tags are shared. Profiles can also be set
+        with the BASHISTDB_PROFILE env variable or the configuration file.
+        Servers older than profiles refuse them. Default: `+DEFAULT_PROFILE+`
+    -sync
+        Client mode only. Before importing, ask the server for the time of
+        its latest command from this user and host, and send only the history
+        since then (an hour before, for shells that write their history late).
+        If our history doesn't have that command's time, e.g. it was rotated
+        or a clock jumped, or the server doesn't support it, all of it is sent.
+    -readonly, -read-only
+        Open the database read-only. Only queries work, imports and deletes
+        fail. Useful to query a snapshot or copy of a busy database, or to
+        serve a query-only replica: a read-only server refuses imports and
+        queries that change the database with an error, and doesn't log
+        connections.
+        Local queries that don't change the database (all but -del, -tag,
+        -favorite, -unfavorite, -annotate, -undo-import and -archive) always
+        open it read-only, so a mistyped -db fails instead of creating an
+        empty database.
+    -key-includes-host
+        Rebuild the database so host is part of a history line's key. By
+        default a command run by a user at the same second on two hosts is
+        stored once. The rebuild happens once and can't be undone, from then
+        on the flag isn't needed. Back up your database first.
+    -normalize [-strip-domains DOMAINS]
+        Lowercase the users and hosts of the commands we import, and strip
+        trailing dots and the first of the comma separated DOMAINS hosts end
+        with, so Web01, web01. and web01.local are all web01 with
+        -strip-domains local. User and host patterns of queries are
+        normalized as well, so they keep matching; domains are stripped only
+        from patterns without wildcards. Local and server mode only, names
+        stored before stay as they are, see -normalize-existing.
 
     -V
         Print version info and exit.
 
     -v , -verbose LEVEL
-        Verbosity level: 0 for silent, 1 for info, 2 for debug.
-        In server mode it is set to 1 if left 0.
+        Verbosity level: 0 for silent (errors only), 1 for info (and warnings),
+        2 for debug, 3 for trace. In server mode it is set to 1 if left 0.
+    -quiet
+        Log errors only, the level 0, in server mode too. Fatal errors are
+        always printed.
+    -debug
+        Log debug messages too, the level 2, unless -verbose is higher.
+    -log-file FILE
+        Write logs to FILE instead of stderr. The file is appended to and
+        reopened on SIGHUP, so it can be rotated with logrotate.
+    -log-json
+        Write logs as JSON lines (time, level, msg) for log ingestion.
+    -log-syslog
+        Send logs also to the local syslog daemon (facility daemon), with
+        severities matching the log levels. Useful in server mode, where each
+        connection is logged as a single 'access' line.
 
     -U, -user USER
-        Optional user name to use instead of reading $USER variable. In query
-        operations it doubles as search term for the username. Wildcard
-        operators (%, _) work but unlike query we search for the exact term.
-        Current: `+user+`
+        Optional user name to use instead of detecting it. We detect it from the
+        BASHISTDB_USER env variable, then $USER, then the system's user
+        database. If set, in query operations it doubles as search term for the
+        username. Wildcard operators (%, _) work but unlike query we search for
+        the exact term. Current: `+user+`
     -H, -host HOST
-        Optional hostname to use instead of reading it from the system. In query
-        operations, it doubles as search term for the hostname. Wildcard
-        operators (%, _) work but unlike query we search for the exact term.
-        Current: `+host+`
+        Optional hostname to use instead of detecting it. We detect it from the
+        BASHISTDB_HOST env variable, then the system. Useful in containers,
+        whose hostnames change. If set, in query operations, it doubles as
+        search term for the hostname. Wildcard operators (%, _) work but unlike
+        query we search for the exact term. Current: `+host+`
+    -query-user USER, -query-host HOST
+        Search term for the username and hostname in query operations. These
+        are independent of the user and host used for imports and override
+        -user and -host. If neither is set, queries search all users (%) and
+        hosts (%).
     -g, --global
         Sets user and host to % for query operation. (equiv: -user % -host %)
 
     -u, -unique
         If the query type permits, return unique results for the
         command line field (returns the most recent execution of each command).
+    -distinct
+        Return each command line once, with its most recent execution and
+        how many times it was run. Works with searches and -lastk. With
+        -format restore it rebuilds a clean history file, without copies.
     -R
         The query is a regular expession. This works only for the default query.
         For other types of query (e.g lastk, topk), it works as an exact match
@@ -173,21 +444,237 @@ Available options:
     -lastk, -tail K
         Return the K most recent commands for the set user and host. If you add
         a query term it will return the K most recent commands that include it.
+        K must be positive. Default: 20
     -topk K
         Return the K most frequent commands for the set user and host. If you add
         a query term it will return the K most frequent commands that include it.
+        K must be positive. Default: 20
+    -max-k K
+        Return at most K commands for -lastk and -topk, larger K are lowered to
+        it. In client mode the server's setting applies. Default: 10000
+    -limit N, -offset N
+        Return at most N results, after skipping the first -offset ones, to
+        page through searches, -topk and -lastk in scripts. -limit is the K of
+        -topk and -lastk, use one of them; searches return all results
+        without it. -lastk skips the most recent commands, e.g. -lastk 100
+        -offset 200 returns the third page of 100 going back in time.
+        Default offset: 0
+    -case-sensitive
+        Match the case of the query term in searches, -topk and -lastk:
+        'Make' doesn't find make. Without it, ASCII letters match in any
+        case. Regular expressions (-R) always match case, use (?i) for them.
+    -exclude-cmd PATTERN, -exclude-user PATTERN, -exclude-host PATTERN
+        Skip commands, users or hosts that match PATTERN, in searches, -topk
+        and -lastk. PATTERN is an SQL LIKE pattern, % matches anything and _
+        one character: -exclude-cmd 'ls%' skips directory listings.
+    -sort asc|desc
+        With -topk, asc returns the least used commands first. With -lastk,
+        asc returns the oldest K commands instead of the newest ones, oldest
+        first. Default: desc
+    -topk K -decay HALFLIFE
+        Rank commands by recency instead: each time a command was run counts
+        as 1 if it was now, 1/2 if it was HALFLIFE ago, 1/4 if twice HALFLIFE
+        ago and so on. HALFLIFE is in days (90d) or a duration (720h). Prints
+        the score and the times each command was run. Default: 90d
+    -top-24h, -top-week
+        As -topk, but count only the commands run in the last 24 hours or the
+        last 7 days. Use -topk K along to set K.
     -row K
         Return the K row from the database. You can pipe it to bash.
     -del EXPRESSION (e.g: 9-13,100,5)
         Delete rows with the given row ids. Row ids stay unique unless you delete
         the last row, where its id will be given to the next new entry.
+    -undo-import ID|last
+        Delete the commands added by import ID, or by your most recent import
+        (user and host) with last. Default: last
+    -archive FILE [-older DURATION]
+        Move the commands run more than DURATION ago, of every user, to the
+        database FILE, created if it doesn't exist. It is a database like
+        any other, query it with -db FILE. Commands it has already are
+        dropped all the same. Local mode only. Default: DURATION=90d
+    -rename-host OLD=NEW [-dry-run]
+        Rename host OLD to NEW, e.g. after renaming the machine, in every
+        profile. Commands NEW has already, at the same time, are merged into
+        NEW's instead of failing. Returns how many commands were updated and
+        merged; with -dry-run, how many would be, without changing anything.
+        Servers answer only admin keys.
+    -rename-user OLD=NEW [-dry-run]
+        The same as -rename-host, for users.
+    -normalize-existing [-dry-run]
+        Give the users and hosts stored before -normalize the spelling it
+        imports them with, merging commands like -rename-host does. Needs
+        -normalize and its -strip-domains. Local mode only.
+    -list-profiles
+        Return the profiles with history, with how many commands each has.
+    -list-imports [-top K]
+        Return the K most recent import batches, with their id, user, host,
+        start time and commands added. Default: K=20
     -users
         Return the users in the database. You may use search criteria, eg to
-        find users who run a certain commands. By default this option searches
+        find users who run a certain commands. Like all queries, it searches
         across all users and host unless you explicitly set them via flags.
+    -by-source
+        Return how many commands were imported with each -source.
     -A K, -B K, -C K
         Also print K lines A(fter), B(efore) or before and after C(ontent) of
         each match.
+    -after COMMAND, -before COMMAND
+        Return the commands you usually run after (or before) COMMAND, along
+        with how many times each one was seen. Only commands by the same user
+        at the same host within -window seconds count. Wildcard operators (%, _)
+        work but we search for the exact term.
+    -window SECONDS
+        Time window for -after and -before. Default: 300
+    -on-this-day
+        Return what you were running on today's date in previous years, grouped
+        by year and host. On February 28 of a non-leap year, February 29 is
+        included too. A query term, if given, filters the commands.
+    -suggest PREFIX [-top K]
+        Return up to K commands you ran that start with PREFIX, one per line,
+        most likely first. Commands you run often and recently rank higher.
+        It is fast enough to bind to a key in bash. Default K: 20
+    -status
+        Return the database file, its size, schema version, journal mode and
+        number of rows. In client mode, the server reports its database.
+    -check
+        Check the database for corruption (e.g. after a crash) with SQLite's
+        integrity and foreign key checks, and that its schema version is one
+        bashistdb knows. Prints ok, or the problems found and exits with an
+        error. Local mode only.
+    -info
+        Return the number of commands and the datetime of the earliest and
+        latest one, for the set user, host and query term. It is cheap, so
+        it can be used for dashboards.
+    -trend PATTERN [-bucket BUCKET]
+        Return how many times commands matching PATTERN were run per month (or
+        week) across your whole history, as a bar chart with the peak marked.
+        Wildcard operators (%, _) work but we search for the exact term, e.g:
+        -trend 'svn%'. Buckets: `+BUCKET_MONTH+", "+BUCKET_WEEK+`. Default: `+BUCKET_MONTH+`
+    -sessions [-session-gap MINUTES]
+        List your sessions: consecutive commands of the same user at the same
+        host, with less than MINUTES between them. For each session, print its
+        number, start, duration, number of commands, first and last command.
+        Default gap: 30
+    -session-show N [-session-gap MINUTES]
+        Return the commands of session N (as numbered by -sessions).
+    -env-usage
+        Return the environment variables you set inline in commands (e.g.
+        GOPATH=/tmp/test go build) and how many times each one was set.
+    -sudo-stats
+        Return the most used command lines that start with sudo (as many as
+        -topk, default 20) and how many distinct programs were run with sudo.
+    -follow [QUERY]
+        Client mode only. Like tail -f, print new command lines that match
+        QUERY (and -query-user, -query-host) as the server imports them, until
+        interrupted. Uses the -format output format, by default log, which
+        shows when and where each command was run. E.g. to watch the commands
+        of another machine live: bashistdb -follow -host studentbox. If the
+        server stops sending heartbeats, we give up on it.
+    -fuzzy QUERY
+        Return the commands closest to QUERY (e.g. with typos fixed) instead
+        of those that include it. Searches that find nothing fall back to
+        this automatically, unless the output format is meant for machines
+        (json, ndjson, rows, restore, export).
+    -favorite COMMAND, -unfavorite COMMAND
+        Add or remove COMMAND (exact command line) to your favorites.
+    -list-favorites
+        Return your favorites and when you added them.
+    -include-favorites
+        With -format restore, add your favorites at the end of the output,
+        so they are right under your fingertips in the restored history.
+    -highlight MARKERS
+        With -format restore and a query term, mark what the term matches in
+        each command with MARKERS, where %s stands for the match, e.g.
+        '>>>%s<<<', to review a restore before sourcing it. The marks end up
+        in the commands, so leave it out for restores you source directly.
+    -explain
+        Instead of the result of a query, return the SQL statements it runs,
+        each with its parameters and SQLite's query plan, to check filters
+        work as expected. Parameters are never part of the SQL, they are
+        shown quoted.
+    -anonymize LIST [-anonymize-salt SALT]
+        With -format json, ndjson or export, searches and -lastk, hide what
+        LIST, a comma separated list of users, hosts and args, says: users and
+        hosts are replaced by a hash keyed with SALT and commands are cut to
+        their first word, dropping notes too. Use it to share usage statistics.
+        Give the same SALT to get the same names across exports, keep it
+        secret so they can't be reversed. Without it, a random one is used.
+        A server older than the client ignores it and returns rows in full.
+    -tag COMMAND -tag-name TAG
+        Tag COMMAND (exact command line) for your user and host with TAG,
+        e.g. deployment, debugging, build. A command may have many tags.
+    -filter-tag TAG [QUERY]
+        Return the command lines tagged with TAG (that include QUERY).
+    -list-tags
+        Return your tags.
+    -annotate COMMAND -note NOTE
+        Attach NOTE to COMMAND (exact command line) for your user and host.
+        Queries that return command lines show it next to them. An empty
+        NOTE removes it.
+    -list-annotations
+        Return your annotations.
+    -audit [-audit-rules FILE] [-audit-disable ID1,ID2,...]
+        Report dangerous commands (rm -rf /, chmod -R 777, curl | sh, etc),
+        grouped by the id of the rule they matched. You can add your own rules
+        from FILE, one per line as "ID REGEX"; empty lines and lines starting
+        with # are skipped. Rules that give you false positives can be
+        disabled by id. Built-in rules: rm-root, chmod-777, curl-pipe-sh,
+        dd-disk, mkfs, iptables-flush.
+    -background-stats
+        Return the programs you run in the background (e.g. firefox &) and
+        how many times each one was backgrounded.
+    -pipelines-only [QUERY] [-top K]
+        Return the K command lines (that match QUERY) with pipes in them, the
+        ones with the most pipes first, to review your multi-step pipelines.
+    -redirections-only [QUERY] [-top K]
+        Return the K most recent command lines (that match QUERY) that
+        redirect input or output with >, >> or <, such as one-liners that
+        process data. Comparisons (>=, <=) don't count.
+    -report frecent [QUERY] [-top K]
+        Return the K command lines (that match QUERY) you run most, weighting
+        recent uses higher, like a browser's URL bar. Each use adds
+        1/(DAYS+1) to a command's score, DAYS being how long ago it was.
+    -recent-hosts [-since DURATION]
+        Return the hosts that ran commands in the last DURATION (e.g. 7d, 12h),
+        with how many commands each ran and when it was last seen, most
+        recently seen first. Default: 7d. Servers answer only admin keys.
+    -recent-users [-since DURATION]
+        The same as -recent-hosts, for users: which accounts use the system.
+        Default: 7d. Servers answer only admin keys.
+    -inactive-users [-since DURATION]
+        Return the users that ran no commands in the last DURATION, with when
+        they were last seen, least recently first, to find dormant accounts.
+        Use -format json for JSON. Default: 90d. Servers answer only admin
+        keys.
+    -chains [-ngram N] [-top K]
+        Return the K most common sequences of N commands (N=2 for pairs, N=3
+        for triplets) run one after the other by the same user at the same
+        host. Defaults: N=2, K=20
+    -cd-stats [-top K]
+        Return the K directories you cd to the most. Paths under your home
+        are shown with ~ and relative paths are resolved against the last
+        directory you changed to at the same host, when known. Default: K=20
+    -editor-stats [-top K]
+        Return how many times you ran each editor (vim, vi, nano, emacs, code,
+        gedit) and the K files you edited the most, as you typed them.
+        Default: K=20
+    -git-stats
+        Return how many times you ran each git subcommand (commit, log, etc),
+        counting hub and gh too. With -format `+FORMAT_JSON+` it returns a list of
+        {"subcommand": "commit", "count": 1234} objects.
+    -common-prefixes [-prefix-len N] [-top K]
+        Return the K command prefixes of N characters you typed with the most
+        different endings, candidates for an alias. Only prefixes with at
+        least 3 variants count. Defaults: N=10, K=20
+    -recurring [-min-occurrences N]
+        Return the commands you run on a regular schedule (e.g. df -h every
+        morning), those run at least N times (default 5) with intervals
+        between runs that vary little. Most regular first.
+    -suggest-aliases [-min-count N]
+        Return alias definitions for your .bashrc, for the command lines (with
+        arguments) you run at least N times, most frequent first. Aliases are
+        named after the program with a hash, e.g. alias git_4c1f='git log
+        --oneline'; rename them as you like. Default: N=10
 
     -local
         Force local [db] mode, despite remote mode being set by env or conf.
@@ -202,21 +689,184 @@ Available options:
     -k, -key PASSPHRASE
         Passphrase to use for creating keys to encrypt network communications.
         You may also set it via the BASHISTDB_KEY env variable.
+    -key-file FILE
+        Read the key from FILE instead of deriving it from -key. FILE is
+        hex encoded if it has only hex digits, or else it is the key as is
+        (e.g. head -c 32 /dev/urandom). Keep it readable by its owner only,
+        bashistdb warns if it isn't. You may also set it via the
+        BASHISTDB_KEY_FILE env variable.
+    -key-salt FILE
+        Derive the keys from the passphrases (-key, -old-key, -user-key and
+        the -policy ones) with scrypt and the salt in FILE, instead of using
+        them as they are, so weak passphrases make strong keys. If FILE
+        doesn't exist, it is created with a random salt. The server and its
+        clients must use the same salt, copy FILE to them. You may also set
+        it via the BASHISTDB_KEY_SALT env variable.
+    -auth-mode MODE
+        How network messages are protected with the keys: '`+AUTH_ENCRYPT+`' with
+        NaCl authenticated encryption, or '`+AUTH_SIGN+`' with HMAC-SHA256 tags
+        only, which is cheaper but anyone on the network can read them. Use
+        '`+AUTH_SIGN+`' only on networks that are encrypted already (a VPN,
+        stunnel). The server and its clients must use the same mode. You may
+        also set it via the BASHISTDB_AUTH_MODE env variable.
+        Default: `+AUTH_ENCRYPT+`
+    -old-key PASSPHRASE
+        Server only. Accept messages encrypted with PASSPHRASE too and reply
+        to them with it. May be given many times. Use it to rotate the key
+        without breaking clients: start the server with the new key and the
+        old one as -old-key, update the clients, then drop -old-key.
+    -user-key USER:PASSPHRASE
+        Server only. Accept messages encrypted with PASSPHRASE as USER's only:
+        whatever user they set, they import and query USER's history, so a
+        server may be shared by people who can't read each other's history.
+        May be given many times. Keys from -key and -old-key see everything,
+        unless there is a -policy. USER can't have the wildcards % and _.
+        Queries that aren't limited to a user (-row, -del, -status, -check and
+        the demo) are refused for USER's keys.
+    -policy FILE
+        Server only. Limit whose history clients may access, as FILE says.
+        Each line is one of:
+            admin PASSPHRASE            full access, for stats and maintenance
+            key USER[@HOST] PASSPHRASE  as -user-key, limited to HOST too if set
+            claim CIDR                  clients from CIDR may use the -key and
+                                        -old-key keys, as the user they claim
+        Lines starting with # are comments. With a policy, the -key and
+        -old-key keys work only from the claim networks and only for the
+        user clients send (-user), which can't have % or _. Refused requests
+        are logged and the client gets an error.
+    -hooks FILE
+        Server only. Take actions when imported commands match a watchlist,
+        e.g. to alert when someone runs userdel on production hosts. Each line
+        is one of:
+            match [@HOST] REGEXP   the actions below are for commands matching
+                                   REGEXP, run at hosts matching HOST (%, _)
+            exec PROGRAM [ARG...]  run PROGRAM, {user}, {host}, {command},
+                                   {datetime} and {row} in ARGs are replaced
+            post URL               POST the command as JSON to URL
+        Lines starting with # are comments. Actions run in the background, at
+        most 30 a minute, the rest are dropped. Failed actions are logged,
+        they don't affect imports.
+    -upstream SERVER[:PORT]
+        Server only. Forward the history clients import to SERVER too, as a
+        client with the server's passphrase, e.g. from office servers to a
+        central one. PORT is the server's -port unless set. Forwarding is
+        best effort: failures are logged and the history isn't sent again.
+        Forwarded history isn't forwarded further, so two servers may
+        forward to each other.
+    -cache-ttl DURATION
+        Server only. Keep query results for DURATION (e.g. 30s, 5m), so the
+        same query from clients doesn't hit the database again. Cached results
+        are dropped whenever history is imported or changed. Results bigger
+        than a network message (1MiB) aren't cached. 0 disables the cache.
+        Default: 30s
+    -querylog [-top K]
+        Return the K queries the server served most recently: when, from where,
+        the user the client claimed, the query, how many lines it returned and
+        how long it took. Remotely only keys with full access may ask for it.
+        Default: K=20
+    -querylog-retention DURATION
+        Server only. Drop query and audit log entries older than DURATION
+        (e.g. 720h). 0 keeps them forever. Default: 720h
+    -audit-log [-since DURATION] [-top K]
+        Return the K operations the server performed most recently, in the
+        last DURATION if set: when, the user and host the client acted as,
+        the operation (queries with their type), whether it succeeded or why
+        not, and how many commands it imported. Unlike -querylog it has
+        imports and refused requests too. Local mode only, on the server's
+        database. Default: K=20
+    -audit-summary [-from DATE] [-to DATE]
+        Return a report of the operations the server performed from DATE to
+        DATE, both included, as JSON for compliance tools: how many there
+        were, of each type and by each user, how many failed and how many
+        were performed outside working hours (8am to 6pm, local time). DATEs
+        are like 2015-10-12, or RFC3339 times. Local mode only, on the
+        server's database. Default: all of the audit log
+    -flush-cache
+        Client mode only. Drop the server's cached query results.
+    -rotate-key PASSPHRASE
+        Client mode only. Switch the server's passphrase to PASSPHRASE, with a
+        key that has full access. The server accepts the old one too for
+        -key-rotation-grace, so its clients can be updated meanwhile. Not
+        with -auth-mode '`+AUTH_SIGN+`', it would send PASSPHRASE unencrypted.
+        The server forgets it when it restarts, update its -key as well.
+        PASSPHRASE ends up in your shell history, use -rotate-key-file instead
+        to keep it out.
+    -rotate-key-file FILE
+        Client mode only. Like -rotate-key, with the key in FILE, hex encoded
+        or as raw bytes like -key-file. Update the server's -key-file to it.
+    -key-rotation-grace DURATION
+        Server only. How long the server still accepts its old passphrase
+        after -rotate-key. Default: 24h
+    -watch DURATION [-no-clear]
+        Client mode only. Re-run the query every DURATION (e.g. 5s, 1m) until
+        interrupted, clearing the screen between runs like watch(1), so you
+        can keep a live view of some stats in a terminal. With -no-clear, the
+        output of previous runs stays on screen. Queries that change the
+        database can't be watched. To see new commands as they are imported
+        instead, use -follow.
+    -record COMMAND
+        Add COMMAND, as run now by the set user at the set host. It is meant
+        for shell hooks that log every command as it is run, without sending
+        a history block. If the command is already there for this second, it
+        is ignored, so a later import of the same history adds nothing.
+    -multi FILE
+        Client mode only. Run the queries in FILE with a single request to the
+        server, e.g. for dashboards, and print their results in order with an
+        empty line between them. FILE is a JSON list of query parameters, as
+        in [{"Type": "info"}, {"Type": "topk", "Kappa": 5}]. Types are those
+        of the protocol (query, lastk, topk, info, gitstats, etc). Fields left
+        out get the defaults of the flags, the search fields match anything
+        and the output format is -format.
 
     -f, --format FORMAT
         How to format query output. Available types are:
         `+FORMAT_ALL+", "+FORMAT_BASH_HISTORY+", "+FORMAT_COMMAND_LINE+
-		", "+FORMAT_JSON+", "+FORMAT_LOG+", "+FORMAT_TIMESTAMP+", "+
+		", "+FORMAT_JSON+", "+FORMAT_NDJSON+", "+FORMAT_LOG+", "+FORMAT_TIMESTAMP+", "+
 		FORMAT_EXPORT+", "+FORMAT_ROWS+`
         Format '`+FORMAT_BASH_HISTORY+`' can be used to restore your history file.
         Format '`+FORMAT_EXPORT+`' can be used to pipe your history to another
         instance of bashistdb, while retaining user and host of each command.
         Format '`+FORMAT_ROWS+`' can be used for advanced delete operations.
+        Format '`+FORMAT_NDJSON+`' is a JSON object (user, host, command, datetime,
+        count) per line, written as rows are read, to pipe large results to
+        other tools.
         Default: `+FORMAT_DEFAULT+`
+        When importing, FORMAT is the format of the history instead:
+        '`+IMPORT_BASH+`' for the output of history, or '`+IMPORT_SYSLOG+`' for syslog lines
+        whose message is the command, as logged by a shell audit hook. Syslog
+        times may be ISO 8601 (journalctl -o short-iso) or traditional (Oct 12
+        12:00:40, taken as local time within the last year). Lines in format
+        '`+FORMAT_EXPORT+`' are accepted with either.
+        Default: `+IMPORT_BASH+`
+        Import statistics go to the log. With '`+FORMAT_JSON+`', bash history is imported
+        and its statistics are printed to stdout as JSON, after the log line.
+        Old servers send the log line only, then nothing is printed.
+        If nothing was added and most lines were malformed, bashistdb exits
+        with an error.
+        Bash history timestamps may be in HISTTIMEFORMAT '%FT%T%z ' (what -init
+        sets), '%FT%T%:z ', '%F %T ' (local time) or '%s ', the layout of the
+        first line is detected and the statistics say which, unless it was
+        the first one.
+    -time-layout LAYOUT
+        Decode imported bash history timestamps with Go's time LAYOUT (e.g.
+        "02/01/2006 15:04"), local time unless it has a zone, for formats that
+        can't be detected.
+    -tz ZONE, -time-format LAYOUT
+        Show times of formats '`+FORMAT_ALL+`' and '`+FORMAT_TIMESTAMP+`' in time zone ZONE
+        (e.g. UTC, Europe/Athens) with Go's time LAYOUT (e.g. "2006-01-02
+        15:04"). In client mode the server formats output, its settings apply.
+        Defaults: Local, "2006-01-02 15:04:05"
+    -color, -no-color
+        Color query output meant to be read by people: counts in yellow,
+        times in cyan and commands in white. Formats meant for machines or to
+        be imported again aren't colored. In client mode the server formats
+        output, its settings apply. Default: color if output is a terminal,
+        never in server mode
 
     -save
-        Write some settings (database, remote, port, key) to configuration file:
-        `+confFile+`. These settings override environment variables.
+        Write some settings (database, remote, port, key, key file, auth mode, profile) to
+        configuration file: `+confFile+`. These settings override environment
+        variables.
     -init
         Setup system for bashistdb: (1) Save settings to file. (2) Add to bashrc
         functions to timestamp history and sent each command to bashistdb
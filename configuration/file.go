@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"strings"
 )
 
 // exportFields is a struct used to export some
@@ -32,6 +33,10 @@ type exportFields struct {
 	Remote   string
 	Port     string
 	Key      string
+	KeySalt  string
+	KeyFile  string
+	AuthMode string
+	Profile  string
 }
 
 // Read configuration file, overrides environment variables.
@@ -52,6 +57,18 @@ func readConfFile() error {
 			if e.Key != "" {
 				passphrase = e.Key
 			}
+			if e.KeySalt != "" {
+				keySalt = e.KeySalt
+			}
+			if e.KeyFile != "" {
+				keyFile = e.KeyFile
+			}
+			if e.AuthMode != "" {
+				authMode = e.AuthMode
+			}
+			if e.Profile != "" {
+				profile = e.Profile
+			}
 			foundConfFile = true
 		} else {
 			return errors.New("Could not parse configuration file: " +
@@ -67,12 +84,62 @@ func writeConfFile() error {
 "database": %#v,
 "remote"  : %#v,
 "port"    : %#v,
-"key"     : %#v
+"key"     : %#v,
+"keysalt" : %#v,
+"keyfile" : %#v,
+"authmode": %#v,
+"profile" : %#v
 }
-`, Database, remote, port, string(Key))
+`, Database, remote, port, Passphrase, KeySaltFile, KeyFile, AuthMode, Profile)
 	err := ioutil.WriteFile(confFile, []byte(conf), 0600)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// Read audit rules from file, one "ID REGEX" rule per line. Empty lines
+// and lines starting with # are skipped. Rules are parsed by the database
+// so they work the same over the network.
+func readAuditRules(file string) ([]string, error) {
+	c, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read audit rules file: " + err.Error())
+	}
+	var rules []string
+	for _, l := range strings.Split(string(c), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		rules = append(rules, l)
+	}
+	return rules, nil
+}
+
+// readQueries reads the queries of a -multi file, a JSON list of query
+// parameters. Fields a query leaves out keep their value from base.
+func readQueries(file string, base QueryParams) ([]QueryParams, error) {
+	c, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read queries file: " + err.Error())
+	}
+	var raw []json.RawMessage
+	if err = json.Unmarshal(c, &raw); err != nil {
+		return nil, errors.New("Could not parse queries file: " + err.Error())
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("No queries in queries file: " + file)
+	}
+	queries := make([]QueryParams, len(raw))
+	for i, r := range raw {
+		queries[i] = base
+		if err = json.Unmarshal(r, &queries[i]); err != nil {
+			return nil, fmt.Errorf("Could not parse query %d of queries file: %s", i+1, err)
+		}
+		if queries[i].Type == "" {
+			return nil, fmt.Errorf("Query %d of queries file has no Type.", i+1)
+		}
+	}
+	return queries, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package configuration
+
+import (
+	"os"
+	osuser "os/user"
+)
+
+// Lookups we detect the default user and host with. Tests replace them.
+var (
+	lookupEnv  = os.Getenv
+	lookupUser = osuser.Current
+	lookupHost = os.Hostname
+)
+
+// An identity is the default user and host, and where we found them.
+type identity struct {
+	user, userFrom string
+	host, hostFrom string
+}
+
+// detectIdentity finds the default user and host. Containers often come
+// without $USER and with a random hostname, so BASHISTDB_USER and
+// BASHISTDB_HOST override what the system says.
+func detectIdentity() identity {
+	var id identity
+	id.user, id.userFrom = detectUser()
+	id.host, id.hostFrom = detectHost()
+	return id
+}
+
+// detectUser returns the user from $BASHISTDB_USER, $USER or the user
+// database, the first that has one, and which one it was. Both are empty
+// if none has.
+func detectUser() (string, string) {
+	if u := lookupEnv("BASHISTDB_USER"); u != "" {
+		return u, "$BASHISTDB_USER"
+	}
+	if u := lookupEnv("USER"); u != "" {
+		return u, "$USER"
+	}
+	if u, err := lookupUser(); err == nil && u.Username != "" {
+		return u.Username, "the user database"
+	}
+	return "", ""
+}
+
+// detectHost returns the host from $BASHISTDB_HOST or the system, the first
+// that has one, and which one it was. Both are empty if none has.
+func detectHost() (string, string) {
+	if h := lookupEnv("BASHISTDB_HOST"); h != "" {
+		return h, "$BASHISTDB_HOST"
+	}
+	if h, err := lookupHost(); err == nil && h != "" {
+		return h, "the system"
+	}
+	return "", ""
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package configuration
+
+import (
+	"errors"
+	osuser "os/user"
+	"testing"
+)
+
+func TestDetectIdentity(t *testing.T) {
+	defer func(e func(string) string, u func() (*osuser.User, error), h func() (string, error)) {
+		lookupEnv, lookupUser, lookupHost = e, u, h
+	}(lookupEnv, lookupUser, lookupHost)
+
+	test := []struct {
+		env      map[string]string
+		sysUser  string // empty means the user database lookup fails
+		sysHost  string // empty means the hostname lookup fails
+		want     identity
+		testName string
+	}{
+		{map[string]string{"BASHISTDB_USER": "alice", "USER": "root", "BASHISTDB_HOST": "laptop"}, "bob", "4f2a9c",
+			identity{"alice", "$BASHISTDB_USER", "laptop", "$BASHISTDB_HOST"}, "overrides"},
+		{map[string]string{"USER": "root"}, "bob", "4f2a9c",
+			identity{"root", "$USER", "4f2a9c", "the system"}, "$USER and system hostname"},
+		{map[string]string{}, "bob", "4f2a9c",
+			identity{"bob", "the user database", "4f2a9c", "the system"}, "user database"},
+		{map[string]string{}, "", "",
+			identity{"", "", "", ""}, "nothing found"},
+	}
+
+	for _, c := range test {
+		lookupEnv = func(k string) string { return c.env[k] }
+		lookupUser = func() (*osuser.User, error) {
+			if c.sysUser == "" {
+				return nil, errors.New("no user")
+			}
+			return &osuser.User{Username: c.sysUser}, nil
+		}
+		lookupHost = func() (string, error) {
+			if c.sysHost == "" {
+				return "", errors.New("no hostname")
+			}
+			return c.sysHost, nil
+		}
+		if got := detectIdentity(); got != c.want {
+			t.Errorf("Test '%s'\nWanted: %+v\nGot   : %+v\n", c.testName, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package configuration
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/andmarios/crypto/scrypt"
+)
+
+// Parameters of the key derivation of -key-salt. Changing them changes
+// every derived key, servers and clients must agree on them.
+const (
+	kdfN        = 1 << 15
+	kdfR        = 8
+	kdfP        = 1
+	kdfKeyBytes = 32
+	saltBytes   = 16
+)
+
+// loadSalt returns the salt in file, hex encoded on its first line. If file
+// doesn't exist, it is created with a random salt, to be copied to the
+// server and the other clients.
+func loadSalt(file string) ([]byte, error) {
+	c, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		salt := make([]byte, saltBytes)
+		if _, err = rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if err = ioutil.WriteFile(file, []byte(hex.EncodeToString(salt)+"\n"), 0600); err != nil {
+			return nil, errors.New("Could not create key salt file: " + err.Error())
+		}
+		Log.Info.Printf("Created key salt file %s, copy it to the server and the other clients.\n", file)
+		return salt, nil
+	}
+	if err != nil {
+		return nil, errors.New("Could not read key salt file: " + err.Error())
+	}
+	salt, err := hex.DecodeString(strings.TrimSpace(string(c)))
+	if err != nil || len(salt) < saltBytes {
+		return nil, errors.New("Invalid key salt file, it should have a hex encoded salt of 16 bytes or more: " + file)
+	}
+	return salt, nil
+}
+
+// loadKey returns the key in file: hex encoded if the file has only hex
+// digits (and a newline), the bytes of the file as they are if not. It
+// warns if others than its owner may read file.
+func loadKey(file string) ([]byte, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.New("Could not read key file: " + err.Error())
+	}
+	if fi.Mode().Perm()&0044 != 0 {
+		Log.Warn.Printf("Key file %s can be read by group or others, chmod 600 it.\n", file)
+	}
+	c, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read key file: " + err.Error())
+	}
+	if key, err := hex.DecodeString(strings.TrimSpace(string(c))); err == nil && len(key) > 0 {
+		return key, nil
+	}
+	if len(strings.TrimSpace(string(c))) == 0 {
+		return nil, errors.New("Invalid key file, it is empty: " + file)
+	}
+	return c, nil
+}
+
+// DeriveKey returns the key for passphrase: stretched with scrypt and
+// KeySalt if it is set, the passphrase as is if not. Weak passphrases make
+// weak keys when used as is.
+func DeriveKey(passphrase string) ([]byte, error) {
+	if KeySalt == nil {
+		return []byte(passphrase), nil
+	}
+	return scrypt.Key([]byte(passphrase), KeySalt, kdfN, kdfR, kdfP, kdfKeyBytes)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package configuration
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeriveKey(t *testing.T) {
+	defer func(s []byte) { KeySalt = s }(KeySalt)
+
+	KeySalt = nil
+	if k, err := DeriveKey("weak"); err != nil || string(k) != "weak" {
+		t.Fatalf("Test derive key without salt: wanted the passphrase, got %q (%v).", k, err)
+	}
+
+	derive := func(passphrase string, salt []byte) []byte {
+		KeySalt = salt
+		k, err := DeriveKey(passphrase)
+		if err != nil {
+			t.Fatal("Test derive key: " + err.Error())
+		}
+		return k
+	}
+	salt1, salt2 := bytes.Repeat([]byte{1}, saltBytes), bytes.Repeat([]byte{2}, saltBytes)
+	k := derive("weak", salt1)
+	if len(k) != kdfKeyBytes || bytes.Contains(k, []byte("weak")) {
+		t.Errorf("Test derive key: got a key of %d bytes, %q.", len(k), k)
+	}
+	if !bytes.Equal(k, derive("weak", salt1)) {
+		t.Error("Test derive key: the same passphrase and salt derived different keys.")
+	}
+	if bytes.Equal(k, derive("weak", salt2)) {
+		t.Error("Test derive key: different salts derived the same key.")
+	}
+	if bytes.Equal(k, derive("weaker", salt1)) {
+		t.Error("Test derive key: different passphrases derived the same key.")
+	}
+}
+
+func TestKeySalt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "salt")
+
+	resetFlags("cmd", "-s", "-k", "admin", "-old-key", "old", "-key-salt", file)
+	if err = parse(); err != nil {
+		t.Fatal("Test key salt: " + err.Error())
+	}
+	if len(KeySalt) != saltBytes || string(Key) == "admin" || len(Keys) != 2 || string(Keys[1]) == "old" {
+		t.Fatalf("Test key salt: wanted derived keys, got salt %x and keys %q.", KeySalt, Keys)
+	}
+	salt, key := KeySalt, Key
+
+	// The salt is created once, clients that share it derive the same key.
+	resetFlags("cmd", "-r", "server", "-k", "admin", "-key-salt", file)
+	if err = parse(); err != nil {
+		t.Fatal("Test key salt: " + err.Error())
+	}
+	if !bytes.Equal(KeySalt, salt) || !bytes.Equal(Key, key) {
+		t.Errorf("Test key salt: wanted the salt and key of the server, got %x and %x.", KeySalt, Key)
+	}
+
+	resetFlags("cmd", "-r", "server", "-k", "admin")
+	if err = parse(); err != nil || KeySalt != nil || string(Key) != "admin" {
+		t.Errorf("Test key salt: wanted the passphrase as key without -key-salt, got %q (%v).", Key, err)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("not hex\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resetFlags("cmd", "-r", "server", "-k", "admin", "-key-salt", file)
+	if err = parse(); err == nil {
+		t.Error("Test key salt: wanted an error for an invalid salt file.")
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "key")
+
+	raw := []byte{0, 1, 2, 0xfe, '\n', 0xff}
+	tests := []struct {
+		content []byte
+		perm    os.FileMode
+		want    []byte
+	}{
+		{[]byte("00010203\n"), 0600, []byte{0, 1, 2, 3}},
+		{raw, 0600, raw},
+		{[]byte("not hex\n"), 0644, []byte("not hex\n")}, // readable by others, it only warns
+	}
+	for _, test := range tests {
+		if err = ioutil.WriteFile(file, test.content, test.perm); err != nil {
+			t.Fatal(err)
+		}
+		os.Chmod(file, test.perm)
+		resetFlags("cmd", "-r", "server", "-key-file", file)
+		if err = parse(); err != nil || !bytes.Equal(Key, test.want) || KeyFile != file {
+			t.Errorf("Test key file %q: wanted key %q, got %q (%v).", test.content, test.want, Key, err)
+		}
+	}
+
+	// The key file isn't derived with the salt, the passphrases are.
+	salt := filepath.Join(dir, "salt")
+	resetFlags("cmd", "-s", "-key-file", file, "-old-key", "old", "-key-salt", salt)
+	if err = parse(); err != nil || string(Key) != "not hex\n" || string(Keys[1]) == "old" {
+		t.Errorf("Test key file with salt: got keys %q (%v).", Keys, err)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, input := range [][]string{
+		{"cmd", "-r", "server", "-key-file", file},
+		{"cmd", "-r", "server", "-key-file", filepath.Join(dir, "missing")},
+		{"cmd", "-r", "server", "-k", "admin", "-key-file", file},
+	} {
+		resetFlags(input...)
+		if err = parse(); err == nil {
+			t.Errorf("Test key file %v: should get error", input[1:])
+		}
+	}
+}
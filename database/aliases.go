@@ -0,0 +1,89 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path"
+	"regexp"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// aliasUnsafe matches what can't be in an alias name.
+var aliasUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// GetStashableCommands returns alias definitions, ready for .bashrc, for
+// the command lines within the search criteria that were run with the same
+// arguments at least minCount times, most frequent first. Each alias is
+// named after the program, with a hash of the command line so names don't
+// clash.
+func (d Database) GetStashableCommands(params conf.QueryParams, minCount int) ([]byte, error) {
+	if minCount < 2 {
+		return []byte{}, errors.New("Alias suggestions need commands run at least 2 times.")
+	}
+	rows, err := d.Query(`SELECT command, count(*) AS count FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               GROUP BY command HAVING count >= ?
+                               ORDER BY count DESC, command ASC`,
+		params.User, params.Host, d.Profile(), minCount)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var command string
+		var count int
+		rows.Scan(&command, &count)
+		// Commands without arguments are as short as an alias.
+		fields := strings.Fields(command)
+		if len(fields) < 2 {
+			continue
+		}
+		if out.Len() > 0 {
+			out.WriteString("\n")
+		}
+		fmt.Fprintf(&out, "alias %s='%s' # run %d times", aliasName(fields[0], command),
+			strings.Replace(command, "'", `'\''`, -1), count)
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if out.Len() == 0 {
+		return []byte("No alias candidates found."), nil
+	}
+	return out.Bytes(), nil
+}
+
+// aliasName returns the name we suggest for an alias of command, whose
+// program is program: the program's name and a short hash of command.
+func aliasName(program, command string) string {
+	h := fnv.New32a()
+	h.Write([]byte(command))
+	name := aliasUnsafe.ReplaceAllString(path.Base(program), "")
+	if name == "" {
+		name = "cmd"
+	}
+	return fmt.Sprintf("%s_%04x", name, h.Sum32()&0xffff)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// AnnotateCommand attaches note to command for user@host. It replaces any
+// previous note. An empty note removes the annotation.
+func (d Database) AnnotateCommand(user, host, command, note string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if note == "" {
+		_, err := d.Exec(`DELETE FROM annotations WHERE user = ? AND host = ? AND command = ?`,
+			user, host, command)
+		return err
+	}
+	_, err := d.Exec(`INSERT OR REPLACE INTO annotations(user, host, command, note) VALUES(?, ?, ?, ?)`,
+		user, host, command, note)
+	return err
+}
+
+// GetAnnotations returns the annotations of users and hosts matching user
+// and host (they may contain wildcards), one per line.
+func (d Database) GetAnnotations(user, host string) ([]byte, error) {
+	rows, err := d.Query(`SELECT user, host, command, note FROM annotations
+                               WHERE user LIKE ? AND host LIKE ?
+                               ORDER BY user, host, command`,
+		user, host)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var user, host, command, note string
+		rows.Scan(&user, &host, &command, &note)
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s@%s %s  # %s", user, host, command, note))
+	}
+	return out.Bytes(), nil
+}
+
+type annotationKey struct {
+	user, host, command string
+}
+
+// annotations holds the notes of commands, so queries can show them next
+// to command lines.
+type annotations map[annotationKey]string
+
+// annotations loads the annotations of users and hosts matching user and
+// host. They are few, so we keep them in memory instead of joining them
+// with the history table in every query. If they can't be loaded (e.g. a
+// read-only database on an older schema) queries work without them.
+func (d Database) annotations(user, host string) annotations {
+	a := make(annotations)
+	rows, err := d.Query(`SELECT user, host, command, note FROM annotations
+                               WHERE user LIKE ? AND host LIKE ?`,
+		user, host)
+	if err != nil {
+		log.Debug.Println("Could not load annotations:", err.Error())
+		return a
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k annotationKey
+		var note string
+		rows.Scan(&k.user, &k.host, &k.command, &note)
+		a[k] = note
+	}
+	return a
+}
+
+// note returns the note of command for user@host, if any.
+func (a annotations) note(user, host, command string) string {
+	return a[annotationKey{user, host, command}]
+}
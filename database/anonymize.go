@@ -0,0 +1,73 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// anonymize sets res to hide what qp.Anonymize lists of its rows: users
+// and hosts are replaced by a keyed hash, so the same salt always gives the
+// same names but they can't be reversed without it, and commands are cut
+// to their first word, as their arguments tell paths and names. Notes are
+// dropped with the arguments, they may tell as much.
+func anonymize(qp conf.QueryParams, res *result.Result) {
+	if len(qp.Anonymize) == 0 {
+		return
+	}
+	var users, hosts, args bool
+	for _, a := range qp.Anonymize {
+		switch a {
+		case conf.ANON_USERS:
+			users = true
+		case conf.ANON_HOSTS:
+			hosts = true
+		case conf.ANON_ARGS:
+			args = true
+		}
+	}
+	res.Rewrite(func(user, host, command, note string) (string, string, string, string) {
+		if users {
+			user = anonymousName(qp.AnonymizeSalt, user)
+		}
+		if hosts {
+			host = anonymousName(qp.AnonymizeSalt, host)
+		}
+		if args {
+			if f := strings.Fields(command); len(f) > 0 {
+				command = f[0]
+			}
+			note = ""
+		}
+		return user, host, command, note
+	})
+}
+
+// anonymousName returns the first 16 hex digits of the HMAC-SHA256 of name,
+// keyed with salt.
+func anonymousName(salt, name string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(name))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
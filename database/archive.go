@@ -0,0 +1,123 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Archive moves the commands p asks for to their archive and says how many
+// it moved.
+func (d Database) Archive(p conf.QueryParams) ([]byte, error) {
+	moved, err := d.ArchiveOlderThan(p.Archive, p.DateTo)
+	if err != nil {
+		return []byte{}, err
+	}
+	return []byte(fmt.Sprintf("Moved %d commands run before %s to %s.", moved,
+		p.DateTo.Format(time.RFC3339), p.Archive)), nil
+}
+
+// ArchiveOlderThan moves the commands run before cutoff to the database at
+// dest, which is created if it doesn't exist, so d stays small. The archive
+// is a bashistdb database like d, with the same key, and it may be queried
+// as one. Commands of every profile are moved, they keep their profile.
+// Commands it has already are dropped from d all the same. Both
+// databases change in one transaction, or neither does.
+func (d Database) ArchiveOlderThan(dest string, cutoff time.Time) (moved int, err error) {
+	if d.readOnly {
+		return 0, ErrReadOnly
+	}
+	if absPath(dest) == absPath(d.path) {
+		return 0, errors.New("The archive can't be the database itself.")
+	}
+	withHost, err := hostInKey(d.DB)
+	if err != nil {
+		return 0, err
+	}
+	// Open creates, or migrates, the archive like any database.
+	var opts []Option
+	if withHost {
+		opts = append(opts, KeyIncludesHost())
+	}
+	archive, err := Open(dest, nil, opts...)
+	if err != nil {
+		return 0, err
+	}
+	if err = archive.Close(); err != nil {
+		return 0, err
+	}
+
+	// ATTACH is per connection and can't run in a transaction, so we keep a
+	// connection for it.
+	ctx := d.context()
+	c, err := d.DB.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	if _, err = c.ExecContext(ctx, `ATTACH DATABASE ? AS archive`, dest); err != nil {
+		return 0, err
+	}
+	defer c.ExecContext(context.Background(), `DETACH DATABASE archive`)
+
+	var tx *sql.Tx
+	if err = retryBusy(ctx, func() (err error) {
+		tx, err = c.BeginTx(ctx, nil)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	before := cutoff.Unix()
+	if _, err = tx.Exec(`INSERT OR IGNORE INTO archive.imports(id, user, host, started_at, rows_added)
+                             SELECT id, user, host, started_at, rows_added FROM main.imports
+                             WHERE id IN (SELECT import_id FROM main.history WHERE datetime < ?)`,
+		before); err != nil {
+		return 0, err
+	}
+	if _, err = tx.Exec(`INSERT OR IGNORE INTO archive.history(user, host, command, datetime, source, import_id, profile)
+                             SELECT user, host, command, datetime, source, import_id, profile FROM main.history
+                             WHERE datetime < ?`, before); err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec(`DELETE FROM main.history WHERE datetime < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	log.Info.Printf("Archived %d commands to %s.\n", n, dest)
+	return int(n), nil
+}
+
+// absPath is path made absolute, or path if it can't be.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// A Rule is a regular expression that matches dangerous commands. Its ID is
+// printed next to matches, so it should be short.
+type Rule struct {
+	ID     string
+	Regexp *regexp.Regexp
+}
+
+// DefaultRules are the built-in audit rules.
+var DefaultRules = []Rule{
+	{"rm-root", regexp.MustCompile(`\brm\s+(\S+\s+)*-\S*[rR]\S*\s+(\S+\s+)*/\*?(\s|$)`)},
+	{"chmod-777", regexp.MustCompile(`\bchmod\b.*(\s-\S*R.*\s0?777\b|\s0?777\b.*\s-\S*R)`)},
+	{"curl-pipe-sh", regexp.MustCompile(`\b(curl|wget)\b.*\|\s*(sudo\s+)?(ba|da|k|z)?sh\b`)},
+	{"dd-disk", regexp.MustCompile(`\bdd\b.*\bof=/dev/(sd|hd|vd|xvd|nvme|mmcblk|disk)`)},
+	// Also matches man mkfs, apropos mkfs, etc. Disable it if it bothers you.
+	{"mkfs", regexp.MustCompile(`\bmkfs(\.\w+)?(\s|$)`)},
+	{"iptables-flush", regexp.MustCompile(`\bip6?tables\b.*\s(-F|--flush)\b`)},
+}
+
+// AuditRules returns the default rules, minus the ones disabled in qp,
+// plus the extra rules in qp.
+func AuditRules(qp conf.QueryParams) ([]Rule, error) {
+	disabled := make(map[string]bool)
+	for _, id := range qp.AuditDisable {
+		disabled[strings.TrimSpace(id)] = true
+	}
+
+	var rules []Rule
+	for _, r := range DefaultRules {
+		if !disabled[r.ID] {
+			rules = append(rules, r)
+		}
+	}
+	for _, l := range qp.AuditRules {
+		f := strings.Fields(l)
+		if len(f) < 2 {
+			return nil, errors.New("Audit rule without regular expression: " + l)
+		}
+		re, err := regexp.Compile(strings.TrimSpace(strings.TrimPrefix(l, f[0])))
+		if err != nil {
+			return nil, errors.New("Could not parse audit rule " + f[0] + ": " + err.Error())
+		}
+		if !disabled[f[0]] {
+			rules = append(rules, Rule{f[0], re})
+		}
+	}
+	return rules, nil
+}
+
+// Audit returns the commands within the search criteria that match any of
+// rules, grouped by rule, with the time and host they were run at.
+func (d Database) Audit(qp conf.QueryParams, rules []Rule) ([]byte, error) {
+	rows, err := d.Query(`SELECT user, host, command, datetime FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY datetime ASC`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	matches := make([][]string, len(rules))
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		rows.Scan(&user, &host, &command, epoch{&t})
+		for i, r := range rules {
+			if r.Regexp.MatchString(command) {
+				matches[i] = append(matches[i], fmt.Sprintf("  %s %s@%s %s",
+					t.Format(RFC3339alt), user, host, command))
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	var out bytes.Buffer
+	for i, r := range rules {
+		if len(matches[i]) == 0 {
+			continue
+		}
+		if out.Len() > 0 {
+			out.WriteString("\n\n")
+		}
+		out.WriteString(fmt.Sprintf("[%s] %d matches:\n", r.ID, len(matches[i])))
+		out.WriteString(strings.Join(matches[i], "\n"))
+	}
+	if out.Len() == 0 {
+		out.WriteString("No dangerous commands found.")
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// An AuditEntry is an operation a server performed for a client, for the
+// audit log. Unlike the query log it has every operation, imports and
+// refused ones too.
+type AuditEntry struct {
+	Datetime     time.Time
+	User         string // the user the client acted as
+	Host         string // the host the client acted as
+	Operation    string // the message type, with the query type for queries
+	Status       string // ok, or why it failed
+	RowsAffected int    // commands imported, for imports
+}
+
+// auditTime is the layout of audit log datetimes, in UTC, so they sort and
+// compare as text.
+const auditTime = "2006-01-02 15:04:05"
+
+// LogAudit queues e to be written to the audit log. It doesn't wait for
+// the write, errors writing it are only logged. Entries are kept as long as
+// query log ones.
+func (d Database) LogAudit(e AuditEntry) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.w.enqueueAudit(e)
+}
+
+// GetAuditLog returns the limit most recent audit log entries since since,
+// one per line, the most recent first.
+func (d Database) GetAuditLog(since time.Time, limit int) ([]byte, error) {
+	rows, err := d.Query(`SELECT datetime, user, host, operation, status, rows_affected FROM audit_log
+                               WHERE datetime >= ? ORDER BY datetime DESC, rowid DESC LIMIT ?`,
+		since.UTC().Format(auditTime), limit)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var datetime, user, host, operation, status string
+		var n int
+		if err = rows.Scan(&datetime, &user, &host, &operation, &status, &n); err != nil {
+			return []byte{}, err
+		}
+		t, err := time.Parse(auditTime, datetime)
+		if err != nil {
+			return []byte{}, err
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s | %s@%s | %s | %s | %d rows",
+			t.Local().Format(time.RFC3339), user, host, operation, status, n))
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if out.Len() == 0 {
+		return []byte("No operations logged."), nil
+	}
+	return out.Bytes(), nil
+}
+
+// Working hours, in local time. Operations outside them are reported by
+// GetAuditSummary.
+const (
+	workStart = 8  // hour working hours start at
+	workEnd   = 18 // hour working hours end at
+)
+
+// An auditSummary is what GetAuditSummary returns, as JSON.
+type auditSummary struct {
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Operations   int            `json:"operations"`
+	Failed       int            `json:"failed"`
+	UnusualHours int            `json:"unusual_hours"`
+	ByOperation  map[string]int `json:"by_operation"`
+	ByUser       map[string]int `json:"by_user"`
+	UnusualUsers map[string]int `json:"unusual_hours_by_user"`
+}
+
+// GetAuditSummary returns a report of the audit log entries since from and
+// before to, all of them after from if to is zero, for compliance tools, in
+// JSON: how many operations there were, of each type and by each user, how
+// many failed, and how many were performed outside working hours, 8am to
+// 6pm local time, in all and by user.
+func (d Database) GetAuditSummary(from, to time.Time) ([]byte, error) {
+	query := `SELECT datetime, user, operation, status FROM audit_log WHERE datetime >= ?`
+	args := []interface{}{from.UTC().Format(auditTime)}
+	if !to.IsZero() {
+		query += ` AND datetime < ?`
+		args = append(args, to.UTC().Format(auditTime))
+	}
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	s := auditSummary{From: from, To: to,
+		ByOperation: map[string]int{}, ByUser: map[string]int{}, UnusualUsers: map[string]int{}}
+	for rows.Next() {
+		var datetime, user, operation, status string
+		if err = rows.Scan(&datetime, &user, &operation, &status); err != nil {
+			return []byte{}, err
+		}
+		t, err := time.Parse(auditTime, datetime)
+		if err != nil {
+			return []byte{}, err
+		}
+		s.Operations++
+		s.ByOperation[operation]++
+		s.ByUser[user]++
+		if status != "ok" {
+			s.Failed++
+		}
+		if h := t.Local().Hour(); h < workStart || h >= workEnd {
+			s.UnusualHours++
+			s.UnusualUsers[user]++
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	return json.Marshal(s)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// schemaVersions are the schema versions migrate knows, oldest first.
+var schemaVersions = []string{"1", "2", "2.1", "2.2", "2.3", "2.4", "2.5", "2.6", VERSION}
+
+// Check verifies the database isn't corrupt with SQLite's integrity and
+// foreign key checks and that we know its schema version. It returns "ok"
+// if all pass, else an error that lists the problems found.
+func (d Database) Check() ([]byte, error) {
+	var problems []string
+
+	rows, err := d.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		problems = append(problems, "integrity check: "+err.Error())
+	} else {
+		for rows.Next() {
+			var msg string
+			rows.Scan(&msg)
+			if msg != "ok" {
+				problems = append(problems, "integrity check: "+msg)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			problems = append(problems, "integrity check: "+err.Error())
+		}
+		rows.Close()
+	}
+
+	rows, err = d.Query(`PRAGMA foreign_key_check`)
+	if err != nil {
+		problems = append(problems, "foreign key check: "+err.Error())
+	} else {
+		for rows.Next() {
+			var table, parent string
+			var row, fk int
+			rows.Scan(&table, &row, &parent, &fk)
+			problems = append(problems, fmt.Sprintf("foreign key check: row %d of %s references a missing row of %s", row, table, parent))
+		}
+		if err = rows.Err(); err != nil {
+			problems = append(problems, "foreign key check: "+err.Error())
+		}
+		rows.Close()
+	}
+
+	var version string
+	err = d.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
+	switch {
+	case err != nil:
+		problems = append(problems, "schema version: "+err.Error())
+	case !knownVersion(version):
+		problems = append(problems, fmt.Sprintf("schema version: unknown version %s, this bashistdb supports up to %s", version, VERSION))
+	}
+
+	if len(problems) > 0 {
+		return []byte{}, errors.New("Database check failed:\n" + strings.Join(problems, "\n"))
+	}
+	return []byte("ok"), nil
+}
+
+func knownVersion(version string) bool {
+	for _, v := range schemaVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+)
+
+// WithContext returns a copy of d whose queries run with ctx, so canceling
+// ctx aborts them. Transactions started with it are rolled back when ctx is
+// canceled. Every Database method may be called on the copy.
+func (d Database) WithContext(ctx context.Context) Database {
+	d.ctx = ctx
+	return d
+}
+
+// context returns d's context, or the background context if it has none.
+func (d Database) context() context.Context {
+	if d.ctx == nil {
+		return context.Background()
+	}
+	return d.ctx
+}
+
+// Query is sql.DB's Query with d's context. The query is logged if it is
+// slow, once its rows are closed.
+func (d Database) Query(query string, args ...interface{}) (*Rows, error) {
+	d.explainQuery(query, args)
+	done := d.timeQuery(query, args)
+	rows, err := d.DB.QueryContext(d.context(), query, args...)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	return &Rows{rows, done}, nil
+}
+
+// QueryRow is sql.DB's QueryRow with d's context. The query is logged if it
+// is slow, once its row is scanned.
+func (d Database) QueryRow(query string, args ...interface{}) *SingleRow {
+	d.explainQuery(query, args)
+	done := d.timeQuery(query, args)
+	return &SingleRow{d.DB.QueryRowContext(d.context(), query, args...), done}
+}
+
+// Exec is sql.DB's Exec with d's context. The statement is logged if it is
+// slow.
+func (d Database) Exec(query string, args ...interface{}) (sql.Result, error) {
+	defer d.timeQuery(query, args)()
+	return d.DB.ExecContext(d.context(), query, args...)
+}
+
+// Begin is sql.DB's Begin with d's context.
+func (d Database) Begin() (*sql.Tx, error) {
+	return d.DB.BeginTx(d.context(), nil)
+}
@@ -23,12 +23,18 @@ package database
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"sync"
@@ -36,7 +42,6 @@ import (
 
 	conf "github.com/andmarios/bashistdb/configuration"
 	"github.com/andmarios/bashistdb/llog"
-	"github.com/mattn/go-sqlite3"
 )
 
 // Golang's RFC3339 does not comply with all RFC3339 representations
@@ -45,14 +50,79 @@ const RFC3339alt = "2006-01-02T15:04:05-0700"
 // VERSION is the database's schema supported version.
 // If your database is older it will be automatically migrated.
 // If it is newer you have to update your bashistdb copy.
-const VERSION = "2.1"
+const VERSION = "3.0"
 
 // A Database holds a bashistdb database.
 type Database struct {
 	*sql.DB
 	statements
+	readOnly  bool
+	w         *writer // inserts history rows, nil if read-only
+	ctx       context.Context
+	path      string        // the database file
+	parser    LineParser    // decodes lines AddFromBuffer reads, BashParser if nil
+	forUser   string        // if set, the user of every line AddFromBuffer imports
+	forHost   string        // if set, the host of every line AddFromBuffer imports
+	source    string        // the source label of the rows we import, none if empty
+	explained *bytes.Buffer // if set, queries write their SQL and plan to it
+	// rejectsFile is where AddFromBuffer appends lines it couldn't decode.
+	rejectsFile string
+	maxCommand  int             // longest command AddFromBuffer imports, in bytes, 0 is no limit
+	slowQuery   time.Duration   // statements that take longer are logged, 0 logs none
+	profile     string          // the history d reads and writes, DefaultProfile if empty
+	names       *nameNormalizer // normalizes users and hosts, nil keeps them as they are
 }
 
+// A Row is a history row.
+type Row struct {
+	ID                  int
+	User, Host, Command string
+	Datetime            time.Time
+	Source              string // label of the batch it was imported with
+	ImportID            int    // the import batch that added it, 0 if none
+	Profile             string // the history it belongs to, DefaultProfile if empty
+}
+
+// OnCommit sets f to be called with the history rows inserted, after they
+// are committed. It is called from the goroutine that writes them, so f
+// should not block. Set it before any import.
+func (d *Database) OnCommit(f func(rows []Row)) {
+	if d.w != nil {
+		d.w.committed = f
+	}
+}
+
+// ReadOnly reports whether d was opened read-only.
+func (d Database) ReadOnly() bool {
+	return d.readOnly
+}
+
+// Close writes any history rows still queued and closes the database.
+func (d Database) Close() error {
+	if d.w != nil {
+		d.w.close()
+	}
+	return d.DB.Close()
+}
+
+// ErrReadOnly is returned by methods that write to the database when it
+// was opened read-only.
+var ErrReadOnly = errors.New("Database is opened read-only.")
+
+// ErrNewerSchema is returned when the database was written by a newer
+// bashistdb, that we can't migrate from.
+var ErrNewerSchema = errors.New("Database schema is newer than this bashistdb's, update it.")
+
+// ErrDuplicate is returned by AddRecord when the record exists already.
+var ErrDuplicate = errors.New("Command is recorded already.")
+
+// ErrLineTooLong is returned by Import for lines longer than MaxLineBytes.
+var ErrLineTooLong = fmt.Errorf("History line is longer than %d bytes.", MaxLineBytes)
+
+// MaxLineBytes is the longest line, with its newline, Import reads. Imports
+// may come from the network, we don't hold more than that in memory.
+const MaxLineBytes = 1 << 20
+
 type statements struct {
 	insert *sql.Stmt
 }
@@ -63,29 +133,64 @@ func init() {
 	log = conf.Log
 }
 
-// New returns a new Database instance. It gets the filename for the
-// database from the configuration package. If the file does not exist,
-// it creates a new database. If it exists, it migrates it if it has an
-// older schema version than current.
+// New returns a new Database instance. It is Open with the filename and
+// options from the configuration package, kept for compatibility.
 func New() (Database, error) {
+	opts := []Option{RejectsFile(conf.RejectsFile), MaxCommandBytes(conf.MaxCommandBytes), SlowQuery(conf.SlowQuery)}
+	if conf.DbPerm != 0 {
+		opts = append(opts, FilePerm(conf.DbPerm))
+	}
+	if conf.ReadOnly {
+		opts = append(opts, ReadOnly())
+	}
+	if conf.KeyIncludesHost {
+		opts = append(opts, KeyIncludesHost())
+	}
+	if conf.NormalizeNames {
+		opts = append(opts, NormalizeNames(conf.StripDomains))
+	}
+	db, err := Open(conf.Database, nil, opts...)
+	return db.WithProfile(conf.Profile), err
+}
+
+// Open returns a new Database instance for the file at path. If the file
+// does not exist, it creates a new database. If it exists, it migrates it
+// if it has an older schema version than current. If logger isn't nil,
+// the package logs to it from then on.
+func Open(path string, logger *llog.Logger, opts ...Option) (Database, error) {
+	if logger != nil {
+		log = logger
+	}
+	o := options{slowQuery: defaultSlowQuery, perm: defaultPerm}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.readOnly {
+		return openReadOnly(path, o)
+	}
 	// If database file does not exist, set a flag to create file and table.
 	init := false
-	if _, err := os.Stat(conf.Database); os.IsNotExist(err) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
 		log.Info.Println("Database file not found. Creating new.")
+		if err = create(path, o.perm); err != nil {
+			return Database{}, err
+		}
 		init = true
 	} else {
-		log.Info.Println("Database file found.")
+		log.Debug.Println("Database file found.")
 	}
 	// Open database. SQLite3 provides concurrency in the library level, thus
-	// we don't need to implement locking.
-	db, err := sql.Open("sqlite3", conf.Database)
+	// we don't need to implement locking. Transactions take the write lock
+	// when they begin, so concurrent imports wait for each other instead of
+	// failing to upgrade their lock midway.
+	db, err := sql.Open(driverName, fileURI(path, "_txlock=immediate"+o.dsn()))
 	if err != nil {
 		return Database{}, err
 	}
 	// If database is new, initialize it with our tables.
 	// Else migrate it if needed.
 	if init {
-		if err = initDB(db); err != nil {
+		if err = initDB(db, o.keyIncludesHost); err != nil {
 			_ = db.Close()
 			return Database{}, err
 		}
@@ -95,10 +200,21 @@ func New() (Database, error) {
 			return Database{}, err
 		}
 	}
+	if o.keyIncludesHost {
+		if err = rekeyWithHost(db); err != nil {
+			_ = db.Close()
+			return Database{}, err
+		}
+	}
 	// Prepare various statements that may be used frequently.
 	errs := make([]error, 5)
-	var insert *sql.Stmt
-	insert, errs[0] = db.Prepare("INSERT INTO history(user, host, command, datetime) VALUES(?, ?, ?, ?)")
+	var insert, insertMany, insertShared, logInsert *sql.Stmt
+	insert, errs[0] = db.Prepare("INSERT INTO history(user, host, command, datetime, source, import_id, profile) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	logInsert, errs[1] = db.Prepare("INSERT INTO querylog(datetime, remote, user, type, params, rows, duration_ms) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	insertMany, errs[2] = db.Prepare("INSERT INTO history(user, host, command, datetime, source, import_id, profile) VALUES" +
+		strings.Repeat("(?, ?, ?, ?, ?, ?, ?), ", insertRows-1) + "(?, ?, ?, ?, ?, ?, ?)")
+	insertShared, errs[3] = db.Prepare("INSERT INTO history(user, host, command, datetime, source, import_id, profile) SELECT ?1, ?2, column1, column2, ?3, ?4, ?5 FROM (VALUES" +
+		strings.Repeat("(?, ?), ", insertRows-1) + "(?, ?))")
 	for _, e := range errs {
 		if e != nil {
 			_ = db.Close()
@@ -106,19 +222,76 @@ func New() (Database, error) {
 		}
 	}
 	stmts := statements{insert}
-	return Database{db, stmts}, nil
+	return Database{DB: db, statements: stmts, w: newWriter(db, insert, insertMany, insertShared, logInsert, o.queryLogRetention, o.slowQuery),
+		path: path, rejectsFile: o.rejectsFile, maxCommand: o.maxCommandBytes, slowQuery: o.slowQuery, names: o.names}, nil
+}
+
+// fileURI returns the SQLite URI that opens the file at path with the
+// query params. The path is escaped, so a ?, # or % in it is part of the
+// file name.
+func fileURI(path, params string) string {
+	u := url.URL{Scheme: "file", Opaque: (&url.URL{Path: path}).EscapedPath(), RawQuery: params}
+	return u.String()
+}
+
+// openReadOnly opens an existing database in read-only mode. It doesn't
+// prepare any write statements nor migrates the database, so queries
+// against an older schema may fail.
+func openReadOnly(path string, o options) (Database, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return Database{}, fmt.Errorf("database file not found at %s", path)
+	} else if err != nil {
+		return Database{}, err
+	}
+	db, err := sql.Open(driverName, fileURI(path, "mode=ro&immutable=0"+o.dsn()))
+	if err != nil {
+		return Database{}, err
+	}
+	var version string
+	err = db.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
+	if err != nil {
+		_ = db.Close()
+		return Database{}, err
+	}
+	if version != VERSION {
+		log.Warn.Printf("Database version is %s, code version is %s. Read-only mode won't migrate it.\n", version, VERSION)
+	}
+	log.Debug.Println("Database opened read-only.")
+	return Database{DB: db, readOnly: true, path: path, slowQuery: o.slowQuery, names: o.names}, nil
 }
 
-func initDB(db *sql.DB) error {
+// historyKey returns the primary key for new history tables. Without host
+// in it, the same command run at the same second on two hosts is stored
+// once. Profiles never share rows.
+func historyKey(withHost bool) string {
+	if withHost {
+		return "user, host, command, datetime, profile"
+	}
+	return "user, command, datetime, profile"
+}
+
+func initDB(db *sql.DB, keyIncludesHost bool) error {
 	stmt := `
 CREATE TABLE history (
     user     TEXT,
     host     TEXT,
     command  TEXT,
-    datetime DATETIME,
-    PRIMARY KEY (user, command, datetime)
+    datetime INTEGER,
+    source   TEXT,
+    import_id INTEGER,
+    profile  TEXT NOT NULL DEFAULT 'default',
+    PRIMARY KEY (` + historyKey(keyIncludesHost) + `)
 );
 CREATE INDEX HistoryDatetimeIdx ON history(datetime);
+CREATE INDEX HistoryImportIdx ON history(import_id);
+
+CREATE TABLE imports (
+    id         INTEGER PRIMARY KEY,
+    user       TEXT,
+    host       TEXT,
+    started_at DATETIME,
+    rows_added INTEGER
+);
 
 CREATE TABLE admin (
     key   TEXT PRIMARY KEY,
@@ -139,7 +312,53 @@ CREATE VIEW connections AS
     SELECT datetime, remote, reverse
     FROM connlog AS c
         LEFT JOIN rlookup AS r
-        ON c.remote=r.ip;`
+        ON c.remote=r.ip;
+
+CREATE TABLE annotations (
+    user    TEXT,
+    host    TEXT,
+    command TEXT,
+    note    TEXT,
+    PRIMARY KEY (user, host, command)
+);
+
+CREATE TABLE tags (
+    user    TEXT,
+    host    TEXT,
+    command TEXT,
+    tag     TEXT,
+    PRIMARY KEY (user, host, command, tag)
+);
+
+CREATE TABLE favorites (
+    user     TEXT,
+    host     TEXT,
+    command  TEXT,
+    added_at DATETIME,
+    profile  TEXT NOT NULL DEFAULT 'default',
+    PRIMARY KEY (user, host, command, profile)
+);
+
+CREATE TABLE querylog (
+    datetime    DATETIME,
+    remote      TEXT,
+    user        TEXT,
+    type        TEXT,
+    params      TEXT,
+    rows        INTEGER,
+    duration_ms INTEGER
+);
+CREATE INDEX QueryLogDatetimeIdx ON querylog(datetime);
+
+CREATE TABLE audit_log (
+    datetime      TEXT,
+    user          TEXT,
+    host          TEXT,
+    operation     TEXT,
+    status        TEXT,
+    rows_affected INTEGER
+);
+CREATE INDEX AuditLogDatetimeIdx ON audit_log(datetime);`
 
 	if _, err := db.Exec(stmt); err != nil {
 		return err
@@ -153,124 +372,337 @@ CREATE VIEW connections AS
 	return nil
 }
 
-// AddRecord tries to insert a new record in the database,
-// if the record already exists, it updates the count
-// Note: function isn't used anywhere, may need testing if used.
+// AddRecord tries to insert a new record in the database and waits until
+// it is written. If the record already exists, it returns ErrDuplicate.
 func (d Database) AddRecord(user, host, command string, time time.Time) error {
-	// Try to insert row
-	_, err := d.insert.Exec(user, host, command, time)
-	if err != nil {
-		// If failed due to duplicate primary key, then ignore error
-		// We expect for ease of use, the user to resubmit the whole
-		// history from time to time.
-		if driverErr, ok := err.(sqlite3.Error); ok {
-			if driverErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
-				log.Debug.Println("Duplicate entry. Ignoring.", user, host, command, time)
-			} else {
-				return err
-			}
-		} else { // Normally we can never reach this. Should we omit it?
-			return err
-		}
+	if d.readOnly {
+		return ErrReadOnly
 	}
-	return nil
+	p := &pending{}
+	if err := d.w.enqueue(Row{User: d.names.user(user), Host: d.names.host(host), Command: command, Datetime: time, Source: d.source, Profile: d.Profile()}, p); err != nil {
+		return err
+	}
+	p.Wait()
+	if p.err == nil && p.duplicates > 0 {
+		return ErrDuplicate
+	}
+	return p.err
 }
 
-// A parseline parses history output lines of the following format:
-//     LINENUM RFC3339_DATETIME COMMAND
-var parseLine = regexp.MustCompile(`^ *[0-9]+\*? *([0-9T:+-]{24,24}) *(.*)`)
+// QueueRecord is AddRecord without waiting. Errors are only logged.
+func (d Database) QueueRecord(user, host, command string, time time.Time) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.w.enqueue(Row{User: d.names.user(user), Host: d.names.host(host), Command: command, Datetime: time, Source: d.source, Profile: d.Profile()}, nil)
+}
 
 // A parseExportLine parses export formatted output from bashistdb:
-//     USER HOSTNAME RFC3339_DATETIME COMMAND
-//([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)
+//
+//	USER HOSTNAME RFC3339_DATETIME COMMAND
+//
+// ([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)
 var parseExportLine = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_-]*) ([a-zA-Z0-9][a-zA-Z0-9.-]*) *([0-9T:+-]{24,24}) *(.*)`)
 
-// AddFromBuffer reads from a buffered Reader and scans for lines that match
-// history command's structure:
-//     LINENUM RFC3339_DATETIME COMMAND
-// Upon succesful encounter it tries to store it to the database. It counts
-// total lines read and lines failed to insert into the database —usually
-// because they already exist. It reports the results in a sentence (stats
-// string) because we don't anything fancier currently.
+// parseExport decodes a line of bashistdb's export format.
+func parseExport(line string) (Row, bool) {
+	args := parseExportLine.FindStringSubmatch(line)
+	if len(args) != 5 {
+		return Row{}, false
+	}
+	t, err := time.Parse(RFC3339alt, args[3])
+	if err != nil {
+		return Row{}, false
+	}
+	return Row{User: args[1], Host: args[2], Command: args[4], Datetime: t}, true
+}
+
+// ImportStats are the results of an import.
+type ImportStats struct {
+	Total      int    // lines read
+	Added      int    // lines stored
+	Duplicates int    // lines already in the database
+	Malformed  int    // lines that couldn't be decoded (rejected)
+	TooLong    int    // lines with commands over the size limit (rejected)
+	Redacted   int    // stored lines with secrets masked, we don't redact on import yet
+	DurationMs int64  // how long the import took
+	Layout     string `json:",omitempty"` // timestamp layout of bash history, as HISTTIMEFORMAT spells it
+}
+
+// String returns s in a sentence, as bashistdb always reported imports. A
+// layout other than the one bashistdb -init sets is mentioned.
+func (s ImportStats) String() string {
+	rejected := s.Malformed + s.TooLong
+	str := fmt.Sprintf("Processed %d entries, successful %d, failed %d (duplicates %d, rejected %d).",
+		s.Total, s.Added, s.Duplicates+rejected, s.Duplicates, rejected)
+	if s.Layout != "" && s.Layout != timeLayouts[0].name {
+		str += " Timestamps were in layout '" + s.Layout + "'."
+	}
+	return str
+}
+
+// Err returns an error if nothing was added and most lines were malformed,
+// likely the history isn't in the format we expected. Cron jobs notice it
+// by the exit code.
+func (s ImportStats) Err() error {
+	if s.Added == 0 && s.Malformed > s.Total/2 {
+		return fmt.Errorf("Import failed, nothing was added and %d of %d lines were malformed.", s.Malformed, s.Total)
+	}
+	return nil
+}
+
+// ReportImport writes s to w as JSON when format is FORMAT_JSON. Otherwise
+// it prints it to log, because we usually want imports to be quiet as we
+// may run them every time we hit ENTER in a bash prompt. It returns s.Err().
+func ReportImport(s ImportStats, format string, w io.Writer) error {
+	if format == conf.FORMAT_JSON {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(w, string(b)); err != nil {
+			return err
+		}
+	} else {
+		log.Info.Println(s)
+	}
+	return s.Err()
+}
+
+// AddFromBuffer is Import, it reports the results in a sentence.
 func (d Database) AddFromBuffer(r *bufio.Reader, user, host string) (stats string, e error) {
+	s, err := d.Import(r, user, host)
+	if err != nil {
+		return "", err
+	}
+	return s.String(), nil
+}
+
+// Import reads from a buffered Reader and scans for lines that match
+// history command's structure:
+//
+//	LINENUM DATETIME COMMAND
+//
+// or the format of the parser set with WithParser, or bashistdb's export
+// format. DATETIME is in the layout of the first line that has one, as
+// BashParser detects it, and the stats say which. Upon succesful encounter it tries to store it to the database. It counts
+// total lines read and lines failed to insert into the database, either
+// because they already exist (duplicates) or because they couldn't be
+// decoded (malformed). Commands longer than the MaxCommandBytes option are
+// rejected (too long). A line longer than MaxLineBytes fails the import with
+// ErrLineTooLong, the lines before it are imported.
+// If the database was opened with RejectsFile, rejected lines are appended to it verbatim,
+// so they can be fixed and imported again. Their line numbers and byte
+// offsets are logged.
+// Lines are queued to the database's writer as they are read, so they may
+// be written together with other imports. It returns once all are written.
+// The rows it adds are tagged with a new import batch, so they can be
+// removed again with UndoImport. If the same stream, for the same user,
+// host and profile, was imported within importHashWindow and added nothing
+// again, a warning says so: it was likely piped twice by accident.
+func (d Database) Import(r *bufio.Reader, user, host string) (ImportStats, error) {
+	if d.readOnly {
+		return ImportStats{}, ErrReadOnly
+	}
+	start := time.Now()
+	if d.forUser != "" {
+		user = d.forUser
+	}
+	if d.forHost != "" {
+		host = d.forHost
+	}
+	user, host = d.names.user(user), d.names.host(host)
+	batch, err := d.newImport(user, host, start)
+	if err != nil {
+		return ImportStats{}, err
+	}
 	//                                  LINENUM        DATETIME         CM
-	tx, _ := d.Begin()
-	stmt := tx.Stmt(d.insert)
-	total, failed := 0, 0
-	lineFormat := 1 // 1 means default history format, 3 is for export format
+	p := &pending{}
+	total, rejected, tooLong, offset := 0, 0, 0, 0
+	rejects := newRejectsWriter(d.rejectsFile)
+	defer rejects.Close()
+	parser := d.lineParser()
 	var once sync.Once
+	stream := sha256.New()
+	fmt.Fprintf(stream, "%s\x00%s\x00%s\x00", user, host, d.Profile())
 	for {
-		historyLine, err := r.ReadString('\n')
+		b, err := readLine(r)
+		stream.Write(b)
+		historyLine := string(b)
 		total++
 		if err != nil {
 			if err == io.EOF {
 				break
-			} else {
-				return "", errors.New("Error while reading stdin: " + err.Error())
 			}
+			p.Wait()
+			d.finishImport(batch)
+			if err == ErrLineTooLong {
+				return ImportStats{}, fmt.Errorf("Line %d: %w", total, err)
+			}
+			return ImportStats{}, errors.New("Error while reading stdin: " + err.Error())
 		}
+		lineOffset := offset
+		offset += len(historyLine)
 
-		args := parseLine.FindStringSubmatch(historyLine)
-		if len(args) != 3 {
-			args = parseExportLine.FindStringSubmatch(historyLine)
-			if len(args) != 5 {
-				log.Info.Println("Could't decode line, unknown format. Skipping:", historyLine)
-				failed++
-				continue
+		line := strings.TrimSuffix(historyLine, "\n")
+		row := Row{User: user, Host: host}
+		var ok bool
+		if row.Command, row.Datetime, ok = parser.Parse(line); !ok {
+			if row, ok = parseExport(line); ok {
+				once.Do(func() { log.Info.Println("Bashistdb export format detected.") })
 			}
-			once.Do(func() { log.Info.Println("Bashistdb export format detected.") })
-			lineFormat = 3
 		}
-
-		time, err := time.Parse(RFC3339alt, args[lineFormat])
-		if err != nil {
-			tx.Rollback()
-			return "", err
+		if !ok {
+			log.Warn.Printf("Could't decode line %d, unknown format or datetime. Skipping: %s", total, historyLine)
+			rejected++
+			rejects.Write(historyLine, total, lineOffset)
+			continue
 		}
-
-		switch lineFormat {
-		case 1:
-			_, err = stmt.Exec(user, host, strings.TrimSuffix(args[2], "\n"), time)
-		case 3:
-			_, err = stmt.Exec(args[1], args[2], strings.TrimSuffix(args[4], "\n"), time)
+		if d.maxCommand > 0 && len(row.Command) > d.maxCommand {
+			log.Warn.Printf("Command of line %d is %d bytes, longer than %d. Skipping.\n", total, len(row.Command), d.maxCommand)
+			tooLong++
+			rejects.Write(historyLine, total, lineOffset)
+			continue
 		}
-		if err != nil {
-			// If failed due to duplicate primary key, then ignore error
-			// We expect for ease of use, the user to resubmit the whole
-			// history from time to time.
-			if driverErr, ok := err.(sqlite3.Error); ok {
-				if driverErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
-					switch lineFormat {
-					case 1:
-						log.Debug.Println("Duplicate entry. Ignoring.", user, host, strings.TrimSuffix(args[2], "\n"), time)
-					case 3:
-						log.Debug.Println("Duplicate entry. Ignoring.", args[1], args[2], strings.TrimSuffix(args[4], "\n"), time)
-					}
-					failed++
-				} else {
-					tx.Rollback()
-					return "", err
-				}
-			} else { // Normally we can never reach this. Should we omit it?
-				return "", err
-			}
+		if d.forUser != "" {
+			row.User = d.forUser
+		}
+		if d.forHost != "" {
+			row.Host = d.forHost
+		}
+		row.User, row.Host = d.names.user(row.User), d.names.host(row.Host)
+		row.Source = d.source
+		row.ImportID = batch
+		row.Profile = d.Profile()
+
+		if err = d.w.enqueue(row, p); err != nil {
+			p.Wait()
+			d.finishImport(batch)
+			return ImportStats{}, err
 		}
 	}
-	tx.Commit()
+	p.Wait()
+	if err := d.finishImport(batch); err != nil {
+		return ImportStats{}, err
+	}
+	if p.err != nil {
+		return ImportStats{}, p.err
+	}
 	total--
-	stats = fmt.Sprintf("Processed %d entries, successful %d, failed %d.", total, total-failed, failed)
+	stats := ImportStats{
+		Total:      total,
+		Added:      total - p.duplicates - rejected - tooLong,
+		Duplicates: p.duplicates,
+		Malformed:  rejected,
+		TooLong:    tooLong,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if s, ok := parser.(*bashStream); ok {
+		stats.Layout = s.layout()
+	}
+	// It is only a hint, it never fails the import.
+	if total > 0 {
+		seen, err := d.seenImport(stream.Sum(nil), start)
+		switch {
+		case err != nil:
+			log.Debug.Println("Couldn't check for identical imports:", err)
+		case seen && stats.Added == 0 && stats.Duplicates > 0:
+			log.Warn.Println("Identical import detected, all rows were duplicates.")
+		}
+	}
 	return stats, nil
 }
 
+// create creates an empty database file at path with perm, and its missing
+// directories. SQLite would create it, but with the umask's permissions,
+// often readable by anyone.
+func create(path string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), perm|(perm&0444)>>2); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	// The umask may have taken some of perm.
+	return os.Chmod(path, perm)
+}
+
+// readLine is r.ReadBytes('\n') that stops with ErrLineTooLong instead of
+// reading a line longer than MaxLineBytes. Lines that fit in r's buffer,
+// most of them, aren't copied: they are valid until the next read.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		line = append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull && len(line) <= MaxLineBytes {
+			var chunk []byte
+			chunk, err = r.ReadSlice('\n')
+			line = append(line, chunk...)
+		}
+	}
+	if len(line) > MaxLineBytes {
+		return nil, ErrLineTooLong
+	}
+	return line, err
+}
+
+// A rejectsWriter appends rejected history lines to a file. The file is
+// opened on the first rejected line. If no filename is set or the file
+// can't be opened, it just discards lines.
+type rejectsWriter struct {
+	name string
+	f    *os.File
+	err  error
+}
+
+func newRejectsWriter(name string) *rejectsWriter {
+	return &rejectsWriter{name: name}
+}
+
+// Write appends line verbatim, so the file can be fixed and imported again.
+// Its line number and byte offset in the input are only logged.
+func (w *rejectsWriter) Write(line string, num, offset int) {
+	if w.name == "" || w.err != nil {
+		return
+	}
+	if w.f == nil {
+		if w.f, w.err = os.OpenFile(w.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); w.err != nil {
+			log.Error.Println("Could not open rejects file:", w.err)
+			return
+		}
+	}
+	if _, w.err = io.WriteString(w.f, line); w.err != nil {
+		log.Error.Println("Could not write to rejects file:", w.err)
+		return
+	}
+	log.Info.Printf("Rejected line %d, byte offset %d, written to %s.\n", num, offset, w.name)
+}
+
+func (w *rejectsWriter) Close() {
+	if w.f != nil {
+		_ = w.f.Close()
+	}
+}
+
 // LogConn logs the remote's IP address and connection time into connlog table.
 // Also if it can't find a reverse lookup for the IP address inside table rlookup,
 // it performs it asynchronously. Reverse lookup may fail, but we don't care.
 func (d Database) LogConn(remote net.Addr) (err error) {
+	if d.readOnly {
+		return ErrReadOnly
+	}
 	t := time.Now()
 	// Find IP
 	if ip, _, err := net.SplitHostPort(remote.String()); err == nil {
 		// Store IP and datetime
-		_, err = d.Exec(`INSERT INTO connlog VALUES (?, ?);`, t, ip)
+		err = retryBusy(d.context(), func() error {
+			_, err := d.Exec(`INSERT INTO connlog VALUES (?, ?);`, t, ip)
+			return err
+		})
 		if err == nil {
 			// Perform a reverse lookup if needed.
 			go func() {
@@ -278,13 +710,16 @@ func (d Database) LogConn(remote net.Addr) (err error) {
 				err = d.QueryRow("SELECT ip FROM rlookup WHERE ip LIKE ?", ip).Scan(&rip)
 				if err == sql.ErrNoRows {
 					if addr, err := net.LookupAddr(ip); err == nil {
-						_, err = d.Exec(`INSERT INTO rlookup(ip, reverse)
-                                                           VALUES(? ,?)`,
-							ip, strings.Join(addr, ","))
+						err = retryBusy(d.context(), func() error {
+							_, err := d.Exec(`INSERT INTO rlookup(ip, reverse)
+                                                                   VALUES(? ,?)`,
+								ip, strings.Join(addr, ","))
+							return err
+						})
 					}
 				}
 				if err != nil {
-					log.Info.Println(err)
+					log.Warn.Println("Reverse lookup failed:", err)
 				}
 			}()
 		}
@@ -292,6 +727,67 @@ func (d Database) LogConn(remote net.Addr) (err error) {
 	return
 }
 
+// hostInKey reports whether host is part of the history's primary key.
+func hostInKey(d *sql.DB) (bool, error) {
+	rows, err := d.Query(`PRAGMA table_info(history)`)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return false, err
+		}
+		if name == "host" {
+			return pk > 0, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// rekeyWithHost rebuilds the history table with (user, host, command,
+// datetime, profile) as its primary key, if it isn't already. Rowids are kept. It
+// runs in a transaction, so the database is left untouched if it fails.
+// There is no way back, as the old key may not fit the rows anymore.
+func rekeyWithHost(d *sql.DB) error {
+	ok, err := hostInKey(d)
+	if err != nil || ok {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	stmt := `CREATE TABLE history_new (
+                         user     TEXT,
+                         host     TEXT,
+                         command  TEXT,
+                         datetime INTEGER,
+                         source   TEXT,
+                         import_id INTEGER,
+                         profile  TEXT NOT NULL DEFAULT 'default',
+                         PRIMARY KEY (user, host, command, datetime, profile)
+                     );
+                     INSERT INTO history_new(rowid, user, host, command, datetime, source, import_id, profile)
+                         SELECT rowid, user, host, command, datetime, source, import_id, profile FROM history;
+                     DROP TABLE history;
+                     ALTER TABLE history_new RENAME TO history;
+                     CREATE INDEX HistoryDatetimeIdx ON history(datetime);
+                     CREATE INDEX HistoryImportIdx ON history(import_id);`
+	if _, err = tx.Exec(stmt); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	log.Info.Println("Database history rebuilt with host in its primary key.")
+	return nil
+}
+
 // migrate is a unexported function that handles database migrations.
 // It is safe to run on databases that already are on latest version.
 func migrate(d *sql.DB) error {
@@ -342,20 +838,299 @@ func migrate(d *sql.DB) error {
 		if _, err = tx.Exec(`CREATE INDEX HistoryDatetimeIdx ON history(datetime)`); err != nil {
 			return err
 		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.1"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.1.")
+		fallthrough
+	case "2.1":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE annotations (
+                             user    TEXT,
+                             host    TEXT,
+                             command TEXT,
+                             note    TEXT,
+                             PRIMARY KEY (user, host, command)
+                         );`
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.2"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.2.")
+		fallthrough
+	case "2.2":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE tags (
+                             user    TEXT,
+                             host    TEXT,
+                             command TEXT,
+                             tag     TEXT,
+                             PRIMARY KEY (user, host, command, tag)
+                         );`
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.3"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.3.")
+		fallthrough
+	case "2.3":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE favorites (
+                             user     TEXT,
+                             host     TEXT,
+                             command  TEXT,
+                             added_at DATETIME,
+                             PRIMARY KEY (user, host, command)
+                         );`
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.4"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.4.")
+		fallthrough
+	case "2.4":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`ALTER TABLE history ADD COLUMN source TEXT`); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.5"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.5.")
+		fallthrough
+	case "2.5":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `ALTER TABLE history ADD COLUMN import_id INTEGER;
+                         CREATE INDEX HistoryImportIdx ON history(import_id);
+                         CREATE TABLE imports (
+                             id         INTEGER PRIMARY KEY,
+                             user       TEXT,
+                             host       TEXT,
+                             started_at DATETIME,
+                             rows_added INTEGER
+                         );`
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.6"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.6.")
+		fallthrough
+	case "2.6":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE querylog (
+                             datetime    DATETIME,
+                             remote      TEXT,
+                             user        TEXT,
+                             type        TEXT,
+                             params      TEXT,
+                             rows        INTEGER,
+                             duration_ms INTEGER
+                         );
+                         CREATE INDEX QueryLogDatetimeIdx ON querylog(datetime);`
+		if _, err = tx.Exec(stmt); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.7"); err != nil {
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.7.")
+		fallthrough
+	case "2.7":
+		// Profile joins the keys, so rows of different profiles
+		// never collide. Rowids are kept.
+		withHost, err := hostInKey(d)
+		if err != nil {
+			return err
+		}
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE history_new (
+                             user     TEXT,
+                             host     TEXT,
+                             command  TEXT,
+                             datetime DATETIME,
+                             source   TEXT,
+                             import_id INTEGER,
+                             profile  TEXT NOT NULL DEFAULT 'default',
+                             PRIMARY KEY (` + historyKey(withHost) + `)
+                         );
+                         INSERT INTO history_new(rowid, user, host, command, datetime, source, import_id)
+                             SELECT rowid, user, host, command, datetime, source, import_id FROM history;
+                         DROP TABLE history;
+                         ALTER TABLE history_new RENAME TO history;
+                         CREATE INDEX HistoryDatetimeIdx ON history(datetime);
+                         CREATE INDEX HistoryImportIdx ON history(import_id);
+                         CREATE TABLE favorites_new (
+                             user     TEXT,
+                             host     TEXT,
+                             command  TEXT,
+                             added_at DATETIME,
+                             profile  TEXT NOT NULL DEFAULT 'default',
+                             PRIMARY KEY (user, host, command, profile)
+                         );
+                         INSERT INTO favorites_new(user, host, command, added_at)
+                             SELECT user, host, command, added_at FROM favorites;
+                         DROP TABLE favorites;
+                         ALTER TABLE favorites_new RENAME TO favorites;`
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.8"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.8.")
+		fallthrough
+	case "2.8":
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		stmt := `CREATE TABLE audit_log (
+                             datetime      TEXT,
+                             user          TEXT,
+                             host          TEXT,
+                             operation     TEXT,
+                             status        TEXT,
+                             rows_affected INTEGER
+                         );
+                         CREATE INDEX AuditLogDatetimeIdx ON audit_log(datetime);`
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, "2.9"); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+		log.Info.Println("Database upgraded to version 2.9.")
+		fallthrough
+	case "2.9":
+		// Datetimes become Unix time. SQLite converts the text to UTC,
+		// with the zone it was imported with. The same command imported
+		// in two zones was two rows, it is one now: we keep the first.
+		withHost, err := hostInKey(d)
+		if err != nil {
+			return err
+		}
+		tx, err := d.Begin()
+		if err != nil {
+			return err
+		}
+		var bad, before, after int
+		if err = tx.QueryRow(`SELECT count(*) FROM history WHERE typeof(datetime) = 'text' AND strftime('%s', datetime) IS NULL`).Scan(&bad); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if bad > 0 {
+			tx.Rollback()
+			return fmt.Errorf("Can't upgrade the database, %d history datetimes aren't in a format SQLite understands.", bad)
+		}
+		stmt := `CREATE TABLE history_new (
+                             user     TEXT,
+                             host     TEXT,
+                             command  TEXT,
+                             datetime INTEGER,
+                             source   TEXT,
+                             import_id INTEGER,
+                             profile  TEXT NOT NULL DEFAULT 'default',
+                             PRIMARY KEY (` + historyKey(withHost) + `)
+                         );
+                         INSERT OR IGNORE INTO history_new(rowid, user, host, command, datetime, source, import_id, profile)
+                             SELECT rowid, user, host, command,
+                                    CASE typeof(datetime) WHEN 'text' THEN CAST(strftime('%s', datetime) AS INTEGER) ELSE datetime END,
+                                    source, import_id, profile
+                             FROM history ORDER BY rowid;`
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.QueryRow(`SELECT (SELECT count(*) FROM history), (SELECT count(*) FROM history_new)`).Scan(&before, &after); err != nil {
+			tx.Rollback()
+			return err
+		}
+		stmt = `DROP TABLE history;
+                        ALTER TABLE history_new RENAME TO history;
+                        CREATE INDEX HistoryDatetimeIdx ON history(datetime);
+                        CREATE INDEX HistoryImportIdx ON history(import_id);`
+		if _, err = tx.Exec(stmt); err != nil {
+			tx.Rollback()
+			return err
+		}
 		if _, err = tx.Exec(`UPDATE admin SET value=? WHERE key LIKE 'version'`, VERSION); err != nil {
+			tx.Rollback()
 			return err
 		}
 		if err = tx.Commit(); err != nil {
 			return err
 		}
-		log.Info.Println("Database upgraded to latest version (2.1).")
+		if before > after {
+			log.Info.Printf("Merged %d history rows that were the same command at the same time, in another zone.\n", before-after)
+		}
+		log.Info.Println("Database upgraded to latest version (3.0).")
 		return nil
-	case "2.1":
+	case "3.0":
 		log.Debug.Println("Database on latest version.")
 	}
 
 	if version != VERSION {
-		return errors.New("Database version different than code version but couldn't fix it.")
+		return fmt.Errorf("%w It is version %s, we know up to %s.", ErrNewerSchema, version, VERSION)
 	}
 
 	return nil
@@ -20,16 +20,34 @@ package database
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	l "log"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	conf "github.com/andmarios/bashistdb/configuration"
 )
 
+// History times are shown in local time, tests expect UTC wherever they run.
+func init() {
+	time.Local = time.UTC
+}
+
 func TestNew(t *testing.T) {
 	f, err := ioutil.TempFile("", "test-bashistdb")
 	if err != nil {
@@ -54,8 +72,8 @@ func TestNew(t *testing.T) {
 	}
 	// Test try to add duplicate record
 	err = testdb.AddRecord("user1", "host1", "htop", tt)
-	if err != nil {
-		t.Fatal("AddRecord failed: " + err.Error())
+	if !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("AddRecord of a duplicate should fail with ErrDuplicate, got: %v", err)
 	}
 
 	// Test add from buffer: default (history pipe) import:
@@ -185,6 +203,54 @@ func TestNew(t *testing.T) {
 			want:   demoResponse,
 			test:   "demo",
 		},
+		{ // after
+			params: conf.QueryParams{Type: conf.QUERY_AFTER, User: "user1", Host: "host1", Command: "topk 1", Window: 60},
+			expect: OK,
+			want:   "3 | topk 1\n" + "1 | topk 2",
+			test:   "after",
+		},
+		{ // after with small window
+			params: conf.QueryParams{Type: conf.QUERY_AFTER, User: "user1", Host: "host1", Command: "topk 1", Window: 3},
+			expect: OK,
+			want:   "3 | topk 1",
+			test:   "after small window",
+		},
+		{ // before
+			params: conf.QueryParams{Type: conf.QUERY_BEFORE, User: "user1", Host: "host1", Command: "default query", Window: 60},
+			expect: OK,
+			want:   "1 | default query\n" + "1 | topk 2",
+			test:   "before",
+		},
+		{ // on this day
+			params: conf.QueryParams{Type: conf.QUERY_ON_THIS_DAY, User: "user1", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%topk%", Day: "2016-10-12"},
+			expect: OK,
+			want: "2015 @ host1:\n" + "6 topk\n" + "7 topk 1\n" + "8 topk 1\n" + "9 topk 1\n" + "10 topk 1\n" +
+				"15 topk 2\n" + "16 topk 2\n" + "17 topk 2\n\n" + "2015 @ host2:\n" + "14 topk 2",
+			test: "on this day",
+		},
+		{ // on this day, no previous years
+			params: conf.QueryParams{Type: conf.QUERY_ON_THIS_DAY, User: "user1", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%topk%", Day: "2015-10-12"},
+			expect: OK,
+			want:   "",
+			test:   "on this day current year",
+		},
+		{ // command chains, pairs
+			params: conf.QueryParams{Type: conf.QUERY_CHAINS, NGram: 2, Kappa: 2, User: "user1", Host: "host1"},
+			expect: OK,
+			want:   "3 | topk 1 -> topk 1\n" + "2 | topk 2 -> topk 2",
+			test:   "chains",
+		},
+		{ // command chains, triplets
+			params: conf.QueryParams{Type: conf.QUERY_CHAINS, NGram: 3, Kappa: 1, User: "user1", Host: "host1"},
+			expect: OK,
+			want:   "2 | topk 1 -> topk 1 -> topk 1",
+			test:   "chains triplets",
+		},
+		{ // command chains, bad length
+			params: conf.QueryParams{Type: conf.QUERY_CHAINS, NGram: 1, Kappa: 1, User: "user1", Host: "host1"},
+			expect: ER,
+			test:   "chains bad length",
+		},
 	}
 
 	for _, v := range queries {
@@ -200,7 +266,7 @@ func TestNew(t *testing.T) {
 			}
 		case ER:
 			if err == nil {
-				t.Fatal("Test '%s' should have returned error. "+
+				t.Fatalf("Test '%s' should have returned error. "+
 					"Instead  returned: %s.", v.test, string(res))
 			}
 		}
@@ -215,7 +281,7 @@ var entriesDefault = []byte(`99  2015-10-12T12:00:00+0000 ls
 102  2015-10-12T12:00:15+0000 history
 103  2015-10-12T12:00:15+0000 history
 `)
-var entriesDefaultExpect = "Processed 5 entries, successful 4, failed 1."
+var entriesDefaultExpect = "Processed 5 entries, successful 4, failed 1 (duplicates 1, rejected 0)."
 
 // Test add from buffer, export format
 // Out of 18, 17 are accepted, one is bad.
@@ -241,7 +307,7 @@ user1 host1 2015-10-12T12:03:45+0000 lastk 2
 user1 host1 2015-10-12T12:03:50+0000 lastk 2
 user1 host1 nodate command
 `)
-var entriesImportExpect = "Processed 21 entries, successful 20, failed 1."
+var entriesImportExpect = "Processed 21 entries, successful 20, failed 1 (duplicates 0, rejected 1)."
 
 var demoResponse = `There are 23 command lines (12 unique) in your database from 5 users across 3 hosts.
 
@@ -270,3 +336,3456 @@ Last 10 commands user %@% ran:
 23 lastk 1
 24 lastk 2
 25 lastk 2`
+
+// newTestDB creates a new database in a temporary file. Call the returned
+// function to close it and remove the file.
+func newTestDB() (Database, func()) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	db := f.Name()
+	f.Close()
+	os.Remove(db)
+	conf.Database = db
+
+	testdb, err := New()
+	if err != nil {
+		l.Fatalln(err)
+	}
+	return testdb, func() {
+		testdb.Close()
+		os.Remove(db)
+	}
+}
+
+func TestAddRecord(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	tt := time.Date(2015, 10, 12, 12, 0, 40, 0, time.UTC)
+	if err := testdb.AddRecord("user1", "host1", "make", tt); err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+	if err := testdb.AddRecord("user1", "host1", "make", tt); !errors.Is(err, ErrDuplicate) {
+		t.Fatalf("AddRecord of a duplicate should fail with ErrDuplicate, got: %v", err)
+	}
+	qp := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_EXPORT}
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "user1 host1 2015-10-12T12:00:40+0000 make"; string(res) != want {
+		t.Fatalf("AddRecord.\nWanted: %s\nGot   : %s", want, res)
+	}
+
+	// Importing the same command from history later adds nothing.
+	br := bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 make\n")))
+	stats, err := testdb.AddFromBuffer(br, "user1", "host1")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	if want := "Processed 1 entries, successful 0, failed 1 (duplicates 1, rejected 0)."; stats != want {
+		t.Fatalf("Import after AddRecord.\nWanted: %s\nGot   : %s", want, stats)
+	}
+}
+
+func TestImport(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	br := bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 ls\nls\nhtop\n")))
+	stats, err := testdb.Import(br, "user1", "host1")
+	if err != nil {
+		t.Fatal("Import failed: " + err.Error())
+	}
+	stats.DurationMs = 0
+	if want := (ImportStats{Total: 3, Added: 1, Malformed: 2, Layout: "%FT%T%z"}); stats != want {
+		t.Fatalf("Import statistics.\nWanted: %+v\nGot   : %+v", want, stats)
+	}
+	if err = stats.Err(); err != nil {
+		t.Fatal("Import that added lines shouldn't fail: " + err.Error())
+	}
+
+	br = bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 ls\nls\nhtop\n")))
+	if stats, err = testdb.Import(br, "user1", "host1"); err != nil {
+		t.Fatal("Import failed: " + err.Error())
+	}
+	if stats.Err() == nil {
+		t.Fatalf("Import with nothing added and mostly malformed lines should fail: %+v", stats)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	rwdb, cleanup := newTestDB()
+	defer cleanup()
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	if err := rwdb.AddRecord("user1", "host1", "htop", tt); err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+	rwdb.Close()
+
+	conf.ReadOnly = true
+	defer func() { conf.ReadOnly = false }()
+	rodb, err := New()
+	if err != nil {
+		t.Fatal("Opening read-only failed: " + err.Error())
+	}
+	defer rodb.Close()
+
+	br := bufio.NewReader(bytes.NewReader(entriesDefault))
+	if _, err = rodb.AddFromBuffer(br, "user", "test"); err != ErrReadOnly {
+		t.Fatalf("AddFromBuffer on read-only database should fail with ErrReadOnly, got: %v", err)
+	}
+
+	res, err := rodb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%"})
+	if err != nil {
+		t.Fatal("Query on read-only database failed: " + err.Error())
+	}
+	if string(res) != "1 htop" {
+		t.Fatalf("Query on read-only database.\nWanted: 1 htop\nGot   : %s", string(res))
+	}
+}
+
+func TestKeyIncludesHost(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	count := func(d Database) (n int) {
+		d.QueryRow(`SELECT count(*) FROM history`).Scan(&n)
+		return n
+	}
+
+	// Default key, the second host's line is a duplicate.
+	for _, host := range []string{"host1", "host2"} {
+		if err := testdb.AddRecord("user1", host, "make", tt); err != nil && (host == "host1" || !errors.Is(err, ErrDuplicate)) {
+			t.Fatal("AddRecord failed: " + err.Error())
+		}
+	}
+	if n := count(testdb); n != 1 {
+		t.Fatalf("Default key kept %d rows, wanted 1.", n)
+	}
+	testdb.Close()
+
+	conf.KeyIncludesHost = true
+	defer func() { conf.KeyIncludesHost = false }()
+	testdb, err := New()
+	if err != nil {
+		t.Fatal("Rebuilding with host in key failed: " + err.Error())
+	}
+	defer testdb.Close()
+	// host1's line was kept, host2's is new.
+	for _, host := range []string{"host1", "host2"} {
+		if err := testdb.AddRecord("user1", host, "make", tt); err != nil && (host == "host2" || !errors.Is(err, ErrDuplicate)) {
+			t.Fatal("AddRecord failed: " + err.Error())
+		}
+	}
+	if n := count(testdb); n != 2 {
+		t.Fatalf("Key with host kept %d rows, wanted 2.", n)
+	}
+	var row int
+	testdb.QueryRow(`SELECT rowid FROM history WHERE host = 'host1'`).Scan(&row)
+	if row != 1 {
+		t.Fatalf("Rebuild changed rowid to %d, wanted 1.", row)
+	}
+	var version string
+	testdb.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
+	if version != VERSION {
+		t.Fatalf("Rebuild changed schema version to %s.", version)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.Remove(path)
+
+	testdb, err := Open(path, nil, WAL(), BusyTimeout(2*time.Second))
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	var journal string
+	var timeout int
+	testdb.QueryRow(`PRAGMA journal_mode`).Scan(&journal)
+	testdb.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout)
+	if journal != "wal" || timeout != 2000 {
+		t.Fatalf("Open options not applied, journal_mode %s and busy_timeout %d.", journal, timeout)
+	}
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	if err = testdb.AddRecord("user1", "host1", "htop", tt); err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+	status, err := testdb.Status()
+	if err != nil {
+		t.Fatal("Status failed: " + err.Error())
+	}
+	if !strings.Contains(string(status), "Database: "+path+"\n") {
+		t.Fatalf("Status doesn't report the opened file.\nGot: %s", status)
+	}
+	testdb.Close()
+
+	rodb, err := Open(path, nil, ReadOnly())
+	if err != nil {
+		t.Fatal("Opening read-only failed: " + err.Error())
+	}
+	defer rodb.Close()
+	if err = rodb.AddRecord("user1", "host1", "ls", tt); err != ErrReadOnly {
+		t.Fatalf("AddRecord on read-only database should fail with ErrReadOnly, got: %v", err)
+	}
+
+	missing := path + "-missing"
+	_, err = Open(missing, nil, ReadOnly())
+	if want := "database file not found at " + missing; err == nil || err.Error() != want {
+		t.Fatalf("Opening a missing file read-only.\nWanted: %s\nGot   : %v", want, err)
+	}
+	if _, err = os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatal("Opening a missing file read-only created it.")
+	}
+}
+
+// TestDriverErrors checks we recognize the errors of the SQLite driver we
+// are built with (go-sqlite3, or modernc.org/sqlite with -tags purego).
+func TestDriverErrors(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.Remove(path)
+
+	testdb, err := Open(path, nil, BusyTimeout(time.Millisecond))
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	defer testdb.Close()
+
+	insert := `INSERT INTO history(user, host, command, datetime) VALUES ("user1", "host1", "ls", ?)`
+	tt := time.Date(2015, 1, 1, 1, 1, 0, 0, time.UTC)
+	if _, err = testdb.Exec(insert, tt); err != nil {
+		t.Fatal("Insert failed: " + err.Error())
+	}
+	_, err = testdb.Exec(insert, tt)
+	if !isDuplicate(err) {
+		t.Fatalf("Inserting a row twice should be a duplicate, got: %v", err)
+	}
+	if isBusy(err) {
+		t.Fatal("A duplicate isn't a busy database.")
+	}
+	if _, err = testdb.Exec(`INSERT INTO nosuchtable VALUES (1)`); err == nil || isDuplicate(err) {
+		t.Fatalf("A missing table isn't a duplicate, got: %v", err)
+	}
+
+	other, err := Open(path, nil, BusyTimeout(time.Millisecond))
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	defer other.Close()
+	tx, err := other.Begin() // Takes the write lock.
+	if err != nil {
+		t.Fatal("Begin failed: " + err.Error())
+	}
+	defer tx.Rollback()
+	_, err = testdb.Exec(insert, tt.Add(time.Second))
+	if !isBusy(err) {
+		t.Fatalf("Writing while another connection holds the lock should be busy, got: %v", err)
+	}
+	if isDuplicate(err) {
+		t.Fatal("A busy database isn't a duplicate.")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	var history bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		history.WriteString(fmt.Sprintf("%d 2015-10-12T12:00:00+0000 command number %d with some padding\n", i, i))
+	}
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(&history), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_CHECK})
+	if err != nil || string(res) != "ok" {
+		t.Fatalf("Check of a good database.\nWanted: ok\nGot   : %s %v", res, err)
+	}
+
+	if _, err = testdb.Exec(`UPDATE admin SET value = '9.9' WHERE key LIKE 'version'`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = testdb.Check(); err == nil || !strings.Contains(err.Error(), "unknown version 9.9") {
+		t.Fatalf("Check should report an unknown schema version, got: %v", err)
+	}
+	if _, err = testdb.Exec(`UPDATE admin SET value = ? WHERE key LIKE 'version'`, VERSION); err != nil {
+		t.Fatal(err.Error())
+	}
+	testdb.Close()
+
+	// Cut the file in half, as a crash might.
+	fi, err := os.Stat(conf.Database)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = os.Truncate(conf.Database, fi.Size()/2); err != nil {
+		t.Fatal(err.Error())
+	}
+	rodb, err := Open(conf.Database, nil, ReadOnly())
+	if err != nil {
+		return // Too broken to open is a failure reported too.
+	}
+	defer rodb.Close()
+	if _, err = rodb.Check(); err == nil {
+		t.Fatal("Check of a truncated database should fail.")
+	}
+}
+
+func TestSpan(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	qp := conf.QueryParams{User: "user1", Host: "host1", Command: "%%"}
+
+	// Empty database
+	min, max, count, err := testdb.Span(qp)
+	if err != nil {
+		t.Fatal("Span failed: " + err.Error())
+	}
+	if !min.IsZero() || !max.IsZero() || count != 0 {
+		t.Fatalf("Span on empty database should return zero values. Got %v, %v, %d", min, max, count)
+	}
+
+	br := bufio.NewReader(bytes.NewReader(entriesImport))
+	if _, err = testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	min, max, count, err = testdb.Span(qp)
+	if err != nil {
+		t.Fatal("Span failed: " + err.Error())
+	}
+	wantMin := time.Date(2015, 10, 12, 12, 0, 40, 0, time.UTC)
+	wantMax := time.Date(2015, 10, 12, 12, 3, 50, 0, time.UTC)
+	if !min.Equal(wantMin) || !max.Equal(wantMax) || count != 16 {
+		t.Fatalf("Span returned wrong values.\nWanted: %v, %v, %d\nGot   : %v, %v, %d",
+			wantMin, wantMax, 16, min, max, count)
+	}
+}
+
+func TestSudoStats(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 sudo apt-get update
+user1 host1 2015-10-12T12:00:41+0000 sudo apt-get update
+user1 host1 2015-10-12T12:00:42+0000 sudo -u postgres psql
+user1 host1 2015-10-12T12:00:43+0000 sudo -i
+user1 host1 2015-10-12T12:00:44+0000 sudo apt-get upgrade
+user1 host1 2015-10-12T12:00:45+0000 sudoedit /etc/hosts
+user2 host1 2015-10-12T12:00:46+0000 sudo reboot
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	want := "Top-2 sudo command lines:\n" + "2 | sudo apt-get update\n" + "1 | sudo -i\n\n" +
+		"Distinct programs run with sudo: 2"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_SUDO_STATS, Kappa: 2, User: "user1", Host: "%"})
+	if err != nil {
+		t.Fatal("GetSudoStats failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetSudoStats returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+func TestTrend(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-01-12T12:00:40+0000 svn up
+user1 host1 2015-01-13T12:00:41+0000 svn commit
+user1 host1 2015-03-02T12:00:42+0000 svn up
+user1 host1 2015-03-03T12:00:43+0000 git pull
+user2 host1 2015-04-12T12:00:46+0000 svn up
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{conf.BUCKET_MONTH, "2015-01 | 2 | ######################################## <- peak\n" +
+			"2015-02 | 0 |\n" +
+			"2015-03 | 1 | ####################"},
+		{conf.BUCKET_WEEK, "2015-W03 | 2 | ######################################## <- peak\n" +
+			"2015-W04 | 0 |\n" + "2015-W05 | 0 |\n" + "2015-W06 | 0 |\n" + "2015-W07 | 0 |\n" +
+			"2015-W08 | 0 |\n" + "2015-W09 | 0 |\n" +
+			"2015-W10 | 1 | ####################"},
+	}
+	for _, v := range tests {
+		qp := conf.QueryParams{Type: conf.QUERY_TREND, User: "user1", Host: "%", Command: "svn%", Bucket: v.bucket}
+		res, err := testdb.RunQuery(qp)
+		if err != nil {
+			t.Fatal("Trend failed: " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Trend (%s) returned wrong result.\nWanted: %s\nGot   : %s", v.bucket, v.want, string(res))
+		}
+	}
+
+	if _, err := testdb.Trend(conf.QueryParams{User: "%", Host: "%", Command: "%"}, "year"); err == nil {
+		t.Fatal("Trend with unknown bucket should fail.")
+	}
+}
+
+func TestEnvVariableUsage(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 GOPATH=/tmp/test go build
+user1 host1 2015-10-12T12:00:41+0000 GOPATH=/tmp/test GOOS=linux go build
+user1 host1 2015-10-12T12:00:42+0000 CGO_ENABLED=0 go build
+user1 host1 2015-10-12T12:00:43+0000 go build -ldflags X=1
+user1 host1 2015-10-12T12:00:44+0000 export a=b
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	want := "2 | GOPATH\n" + "1 | CGO_ENABLED\n" + "1 | GOOS"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_ENV_USAGE, User: "%", Host: "%"})
+	if err != nil {
+		t.Fatal("GetEnvVariableUsage failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetEnvVariableUsage returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+// epochParser decodes "EPOCH;COMMAND" lines.
+type epochParser struct{}
+
+func (epochParser) Parse(line string) (string, time.Time, bool) {
+	fields := strings.SplitN(line, ";", 2)
+	if len(fields) != 2 {
+		return "", time.Time{}, false
+	}
+	sec, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return fields[1], time.Unix(sec, 0), true
+}
+
+func TestLineParser(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`1444651240;ls -l
+1444651241;git status
+1  2015-10-12T12:00:42+0000 bash format isn't epoch's
+user2 host2 2015-10-12T12:00:43+0000 export format is always accepted
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	stats, err := testdb.WithParser(epochParser{}).AddFromBuffer(br, "user1", "host1")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	if want := "Processed 4 entries, successful 3, failed 1 (duplicates 0, rejected 1)."; stats != want {
+		t.Fatalf("Wanted: %s\nGot   : %s", want, stats)
+	}
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Format: conf.FORMAT_EXPORT, Command: "%%"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "user1 host1 2015-10-12T12:00:40+0000 ls -l\n" +
+		"user1 host1 2015-10-12T12:00:41+0000 git status\n" +
+		"user2 host2 2015-10-12T12:00:43+0000 export format is always accepted"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+}
+
+func TestSyslogParser(t *testing.T) {
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.Local) }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		line, cmd string
+		t         time.Time
+		ok        bool
+	}{
+		{"2015-10-12T12:00:40+0300 host1 bash[1234]: cd /tmp", "cd /tmp", time.Date(2015, 10, 12, 9, 0, 40, 0, time.UTC), true},
+		{"2015-10-12T12:00:40.123456+03:00 host1 bash: ls -l", "ls -l", time.Date(2015, 10, 12, 9, 0, 40, 123456000, time.UTC), true},
+		{"Oct 12 11:59:00 host1 bash[1234]: make", "make", time.Date(2015, 10, 12, 11, 59, 0, 0, time.Local), true},
+		{"Dec  1 08:00:00 host1 bash[1234]: df -h", "df -h", time.Date(2014, 12, 1, 8, 0, 0, 0, time.Local), true},
+		{"1  2015-10-12T12:00:42+0000 ls", "", time.Time{}, false},
+		{"Oct 12 11:59:00 this is not syslog", "", time.Time{}, false},
+	}
+	for _, test := range tests {
+		cmd, tt, ok := SyslogParser{}.Parse(test.line)
+		if cmd != test.cmd || !tt.Equal(test.t) || ok != test.ok {
+			t.Errorf("Parse(%q) = %q, %v, %v. Wanted %q, %v, %v.", test.line, cmd, tt, ok, test.cmd, test.t, test.ok)
+		}
+	}
+}
+
+func TestTimeLayouts(t *testing.T) {
+	tt := time.Date(2015, 10, 12, 12, 0, 40, 0, time.UTC)
+	tests := []struct {
+		line, cmd string
+		ok        bool
+	}{
+		{"    1  2015-10-12T12:00:40+0000 ls -l", "ls -l", true},
+		{"    1* 2015-10-12T15:00:40+03:00 ls -l", "ls -l", true},
+		{"    1  2015-10-12T12:00:40Z ls -l", "ls -l", true},
+		{"    1  2015-10-12 12:00:40 ls -l", "ls -l", true},
+		{"    1  1444651240 ls -l", "ls -l", true},
+		{"    1  1444651240", "", true},
+		{"    1  ls -l", "", false},
+		{"    1  2015-10-12 ls -l", "", false},
+		{"ls -l", "", false},
+	}
+	for _, test := range tests {
+		cmd, got, ok := BashParser{}.Parse(test.line)
+		if cmd != test.cmd || ok != test.ok || (ok && !got.Equal(tt)) {
+			t.Errorf("Parse(%q) = %q, %v, %v. Wanted %q, %v, %v.", test.line, cmd, got, ok, test.cmd, tt, test.ok)
+		}
+	}
+
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// The layout of the first line is the layout of the rest.
+	history := []byte(`1  1444651240 ls
+2  2015-10-12T12:00:41+0000 make
+3  1444651242 htop
+user2 host2 2015-10-12T12:00:43+0000 export format is always accepted
+`)
+	stats, err := testdb.Import(bufio.NewReader(bytes.NewReader(history)), "user1", "host1")
+	if err != nil {
+		t.Fatal("Import failed: " + err.Error())
+	}
+	if stats.Added != 3 || stats.Malformed != 1 || stats.Layout != "%s" {
+		t.Fatalf("Import of epoch history: %+v", stats)
+	}
+	if want := "Processed 4 entries, successful 3, failed 1 (duplicates 0, rejected 1). Timestamps were in layout '%s'."; stats.String() != want {
+		t.Fatalf("Wanted: %s\nGot   : %s", want, stats.String())
+	}
+
+	layout, _ := ParserFor(conf.IMPORT_BASH, "02/01/2006 15:04:05")
+	history = []byte("1  12/10/2015 12:00:44 ls\n2  2015-10-12T12:00:45+0000 make\n")
+	if stats, err = testdb.WithParser(layout).Import(bufio.NewReader(bytes.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("Import failed: " + err.Error())
+	}
+	if stats.Added != 1 || stats.Malformed != 1 || stats.Layout != "02/01/2006 15:04:05" {
+		t.Fatalf("Import with a layout: %+v", stats)
+	}
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Format: conf.FORMAT_EXPORT, Command: "%%"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "user1 host1 2015-10-12T12:00:40+0000 ls\n" +
+		"user1 host1 2015-10-12T12:00:42+0000 htop\n" +
+		"user2 host2 2015-10-12T12:00:43+0000 export format is always accepted\n" +
+		"user1 host1 2015-10-12T12:00:44+0000 ls"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+}
+
+func TestParseHistoryLine(t *testing.T) {
+	tt := time.Date(2015, 10, 12, 12, 0, 40, 0, time.UTC)
+	tests := []struct {
+		line, cmd string
+		ok        bool
+	}{
+		{"    1  2015-10-12T12:00:40+0000 ls -l", "ls -l", true},
+		{"    1  2015-10-12T12:00:40+0000 printf '\x1b[31mred\x1b[0m'", "printf '\x1b[31mred\x1b[0m'", true},
+		{"    1  2015-10-12T12:00:40+0000 echo a\x00b", "echo a\x00b", true},
+		{"    1  2015-10-12T12:00:40+0000 echo שלום ‮abc", "echo שלום ‮abc", true},
+		{"    1  2015-10-12T12:00:40+0000 echo \xff\xfe", "echo \xff\xfe", true},
+		{"    1  2015-10-12T12:00:40+0000 ls\n    2  2015-10-12T12:00:41+0000 rm -rf /", "", false},
+		{"    1  99999999999999 ls", "", false},
+		{"    1  \x002015-10-12T12:00:40+0000 ls", "", false},
+	}
+	for _, test := range tests {
+		got, cmd, ok := parseHistoryLine(test.line)
+		if cmd != test.cmd || ok != test.ok || (ok && !got.Equal(tt)) {
+			t.Errorf("parseHistoryLine(%q) = %v, %q, %v. Wanted %v, %q, %v.", test.line, got, cmd, ok, tt, test.cmd, test.ok)
+		}
+	}
+	long := "1  2015-10-12T12:00:40+0000 " + strings.Repeat("x", 1<<20)
+	if _, cmd, ok := parseHistoryLine(long); !ok || len(cmd) != 1<<20 {
+		t.Errorf("parseHistoryLine of a 1MiB command: %d bytes, %v", len(cmd), ok)
+	}
+
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := "1  2015-10-12T12:00:40+0000 ls\n" + long + "x\n3  2015-10-12T12:00:42+0000 make\n"
+	_, err := testdb.Import(bufio.NewReader(strings.NewReader(history)), "user1", "host1")
+	if !errors.Is(err, ErrLineTooLong) {
+		t.Fatalf("Import of a line over MaxLineBytes returned %v, wanted ErrLineTooLong.", err)
+	}
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, User: "%", Host: "%", Command: "%", Kappa: 5,
+		Format: conf.FORMAT_COMMAND_LINE})
+	if err != nil {
+		t.Fatal("RunQuery failed: " + err.Error())
+	}
+	if string(res) != "1 ls" {
+		t.Fatalf("Import before a line over MaxLineBytes added: %q, wanted 1 ls.", res)
+	}
+}
+
+// oldParseLine and oldParseBash are how parseBash decoded lines before
+// trimLineNumber and timeLayout.parse stopped using a regular expression and
+// splitting. TestParseBashUnchanged keeps them around to compare.
+var oldParseLine = regexp.MustCompile(`^ *[0-9]+\*? +(.*)`)
+
+func oldParseBash(line string, layouts []timeLayout) (string, time.Time, *timeLayout, bool) {
+	if strings.Contains(line, "\n") {
+		return "", time.Time{}, nil, false
+	}
+	args := oldParseLine.FindStringSubmatch(line)
+	if len(args) != 2 {
+		return "", time.Time{}, nil, false
+	}
+	for i := range layouts {
+		l := layouts[i]
+		n := strings.Count(l.layout, " ") + 1
+		fields := strings.SplitN(args[1], " ", n+1)
+		if len(fields) < n {
+			continue
+		}
+		stamp := strings.Join(fields[:n], " ")
+		var t time.Time
+		if l.layout == "" {
+			if strings.Trim(stamp, "0123456789") != "" {
+				continue
+			}
+			sec, err := strconv.ParseInt(stamp, 10, 64)
+			if err != nil {
+				continue
+			}
+			if t = time.Unix(sec, 0); t.Year() > 9999 {
+				continue
+			}
+		} else {
+			var err error
+			if t, err = time.ParseInLocation(l.layout, stamp, time.Local); err != nil {
+				continue
+			}
+		}
+		if len(fields) == n {
+			return "", t, &layouts[i], true
+		}
+		return strings.TrimLeft(fields[n], " "), t, &layouts[i], true
+	}
+	return "", time.Time{}, nil, false
+}
+
+// TestParseBashUnchanged decodes the same lines with parseBash and
+// oldParseBash, with every layout. They must agree on all of them, the
+// malformed ones too.
+func TestParseBashUnchanged(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(string(importCorpus(200)), "\n"), "\n")
+	for _, stamp := range []string{"2015-10-12T12:00:40+0000", "2015-10-12T15:00:40+03:00", "2015-10-12 12:00:40",
+		"1444651240", "12/10/2015 12:00:40", "Oct 12 12:00:40", "Oct  2 12:00:40", "99999999999999", "2015-10-12"} {
+		for _, prefix := range []string{"1  ", "    1  ", "    1* ", "1 ", "1*", "1**  ", " 1 ", "12345678901234567890 ", "  ", "x1  ", "1\t", ""} {
+			for _, rest := range []string{"", " ", "ls -l", "  ls  -l  ", "echo \xff\xfe", "ls\n    2  " + stamp + " rm"} {
+				lines = append(lines, prefix+stamp+" "+rest, prefix+stamp+rest)
+			}
+		}
+	}
+	lines = append(lines, "", " ", "1", "1 ", "*", "ls -l", "\xff1  1444651240 ls")
+
+	layouts := [][]timeLayout{timeLayouts, {{"%d/%m/%Y %T", "02/01/2006 15:04:05"}}, {{"%b %e %T", "Jan _2 15:04:05"}}}
+	for i := range timeLayouts {
+		layouts = append(layouts, timeLayouts[i:i+1])
+	}
+	for _, ls := range layouts {
+		for _, line := range lines {
+			cmd, tm, l, ok := parseBash(line, ls)
+			oldCmd, oldTm, oldL, oldOK := oldParseBash(line, ls)
+			if cmd != oldCmd || !tm.Equal(oldTm) || l != oldL || ok != oldOK {
+				t.Errorf("parseBash(%q, %v) = %q, %v, %v, %v. Before it was %q, %v, %v, %v.", line, ls, cmd, tm, l, ok, oldCmd, oldTm, oldL, oldOK)
+			}
+		}
+	}
+}
+
+func FuzzParseHistoryLine(f *testing.F) {
+	for _, seed := range []string{
+		"    1  2015-10-12T12:00:40+0000 ls -l",
+		"    1* 2015-10-12T15:00:40+03:00 ls -l",
+		"    1  2015-10-12 12:00:40 ls -l",
+		"    1  1444651240 ls -l",
+		"    1  1444651240",
+		"    1  2015-10-12T12:00:40+0000 printf '\x1b[31mred\x1b[0m'",
+		"    1  2015-10-12T12:00:40+0000 echo a\x00b",
+		"    1  2015-10-12T12:00:40+0000 echo שלום ‮abc",
+		"    1  2015-10-12T12:00:40+0000 echo \xff\xfe\xfd",
+		"    1  2015-10-12T12:00:40+0000 ls\n    2  2015-10-12T12:00:41+0000 rm -rf /",
+		"    1  9223372036854775807 ls",
+		"    1  2015-10-12T12:00:40.999999999+0000 ls",
+		"1  2015-10-12T12:00:40+0000 " + strings.Repeat("x", 1<<20),
+		"",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, line string) {
+		tm, cmd, ok := parseHistoryLine(line)
+		if !ok {
+			return
+		}
+		if !strings.HasSuffix(line, cmd) || strings.Contains(cmd, "\n") {
+			t.Fatalf("parseHistoryLine(%q) returned command %q, not the end of the line.", line, cmd)
+		}
+		if tm.Year() < 0 || tm.Year() > 9999 {
+			t.Fatalf("parseHistoryLine(%q) returned time %v, it can't be written as RFC3339.", line, tm)
+		}
+		// What we decoded, written back, decodes the same.
+		again := "1 " + tm.Format(RFC3339alt) + " " + cmd
+		tm2, cmd2, ok := parseHistoryLine(again)
+		if !ok || cmd2 != cmd || tm2.Unix() != tm.Unix() {
+			t.Fatalf("parseHistoryLine(%q) = %v, %q, %v, wanted %v, %q.", again, tm2, cmd2, ok, tm, cmd)
+		}
+	})
+}
+
+// TestOddPath opens databases whose names have characters that mean
+// something in a URI, read-write and read-only.
+func TestOddPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"what?.sqlite3", "#1.sqlite3", "100%.sqlite3", "a b&c=d.sqlite3"} {
+		path := filepath.Join(dir, name)
+		db, err := Open(path, nil)
+		if err != nil {
+			t.Fatalf("Open %s failed: %s", name, err.Error())
+		}
+		if _, err = db.AddFromBuffer(bufio.NewReader(strings.NewReader("1 2015-10-12T12:00:40+0000 ls\n")), "user1", "host1"); err != nil {
+			t.Fatalf("AddFromBuffer to %s failed: %s", name, err.Error())
+		}
+		db.Close()
+		if _, err = os.Stat(path); err != nil {
+			t.Fatalf("Database %s isn't where it should be: %s", name, err.Error())
+		}
+
+		db, err = Open(path, nil, ReadOnly())
+		if err != nil {
+			t.Fatalf("Open %s read-only failed: %s", name, err.Error())
+		}
+		res, err := db.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_COMMAND_LINE})
+		db.Close()
+		if err != nil || string(res) != "1 ls" {
+			t.Errorf("Query of %s read-only returned %q (%v).", name, res, err)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 4 {
+		t.Errorf("Expected only the 4 databases in %s, got %d files.", dir, len(files))
+	}
+}
+
+func TestFilePerm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		path string
+		opts []Option
+		perm os.FileMode
+	}{
+		{filepath.Join(dir, "missing", "dirs", "history.sqlite3"), nil, 0600},
+		{filepath.Join(dir, "shared.sqlite3"), []Option{FilePerm(0640)}, 0640},
+	}
+	for _, test := range tests {
+		db, err := Open(test.path, nil, test.opts...)
+		if err != nil {
+			t.Fatal("Open failed: " + err.Error())
+		}
+		db.Close()
+		fi, err := os.Stat(test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != test.perm {
+			t.Errorf("Database %s was created with mode %v, wanted %v.", test.path, fi.Mode().Perm(), test.perm)
+		}
+	}
+	fi, err := os.Stat(filepath.Join(dir, "missing", "dirs"))
+	if err != nil {
+		t.Fatal("Missing directory wasn't created: " + err.Error())
+	}
+	if fi.Mode().Perm() != 0700 {
+		t.Errorf("Missing directory was created with mode %v, wanted %v.", fi.Mode().Perm(), os.FileMode(0700))
+	}
+
+	// Existing files keep their permissions.
+	if err = os.Chmod(tests[1].path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := Open(tests[1].path, nil)
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	db.Close()
+	if fi, err = os.Stat(tests[1].path); err != nil || fi.Mode().Perm() != 0644 {
+		t.Errorf("Existing database changed its mode to %v.", fi.Mode().Perm())
+	}
+}
+
+func TestRejectsFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb-rejects")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	rejects := f.Name()
+	f.Close()
+	defer os.Remove(rejects)
+	conf.RejectsFile = rejects
+	defer func() { conf.RejectsFile = "" }()
+
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`1  2015-10-12T12:00:00+0000 ls
+this line is garbage
+3  2015-13-45T12:00:10+0000 bad date
+4  2015-10-12T12:00:15+0000 history
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	stats, err := testdb.AddFromBuffer(br, "user", "test")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	want := "Processed 4 entries, successful 2, failed 2 (duplicates 0, rejected 2)."
+	if stats != want {
+		t.Fatalf("AddFromBuffer returned wrong stats.\nWanted: %s\nGot   : %s", want, stats)
+	}
+
+	got, err := ioutil.ReadFile(rejects)
+	if err != nil {
+		t.Fatal("Could not read rejects file: " + err.Error())
+	}
+	want = "this line is garbage\n" + "3  2015-13-45T12:00:10+0000 bad date\n"
+	if string(got) != want {
+		t.Fatalf("Rejects file has wrong content.\nWanted: %s\nGot   : %s", want, string(got))
+	}
+
+	// Fixed, the rejects import like any history.
+	fixed := strings.Replace(string(got), "2015-13-45", "2015-10-12", 1)
+	stats, err = testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(fixed)), "user", "test")
+	if err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	want = "Processed 2 entries, successful 1, failed 1 (duplicates 0, rejected 1)."
+	if stats != want {
+		t.Fatalf("Re-import of the rejects returned wrong stats.\nWanted: %s\nGot   : %s", want, stats)
+	}
+}
+
+func TestSessions(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:00+0000 cd project
+user1 host1 2015-10-12T12:10:00+0000 make
+user2 host1 2015-10-12T12:15:00+0000 htop
+user1 host1 2015-10-12T12:20:00+0000 git commit
+user1 host1 2015-10-12T14:00:00+0000 ls
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	queries := []struct {
+		params conf.QueryParams
+		want   string
+		test   string
+	}{
+		{
+			params: conf.QueryParams{Type: conf.QUERY_SESSIONS, User: "%", Host: "%", Gap: 30},
+			want: "1 | user1@host1 | 2015-10-12T12:00:00+0000 | 20m0s | 3 commands | cd project ... git commit\n" +
+				"2 | user2@host1 | 2015-10-12T12:15:00+0000 | 0s | 1 commands | htop ... htop\n" +
+				"3 | user1@host1 | 2015-10-12T14:00:00+0000 | 0s | 1 commands | ls ... ls",
+			test: "sessions",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY_SESSIONS, User: "user1", Host: "%", Gap: 5},
+			want: "1 | user1@host1 | 2015-10-12T12:00:00+0000 | 0s | 1 commands | cd project ... cd project\n" +
+				"2 | user1@host1 | 2015-10-12T12:10:00+0000 | 0s | 1 commands | make ... make\n" +
+				"3 | user1@host1 | 2015-10-12T12:20:00+0000 | 0s | 1 commands | git commit ... git commit\n" +
+				"4 | user1@host1 | 2015-10-12T14:00:00+0000 | 0s | 1 commands | ls ... ls",
+			test: "sessions small gap",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY_SESSION_SHOW, User: "%", Host: "%", Gap: 30, Kappa: 1, Format: conf.FORMAT_COMMAND_LINE},
+			want:   "1 cd project\n" + "2 make\n" + "4 git commit",
+			test:   "session show",
+		},
+	}
+	for _, v := range queries {
+		res, err := testdb.RunQuery(v.params)
+		if err != nil {
+			t.Fatal(v.test + ": " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s", v.test, v.want, string(res))
+		}
+	}
+
+	if _, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_SESSION_SHOW, User: "%", Host: "%", Gap: 30, Kappa: 4}); err == nil {
+		t.Fatal("Showing a session that doesn't exist should fail.")
+	}
+}
+
+func TestCommandsWithPipe(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 ls | wc -l
+user1 host1 2015-10-12T12:00:41+0000 cat log | grep error | sort | uniq -c
+user1 host1 2015-10-12T12:00:42+0000 make
+user1 host1 2015-10-12T12:00:43+0000 ps aux | grep ssh
+user2 host1 2015-10-12T12:00:44+0000 dmesg | grep usb
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_PIPELINES, User: "user1", Host: "%", Command: "%", Kappa: 10, Format: conf.FORMAT_COMMAND_LINE},
+			"2 cat log | grep error | sort | uniq -c\n4 ps aux | grep ssh\n1 ls | wc -l"},
+		{conf.QueryParams{Type: conf.QUERY_PIPELINES, User: "%", Host: "%", Command: "%grep%", Kappa: 2, Format: conf.FORMAT_COMMAND_LINE},
+			"2 cat log | grep error | sort | uniq -c\n5 dmesg | grep usb"},
+	}
+	for _, c := range tests {
+		res, err := testdb.RunQuery(c.qp)
+		if err != nil {
+			t.Fatal("GetCommandsWithPipe failed: " + err.Error())
+		}
+		if string(res) != c.want {
+			t.Fatalf("GetCommandsWithPipe returned wrong result.\nWanted: %s\nGot   : %s", c.want, string(res))
+		}
+	}
+}
+
+func TestCommandsWithRedirection(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 sort < names.txt
+user1 host1 2015-10-12T12:00:41+0000 [ $n -ge 2 ] && echo ok
+user1 host1 2015-10-12T12:00:42+0000 awk '$3 >= 10' data.csv
+user1 host1 2015-10-12T12:00:43+0000 echo done >> build.log
+user1 host1 2015-10-12T12:00:44+0000 awk '$3 <= 10 { print }' data.csv > small.csv
+user1 host1 2015-10-12T12:00:45+0000 make 2>&1
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	want := "6 make 2>&1\n5 awk '$3 <= 10 { print }' data.csv > small.csv\n4 echo done >> build.log\n1 sort < names.txt"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_REDIRECTIONS, User: "%", Host: "%", Command: "%",
+		Kappa: 10, Format: conf.FORMAT_COMMAND_LINE})
+	if err != nil {
+		t.Fatal("GetCommandsWithRedirection failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetCommandsWithRedirection returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+func TestRecentHosts(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 old 2015-10-01T12:00:00+0000 ls
+user1 build 2015-10-10T12:00:00+0000 make
+user2 build 2015-10-11T09:00:00+0000 make install
+user1 laptop 2015-10-11T10:30:00+0200 git pull
+user1 laptop 2015-10-09T12:00:00+0000 git status
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	// laptop's latest is at 08:30 UTC, before build's, though its text
+	// (10:30+0200) sorts after it.
+	want := "build | 2 commands | last seen 2015-10-11T09:00:00Z\n" +
+		"laptop | 2 commands | last seen 2015-10-11T08:30:00Z"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_RECENT_HOSTS,
+		DateFrom: time.Date(2015, 10, 5, 0, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal("GetRecentHosts failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetRecentHosts returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+
+	res, err = testdb.GetRecentHosts(time.Date(2015, 10, 12, 0, 0, 0, 0, time.UTC))
+	if want = "No hosts ran commands since 2015-10-12T00:00:00Z."; err != nil || string(res) != want {
+		t.Fatalf("GetRecentHosts returned wrong result.\nWanted: %s\nGot   : %s (%v)", want, string(res), err)
+	}
+
+	want = "user2 | 1 commands | last seen 2015-10-11T09:00:00Z\n" +
+		"user1 | 3 commands | last seen 2015-10-11T08:30:00Z"
+	res, err = testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_RECENT_USERS,
+		DateFrom: time.Date(2015, 10, 5, 0, 0, 0, 0, time.UTC)})
+	if err != nil || string(res) != want {
+		t.Fatalf("GetRecentUsers returned wrong result.\nWanted: %s\nGot   : %s (%v)", want, string(res), err)
+	}
+	res, err = testdb.GetRecentUsers(time.Date(2015, 10, 12, 0, 0, 0, 0, time.UTC))
+	if want = "No users ran commands since 2015-10-12T00:00:00Z."; err != nil || string(res) != want {
+		t.Fatalf("GetRecentUsers returned wrong result.\nWanted: %s\nGot   : %s (%v)", want, string(res), err)
+	}
+}
+
+func TestInactiveUsers(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-07-01T12:00:00+0000 ls
+user1 host1 2015-10-10T12:00:00+0000 make
+user2 host2 2015-08-01T09:00:00+0000 make install
+user3 host2 2015-09-01T01:00:00+0200 git pull
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	// user3 was last seen on 2015-08-31 in UTC, though its text says
+	// 2015-09-01.
+	since := time.Date(2015, 9, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_INACTIVE_USERS, DateFrom: since},
+			"user2 | last seen 2015-08-01T09:00:00Z\nuser3 | last seen 2015-08-31T23:00:00Z"},
+		{conf.QueryParams{Type: conf.QUERY_INACTIVE_USERS, DateFrom: since, Format: conf.FORMAT_JSON},
+			`[
+{"user":"user2","last_seen":"2015-08-01T09:00:00Z"},
+{"user":"user3","last_seen":"2015-08-31T23:00:00Z"}
+]`},
+		{conf.QueryParams{Type: conf.QUERY_INACTIVE_USERS, DateFrom: time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC)},
+			"No users inactive since 2015-07-01T00:00:00Z."},
+		{conf.QueryParams{Type: conf.QUERY_INACTIVE_USERS, DateFrom: time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC),
+			Format: conf.FORMAT_JSON}, "[\n]"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal("GetInactiveUsers failed: " + err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("GetInactiveUsers since %s in format '%s'.\nWanted: %s\nGot   : %s", test.qp.DateFrom,
+				test.qp.Format, test.want, res)
+		}
+	}
+}
+
+func TestRename(t *testing.T) {
+	conf.KeyIncludesHost = true
+	defer func() { conf.KeyIncludesHost = false }()
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`alice debian 2015-10-12T10:00:00+0000 ls
+alice debian 2015-10-12T10:01:00+0000 make
+alice web01 2015-10-12T10:01:00+0000 make
+bob debian 2015-10-12T10:02:00+0000 vim
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	for _, host := range []string{"debian", "web01"} {
+		if err := testdb.AnnotateCommand("alice", host, "make", "at "+host); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	count := func(where string) (n int) {
+		if err := testdb.QueryRow(`SELECT count(*) FROM history WHERE ` + where).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.RENAME_HOST, RenameFrom: "debian", RenameTo: "web01", DryRun: true},
+			"Renaming host debian to web01 would update 2 commands and merge 1 into ones web01 has."},
+		{conf.QueryParams{Type: conf.RENAME_HOST, RenameFrom: "debian", RenameTo: "web01"},
+			"Renamed host debian to web01, updated 2 commands and merged 1 into ones web01 had."},
+		{conf.QueryParams{Type: conf.RENAME_HOST, RenameFrom: "debian", RenameTo: "web01"},
+			"Renamed host debian to web01, updated 0 commands and merged 0 into ones web01 had."},
+		{conf.QueryParams{Type: conf.RENAME_USER, RenameFrom: "bob", RenameTo: "alice"},
+			"Renamed user bob to alice, updated 1 commands and merged 0 into ones alice had."},
+	}
+	for i, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Rename %s to %s.\nWanted: %s\nGot   : %s", test.qp.RenameFrom, test.qp.RenameTo, test.want, res)
+		}
+		// The dry run changes nothing.
+		if i == 0 && count(`host = 'debian'`) != 3 {
+			t.Fatalf("Dry run renamed commands, %d left at debian.", count(`host = 'debian'`))
+		}
+	}
+	if n, m := count(`host = 'web01' AND user = 'alice'`), count(`1`); n != 3 || m != 3 {
+		t.Errorf("Rename left %d commands of alice at web01 and %d in all, wanted 3 and 3.", n, m)
+	}
+	var notes int
+	if err := testdb.QueryRow(`SELECT count(*) FROM annotations WHERE host = 'web01'`).Scan(&notes); err != nil || notes != 1 {
+		t.Errorf("Rename left %d notes at web01, wanted the one web01 had (%v).", notes, err)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-07-01T12:00:00+0000 ls
+user1 host1 2015-07-02T12:00:00+0000 make
+user2 host2 2015-09-30T23:30:00-0200 make install
+user1 host1 2015-10-11T12:00:00+0000 git pull
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	f, err := ioutil.TempFile("", "test-bashistdb-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dest := f.Name()
+	f.Close()
+	os.Remove(dest)
+	defer os.Remove(dest)
+
+	count := func(d Database) (n int) {
+		if err := d.QueryRow(`SELECT count(*) FROM history`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	// 2015-09-30T23:30:00-0200 is October 1st in UTC, it stays.
+	cutoff := time.Date(2015, 10, 1, 0, 0, 0, 0, time.UTC)
+	moved, err := testdb.ArchiveOlderThan(dest, cutoff)
+	if err != nil {
+		t.Fatal("ArchiveOlderThan failed: " + err.Error())
+	}
+	if moved != 2 || count(testdb) != 2 {
+		t.Errorf("ArchiveOlderThan moved %d commands, %d left. Wanted 2 and 2.", moved, count(testdb))
+	}
+	if moved, err = testdb.ArchiveOlderThan(dest, cutoff); err != nil || moved != 0 {
+		t.Errorf("ArchiveOlderThan again moved %d commands (%v), wanted 0.", moved, err)
+	}
+	if _, err = testdb.ArchiveOlderThan(testdb.path, cutoff); err == nil {
+		t.Error("ArchiveOlderThan to the database itself didn't fail.")
+	}
+
+	archive, err := Open(dest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	if n := count(archive); n != 2 {
+		t.Errorf("Archive has %d commands, wanted 2.", n)
+	}
+	res, err := archive.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_COMMAND_LINE})
+	if want := "1 ls\n2 make"; err != nil || string(res) != want {
+		t.Errorf("Query of the archive.\nWanted: %s\nGot   : %s (%v)", want, res, err)
+	}
+}
+
+func TestBackgroundCommandStats(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 firefox &
+user1 host1 2015-10-12T12:00:41+0000 sleep 5 & make > build.log 2>&1 &
+user1 host1 2015-10-12T12:00:42+0000 DISPLAY=:1 firefox&
+user1 host1 2015-10-12T12:00:43+0000 make && make install
+user1 host1 2015-10-12T12:00:44+0000 cd src; make &
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	want := "2 | firefox\n" + "2 | make\n" + "1 | sleep"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_BACKGROUND_STATS, User: "%", Host: "%"})
+	if err != nil {
+		t.Fatal("GetBackgroundCommandStats failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetBackgroundCommandStats returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+func TestAudit(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 sudo rm -rf /
+user1 host1 2015-10-12T12:00:41+0000 rm -rf /tmp/build
+user1 host2 2015-10-12T12:00:42+0000 chmod -R 777 /var/www
+user1 host1 2015-10-12T12:00:43+0000 curl -s https://example.com/install | sudo bash
+user1 host1 2015-10-12T12:00:44+0000 dd if=image.iso of=/dev/sdb bs=4M
+user1 host1 2015-10-12T12:00:45+0000 dd if=/dev/zero of=disk.img
+user1 host1 2015-10-12T12:00:46+0000 man mkfs.ext4
+user1 host1 2015-10-12T12:00:47+0000 iptables -F
+user1 host1 2015-10-12T12:00:48+0000 git push --force
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	queries := []struct {
+		params conf.QueryParams
+		want   string
+		test   string
+	}{
+		{
+			params: conf.QueryParams{Type: conf.QUERY_AUDIT, User: "%", Host: "%"},
+			want: "[rm-root] 1 matches:\n" + "  2015-10-12T12:00:40+0000 user1@host1 sudo rm -rf /\n\n" +
+				"[chmod-777] 1 matches:\n" + "  2015-10-12T12:00:42+0000 user1@host2 chmod -R 777 /var/www\n\n" +
+				"[curl-pipe-sh] 1 matches:\n" + "  2015-10-12T12:00:43+0000 user1@host1 curl -s https://example.com/install | sudo bash\n\n" +
+				"[dd-disk] 1 matches:\n" + "  2015-10-12T12:00:44+0000 user1@host1 dd if=image.iso of=/dev/sdb bs=4M\n\n" +
+				"[mkfs] 1 matches:\n" + "  2015-10-12T12:00:46+0000 user1@host1 man mkfs.ext4\n\n" +
+				"[iptables-flush] 1 matches:\n" + "  2015-10-12T12:00:47+0000 user1@host1 iptables -F",
+			test: "audit",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY_AUDIT, User: "%", Host: "host2"},
+			want:   "[chmod-777] 1 matches:\n" + "  2015-10-12T12:00:42+0000 user1@host2 chmod -R 777 /var/www",
+			test:   "audit host",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY_AUDIT, User: "%", Host: "%",
+				AuditDisable: []string{"rm-root", "chmod-777", "curl-pipe-sh", "dd-disk", "mkfs", "iptables-flush"},
+				AuditRules:   []string{"force-push git\\s+push\\s+.*--force"}},
+			want: "[force-push] 1 matches:\n" + "  2015-10-12T12:00:48+0000 user1@host1 git push --force",
+			test: "audit custom rules",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY_AUDIT, User: "nobody", Host: "%"},
+			want:   "No dangerous commands found.",
+			test:   "audit no matches",
+		},
+	}
+	for _, v := range queries {
+		res, err := testdb.RunQuery(v.params)
+		if err != nil {
+			t.Fatal(v.test + ": " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s", v.test, v.want, string(res))
+		}
+	}
+
+	if _, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_AUDIT, User: "%", Host: "%", AuditRules: []string{"bad ("}}); err == nil {
+		t.Fatal("Audit with a bad rule should fail.")
+	}
+}
+
+func TestAnnotations(t *testing.T) {
+	olddb, cleanup := newTestDB()
+	defer cleanup()
+
+	// Start from a version 2.1 database to test the migration.
+	if _, err := olddb.Exec(`DROP TABLE annotations; DROP TABLE tags; DROP TABLE favorites; DROP TABLE querylog; DROP TABLE audit_log; DROP INDEX HistoryImportIdx; DROP TABLE imports; ALTER TABLE history DROP COLUMN import_id; ALTER TABLE history DROP COLUMN source; UPDATE admin SET value = '2.1' WHERE key LIKE 'version'`); err != nil {
+		t.Fatal("Could not downgrade database: " + err.Error())
+	}
+	olddb.Close()
+	testdb, err := New()
+	if err != nil {
+		t.Fatal("Migration failed: " + err.Error())
+	}
+	defer testdb.Close()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 make release
+user1 host1 2015-10-12T12:00:41+0000 ls
+user2 host1 2015-10-12T12:00:42+0000 make release
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	if err = testdb.AnnotateCommand("user1", "host1", "make release", "builds the binary"); err != nil {
+		t.Fatal("AnnotateCommand failed: " + err.Error())
+	}
+	if err = testdb.AnnotateCommand("user1", "host1", "make release", "builds the release binary"); err != nil {
+		t.Fatal("AnnotateCommand failed to replace note: " + err.Error())
+	}
+	if err = testdb.AnnotateCommand("user1", "host1", "ls", "lists files"); err != nil {
+		t.Fatal("AnnotateCommand failed: " + err.Error())
+	}
+	if err = testdb.AnnotateCommand("user1", "host1", "ls", ""); err != nil {
+		t.Fatal("AnnotateCommand failed to remove note: " + err.Error())
+	}
+
+	queries := []struct {
+		params conf.QueryParams
+		want   string
+		test   string
+	}{
+		{
+			params: conf.QueryParams{Type: conf.QUERY_ANNOTATIONS, User: "%", Host: "%"},
+			want:   "user1@host1 make release  # builds the release binary",
+			test:   "list annotations",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			want:   "1 make release  # builds the release binary\n" + "2 ls\n" + "3 make release",
+			test:   "annotated query",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "user1", Host: "%", Command: "make%", Format: conf.FORMAT_EXPORT},
+			want:   "user1 host1 2015-10-12T12:00:40+0000 make release",
+			test:   "annotated query export format",
+		},
+	}
+	for _, v := range queries {
+		res, err := testdb.RunQuery(v.params)
+		if err != nil {
+			t.Fatal(v.test + ": " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s", v.test, v.want, string(res))
+		}
+	}
+}
+
+func TestTopKDecay(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	entries := []byte(`user1 host1 2013-10-12T12:00:00+0000 svn update
+user1 host1 2013-10-12T12:00:01+0000 svn update
+user1 host1 2013-10-12T12:00:02+0000 svn update
+user1 host1 2013-10-12T12:00:03+0000 svn update
+user1 host1 2015-07-14T12:00:00+0000 git pull
+user1 host1 2015-10-12T12:00:00+0000 git pull
+user1 host1 2015-10-12T12:00:00+0000 ls
+user2 host1 2015-10-12T12:00:00+0000 htop
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	want := "1.50 | 2 | git pull\n" + "1.00 | 1 | ls\n" + "0.01 | 4 | svn update"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_TOPK, User: "user1", Host: "%", Command: "%%",
+		Kappa: 5, HalfLife: 90 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal("TopKDecay failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("TopKDecay returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+	if _, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_TOPK, User: "user1", Host: "%", Command: "%%",
+		Kappa: -1, HalfLife: 90 * 24 * time.Hour}); err == nil {
+		t.Fatal("TopKDecay with a negative K should get an error.")
+	}
+}
+
+func TestTopFrecent(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	// make test is run more, but two months ago.
+	entries := []byte(`user1 host1 2015-08-13T12:00:00+0000 make test
+user1 host1 2015-08-13T12:00:01+0000 make test
+user1 host1 2015-08-13T12:00:02+0000 make test
+user1 host1 2015-10-11T12:00:00+0000 make build
+user1 host1 2015-10-12T12:00:00+0000 make build
+user1 host1 2015-10-12T12:00:00+0000 ls
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	qp := conf.QueryParams{User: "%", Host: "%", Command: "make%"}
+	got, err := testdb.TopFrecent(qp, 5)
+	if err != nil {
+		t.Fatal("TopFrecent failed: " + err.Error())
+	}
+	want := []CommandCount{{"make build", 2, 1.5}, {"make test", 3, 3.0 / 61}}
+	if len(got) != len(want) {
+		t.Fatalf("TopFrecent returned wrong result.\nWanted: %v\nGot   : %v", want, got)
+	}
+	for i := range want {
+		if got[i].Command != want[i].Command || got[i].Count != want[i].Count || math.Abs(got[i].Score-want[i].Score) > 1e-6 {
+			t.Fatalf("TopFrecent returned wrong result.\nWanted: %v\nGot   : %v", want, got)
+		}
+	}
+
+	qp.Type, qp.Kappa = conf.QUERY_FRECENT, 1
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal("RunQuery failed: " + err.Error())
+	}
+	if string(res) != "1.50 | 2 | make build" {
+		t.Fatalf("Frecent query returned wrong result: %s", res)
+	}
+}
+
+func TestTags(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 kubectl apply -f prod.yaml
+user1 host1 2015-10-12T12:00:41+0000 make release
+user1 host1 2015-10-12T12:00:42+0000 kubectl apply -f prod.yaml
+user2 host1 2015-10-12T12:00:43+0000 kubectl apply -f prod.yaml
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	tags := []struct{ command, tag string }{
+		{"kubectl apply -f prod.yaml", "deployment"},
+		{"kubectl apply -f prod.yaml", "devops"},
+		{"kubectl apply -f prod.yaml", "devops"}, // tagging twice is fine
+		{"make release", "build"},
+	}
+	for _, v := range tags {
+		if err := testdb.TagCommand("user1", "host1", v.command, v.tag); err != nil {
+			t.Fatal("TagCommand failed: " + err.Error())
+		}
+	}
+	if err := testdb.TagCommand("user1", "host1", "ls", " "); err == nil {
+		t.Fatal("TagCommand accepted an empty tag.")
+	}
+
+	list, err := testdb.ListTags("%", "%")
+	if err != nil {
+		t.Fatal("ListTags failed: " + err.Error())
+	}
+	if strings.Join(list, ",") != "build,deployment,devops" {
+		t.Fatalf("ListTags returned wrong tags: %v", list)
+	}
+
+	want := "1 kubectl apply -f prod.yaml\n" + "3 kubectl apply -f prod.yaml"
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_TAG, Tag: "devops", User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_COMMAND_LINE})
+	if err != nil {
+		t.Fatal("GetByTag failed: " + err.Error())
+	}
+	if string(res) != want {
+		t.Fatalf("GetByTag returned wrong result.\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+func TestStatus(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 ls
+user1 host1 2015-10-12T12:00:41+0000 make
+user2 host2 2015-10-12T12:00:42+0000 htop
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	// Search criteria shouldn't affect status.
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_STATUS, User: "user1", Host: "%", Command: "%%"})
+	if err != nil {
+		t.Fatal("Status failed: " + err.Error())
+	}
+	for _, want := range []string{"Database: " + conf.Database + "\n", "Schema  : " + VERSION + "\n",
+		"Rows    : 3\n", "Earliest: 2015-10-12T12:00:40+0000\n", "(WAL off)"} {
+		if !strings.Contains(string(res), want) {
+			t.Fatalf("Status is missing '%s'.\nGot: %s", want, string(res))
+		}
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	entries := []byte(`user1 host1 2015-01-01T12:00:00+0000 git checkout old-branch
+user1 host1 2015-01-01T12:00:01+0000 git checkout old-branch
+user1 host1 2015-01-01T12:00:02+0000 git checkout old-branch
+user1 host1 2015-10-12T11:00:00+0000 git checkout master
+user1 host1 2015-10-11T12:00:00+0000 git cherry-pick abc
+user1 host1 2015-10-12T11:00:00+0000 git status
+user1 host1 2015-10-12T11:00:00+0000 Git checkout upper
+user2 host1 2015-10-12T11:00:00+0000 git checkout other-user
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	tests := []struct {
+		prefix string
+		k      int
+		want   string
+	}{
+		{"git ch", 5, "git checkout master,git cherry-pick abc,git checkout old-branch"},
+		{"git ch", 1, "git checkout master"},
+		{"git checkout o", 5, "git checkout old-branch"},
+		{"svn", 5, ""},
+	}
+	for _, v := range tests {
+		res, err := testdb.Suggest("user1", "host1", v.prefix, v.k)
+		if err != nil {
+			t.Fatal("Suggest failed: " + err.Error())
+		}
+		if strings.Join(res, ",") != v.want {
+			t.Fatalf("Suggest '%s' returned wrong result.\nWanted: %s\nGot   : %s", v.prefix, v.want, strings.Join(res, ","))
+		}
+	}
+}
+
+func TestFavorites(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	entries := []byte(`user1 host1 2015-10-12T11:00:00+0000 ls
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	for _, c := range []string{"make release", "ssh prod", "make release", "rsync -a build/ prod:"} {
+		if err := testdb.FavoriteCommand("user1", "host1", c); err != nil {
+			t.Fatal("FavoriteCommand failed: " + err.Error())
+		}
+	}
+	if err := testdb.UnfavoriteCommand("user1", "host1", "ssh prod"); err != nil {
+		t.Fatal("UnfavoriteCommand failed: " + err.Error())
+	}
+
+	queries := []struct {
+		params conf.QueryParams
+		want   string
+		test   string
+	}{
+		{
+			params: conf.QueryParams{Type: conf.QUERY_FAVORITES, User: "%", Host: "%"},
+			want: "2015-10-12T12:00:00+0000 user1@host1 make release\n" +
+				"2015-10-12T12:00:00+0000 user1@host1 rsync -a build/ prod:",
+			test: "list favorites",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%",
+				Format: conf.FORMAT_BASH_HISTORY, IncludeFavorites: true},
+			want: "#1444647600\nls\n" + "#1444651200\nmake release\n" + "#1444651200\nrsync -a build/ prod:",
+			test: "restore with favorites",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%",
+				Format: conf.FORMAT_BASH_HISTORY},
+			want: "#1444647600\nls",
+			test: "restore without favorites",
+		},
+	}
+	for _, v := range queries {
+		res, err := testdb.RunQuery(v.params)
+		if err != nil {
+			t.Fatal(v.test + ": " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s", v.test, v.want, string(res))
+		}
+	}
+}
+
+func TestFuzzyQuery(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 git status
+user1 host1 2015-10-12T12:00:41+0000 git stash
+user1 host1 2015-10-12T12:00:42+0000 git status
+user1 host1 2015-10-12T12:00:43+0000 make install
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	queries := []struct {
+		params conf.QueryParams
+		want   string
+		test   string
+	}{
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git stauts%", Format: conf.FORMAT_COMMAND_LINE},
+			want:   "No exact matches. Closest (fuzzy) matches for 'git stauts':\n" + "3 git status\n" + "2 git stash",
+			test:   "automatic fallback",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git stauts%", Format: conf.FORMAT_ROWS},
+			want:   "",
+			test:   "no fallback for machine formats",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git status%", Format: conf.FORMAT_COMMAND_LINE, Fuzzy: true},
+			want:   "Closest (fuzzy) matches for 'git status':\n" + "3 git status\n" + "2 git stash",
+			test:   "explicit fuzzy",
+		},
+		{
+			params: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%zzz%", Format: conf.FORMAT_COMMAND_LINE},
+			want:   "No exact matches. No fuzzy matches for 'zzz'.",
+			test:   "nothing close",
+		},
+	}
+	for _, v := range queries {
+		res, err := testdb.RunQuery(v.params)
+		if err != nil {
+			t.Fatal(v.test + ": " + err.Error())
+		}
+		if string(res) != v.want {
+			t.Fatalf("Test '%s'\nWanted: %s\nGot   : %s", v.test, v.want, string(res))
+		}
+	}
+
+	if d := levenshtein("kitten", "Sitting"); d != 3 {
+		t.Fatalf("levenshtein returned %d, wanted 3.", d)
+	}
+}
+
+func TestGzipImport(t *testing.T) {
+	entries := []byte(`    1  2015-10-12T12:00:40+0000 ls
+    2  2015-10-12T12:00:41+0000 git status
+    3  2015-10-12T12:00:42+0000 make install
+`)
+	var compressed bytes.Buffer
+	z := gzip.NewWriter(&compressed)
+	z.Write(entries)
+	z.Close()
+
+	imported := func(history []byte, force bool) string {
+		testdb, cleanup := newTestDB()
+		defer cleanup()
+		r, err := Decompress(bufio.NewReader(bytes.NewReader(history)), force)
+		if err != nil {
+			t.Fatal("Decompress failed: ", err.Error())
+		}
+		if _, err = testdb.AddFromBuffer(r, "user1", "host1"); err != nil {
+			t.Fatal("AddFromBuffer failed: ", err.Error())
+		}
+		res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_EXPORT})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(res)
+	}
+
+	plain := imported(entries, false)
+	if plain == "" {
+		t.Fatal("Plain import added no rows.")
+	}
+	if got := imported(compressed.Bytes(), false); got != plain {
+		t.Fatalf("Detected gzip import differs from plain.\nWanted: %s\nGot   : %s", plain, got)
+	}
+	if got := imported(compressed.Bytes(), true); got != plain {
+		t.Fatalf("Forced gzip import differs from plain.\nWanted: %s\nGot   : %s", plain, got)
+	}
+	if _, err := Decompress(bufio.NewReader(bytes.NewReader(entries)), true); err == nil {
+		t.Fatal("Forced gzip on plain history should fail.")
+	}
+}
+
+func TestRecurringCommands(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// df -h runs every day at about the same time, ls at random.
+	entries := []byte(`user1 host1 2015-10-12T09:00:00+0000 df -h
+user1 host1 2015-10-13T09:05:00+0000 df -h
+user1 host1 2015-10-14T08:55:00+0000 df -h
+user1 host1 2015-10-15T09:00:00+0000 df -h
+user1 host1 2015-10-16T09:00:00+0000 df -h
+user1 host1 2015-10-12T10:00:00+0000 ls
+user1 host1 2015-10-12T10:01:00+0000 ls
+user1 host1 2015-10-14T23:00:00+0000 ls
+user1 host1 2015-10-15T01:00:00+0000 ls
+user1 host1 2015-10-20T10:00:00+0000 ls
+user1 host1 2015-10-12T10:00:00+0000 uptime
+user1 host1 2015-10-13T10:00:00+0000 uptime
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	qp := conf.QueryParams{Type: conf.QUERY_RECURRING, User: "%", Host: "%", MinOccurrences: 5}
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "5 runs | every 24h0m0s ± 6m7s | user1@host1 | df -h"
+	if string(res) != want {
+		t.Fatalf("Wanted: %s\nGot   : %s", want, string(res))
+	}
+
+	qp.MinOccurrences = 2
+	if _, err = testdb.RunQuery(qp); err == nil {
+		t.Fatal("Expected error for less than 3 occurrences.")
+	}
+
+	mean, stddev := intervalStats([]time.Time{time.Unix(20, 0), time.Unix(0, 0), time.Unix(10, 0)})
+	if mean != 10*time.Second || stddev != 0 {
+		t.Fatalf("intervalStats returned %v ± %v, wanted 10s ± 0s.", mean, stddev)
+	}
+}
+
+func TestWithContext(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// Counting to 10^12 takes far longer than the timeout.
+	slow := `WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x < 1000000000000)
+                 SELECT count(*) FROM c`
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var n int
+	err := testdb.WithContext(ctx).QueryRow(slow).Scan(&n)
+	if err == nil {
+		t.Fatal("Slow query wasn't aborted.")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("Slow query was aborted after %v.", d)
+	}
+
+	// A canceled context also aborts queries of Database methods and
+	// leaves the database usable.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	qp := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%%"}
+	if _, err = testdb.WithContext(ctx).RunQuery(qp); err == nil {
+		t.Fatal("Query with canceled context didn't fail.")
+	}
+	if _, err = testdb.RunQuery(qp); err != nil {
+		t.Fatal("Query after cancel failed: " + err.Error())
+	}
+}
+
+func TestAbruptStops(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 kubectl get pods
+user1 host1 2015-10-12T12:00:41+0000 kubectl get nodes
+user1 host1 2015-10-12T12:00:42+0000 kubectl describe pod x
+user1 host1 2015-10-12T12:00:43+0000 kubectl get pods
+user1 host1 2015-10-12T12:00:44+0000 git status
+user1 host1 2015-10-12T12:00:45+0000 git stash
+user1 host1 2015-10-12T12:00:46+0000 git stash pop
+user1 host1 2015-10-12T12:00:47+0000 ls -la
+user1 host1 2015-10-12T12:00:48+0000 ls -l
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	qp := conf.QueryParams{Type: conf.QUERY_COMMON_PREFIXES, User: "%", Host: "%", Kappa: 20, PrefixLen: 7}
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "3 | git sta\n" + "3 | kubectl"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+
+	qp.Kappa = 1
+	if res, _ = testdb.RunQuery(qp); string(res) != "3 | git sta" {
+		t.Fatalf("Wanted top-1 prefix, got:\n%s", string(res))
+	}
+
+	qp.PrefixLen = 0
+	if _, err = testdb.RunQuery(qp); err == nil {
+		t.Fatal("Expected error for prefix length 0.")
+	}
+}
+
+func TestStreamQuery(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	br := bufio.NewReader(bytes.NewReader(entriesDefault))
+	if _, err := testdb.AddFromBuffer(br, "user", "test"); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	if err := testdb.AnnotateCommand("user", "test", "git status", "what changed"); err != nil {
+		t.Fatal("AnnotateCommand failed: ", err.Error())
+	}
+
+	buffered := map[string]func(conf.QueryParams) ([]byte, error){
+		conf.QUERY:       testdb.DefaultQuery,
+		conf.QUERY_LASTK: testdb.LastK,
+	}
+	for _, format := range []string{conf.FORMAT_COMMAND_LINE, conf.FORMAT_ALL, conf.FORMAT_JSON, conf.FORMAT_ROWS, conf.FORMAT_EXPORT} {
+		for qtype, query := range buffered {
+			qp := conf.QueryParams{Type: qtype, Kappa: 5, User: "%", Host: "%", Format: format, Command: "%t%"}
+			// Formatted closes JSON based on the global format.
+			conf.QParams.Format = format
+			want, err := query(qp)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			var got bytes.Buffer
+			if err = testdb.StreamQuery(qp, &got); err != nil {
+				t.Fatal(err.Error())
+			}
+			if got.String() != string(want) {
+				t.Fatalf("Streamed %s query in %s format differs.\nWanted: %s\nGot   : %s", qtype, format, want, got.String())
+			}
+		}
+	}
+	conf.QParams.Format = ""
+
+	// Write errors are returned.
+	qp := conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Format: conf.FORMAT_COMMAND_LINE, Command: "%"}
+	if err := testdb.StreamQuery(qp, failingWriter{}); err == nil {
+		t.Fatal("StreamQuery didn't return the writer's error.")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, os.ErrClosed
+}
+
+func TestConcurrentImports(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// Every importer has its own connections, like separate processes.
+	const importers, lines = 8, 200
+	dbs := []Database{testdb}
+	for i := 1; i < importers; i++ {
+		db, err := New()
+		if err != nil {
+			t.Fatal("Opening database failed: " + err.Error())
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	var wg sync.WaitGroup
+	errs := make(chan error, importers)
+	for i, db := range dbs {
+		var history bytes.Buffer
+		for j := 0; j < lines; j++ {
+			history.WriteString(fmt.Sprintf("user%d host %s command %d\n", i, start.Add(time.Duration(j)*time.Second).Format(RFC3339alt), j))
+		}
+		wg.Add(1)
+		go func(db Database, history []byte) {
+			defer wg.Done()
+			// Small batches, so importers interleave.
+			for len(history) > 0 {
+				n := bytes.IndexByte(history[len(history)/4:], '\n') + len(history)/4 + 1
+				if _, err := db.AddFromBuffer(bufio.NewReader(bytes.NewReader(history[:n])), "", ""); err != nil {
+					errs <- err
+					return
+				}
+				history = history[n:]
+				if err := db.AddRecord("conn", "host", fmt.Sprintf("record %d", len(history)), start); err != nil && !errors.Is(err, ErrDuplicate) {
+					errs <- err
+					return
+				}
+			}
+		}(db, history.Bytes())
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal("Concurrent import failed: " + err.Error())
+	}
+
+	var n int
+	if err := testdb.QueryRow(`SELECT count(*) FROM history WHERE user LIKE 'user%'`).Scan(&n); err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != importers*lines {
+		t.Fatalf("Concurrent imports stored %d rows, wanted %d.", n, importers*lines)
+	}
+}
+
+func TestDirectoryChangeStats(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 cd /home/user1/src
+user1 host1 2015-10-12T12:00:41+0000 cd bashistdb
+user1 host1 2015-10-12T12:00:42+0000 cd ..
+user1 host1 2015-10-12T12:00:43+0000 cd -
+user1 host1 2015-10-12T12:00:44+0000 cd
+user1 host1 2015-10-12T12:00:45+0000 cd ~/src/bashistdb && make
+user1 host1 2015-10-12T12:00:46+0000 cd /tmp/
+user1 host2 2015-10-12T12:00:47+0000 cd docs
+user1 host2 2015-10-12T12:00:48+0000 cdrecord foo.iso
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_CD_STATS, User: "%", Host: "%", Kappa: 20})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "3 | ~/src/bashistdb\n" + "2 | ~/src\n" + "1 | /tmp\n" + "1 | docs\n" + "1 | ~"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+}
+
+func TestEditorUsage(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 vim main.go
+user1 host1 2015-10-12T12:00:41+0000 vim -O main.go README.md
+user1 host1 2015-10-12T12:00:42+0000 sudo -u root /usr/bin/vim +12 /etc/hosts
+user1 host1 2015-10-12T12:00:43+0000 nano main.go 2>/dev/null
+user1 host1 2015-10-12T12:00:44+0000 git add main.go && EDITOR=vim git commit
+user1 host1 2015-10-12T12:00:45+0000 make; code .
+user1 host2 2015-10-12T12:00:46+0000 vimdiff a b
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_EDITOR_STATS, User: "%", Host: "%", Kappa: 2})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "Editor runs:\n3 | vim\n1 | code\n1 | nano\n\nTop-2 edited files:\n3 | main.go\n1 | ."
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+
+	res, err = testdb.GetEditorUsage([]string{"vimdiff"}, conf.QueryParams{User: "%", Host: "%", Kappa: 20})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want = "Editor runs:\n1 | vimdiff\n\nTop-20 edited files:\n1 | a\n1 | b"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+
+	res, err = testdb.GetEditorUsage([]string{"emacs"}, conf.QueryParams{User: "%", Host: "%", Kappa: 20})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want = "No editor commands found."; string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+}
+
+func TestGitStats(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 git status
+user1 host1 2015-10-12T12:00:41+0000 git commit -m "fix"
+user1 host1 2015-10-12T12:00:42+0000 git status
+user1 host1 2015-10-12T12:00:43+0000 git -C ~/src --no-pager log
+user1 host1 2015-10-12T12:00:44+0000 hub commit --amend
+user1 host2 2015-10-12T12:00:45+0000 gh pr create
+user1 host2 2015-10-12T12:00:46+0000 gitk --all
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_GIT_STATS, User: "%", Host: "%"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := "2 | commit\n2 | status\n1 | log\n1 | pr"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+
+	res, err = testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_GIT_STATS, User: "%", Host: "host2", Format: conf.FORMAT_JSON})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want = "[\n{\"subcommand\":\"pr\",\"count\":1}\n]"
+	if string(res) != want {
+		t.Fatalf("Wanted:\n%s\nGot:\n%s", want, string(res))
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 make
+user1 host1 2015-10-12T12:00:41+0000 make
+user1 host1 2015-10-12T12:00:42+0000 git status
+user1 host1 2015-10-12T12:00:43+0000 make
+user1 host2 2015-10-12T12:00:44+0000 make
+user1 host1 2015-10-12T12:00:45+0000 make install
+user1 host2 2015-10-12T12:00:46+0000 make
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%make%", Format: conf.FORMAT_LOG, Distinct: true},
+			"2015-10-12T12:00:45+0000 user1@host1 make install\n" +
+				"2015-10-12T12:00:46+0000 user1@host2 make (5 times)"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE, Distinct: true},
+			"6 make install\n7 make (5 times)"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "^make$", Regex: true, Format: conf.FORMAT_JSON, Distinct: true},
+			"[\n" + `{"Row":7,"Datetime":"2015-10-12T12:00:46+0000","User":"user1","Host":"host2","Command":"make","Count":5}` + "\n]"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%make%", Format: conf.FORMAT_EXPORT, Distinct: true},
+			"user1 host1 2015-10-12T12:00:45+0000 make install\nuser1 host2 2015-10-12T12:00:46+0000 make"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%make%", Format: conf.FORMAT_NDJSON, Distinct: true},
+			`{"user":"user1","host":"host1","command":"make install","datetime":"2015-10-12T12:00:45+0000","count":1}` + "\n" +
+				`{"user":"user1","host":"host2","command":"make","datetime":"2015-10-12T12:00:46+0000","count":5}`},
+		// A clean history to restore, each command once at its latest run.
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_BASH_HISTORY, Distinct: true},
+			"#1444651242\ngit status\n#1444651245\nmake install\n#1444651246\nmake"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Wanted:\n%s\nGot:\n%s", test.want, string(res))
+		}
+	}
+}
+
+func TestDisplayTime(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	if err := testdb.AddRecord("user1", "host1", "htop", time.Date(2015, 10, 12, 22, 30, 0, 0, time.UTC)); err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+
+	defer func(tz *time.Location, layout string) { conf.DisplayTZ, conf.DisplayFormat = tz, layout }(conf.DisplayTZ, conf.DisplayFormat)
+	conf.DisplayTZ = time.FixedZone("EEST", 3*60*60)
+	conf.DisplayFormat = "2006-01-02 15:04 MST"
+
+	qp := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Format: conf.FORMAT_TIMESTAMP, Command: "%%"}
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "2015-10-13 01:30 EEST: htop"; string(res) != want {
+		t.Fatalf("Wanted: %s\nGot   : %s", want, string(res))
+	}
+
+	// Formats meant for machines keep the stored time.
+	qp.Format = conf.FORMAT_EXPORT
+	if res, _ = testdb.RunQuery(qp); string(res) != "user1 host1 2015-10-12T22:30:00+0000 htop" {
+		t.Fatalf("Export format changed with display settings: %s", string(res))
+	}
+}
+
+// benchmarkInserts runs insert with many goroutines, like many clients
+// sending single commands at once.
+func benchmarkInserts(b *testing.B, insert func(db Database, i int64) error) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	var n int64
+	var mu sync.Mutex
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			n++
+			i := n
+			mu.Unlock()
+			if err := insert(testdb, i); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkInsertDirect(b *testing.B) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	benchmarkInserts(b, func(db Database, i int64) error {
+		_, err := db.Exec("INSERT INTO history(user, host, command, datetime) VALUES(?, ?, ?, ?)",
+			"user", "host", "command", start.Add(time.Duration(i)*time.Second).Unix())
+		return err
+	})
+}
+
+func BenchmarkInsertQueued(b *testing.B) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	benchmarkInserts(b, func(db Database, i int64) error {
+		return db.AddRecord("user", "host", "command", start.Add(time.Duration(i)*time.Second))
+	})
+}
+
+func TestKappa(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	entries := []byte(`user1 host1 2015-10-12T12:00:40+0000 ls
+user1 host1 2015-10-12T12:00:41+0000 make
+user1 host1 2015-10-12T12:00:42+0000 make
+user1 host1 2015-10-12T12:00:43+0000 git status
+user1 host1 2015-10-12T12:00:44+0000 git status
+user1 host1 2015-10-12T12:00:45+0000 git status
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 45, 0, time.UTC) }
+	defer func() { now = time.Now }()
+	defer func(k int) { conf.MaxK = k }(conf.MaxK)
+	conf.MaxK = 2
+
+	for _, typ := range []string{conf.QUERY_TOPK, conf.QUERY_LASTK} {
+		for _, k := range []int{0, -5} {
+			qp := conf.QueryParams{Type: typ, Kappa: k, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE}
+			if _, err := testdb.RunQuery(qp); err == nil {
+				t.Errorf("Query %s with K=%d should fail.", typ, k)
+			}
+		}
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 100, User: "%", Host: "%", Command: "%%"},
+			"3 | git status\n2 | make"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 100, User: "%", Host: "%", Command: "%%", HalfLife: 24 * time.Hour},
+			"3.00 | 3 | git status\n2.00 | 2 | make"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 100, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"5 git status\n6 git status"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("K beyond MaxK should be clamped.\nWanted:\n%s\nGot:\n%s", test.want, string(res))
+		}
+	}
+}
+
+func TestTopKWindow(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// The make of 2015-10-11 is 25 hours old, though its text sorts after a
+	// day ago in UTC.
+	entries := []byte(`user1 host1 2015-09-01T12:00:00+0000 htop
+user1 host1 2015-10-08T12:00:00+0000 git status
+user1 host1 2015-10-08T12:00:01+0000 git status
+user1 host1 2015-10-08T12:00:02+0000 git status
+user1 host1 2015-10-08T12:00:03+0000 git status
+user1 host1 2015-10-09T12:00:00+0000 make
+user1 host1 2015-10-11T13:00:00+0200 make
+user1 host1 2015-10-12T10:00:00+0000 ls
+user1 host1 2015-10-12T11:00:00+0000 ls
+user1 host1 2015-10-12T13:30:00+0300 make
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	tests := []struct {
+		typ  string
+		want string
+	}{
+		{conf.QUERY_TOPK_24H, "2 | ls\n1 | make"},
+		{conf.QUERY_TOPK_WEEK, "4 | git status\n3 | make\n2 | ls"},
+	}
+	for _, test := range tests {
+		qp := conf.QueryParams{Type: test.typ, Kappa: 10, User: "%", Host: "%", Command: "%%"}
+		res, err := testdb.RunQuery(qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s.\nWanted:\n%s\nGot:\n%s", test.typ, test.want, string(res))
+		}
+	}
+}
+
+func TestSync(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	last, err := testdb.LastEntryTime("user1", "host1")
+	if err != nil {
+		t.Fatal("LastEntryTime failed: " + err.Error())
+	}
+	if !last.IsZero() {
+		t.Fatalf("LastEntryTime of an empty database should be zero, got %v", last)
+	}
+
+	history := []byte(`1 2015-10-12T10:00:00+0000 ls
+2 2015-10-12T11:30:00+0000 make
+3 2015-10-12T12:00:00+0200 htop
+`)
+	br := bufio.NewReader(bytes.NewReader(history))
+	if _, err = testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	if last, err = testdb.LastEntryTime("user1", "host1"); err != nil {
+		t.Fatal("LastEntryTime failed: " + err.Error())
+	}
+	if want := time.Date(2015, 10, 12, 11, 30, 0, 0, time.UTC); !last.Equal(want) {
+		t.Fatalf("LastEntryTime.\nWanted: %v\nGot   : %v", want, last)
+	}
+
+	now = func() time.Time { return time.Date(2015, 10, 12, 13, 0, 0, 0, time.UTC) }
+	defer func() { now = time.Now }()
+
+	// ls and htop are older than SyncMargin, lines we can't decode are kept.
+	history = append(history, []byte("not history\n4 2015-10-12T12:10:00+0000 git status\n")...)
+	want := `2 2015-10-12T11:30:00+0000 make
+not history
+4 2015-10-12T12:10:00+0000 git status
+`
+	got, ok := HistorySince(history, BashParser{}, last)
+	if !ok || string(got) != want {
+		t.Fatalf("HistorySince.\nWanted (true):\n%s\nGot (%v):\n%s", want, ok, got)
+	}
+
+	// A rotated history doesn't have the latest command.
+	if _, ok = HistorySince(history[len("1 2015-10-12T10:00:00+0000 ls\n2 2015-10-12T11:30:00+0000 make\n"):], BashParser{}, last); ok {
+		t.Fatal("HistorySince should be in doubt without the latest command.")
+	}
+	// Nor can we trust a latest command from the future.
+	now = func() time.Time { return time.Date(2015, 10, 12, 11, 0, 0, 0, time.UTC) }
+	if _, ok = HistorySince(history, BashParser{}, last); ok {
+		t.Fatal("HistorySince should be in doubt when the latest command is in the future.")
+	}
+}
+
+func TestGetStashableCommands(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	var entries bytes.Buffer
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&entries, "user1 host1 2015-10-12T12:00:%02d+0000 git log --oneline\n", i)
+		fmt.Fprintf(&entries, "user1 host1 2015-10-12T12:01:%02d+0000 ls\n", i)
+		fmt.Fprintf(&entries, "user2 host2 2015-10-12T12:02:%02d+0000 /usr/bin/grep -r 'it''s' .\n", i)
+	}
+	entries.WriteString("user2 host2 2015-10-12T12:03:00+0000 git log --oneline\n")
+	entries.WriteString("user1 host1 2015-10-12T12:04:00+0000 make test\n")
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(&entries), "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+
+	qp := conf.QueryParams{User: "%", Host: "%"}
+	res, err := testdb.GetStashableCommands(qp, 3)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	want := fmt.Sprintf("alias %s='git log --oneline' # run 4 times\nalias %s='/usr/bin/grep -r '\\''it'\\'''\\''s'\\'' .' # run 3 times",
+		aliasName("git", "git log --oneline"), aliasName("/usr/bin/grep", "/usr/bin/grep -r 'it''s' ."))
+	if string(res) != want {
+		t.Errorf("GetStashableCommands.\nWanted:\n%s\nGot:\n%s", want, res)
+	}
+	if !strings.HasPrefix(aliasName("/usr/bin/grep", "grep"), "grep_") {
+		t.Errorf("Alias names should start with the program's name, got %s", aliasName("/usr/bin/grep", "grep"))
+	}
+
+	qp.User = "user1"
+	if res, err = testdb.GetStashableCommands(qp, 5); err != nil || string(res) != "No alias candidates found." {
+		t.Errorf("GetStashableCommands without candidates, got: %s (%v)", res, err)
+	}
+	if _, err = testdb.GetStashableCommands(qp, 1); err == nil {
+		t.Error("GetStashableCommands with a min count of 1 should fail.")
+	}
+}
+
+func TestSource(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	batches := []struct {
+		source, history string
+	}{
+		{"laptop", "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"},
+		{"backup", "1 2015-10-12T12:00:41+0000 make\n2 2015-10-12T12:00:42+0000 htop\n"},
+		{"", "1 2015-10-12T12:00:43+0000 git status\n"},
+	}
+	for _, b := range batches {
+		br := bufio.NewReader(bytes.NewReader([]byte(b.history)))
+		if _, err := testdb.WithSource(b.source).AddFromBuffer(br, "user1", "host1"); err != nil {
+			t.Fatal("AddFromBuffer failed: " + err.Error())
+		}
+	}
+	if err := testdb.WithSource("record").AddRecord("user1", "host1", "df -h", time.Date(2015, 10, 12, 12, 0, 44, 0, time.UTC)); err != nil {
+		t.Fatal("AddRecord failed: " + err.Error())
+	}
+
+	// The make of backup was a duplicate, it stays laptop's.
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, Source: "laptop", User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n2 make"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, Source: "backup", User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"3 htop"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n2 make\n3 htop\n4 git status\n5 df -h"},
+		{conf.QueryParams{Type: conf.QUERY_BY_SOURCE, User: "%", Host: "%", Command: "%%"},
+			"2 | laptop\n1 | (no source)\n1 | backup\n1 | record"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s of source '%s'.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.Source, test.want, res)
+		}
+	}
+}
+
+func TestImportBatches(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	batches := []struct {
+		user, history string
+	}{
+		{"user1", "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"},
+		{"user1", "1 2015-10-12T12:00:41+0000 make\n2 2015-10-12T12:00:42+0000 htop\n"},
+		{"user1", "1 2015-10-12T12:00:41+0000 make\n"},
+		{"user2", "1 2015-10-12T12:00:43+0000 git status\n"},
+	}
+	for _, b := range batches {
+		br := bufio.NewReader(bytes.NewReader([]byte(b.history)))
+		if _, err := testdb.AddFromBuffer(br, b.user, "host1"); err != nil {
+			t.Fatal("AddFromBuffer failed: " + err.Error())
+		}
+	}
+
+	// The third batch only had a duplicate, so it wasn't kept.
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_IMPORTS, Kappa: 20, User: "%", Host: "%"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(string(res), "\n")
+	wanted := []struct{ prefix, suffix string }{
+		{"3 | user2@host1 | ", " | 1 commands"},
+		{"2 | user1@host1 | ", " | 1 commands"},
+		{"1 | user1@host1 | ", " | 2 commands"},
+	}
+	if len(lines) != len(wanted) {
+		t.Fatalf("Expected %d imports, got:\n%s", len(wanted), res)
+	}
+	for i, w := range wanted {
+		if !strings.HasPrefix(lines[i], w.prefix) || !strings.HasSuffix(lines[i], w.suffix) {
+			t.Errorf("Import line %d.\nWanted: %s...%s\nGot   : %s", i, w.prefix, w.suffix, lines[i])
+		}
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+		err  bool
+	}{
+		{conf.QueryParams{Type: conf.UNDO_IMPORT, User: "user1", Host: "host1"},
+			"Undid import 2, deleted 1 commands.", false},
+		{conf.QueryParams{Type: conf.UNDO_IMPORT, Kappa: 3, User: "user1", Host: "host1"},
+			"", true},
+		{conf.QueryParams{Type: conf.UNDO_IMPORT, Kappa: 7, User: "%", Host: "%"},
+			"", true},
+		{conf.QueryParams{Type: conf.UNDO_IMPORT, Kappa: 1, User: "%", Host: "%"},
+			"Undid import 1, deleted 2 commands.", false},
+		{conf.QueryParams{Type: conf.UNDO_IMPORT, User: "user1", Host: "host1"},
+			"No imports to undo.", false},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if (err != nil) != test.err {
+			t.Fatalf("Undo import %d: unexpected error state: %v", test.qp.Kappa, err)
+		}
+		if string(res) != test.want {
+			t.Errorf("Undo import %d.\nWanted: %s\nGot   : %s", test.qp.Kappa, test.want, res)
+		}
+	}
+
+	res, err = testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "4 git status"; string(res) != want {
+		t.Errorf("After undo.\nWanted: %s\nGot   : %s", want, res)
+	}
+}
+
+func TestColorOutput(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	conf.ColorOutput = true
+	defer func() { conf.ColorOutput = false }()
+
+	history := "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 ls\n3 2015-10-12T12:00:42+0000 make\n"
+	br := bufio.NewReader(bytes.NewReader([]byte(history)))
+	if _, err := testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	conf.DisplayTZ = time.UTC
+	defer func() { conf.DisplayTZ = nil }()
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 10, User: "%", Host: "%", Command: "%%"},
+			"\033[33m2\033[0m | \033[37mls\033[0m\n\033[33m1\033[0m | \033[37mmake\033[0m"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_TIMESTAMP},
+			"\033[36m2015-10-12 12:00:42\033[0m: \033[37mmake\033[0m"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_EXPORT},
+			"user1 host1 2015-10-12T12:00:42+0000 make"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Colored %s query.\nWanted: %q\nGot   : %q", test.qp.Type, test.want, res)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := `1 2015-10-12T12:00:40+0000 ls
+2 2015-10-12T12:00:41+0000 make
+3 2015-10-12T12:00:42+0000 ls
+4 2015-10-12T12:00:43+0000 git status
+5 2015-10-12T12:00:44+0000 make test
+6 2015-10-12T12:00:45+0000 ls
+`
+	br := bufio.NewReader(bytes.NewReader([]byte(history)))
+	if _, err := testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, Kappa: 2, Offset: 1, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"2 make\n3 ls"},
+		{conf.QueryParams{Type: conf.QUERY, Offset: 4, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"5 make test\n6 ls"},
+		{conf.QueryParams{Type: conf.QUERY, Kappa: 1, Offset: 1, Regex: true, User: "%", Host: "%", Command: "^make", Format: conf.FORMAT_COMMAND_LINE},
+			"5 make test"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, Offset: 2, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"3 ls\n4 git status"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, Offset: 1, User: "%", Host: "%", Command: "%%"},
+			"1 | git status\n1 | make"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 2, Offset: 10, User: "%", Host: "%", Command: "%%"},
+			""},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s with limit %d and offset %d.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.Kappa, test.qp.Offset, test.want, res)
+		}
+	}
+
+	// Offsets come from clients, a negative one must be an error, not a panic.
+	for _, qp := range []conf.QueryParams{
+		{Type: conf.QUERY, Kappa: 2, Offset: -1, User: "%", Host: "%", Command: "%%"},
+		{Type: conf.QUERY, Kappa: 1, Offset: -1, Regex: true, User: "%", Host: "%", Command: "^make"},
+		{Type: conf.QUERY_LASTK, Kappa: 2, Offset: -1, User: "%", Host: "%", Command: "%%"},
+		{Type: conf.QUERY_TOPK, Kappa: 2, Offset: -1, User: "%", Host: "%", Command: "%%"},
+		{Type: conf.QUERY_TOPK, Kappa: 2, Offset: -1, HalfLife: time.Hour, User: "%", Host: "%", Command: "%%"},
+		{Type: conf.QUERY_FRECENT, Kappa: 2, Offset: -1, User: "%", Host: "%", Command: "%%"},
+	} {
+		if _, err := testdb.RunQuery(qp); err == nil {
+			t.Errorf("Query %s with offset %d should get an error.", qp.Type, qp.Offset)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := "1 2015-10-12T12:00:40+0000 git status\n2 2015-10-12T12:00:41+0000 make GIT=1 git push\n"
+	br := bufio.NewReader(bytes.NewReader([]byte(history)))
+	if _, err := testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git%", Format: conf.FORMAT_BASH_HISTORY},
+			"#1444651240\ngit status\n#1444651241\nmake GIT=1 git push"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git%", Format: conf.FORMAT_BASH_HISTORY, Highlight: ">>>%s<<<"},
+			"#1444651240\n>>>git<<< status\n#1444651241\nmake >>>GIT<<<=1 >>>git<<< push"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git p_sh%", Format: conf.FORMAT_BASH_HISTORY, Highlight: "[%s]"},
+			"#1444651241\nmake GIT=1 [git push]"},
+		{conf.QueryParams{Type: conf.QUERY, Regex: true, User: "%", Host: "%", Command: "st.t", Format: conf.FORMAT_BASH_HISTORY, Highlight: "[%s]"},
+			"#1444651240\ngit [stat]us"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Command: "%push%", Format: conf.FORMAT_BASH_HISTORY, Highlight: "[%s]"},
+			"#1444651241\nmake GIT=1 git [push]"},
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%push%", Format: conf.FORMAT_COMMAND_LINE, Highlight: "[%s]"},
+			"2 make GIT=1 git push"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query for '%s' with highlight '%s'.\nWanted:\n%s\nGot:\n%s", test.qp.Command, test.qp.Highlight, test.want, res)
+		}
+	}
+
+	_, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%git%",
+		Format: conf.FORMAT_BASH_HISTORY, Highlight: "[]"})
+	if err == nil {
+		t.Error("Highlight without a place for the match should get an error.")
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.Remove(path)
+
+	testdb, err := Open(path, nil, QueryLogRetention(time.Hour))
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	defer testdb.Close()
+
+	now := time.Now()
+	entries := []QueryLogEntry{
+		{Datetime: now.Add(-2 * time.Hour), Remote: "10.0.0.1:4000", User: "old", Type: "query",
+			Params: conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 5}, Rows: 5, DurationMs: 3},
+		{Datetime: now.Add(-time.Minute), Remote: "10.0.0.2:4000", User: "user1", Type: "query",
+			Params: conf.QueryParams{Type: conf.QUERY, Command: "%make%"}, Rows: 2, DurationMs: 1},
+		{Datetime: now, Remote: "10.0.0.3:4000", User: "user2", Type: "multi_query",
+			Params: conf.QueryParams{Type: conf.DELETE, Rows: []int{1}}, Rows: 1, DurationMs: 7},
+	}
+	for _, e := range entries {
+		if err = testdb.LogQuery(e); err != nil {
+			t.Fatal("LogQuery failed: " + err.Error())
+		}
+	}
+	// The writer writes in order, once this import is in so are the entries.
+	br := bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 ls\n")))
+	if _, err = testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	// The oldest entry is past the retention.
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_QUERYLOG, Kappa: 20})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	lines := strings.Split(string(res), "\n")
+	wanted := []string{
+		" | 10.0.0.3:4000 | user2 | multi_query | 1 rows | 7ms | {\"Type\":\"delete\",",
+		" | 10.0.0.2:4000 | user1 | query | 2 rows | 1ms | {\"Type\":\"query\",",
+	}
+	if len(lines) != len(wanted) {
+		t.Fatalf("Expected %d query log entries, got:\n%s", len(wanted), res)
+	}
+	for i, w := range wanted {
+		if !strings.Contains(lines[i], w) {
+			t.Errorf("Query log line %d.\nWanted: ...%s...\nGot   : %s", i, w, lines[i])
+		}
+	}
+
+	res, err = testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_QUERYLOG, Kappa: 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(res), "user2") || strings.Contains(string(res), "\n") {
+		t.Errorf("Query log with K=1.\nGot: %s", res)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		l.Fatalln(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	defer os.Remove(path)
+
+	testdb, err := Open(path, nil, QueryLogRetention(time.Hour))
+	if err != nil {
+		t.Fatal("Open failed: " + err.Error())
+	}
+	defer testdb.Close()
+
+	now := time.Now()
+	entries := []AuditEntry{
+		{Datetime: now.Add(-2 * time.Hour), User: "old", Host: "host1", Operation: "history", Status: "ok", RowsAffected: 9},
+		{Datetime: now.Add(-30 * time.Minute), User: "user1", Host: "host1", Operation: "history", Status: "ok", RowsAffected: 2},
+		{Datetime: now.Add(-time.Minute), User: "user2", Host: "", Operation: "query querylog", Status: "denied"},
+		{Datetime: now, User: "user1", Host: "host1", Operation: "query delete", Status: "ok"},
+	}
+	for _, e := range entries {
+		if err = testdb.LogAudit(e); err != nil {
+			t.Fatal("LogAudit failed: " + err.Error())
+		}
+	}
+	// The writer writes in order, once this import is in so are the entries.
+	br := bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 ls\n")))
+	if _, err = testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	// The oldest entry is past the retention.
+	tests := []struct {
+		qp     conf.QueryParams
+		wanted []string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_AUDIT_LOG, Kappa: 20},
+			[]string{" | user1@host1 | query delete | ok | 0 rows", " | user2@ | query querylog | denied | 0 rows",
+				" | user1@host1 | history | ok | 2 rows"}},
+		{conf.QueryParams{Type: conf.QUERY_AUDIT_LOG, Kappa: 1},
+			[]string{" | user1@host1 | query delete | ok | 0 rows"}},
+		{conf.QueryParams{Type: conf.QUERY_AUDIT_LOG, Kappa: 20, DateFrom: now.Add(-10 * time.Minute)},
+			[]string{" | user1@host1 | query delete | ok | 0 rows", " | user2@ | query querylog | denied | 0 rows"}},
+		{conf.QueryParams{Type: conf.QUERY_AUDIT_LOG, Kappa: 20, DateFrom: now.Add(time.Minute)},
+			[]string{"No operations logged."}},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		lines := strings.Split(string(res), "\n")
+		if len(lines) != len(test.wanted) {
+			t.Fatalf("Expected %d audit log entries, got:\n%s", len(test.wanted), res)
+		}
+		for i, w := range test.wanted {
+			if !strings.HasSuffix(lines[i], w) {
+				t.Errorf("Audit log entry %d.\nWanted: ...%s\nGot   : %s", i, w, lines[i])
+			}
+		}
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	var history bytes.Buffer
+	for i := 0; i < 10; i++ {
+		fmt.Fprintf(&history, "%d 2015-10-12T12:00:%02d+0000 ls\n", i+1, i)
+	}
+	history.WriteString("11 2015-10-12T12:00:20+0000 make\n12 2015-10-12T12:00:21+0000 git status\n13 2015-10-12T12:00:22+0000 make\n")
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(&history), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 3, User: "%", Host: "%", Command: "%%"},
+			"10 | ls\n 2 | make\n 1 | git status"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 3, SortOrder: conf.SORT_ASC, User: "%", Host: "%", Command: "%%"},
+			" 1 | git status\n 2 | make\n10 | ls"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"12 git status\n13 make"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, SortOrder: conf.SORT_ASC, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n2 ls"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, Offset: 10, SortOrder: conf.SORT_ASC, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"11 make\n12 git status"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s sorted '%s'.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.SortOrder, test.want, res)
+		}
+	}
+}
+
+func TestLongCommands(t *testing.T) {
+	long := "echo " + strings.Repeat("x", 200*1024)
+	history := []byte("1 2015-10-12T12:00:40+0000 " + long + "\n2 2015-10-12T12:00:41+0000 ls\n")
+
+	for _, limit := range []int{0, 300 * 1024, 100 * 1024} {
+		conf.MaxCommandBytes = limit
+		testdb, cleanup := newTestDB()
+		stats, err := testdb.Import(bufio.NewReader(bytes.NewReader(history)), "user1", "host1")
+		if err != nil {
+			cleanup()
+			t.Fatal("Import failed: " + err.Error())
+		}
+		var stored string
+		err = testdb.QueryRow(`SELECT command FROM history WHERE command LIKE 'echo %'`).Scan(&stored)
+		switch {
+		case limit == 0 || limit > len(long):
+			if stats.Added != 2 || stored != long {
+				t.Errorf("Import of a %d bytes command with limit %d: added %d, stored %d bytes intact: %t.",
+					len(long), limit, stats.Added, len(stored), stored == long)
+			}
+		default:
+			if stats.Added != 1 || stats.TooLong != 1 || err != sql.ErrNoRows {
+				t.Errorf("Import of a %d bytes command with limit %d: added %d, too long %d, query error %v.",
+					len(long), limit, stats.Added, stats.TooLong, err)
+			}
+		}
+		cleanup()
+	}
+	conf.MaxCommandBytes = 0
+}
+
+func TestExclude(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	imports := []struct{ user, host, history string }{
+		{"user1", "host1", "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 ls -l\n3 2015-10-12T12:00:42+0000 make\n"},
+		{"user2", "host2", "1 2015-10-12T12:00:43+0000 make test\n2 2015-10-12T12:00:44+0000 lsblk\n"},
+	}
+	for _, i := range imports {
+		if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(i.history)), i.user, i.host); err != nil {
+			t.Fatal("AddFromBuffer failed: " + err.Error())
+		}
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, ExcludeCommand: "ls%", User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"3 make\n4 make test"},
+		{conf.QueryParams{Type: conf.QUERY, ExcludeCommand: "ls %", Regex: true, User: "%", Host: "%", Command: "^ls", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n5 lsblk"},
+		{conf.QueryParams{Type: conf.QUERY, ExcludeUser: "user1", User: "%", Host: "%", Command: "%make%", Format: conf.FORMAT_COMMAND_LINE},
+			"4 make test"},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, ExcludeHost: "host2", User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n2 ls -l\n3 make"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 10, ExcludeCommand: "make%", User: "%", Host: "%", Command: "%%"},
+			"1 | ls\n1 | ls -l\n1 | lsblk"},
+		{conf.QueryParams{Type: conf.QUERY, ExcludeCommand: "%", User: "%", Host: "%", Command: "%mkae%"},
+			""},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s for '%s' excluding '%s', '%s', '%s'.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.Command,
+				test.qp.ExcludeCommand, test.qp.ExcludeUser, test.qp.ExcludeHost, test.want, res)
+		}
+	}
+}
+
+func TestAnonymize(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := "1 2015-10-12T12:00:40+0000 scp report.pdf acme:/home/alice\n2 2015-10-12T12:00:41+0000 ls\n"
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "alice", "acme-laptop"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	if err := testdb.AnnotateCommand("alice", "acme-laptop", "scp report.pdf acme:/home/alice", "for acme"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	user, host := anonymousName("salt", "alice"), anonymousName("salt", "acme-laptop")
+	if user == "alice" || user == anonymousName("other salt", "alice") || len(user) != 16 {
+		t.Fatalf("Anonymous name of alice: %s", user)
+	}
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 1, Anonymize: []string{conf.ANON_USERS, conf.ANON_HOSTS},
+			AnonymizeSalt: "salt", User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_EXPORT},
+			user + " " + host + " 2015-10-12T12:00:41+0000 ls"},
+		{conf.QueryParams{Type: conf.QUERY, Anonymize: []string{conf.ANON_HOSTS, conf.ANON_ARGS},
+			AnonymizeSalt: "salt", User: "%", Host: "%", Command: "%scp%", Format: conf.FORMAT_JSON},
+			`[
+{"Row":1,"Datetime":"2015-10-12T12:00:40+0000","User":"alice","Host":"` + host + `","Command":"scp"}
+]`},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s anonymizing %v.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.Anonymize, test.want, res)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	qp := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, Explain: true, User: "user1", Host: "%",
+		Command: "%it's%", ExcludeCommand: "ls%", Source: "laptop", Format: conf.FORMAT_COMMAND_LINE}
+	res, err := testdb.RunQuery(qp)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	out := string(res)
+	wanted := []string{
+		"SQL: SELECT * FROM (SELECT rowid, user, host, command, datetime FROM history WHERE (? = '' OR source = ?) AND user LIKE ? " +
+			"AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\\' AND (? = '' OR command NOT LIKE ?)",
+		"\n  ?1 = \"laptop\"\n  ?2 = \"laptop\"\n  ?3 = \"user1\"\n  ?4 = \"%\"\n  ?5 = \"default\"\n  ?6 = \"%it's%\"\n  ?7 = \"ls%\"\n  ?8 = \"ls%\"\n",
+		"\n  ?13 = 10\n  ?14 = 0\nPlan:\n",
+	}
+	for _, w := range wanted {
+		if !strings.Contains(out, w) {
+			t.Errorf("Explain of a filtered lastk.\nWanted: ...%s...\nGot:\n%s", w, out)
+		}
+	}
+	if strings.Contains(out, "make") {
+		t.Errorf("Explain returned query results:\n%s", out)
+	}
+}
+
+func TestSlowQuery(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	var out bytes.Buffer
+	defer log.Warn.SetOutput(log.Warn.Writer())
+	log.Warn.SetOutput(&out)
+
+	history := "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	pattern := "%" + strings.Repeat("x", 100) + "%"
+	qp := conf.QueryParams{Type: conf.QUERY, User: "user1", Host: "%", Command: pattern, Format: conf.FORMAT_COMMAND_LINE}
+
+	if _, err := testdb.RunQuery(qp); err != nil {
+		t.Fatal(err.Error())
+	}
+	if out.Len() > 0 {
+		t.Errorf("Slow statements logged with the threshold off:\n%s", out.String())
+	}
+
+	testdb.slowQuery = time.Nanosecond
+	if _, err := testdb.RunQuery(qp); err != nil {
+		t.Fatal(err.Error())
+	}
+	logged := out.String()
+	wanted := []string{"Slow statement, ", "SELECT rowid, user, host, command, datetime FROM history WHERE",
+		`"user1", "%", "default", "` + pattern[:maxLoggedArg] + `..."`}
+	for _, w := range wanted {
+		if !strings.Contains(logged, w) {
+			t.Errorf("Slow statement log.\nWanted: ...%s...\nGot:\n%s", w, logged)
+		}
+	}
+	if strings.Contains(logged, pattern[:maxLoggedArg+1]) {
+		t.Errorf("Slow statement logged with its whole pattern:\n%s", logged)
+	}
+}
+
+func TestCaseSensitive(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	history := "1 2015-10-12T12:00:40+0000 make\n2 2015-10-12T12:00:41+0000 Make\n3 2015-10-12T12:00:42+0000 echo 100%_Done*\n"
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%Make%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 make\n2 Make"},
+		{conf.QueryParams{Type: conf.QUERY, CaseSensitive: true, User: "%", Host: "%", Command: "%Make%", Format: conf.FORMAT_COMMAND_LINE},
+			"2 Make"},
+		{conf.QueryParams{Type: conf.QUERY, CaseSensitive: true, User: "%", Host: "%", Command: "%M_ke", Format: conf.FORMAT_COMMAND_LINE},
+			"2 Make"},
+		{conf.QueryParams{Type: conf.QUERY, CaseSensitive: true, User: "%", Host: "%", Command: `%\%\_Done*`, Format: conf.FORMAT_COMMAND_LINE},
+			"3 echo 100%_Done*"},
+		{conf.QueryParams{Type: conf.QUERY, CaseSensitive: true, User: "%", Host: "%", Command: `%\%_done%`, Format: conf.FORMAT_ROWS},
+			""},
+		{conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, CaseSensitive: true, User: "%", Host: "%", Command: "make", Format: conf.FORMAT_COMMAND_LINE},
+			"1 make"},
+		{conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 10, CaseSensitive: true, User: "%", Host: "%", Command: "M%"},
+			"1 | Make"},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s for '%s', case sensitive %t.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.qp.Command,
+				test.qp.CaseSensitive, test.want, res)
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	work := testdb.WithProfile("work")
+
+	history := "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"
+	if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+	// The same commands, at the same time, are rows of their own in another
+	// profile.
+	history += "3 2015-10-12T12:00:42+0000 ssh build-server\n"
+	if _, err := work.AddFromBuffer(bufio.NewReader(strings.NewReader(history)), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	tests := []struct {
+		db   Database
+		qp   conf.QueryParams
+		want string
+	}{
+		{testdb, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_COMMAND_LINE},
+			"1 ls\n2 make"},
+		{testdb.WithProfile(DefaultProfile), conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: 10, User: "%", Host: "%", Command: "%"},
+			"1 | ls\n1 | make"},
+		{work, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_COMMAND_LINE},
+			"3 ls\n4 make\n5 ssh build-server"},
+		{work, conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_EXPORT},
+			"user1 host1 2015-10-12T12:00:40+0000 ls\nuser1 host1 2015-10-12T12:00:41+0000 make\n" +
+				"user1 host1 2015-10-12T12:00:42+0000 ssh build-server"},
+		{testdb.WithProfile("none"), conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_ROWS},
+			""},
+		{testdb, conf.QueryParams{Type: conf.QUERY_PROFILES, User: "%", Host: "%"},
+			"default | 2 commands\nwork | 3 commands"},
+		{work, conf.QueryParams{Type: conf.QUERY_PROFILES, User: "user2", Host: "%"},
+			"No history in any profile."},
+	}
+	for _, test := range tests {
+		res, err := test.db.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Query %s in profile %s.\nWanted:\n%s\nGot:\n%s", test.qp.Type, test.db.Profile(), test.want, res)
+		}
+	}
+}
+
+func TestIdenticalImport(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	var out bytes.Buffer
+	defer log.Warn.SetOutput(log.Warn.Writer())
+	log.Warn.SetOutput(&out)
+
+	history := "1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n"
+	imports := []struct {
+		user, history string
+		warned        bool
+	}{
+		{"user1", history, false},
+		{"user1", history, true},
+		// Another user's history, or more of it, isn't the same import.
+		{"user2", history, false},
+		{"user1", history + "3 2015-10-12T12:00:42+0000 make test\n", false},
+		{"user1", history + "3 2015-10-12T12:00:42+0000 make test\n", true},
+	}
+	for i, imp := range imports {
+		out.Reset()
+		if _, err := testdb.AddFromBuffer(bufio.NewReader(strings.NewReader(imp.history)), imp.user, "host1"); err != nil {
+			t.Fatal("AddFromBuffer failed: " + err.Error())
+		}
+		if warned := strings.Contains(out.String(), "Identical import detected"); warned != imp.warned {
+			t.Errorf("Import %d of %s: wanted warning %t, got log:\n%s", i+1, imp.user, imp.warned, out.String())
+		}
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	n := newNameNormalizer([]string{"local", ".Example.com."})
+	names := []struct{ host, want string }{
+		{"Web01", "web01"},
+		{"web01.local", "web01"},
+		{"WEB01.example.com.", "web01"},
+		{"web01.localdomain", "web01.localdomain"},
+		{"local", "local"},
+	}
+	for _, test := range names {
+		if got := n.host(test.host); got != test.want {
+			t.Errorf("Normalizing host %s.\nWanted: %s\nGot   : %s", test.host, test.want, got)
+		}
+	}
+
+	conf.KeyIncludesHost = true
+	defer func() { conf.KeyIncludesHost = false }()
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	// A database imported before normalizing: one command twice, under
+	// two spellings of the same user and host.
+	entries := []byte(`alice Web01.local 2015-10-12T10:00:00+0000 ls
+Alice web01 2015-10-12T10:00:00+0000 ls
+alice web01. 2015-10-12T10:01:00+0000 make
+bob debian 2015-10-12T10:02:00+0000 vim
+`)
+	br := bufio.NewReader(bytes.NewReader(entries))
+	if _, err := testdb.AddFromBuffer(br, "", ""); err != nil {
+		t.Fatal("AddFromBuffer failed: ", err.Error())
+	}
+	if _, _, err := testdb.NormalizeExisting(false); err != errNoNormalize {
+		t.Errorf("NormalizeExisting without NormalizeNames, wanted %v, got %v.", errNoNormalize, err)
+	}
+
+	testdb.names = n
+	tests := []struct {
+		qp   conf.QueryParams
+		want string
+	}{
+		{conf.QueryParams{Type: conf.NORMALIZE_EXISTING, DryRun: true},
+			"Normalizing users and hosts would update 2 commands and merge 1."},
+		{conf.QueryParams{Type: conf.NORMALIZE_EXISTING},
+			"Normalized users and hosts, updated 2 commands and merged 1."},
+		{conf.QueryParams{Type: conf.NORMALIZE_EXISTING},
+			"Normalized users and hosts, updated 0 commands and merged 0."},
+	}
+	for _, test := range tests {
+		res, err := testdb.RunQuery(test.qp)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if string(res) != test.want {
+			t.Errorf("Normalizing existing names.\nWanted: %s\nGot   : %s", test.want, res)
+		}
+	}
+
+	// New commands come in normalized, queries match them however they
+	// spell the names.
+	if err := testdb.AddRecord("ALICE", "web01.Example.com", "cd", time.Date(2015, 10, 12, 10, 3, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err.Error())
+	}
+	var users, hosts int
+	if err := testdb.QueryRow(`SELECT count(DISTINCT user), count(DISTINCT host) FROM history`).Scan(&users, &hosts); err != nil {
+		t.Fatal(err.Error())
+	}
+	if users != 2 || hosts != 2 {
+		t.Errorf("Got %d users and %d hosts, wanted alice and bob at web01 and debian.", users, hosts)
+	}
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "Alice", Host: "WEB01.local",
+		Format: conf.FORMAT_COMMAND_LINE, Command: "%%"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if want := "2 ls\n3 make\n5 cd"; strings.TrimSpace(string(res)) != want {
+		t.Errorf("Query with unnormalized names.\nWanted: %s\nGot   : %s", want, res)
+	}
+}
+
+func TestAuditSummary(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+
+	day := func(d, h int) time.Time { return time.Date(2015, 10, d, h, 0, 0, 0, time.Local) }
+	entries := []AuditEntry{
+		{Datetime: day(11, 12), User: "user1", Host: "host1", Operation: "history", Status: "ok", RowsAffected: 9},
+		{Datetime: day(12, 10), User: "user1", Host: "host1", Operation: "history", Status: "ok", RowsAffected: 2},
+		{Datetime: day(12, 22), User: "user2", Host: "", Operation: "query querylog", Status: "denied"},
+		{Datetime: day(12, 7), User: "user1", Host: "host1", Operation: "query delete", Status: "ok"},
+		{Datetime: day(13, 9), User: "user2", Host: "host2", Operation: "history", Status: "ok", RowsAffected: 1},
+	}
+	for _, e := range entries {
+		if err := testdb.LogAudit(e); err != nil {
+			t.Fatal("LogAudit failed: " + err.Error())
+		}
+	}
+	// The writer writes in order, once this import is in so are the entries.
+	br := bufio.NewReader(bytes.NewReader([]byte("1 2015-10-12T12:00:40+0000 ls\n")))
+	if _, err := testdb.AddFromBuffer(br, "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_AUDIT_SUMMARY, DateFrom: day(12, 0), DateTo: day(13, 0)})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var got auditSummary
+	if err = json.Unmarshal(res, &got); err != nil {
+		t.Fatalf("Audit summary isn't JSON: %v\n%s", err, res)
+	}
+	wanted := auditSummary{From: day(12, 0), To: day(13, 0), Operations: 3, Failed: 1, UnusualHours: 2,
+		ByOperation:  map[string]int{"history": 1, "query querylog": 1, "query delete": 1},
+		ByUser:       map[string]int{"user1": 2, "user2": 1},
+		UnusualUsers: map[string]int{"user1": 1, "user2": 1}}
+	if !got.From.Equal(wanted.From) || !got.To.Equal(wanted.To) {
+		t.Errorf("Audit summary from %v to %v, wanted from %v to %v.", got.From, got.To, wanted.From, wanted.To)
+	}
+	got.From, got.To = wanted.From, wanted.To
+	if !reflect.DeepEqual(got, wanted) {
+		t.Errorf("Audit summary.\nWanted: %+v\nGot   : %+v", wanted, got)
+	}
+
+	// Without an end it goes on to the last entry.
+	if res, err = testdb.GetAuditSummary(day(12, 0), time.Time{}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = json.Unmarshal(res, &got); err != nil || got.Operations != 4 {
+		t.Errorf("Audit summary without an end has %d operations, wanted 4 (%v).", got.Operations, err)
+	}
+}
+
+func TestEpochMigration(t *testing.T) {
+	olddb, cleanup := newTestDB()
+	defer cleanup()
+
+	// Start from a version 2.9 database, that stored datetimes as text in
+	// the zone they were imported with.
+	stmt := `DROP TABLE history;
+                 CREATE TABLE history (
+                     user     TEXT,
+                     host     TEXT,
+                     command  TEXT,
+                     datetime DATETIME,
+                     source   TEXT,
+                     import_id INTEGER,
+                     profile  TEXT NOT NULL DEFAULT 'default',
+                     PRIMARY KEY (user, command, datetime)
+                 );
+                 INSERT INTO history(user, host, command, datetime) VALUES
+                     ("user1", "host1", "ls", "2015-10-12 12:00:40+03:00"),
+                     ("user1", "host1", "ls", "2015-10-12 09:00:40+00:00"),
+                     ("user1", "host1", "make", "2015-10-12 09:00:41.5+00:00"),
+                     ("user2", "host1", "ls", "2015-10-12 09:00:40+00:00"),
+                     ("user1", "host1", "ls", "2015-10-12 04:00:40-05:00");
+                 UPDATE admin SET value = '2.9' WHERE key LIKE 'version'`
+	if _, err := olddb.Exec(stmt); err != nil {
+		t.Fatal("Could not downgrade database: " + err.Error())
+	}
+	olddb.Close()
+	testdb, err := New()
+	if err != nil {
+		t.Fatal("Migration failed: " + err.Error())
+	}
+	defer testdb.Close()
+
+	rows, err := testdb.Query(`SELECT rowid, user, command, typeof(datetime), datetime FROM history ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for rows.Next() {
+		var id, dt int64
+		var user, command, typ string
+		if err = rows.Scan(&id, &user, &command, &typ, &dt); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %s %s %d", id, user, command, typ, dt))
+	}
+	rows.Close()
+	want := "1 user1 ls integer 1444640440\n3 user1 make integer 1444640441\n4 user2 ls integer 1444640440"
+	if strings.Join(got, "\n") != want {
+		t.Fatalf("Migrated history\nWanted: %s\nGot   : %s", want, strings.Join(got, "\n"))
+	}
+
+	// The same instant in yet another zone is a duplicate, a new one isn't.
+	entries := []byte(`user1 host1 2015-10-12T11:00:40+0200 ls
+user1 host1 2015-10-12T11:00:42+0200 ls
+`)
+	stats, err := testdb.Import(bufio.NewReader(bytes.NewReader(entries)), "", "")
+	if err != nil {
+		t.Fatal("Import failed: " + err.Error())
+	}
+	if stats.Added != 1 || stats.Duplicates != 1 {
+		t.Fatalf("Import after migration added %d and found %d duplicates, wanted 1 and 1.", stats.Added, stats.Duplicates)
+	}
+
+	conf.DisplayTZ = time.UTC
+	defer func() { conf.DisplayTZ = nil }()
+	res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 2, User: "user1", Host: "%", Command: "ls",
+		Format: conf.FORMAT_TIMESTAMP})
+	if err != nil {
+		t.Fatal("RunQuery failed: " + err.Error())
+	}
+	want = "2015-10-12 09:00:40: ls\n2015-10-12 09:00:42: ls"
+	if string(res) != want {
+		t.Fatalf("Query after migration\nWanted: %s\nGot   : %s", want, string(res))
+	}
+
+	res, err = testdb.RunQuery(conf.QueryParams{Type: conf.QUERY_ON_THIS_DAY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_COMMAND_LINE, Day: "2016-10-12"})
+	if err != nil {
+		t.Fatal("RunQuery failed: " + err.Error())
+	}
+	want = "2015 @ host1:\n1 ls\n4 ls\n3 make\n5 ls"
+	if string(res) != want {
+		t.Fatalf("On this day after migration\nWanted: %s\nGot   : %s", want, string(res))
+	}
+}
+
+func TestErrors(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	path := conf.Database
+
+	// A database of a newer bashistdb can't be migrated.
+	if _, err := testdb.Exec(`UPDATE admin SET value = '9.9' WHERE key LIKE 'version'`); err != nil {
+		t.Fatal(err.Error())
+	}
+	testdb.Close()
+	if db, err := Open(path, nil); !errors.Is(err, ErrNewerSchema) {
+		if err == nil {
+			db.Close()
+		}
+		t.Fatalf("Open of a newer schema should fail with ErrNewerSchema, got: %v", err)
+	}
+
+	// It may still be read, read-only.
+	rodb, err := Open(path, nil, ReadOnly())
+	if err != nil {
+		t.Fatal("Read-only Open failed: " + err.Error())
+	}
+	defer rodb.Close()
+	_, err = rodb.Import(bufio.NewReader(strings.NewReader("1 2015-10-12T12:00:40+0000 ls\n")), "user1", "host1")
+	if !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Import to a read-only database should fail with ErrReadOnly, got: %v", err)
+	}
+}
+
+// importCorpus returns n lines of bash history, one a second, cycling
+// through commands of many lengths.
+func importCorpus(n int) []byte {
+	commands := []string{"ls", "git status", "make -j8 test", "cd ~/src/github.com/andmarios/bashistdb",
+		"kubectl get pods --all-namespaces -o wide | grep -v Running", "vim database/writer.go",
+		`find . -name '*.go' -newer go.sum -exec grep -l "sqlite3" {} +`, "htop"}
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "%5d  %s %s\n", i+1, start.Add(time.Duration(i)*time.Second).Format(RFC3339alt), commands[i%len(commands)])
+	}
+	return buf.Bytes()
+}
+
+// TestInsertChunks imports a history with malformed lines and duplicates, then
+// again, inserting rows one at a time and insertRows at a time. Both must
+// keep the same rows, with the same IDs. Its export format lines alternate
+// users, so chunks of them can't share their user.
+func TestInsertChunks(t *testing.T) {
+	history := append(importCorpus(450), "not a history line\n"...)
+	history = append(history, importCorpus(1000)...)
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 300; i++ {
+		history = append(history, fmt.Sprintf("user%d host1 %s make\n", i%2+1, start.Add(time.Duration(i)*time.Second).Format(RFC3339alt))...)
+	}
+
+	imported := func(rows int) ([]Row, []ImportStats, string) {
+		defer func(n int) { insertRows = n }(insertRows)
+		insertRows = rows
+		testdb, cleanup := newTestDB()
+		defer cleanup()
+		var committed []Row
+		testdb.OnCommit(func(rows []Row) { committed = append(committed, rows...) })
+		var stats []ImportStats
+		for i := 0; i < 2; i++ {
+			s, err := testdb.Import(bufio.NewReader(bytes.NewReader(history)), "user1", "host1")
+			if err != nil {
+				t.Fatal("Import failed: ", err.Error())
+			}
+			s.DurationMs = 0
+			stats = append(stats, s)
+		}
+		res, err := testdb.RunQuery(conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%", Command: "%", Format: conf.FORMAT_EXPORT})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return committed, stats, string(res)
+	}
+
+	rows, stats, export := imported(1)
+	if len(rows) != 1300 || stats[0].Added != 1300 || stats[0].Duplicates != 450 || stats[1].Added != 0 {
+		t.Fatalf("Unexpected import of %d rows, stats %+v.", len(rows), stats)
+	}
+	chunkedRows, chunkedStats, chunkedExport := imported(insertRows)
+	if !reflect.DeepEqual(chunkedStats, stats) {
+		t.Errorf("Stats differ.\nWanted: %+v\nGot   : %+v", stats, chunkedStats)
+	}
+	if !reflect.DeepEqual(chunkedRows, rows) {
+		t.Errorf("Committed rows differ, %d one at a time and %d in chunks.", len(rows), len(chunkedRows))
+	}
+	if chunkedExport != export {
+		t.Error("Exported history differs.")
+	}
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	testdb, cleanup := newTestDB()
+	defer cleanup()
+	oldKey, newKey := []byte("old key"), []byte("new key")
+
+	// Nothing is encrypted yet, so rotation leaves the addresses as they are.
+	if _, err := testdb.Exec(`INSERT INTO connlog VALUES ('2015-10-12T12:00:40', '192.0.2.1')`); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := testdb.RotateEncryptionKey(oldKey, newKey); err != nil {
+		t.Fatal("RotateEncryptionKey failed: " + err.Error())
+	}
+	var remote string
+	if err := testdb.QueryRow(`SELECT remote FROM connlog`).Scan(&remote); err != nil || remote != "192.0.2.1" {
+		t.Errorf("Rotation without encrypted columns changed connlog to %q (%v).", remote, err)
+	}
+
+	for _, keys := range [][2][]byte{{nil, newKey}, {oldKey, nil}, {oldKey, oldKey}} {
+		if err := testdb.RotateEncryptionKey(keys[0], keys[1]); err == nil {
+			t.Errorf("RotateEncryptionKey(%q, %q) didn't fail.", keys[0], keys[1])
+		}
+	}
+
+	// Once a column is encrypted its values switch keys, all of them or none.
+	defer func(c []encryptedColumn) { encryptedColumns = c }(encryptedColumns)
+	encryptedColumns = []encryptedColumn{{"connlog", "remote"}}
+	sealed, err := encryptValue([]byte("192.0.2.1"), oldKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err = testdb.Exec(`UPDATE connlog SET remote = ?`, sealed); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err = testdb.RotateEncryptionKey(newKey, oldKey); err == nil {
+		t.Error("Rotation from a key that doesn't decrypt connlog didn't fail.")
+	}
+	if err = testdb.RotateEncryptionKey(oldKey, newKey); err != nil {
+		t.Fatal("RotateEncryptionKey failed: " + err.Error())
+	}
+	var v []byte
+	if err = testdb.QueryRow(`SELECT remote FROM connlog`).Scan(&v); err != nil {
+		t.Fatal(err.Error())
+	}
+	if plain, err := decryptValue(v, newKey); err != nil || string(plain) != "192.0.2.1" {
+		t.Errorf("Rotated connlog decrypts to %q (%v) with the new key.", plain, err)
+	}
+}
+
+// BenchmarkImport imports 10000 lines of history into a new database.
+func BenchmarkImport(b *testing.B) {
+	corpus := importCorpus(10000)
+	b.SetBytes(int64(len(corpus)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		testdb, cleanup := newTestDB()
+		b.StartTimer()
+		stats, err := testdb.Import(bufio.NewReader(bytes.NewReader(corpus)), "user", "host")
+		if err != nil || stats.Added != 10000 {
+			b.Fatalf("Import: %+v, %v", stats, err)
+		}
+		b.StopTimer()
+		cleanup()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !purego
+// +build !purego
+
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// This file has what depends on the SQLite driver, for the default build
+// with go-sqlite3 (cgo). driver_purego.go has the same for modernc.org/sqlite.
+
+// driverName is the sqlite3 driver with our SQL functions registered.
+const driverName = "sqlite3_bashistdb"
+
+// driverParams are DSN parameters the driver needs, so our databases are
+// the same whichever driver wrote them.
+const driverParams = ""
+
+func init() {
+	sql.Register(driverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("levenshtein", levenshtein, true)
+		},
+	})
+}
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED, that is
+// another connection holds a lock we need and we may try again.
+func isBusy(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && (e.Code == sqlite3.ErrBusy || e.Code == sqlite3.ErrLocked)
+}
+
+// isDuplicate reports whether err is because the row already exists.
+func isDuplicate(err error) bool {
+	e, ok := err.(sqlite3.Error)
+	return ok && e.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
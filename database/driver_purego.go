@@ -0,0 +1,76 @@
+//go:build purego
+// +build purego
+
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql/driver"
+	"errors"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// This file has what depends on the SQLite driver, for builds with the pure
+// Go modernc.org/sqlite (-tags purego), that cross-compile without cgo.
+
+// driverName is the sqlite driver, our SQL functions are registered to it.
+const driverName = "sqlite"
+
+// driverParams are DSN parameters the driver needs, so our databases are
+// the same whichever driver wrote them. By default modernc.org/sqlite
+// stores datetimes as time.Time.String does, which doesn't sort.
+const driverParams = "&_time_format=sqlite"
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction("levenshtein", 2,
+		func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+			return int64(levenshtein(text(args[0]), text(args[1]))), nil
+		})
+}
+
+// text returns the value of a TEXT argument of an SQL function.
+func text(v driver.Value) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// isBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED, that is
+// another connection holds a lock we need and we may try again.
+func isBusy(err error) bool {
+	var e *sqlite.Error
+	if !errors.As(err, &e) {
+		return false
+	}
+	// Codes are extended, the primary code is the low byte.
+	code := e.Code() & 0xff
+	return code == sqlite3.SQLITE_BUSY || code == sqlite3.SQLITE_LOCKED
+}
+
+// isDuplicate reports whether err is because the row already exists.
+func isDuplicate(err error) bool {
+	var e *sqlite.Error
+	return errors.As(err, &e) && e.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
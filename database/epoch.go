@@ -0,0 +1,46 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// History datetimes are stored as Unix time, the seconds since the epoch,
+// so the same instant is the same value whatever zone it was imported
+// with, and datetimes compare and sort as numbers. Query arguments are
+// compared to them as t.Unix().
+
+// epoch scans a history datetime into the time it points to, in local
+// time, as rows.Scan(epoch{&t}). Aggregates of datetimes, as max(datetime),
+// scan the same.
+type epoch struct{ t *time.Time }
+
+// Scan implements sql.Scanner.
+func (e epoch) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case int64:
+		*e.t = time.Unix(v, 0)
+	case nil:
+		*e.t = time.Time{}
+	default:
+		return fmt.Errorf("Could not scan datetime: %v", v)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// explain runs p and writes to w the SQL statements it ran, with their
+// parameters and SQLite's query plan, instead of its result.
+func (d Database) explain(p conf.QueryParams, w io.Writer) error {
+	p.Explain = false
+	d.explained = &bytes.Buffer{}
+	if err := d.StreamQuery(p, ioutil.Discard); err != nil {
+		return err
+	}
+	if d.explained.Len() == 0 {
+		d.explained.WriteString("No SQL, this query is answered without the database.")
+	}
+	_, err := w.Write(bytes.TrimSuffix(d.explained.Bytes(), []byte("\n")))
+	return err
+}
+
+// explainQuery writes query, its parameters and its plan to d's explain
+// buffer, if it has one. Parameters are quoted, as they are never part of
+// the SQL.
+func (d Database) explainQuery(query string, args []interface{}) {
+	if d.explained == nil {
+		return
+	}
+	out := d.explained
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	out.WriteString("SQL: " + strings.Join(strings.Fields(query), " ") + "\n")
+	for i, a := range args {
+		fmt.Fprintf(out, "  ?%d = %s\n", i+1, quoteArg(a))
+	}
+	rows, err := d.DB.QueryContext(d.context(), "EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		fmt.Fprintf(out, "Plan: %s\n", err)
+		return
+	}
+	defer rows.Close()
+	out.WriteString("Plan:\n")
+	cols, _ := rows.Columns()
+	for rows.Next() {
+		// The last column is the step, the others are ids.
+		values := make([]interface{}, len(cols))
+		for i := range values {
+			values[i] = new(interface{})
+		}
+		if err := rows.Scan(values...); err != nil || len(values) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "  %s\n", *values[len(values)-1].(*interface{}))
+	}
+}
+
+// quoteArg returns a, a query parameter, as it is shown by explain.
+func quoteArg(a interface{}) string {
+	switch v := a.(type) {
+	case string:
+		return fmt.Sprintf("%q", v)
+	case []byte:
+		return fmt.Sprintf("%q", v)
+	}
+	return fmt.Sprintf("%v", a)
+}
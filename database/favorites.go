@@ -0,0 +1,107 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// FavoriteCommand bookmarks command for user@host. Favoriting a command
+// again keeps the time it was first added.
+func (d Database) FavoriteCommand(user, host, command string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	_, err := d.Exec(`INSERT OR IGNORE INTO favorites(user, host, command, added_at, profile) VALUES(?, ?, ?, ?, ?)`,
+		user, host, command, now(), d.Profile())
+	return err
+}
+
+// UnfavoriteCommand removes command from the favorites of user@host.
+func (d Database) UnfavoriteCommand(user, host, command string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	_, err := d.Exec(`DELETE FROM favorites WHERE user = ? AND host = ? AND command = ? AND profile = ?`,
+		user, host, command, d.Profile())
+	return err
+}
+
+// GetFavorites returns the favorites of users and hosts matching user and
+// host (they may contain wildcards), one per line, oldest first.
+func (d Database) GetFavorites(user, host string) ([]byte, error) {
+	favorites, err := d.favorites(user, host)
+	if err != nil {
+		return []byte{}, err
+	}
+	var out bytes.Buffer
+	for i, f := range favorites {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s %s@%s %s", f.Datetime.Format(RFC3339alt), f.User, f.Host, f.Command))
+	}
+	return out.Bytes(), nil
+}
+
+// favorites returns the favorites of users and hosts matching user and
+// host, oldest first. Datetime is the time they were added.
+func (d Database) favorites(user, host string) ([]Row, error) {
+	rows, err := d.Query(`SELECT user, host, command, added_at FROM favorites
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY added_at ASC, command ASC`,
+		user, host, d.Profile())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var favorites []Row
+	for rows.Next() {
+		var f Row
+		rows.Scan(&f.User, &f.Host, &f.Command, &f.Datetime)
+		favorites = append(favorites, f)
+	}
+	return favorites, rows.Err()
+}
+
+// writeFavorites writes the favorites within qp's search criteria to w in
+// restore format, to be written after the query's result so they end up
+// last (easiest to reach) in the restored bash history. If newline is set,
+// they are separated from what w has already got.
+func (d Database) writeFavorites(w io.Writer, newline bool, qp conf.QueryParams) error {
+	favorites, err := d.favorites(qp.User, qp.Host)
+	if err != nil {
+		return err
+	}
+	if newline && len(favorites) > 0 {
+		if _, err = w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	r := result.NewStream(conf.FORMAT_BASH_HISTORY, w)
+	for _, f := range favorites {
+		r.AddRow(0, f.User, f.Host, f.Command, f.Datetime)
+	}
+	return r.Close()
+}
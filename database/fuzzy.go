@@ -0,0 +1,176 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// levenshtein returns the case insensitive edit distance between a and b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// Limits for FuzzyQuery. We only rank the most recent fuzzyCandidates rows
+// that pass the trigram pre-filter, built from up to fuzzyTrigrams trigrams
+// of the search term.
+const (
+	fuzzyCandidates = 5000
+	fuzzyTrigrams   = 16
+	fuzzyResults    = 10
+)
+
+// maxDistance is the largest edit distance from term that still counts as
+// a fuzzy match.
+func maxDistance(term string) int {
+	if n := utf8.RuneCountInString(term) / 2; n > 2 {
+		return n
+	}
+	return 2
+}
+
+// FuzzyQuery returns the commands closest to the search term. Candidates
+// are the commands that share a trigram (or a short word) with the term;
+// they are ranked by edit distance and those too far from the term are
+// dropped. For every command it returns its latest run.
+func (d Database) FuzzyQuery(qp conf.QueryParams) ([]byte, error) {
+	term := strings.Trim(qp.Command, "%")
+	fragments := fuzzyFragments(term)
+	if len(fragments) == 0 {
+		return []byte(fmt.Sprintf("No fuzzy matches for '%s'.", term)), nil
+	}
+
+	var filter []string
+	args := []interface{}{term, qp.User, qp.Host, d.Profile()}
+	for _, f := range fragments {
+		filter = append(filter, `command LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(f)+"%")
+	}
+	args = append(args, fuzzyCandidates, maxDistance(term), fuzzyResults)
+
+	rows, err := d.Query(`SELECT rowid, user, host, command, max(datetime), levenshtein(command, ?) AS distance FROM
+                                  (SELECT rowid, * FROM history
+                                      WHERE user LIKE ? AND host LIKE ? AND profile = ? AND (`+strings.Join(filter, " OR ")+`)
+                                      ORDER BY datetime DESC LIMIT ?)
+                               GROUP BY command HAVING distance <= ?
+                               ORDER BY distance ASC, command ASC LIMIT ?`,
+		args...)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	res := result.New(qp.Format)
+	found := false
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		var row, distance int
+		rows.Scan(&row, &user, &host, &command, epoch{&t}, &distance)
+		res.AddRow(row, user, host, command, t)
+		found = true
+	}
+	if !found {
+		return []byte(fmt.Sprintf("No fuzzy matches for '%s'.", term)), nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString(fmt.Sprintf("Closest (fuzzy) matches for '%s':\n", term))
+	out.Write(res.Formatted())
+	return out.Bytes(), nil
+}
+
+// fuzzyFallback reports whether an empty result of qp should be retried
+// with FuzzyQuery. Formats meant for machines don't get the extra notice,
+// and searches with exclusions don't either, FuzzyQuery ignores them.
+func fuzzyFallback(qp conf.QueryParams) bool {
+	if qp.Regex || strings.Trim(qp.Command, "%") == "" {
+		return false
+	}
+	if qp.ExcludeCommand != "" || qp.ExcludeUser != "" || qp.ExcludeHost != "" {
+		return false
+	}
+	switch qp.Format {
+	case conf.FORMAT_JSON, conf.FORMAT_NDJSON, conf.FORMAT_ROWS, conf.FORMAT_BASH_HISTORY, conf.FORMAT_EXPORT:
+		return false
+	}
+	return true
+}
+
+// fuzzyFragments returns the trigrams of the words in term. Words shorter
+// than three characters are returned whole.
+func fuzzyFragments(term string) []string {
+	seen := make(map[string]bool)
+	var fragments []string
+	add := func(s string) {
+		if !seen[s] && len(fragments) < fuzzyTrigrams {
+			seen[s] = true
+			fragments = append(fragments, s)
+		}
+	}
+	for _, w := range strings.Fields(term) {
+		if utf8.RuneCountInString(w) < 3 {
+			add(w)
+			continue
+		}
+		r := []rune(w)
+		for i := 0; i+3 <= len(r); i++ {
+			add(string(r[i : i+3]))
+		}
+	}
+	return fragments
+}
+
+// escapeLike escapes LIKE's wildcards in s, for use with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
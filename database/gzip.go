@@ -0,0 +1,45 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+)
+
+// gzipMagic is the header every gzip stream starts with.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Decompress returns a reader with the uncompressed contents of r if r is
+// gzip compressed or force is set. Else it returns r as is, so its result may
+// always be passed to AddFromBuffer.
+func Decompress(r *bufio.Reader, force bool) (*bufio.Reader, error) {
+	if !force {
+		// A short or empty input can't be gzip, Peek's error doesn't matter.
+		header, _ := r.Peek(len(gzipMagic))
+		if !bytes.Equal(header, gzipMagic) {
+			return r, nil
+		}
+	}
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(z), nil
+}
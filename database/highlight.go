@@ -0,0 +1,85 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// highlight sets res to mark the search term of qp in restore format
+// commands, as qp.Highlight says. Without a search term there is nothing
+// to mark.
+func highlight(qp conf.QueryParams, res *result.Result) error {
+	if qp.Highlight == "" || qp.Format != conf.FORMAT_BASH_HISTORY {
+		return nil
+	}
+	parts := strings.Split(qp.Highlight, "%s")
+	if len(parts) != 2 || strings.Contains(qp.Highlight, "\n") {
+		return errors.New("Invalid highlight, it needs a single %s and no newlines: " + qp.Highlight)
+	}
+	re, err := termRegexp(qp)
+	if err != nil || re == nil {
+		return err
+	}
+	res.Highlight(re, parts[0], parts[1])
+	return nil
+}
+
+// termRegexp returns a regular expression for what the search term of qp
+// matches in a command line, nil if it matches everything. LIKE patterns
+// are converted, as SQLite's LIKE they are case insensitive unless
+// qp.CaseSensitive is set.
+func termRegexp(qp conf.QueryParams) (*regexp.Regexp, error) {
+	if qp.Regex {
+		if qp.Command == "" {
+			return nil, nil
+		}
+		return regexp.Compile(qp.Command)
+	}
+	term := strings.Trim(qp.Command, "%")
+	if term == "" {
+		return nil, nil
+	}
+	var re bytes.Buffer
+	if !qp.CaseSensitive {
+		re.WriteString("(?i)")
+	}
+	escaped := false
+	for _, c := range term {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			re.WriteString(".*?")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return regexp.Compile(re.String())
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// newImport starts an import batch for user@host and returns its id.
+func (d Database) newImport(user, host string, start time.Time) (int, error) {
+	res, err := d.Exec(`INSERT INTO imports(user, host, started_at, rows_added) VALUES(?, ?, ?, 0)`,
+		user, host, start)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// finishImport records how many rows batch added. Batches that added none
+// can't be undone, so they are removed. It doesn't use d's context, so the
+// batch is kept right even if the import was canceled.
+func (d Database) finishImport(batch int) error {
+	var added int
+	if err := d.DB.QueryRow(`SELECT count(*) FROM history WHERE import_id = ?`, batch).Scan(&added); err != nil {
+		return err
+	}
+	if added == 0 {
+		_, err := d.DB.Exec(`DELETE FROM imports WHERE id = ?`, batch)
+		return err
+	}
+	_, err := d.DB.Exec(`UPDATE imports SET rows_added = ? WHERE id = ?`, added, batch)
+	return err
+}
+
+// importHashWindow is how long the hashes of imported streams are kept, to
+// notice the same stream imported again.
+const importHashWindow = 24 * time.Hour
+
+// seenImport reports whether an import of a stream with hash sum finished
+// within importHashWindow before at, and records this one. The hashes are
+// kept in the admin table, as import:HASH keys with the time they were
+// seen, older ones are dropped.
+func (d Database) seenImport(sum []byte, at time.Time) (bool, error) {
+	const layout = "2006-01-02 15:04:05"
+	cutoff := at.Add(-importHashWindow).UTC().Format(layout)
+	if _, err := d.DB.Exec(`DELETE FROM admin WHERE key LIKE 'import:%' AND value < ?`, cutoff); err != nil {
+		return false, err
+	}
+	key := "import:" + hex.EncodeToString(sum)
+	var n int
+	if err := d.DB.QueryRow(`SELECT count(*) FROM admin WHERE key = ?`, key).Scan(&n); err != nil {
+		return false, err
+	}
+	_, err := d.DB.Exec(`INSERT OR REPLACE INTO admin(key, value) VALUES(?, ?)`, key, at.UTC().Format(layout))
+	return n > 0, err
+}
+
+// importOfProfile is the SQL condition for import batches that added rows
+// to a profile, it takes the profile as argument.
+const importOfProfile = `id IN (SELECT import_id FROM history WHERE profile = ?)`
+
+// UndoImport deletes the rows added by import batch qp.Kappa, or by the most
+// recent batch of qp.User@qp.Host if qp.Kappa is 0. Only batches of users
+// and hosts matching qp.User and qp.Host may be undone, and only
+// of d's profile.
+func (d Database) UndoImport(qp conf.QueryParams) ([]byte, error) {
+	if d.readOnly {
+		return []byte{}, ErrReadOnly
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return []byte{}, err
+	}
+	defer tx.Rollback()
+
+	var batch int
+	switch qp.Kappa {
+	case 0:
+		err = tx.QueryRow(`SELECT id FROM imports WHERE user LIKE ? AND host LIKE ? AND `+importOfProfile+`
+                                   ORDER BY id DESC LIMIT 1`,
+			qp.User, qp.Host, d.Profile()).Scan(&batch)
+		if err == sql.ErrNoRows {
+			return []byte("No imports to undo."), nil
+		}
+	default:
+		err = tx.QueryRow(`SELECT id FROM imports WHERE id = ? AND user LIKE ? AND host LIKE ? AND `+importOfProfile,
+			qp.Kappa, qp.User, qp.Host, d.Profile()).Scan(&batch)
+		if err == sql.ErrNoRows {
+			return []byte{}, fmt.Errorf("No import with id %d.", qp.Kappa)
+		}
+	}
+	if err != nil {
+		return []byte{}, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM history WHERE import_id = ?`, batch)
+	if err != nil {
+		return []byte{}, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return []byte{}, err
+	}
+	if _, err = tx.Exec(`DELETE FROM imports WHERE id = ?`, batch); err != nil {
+		return []byte{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return []byte{}, err
+	}
+	return []byte(fmt.Sprintf("Undid import %d, deleted %d commands.", batch, deleted)), nil
+}
+
+// ListImports returns the qp.Kappa most recent import batches of users and
+// hosts matching qp.User and qp.Host, one per line.
+func (d Database) ListImports(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT id, user, host, started_at, rows_added FROM imports
+                               WHERE user LIKE ? AND host LIKE ? AND `+importOfProfile+`
+                               ORDER BY id DESC LIMIT ?`,
+		qp.User, qp.Host, d.Profile(), qp.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var id, added int
+		var user, host string
+		var started time.Time
+		if err = rows.Scan(&id, &user, &host, &started, &added); err != nil {
+			return []byte{}, err
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%d | %s@%s | %s | %d commands",
+			id, user, host, started.Format(time.RFC3339), added))
+	}
+	if out.Len() == 0 {
+		return []byte("No imports found."), nil
+	}
+	return out.Bytes(), nil
+}
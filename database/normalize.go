@@ -0,0 +1,190 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// errNoNormalize is returned by NormalizeExisting when the database doesn't
+// normalize names.
+var errNoNormalize = errors.New("Names aren't normalized, there is no normal spelling to give them.")
+
+// A nameNormalizer gives the users and hosts machines report one spelling,
+// so Web01, web01. and web01.local, if .local is stripped, are all web01.
+type nameNormalizer struct {
+	suffixes []string // domains stripped from hosts, lowercase with a leading dot, longest first
+}
+
+// newNameNormalizer returns a nameNormalizer that strips the domains in
+// suffixes from hosts. Their case and leading dots don't matter.
+func newNameNormalizer(suffixes []string) *nameNormalizer {
+	n := &nameNormalizer{}
+	for _, s := range suffixes {
+		s = strings.Trim(strings.ToLower(strings.TrimSpace(s)), ".")
+		if s != "" {
+			n.suffixes = append(n.suffixes, "."+s)
+		}
+	}
+	sort.Slice(n.suffixes, func(i, j int) bool { return len(n.suffixes[i]) > len(n.suffixes[j]) })
+	return n
+}
+
+// host lowercases h and drops its trailing dots and the first of the
+// suffixes it ends with. A nil nameNormalizer returns h as is.
+func (n *nameNormalizer) host(h string) string {
+	if n == nil {
+		return h
+	}
+	h = strings.TrimRight(strings.ToLower(h), ".")
+	for _, s := range n.suffixes {
+		if len(h) > len(s) && strings.HasSuffix(h, s) {
+			return h[:len(h)-len(s)]
+		}
+	}
+	return h
+}
+
+// user lowercases u. A nil nameNormalizer returns u as is.
+func (n *nameNormalizer) user(u string) string {
+	if n == nil {
+		return u
+	}
+	return strings.ToLower(u)
+}
+
+// hostPattern is host for the LIKE patterns queries take. Domains are
+// only stripped from patterns without wildcards, %.local is meant to
+// match the domain, not every host.
+func (n *nameNormalizer) hostPattern(p string) string {
+	if n == nil || strings.ContainsAny(p, "%_") {
+		return strings.ToLower(p)
+	}
+	return n.host(p)
+}
+
+// NormalUser returns user as d stores it, lowercase if d normalizes names,
+// see NormalizeNames.
+func (d Database) NormalUser(user string) string {
+	return d.names.user(user)
+}
+
+// NormalHost returns host as d stores it, see NormalizeNames.
+func (d Database) NormalHost(host string) string {
+	return d.names.host(host)
+}
+
+// NormalParams returns p with its user and host patterns normalized like
+// the names d stores, so they keep matching them.
+func (d Database) NormalParams(p conf.QueryParams) conf.QueryParams {
+	if d.names == nil {
+		return p
+	}
+	p.User, p.ExcludeUser = d.names.user(p.User), d.names.user(p.ExcludeUser)
+	p.Host, p.ExcludeHost = d.names.hostPattern(p.Host), d.names.hostPattern(p.ExcludeHost)
+	return p
+}
+
+// NormalizeExisting gives the users and hosts stored before d normalized
+// names their normal spelling. Commands that collide with ones of it are
+// merged, as RenameHost does. It returns how many commands were updated
+// and how many were merged, or would be if dryRun is set.
+func (d Database) NormalizeExisting(dryRun bool) (updated, merged int, err error) {
+	if d.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if d.names == nil {
+		return 0, 0, errNoNormalize
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	for _, column := range []string{"user", "host"} {
+		normal := d.names.user
+		if column == "host" {
+			normal = d.names.host
+		}
+		names, err := distinctNames(tx, column)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, name := range names {
+			to := normal(name)
+			if to == name {
+				continue
+			}
+			n, m, err := renameTx(tx, column, name, to)
+			if err != nil {
+				return 0, 0, err
+			}
+			updated, merged = updated+n, merged+m
+		}
+	}
+	if dryRun {
+		return updated, merged, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	log.Info.Printf("Normalized users and hosts, updated %d commands and merged %d.\n", updated, merged)
+	return updated, merged, nil
+}
+
+// normalizeExisting is NormalizeExisting for queries.
+func (d Database) normalizeExisting(p conf.QueryParams) ([]byte, error) {
+	updated, merged, err := d.NormalizeExisting(p.DryRun)
+	if err != nil {
+		return []byte{}, err
+	}
+	if p.DryRun {
+		return []byte(fmt.Sprintf("Normalizing users and hosts would update %d commands and merge %d.", updated, merged)), nil
+	}
+	return []byte(fmt.Sprintf("Normalized users and hosts, updated %d commands and merged %d.", updated, merged)), nil
+}
+
+// distinctNames returns the names in column, user or host, of the
+// renamedTables.
+func distinctNames(tx *sql.Tx, column string) ([]string, error) {
+	selects := make([]string, len(renamedTables))
+	for i, table := range renamedTables {
+		selects[i] = `SELECT ` + column + ` FROM ` + table + ` WHERE ` + column + ` IS NOT NULL`
+	}
+	rows, err := tx.Query(strings.Join(selects, " UNION "))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// An Option changes how Open opens a database.
+type Option func(*options)
+
+type options struct {
+	readOnly          bool
+	wal               bool
+	busyTimeout       time.Duration
+	keyIncludesHost   bool
+	rejectsFile       string
+	queryLogRetention time.Duration
+	maxCommandBytes   int
+	slowQuery         time.Duration
+	names             *nameNormalizer
+	perm              os.FileMode
+}
+
+// ReadOnly opens the database read-only. It must exist and it is never
+// migrated. Methods that write return ErrReadOnly.
+func ReadOnly() Option {
+	return func(o *options) { o.readOnly = true }
+}
+
+// WAL switches the database to write-ahead logging, so readers don't wait
+// for writers. The setting is stored in the database file.
+func WAL() Option {
+	return func(o *options) { o.wal = true }
+}
+
+// defaultBusyTimeout is the busy timeout when BusyTimeout isn't given.
+const defaultBusyTimeout = 5 * time.Second
+
+// BusyTimeout sets how long SQLite waits for a lock before it gives up
+// with SQLITE_BUSY. Writes are retried on top of it.
+func BusyTimeout(d time.Duration) Option {
+	return func(o *options) { o.busyTimeout = d }
+}
+
+// KeyIncludesHost makes host part of the history's primary key. An existing
+// database is rebuilt with the new key, which can't be undone.
+func KeyIncludesHost() Option {
+	return func(o *options) { o.keyIncludesHost = true }
+}
+
+// RejectsFile sets the file where AddFromBuffer appends lines it couldn't
+// decode. An empty name disables it.
+func RejectsFile(name string) Option {
+	return func(o *options) { o.rejectsFile = name }
+}
+
+// MaxCommandBytes sets the longest command, in bytes, AddFromBuffer
+// imports. Lines with longer commands are rejected. 0 is no limit.
+func MaxCommandBytes(n int) Option {
+	return func(o *options) { o.maxCommandBytes = n }
+}
+
+// QueryLogRetention sets how long LogQuery entries are kept, older ones are
+// dropped as new ones are written. 0 keeps them forever.
+func QueryLogRetention(d time.Duration) Option {
+	return func(o *options) { o.queryLogRetention = d }
+}
+
+// SlowQuery sets how long a statement, or a batch of imported rows, may
+// take before it is logged as slow, at warning level. 0 logs none. It is
+// defaultSlowQuery when SlowQuery isn't given.
+func SlowQuery(d time.Duration) Option {
+	return func(o *options) { o.slowQuery = d }
+}
+
+// NormalizeNames lowercases the users and hosts of imported commands and
+// strips the domains in stripDomains from hosts, with their trailing dots.
+// Query patterns are normalized the same way, so they keep matching.
+// Names stored before stay as they are, see NormalizeExisting.
+func NormalizeNames(stripDomains []string) Option {
+	return func(o *options) { o.names = newNameNormalizer(stripDomains) }
+}
+
+// defaultPerm are the permissions of new database files when FilePerm
+// isn't given.
+const defaultPerm os.FileMode = 0600
+
+// FilePerm sets the permissions of the database file if Open creates it.
+// The directories it creates get them too, with x where they have r.
+// SQLite gives its journals the permissions of the database file.
+func FilePerm(perm os.FileMode) Option {
+	return func(o *options) { o.perm = perm }
+}
+
+// dsn returns the connection parameters for o, to append to a DSN that
+// already has a query string.
+func (o options) dsn() string {
+	params := driverParams
+	if o.wal && !o.readOnly {
+		params += "&_journal_mode=WAL"
+	}
+	// Drivers don't agree on the default, so we always set it.
+	busyTimeout := o.busyTimeout
+	if busyTimeout <= 0 {
+		busyTimeout = defaultBusyTimeout
+	}
+	params += fmt.Sprintf("&_busy_timeout=%d", busyTimeout/time.Millisecond)
+	return params
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// A LineParser decodes a history line (without its newline) to the command
+// and the time it was run. AddFromBuffer uses it for the lines of a format
+// other than bashistdb's export format.
+type LineParser interface {
+	Parse(line string) (cmd string, t time.Time, ok bool)
+}
+
+// Parsers are the LineParsers for the import formats of the configuration
+// package.
+var Parsers = map[string]LineParser{
+	conf.IMPORT_BASH:   BashParser{},
+	conf.IMPORT_SYSLOG: SyslogParser{},
+}
+
+// ParserFor returns the LineParser of the import format and whether there is
+// one. If layout is set, bash history timestamps are decoded with it instead
+// of detecting theirs.
+func ParserFor(format, layout string) (LineParser, bool) {
+	p, ok := Parsers[format]
+	if b, isBash := p.(BashParser); isBash && layout != "" {
+		b.Layout = layout
+		p = b
+	}
+	return p, ok
+}
+
+// WithParser returns a copy of d whose AddFromBuffer decodes lines with p.
+func (d Database) WithParser(p LineParser) Database {
+	d.parser = p
+	return d
+}
+
+// ForUser returns a copy of d whose AddFromBuffer stores every line as
+// user's, even lines of the export format, which have their own user.
+func (d Database) ForUser(user string) Database {
+	d.forUser = user
+	return d
+}
+
+// ForHost is ForUser for the host of the lines.
+func (d Database) ForHost(host string) Database {
+	d.forHost = host
+	return d
+}
+
+// WithSource returns a copy of d that labels the rows it imports with
+// source, so they can be told apart from other batches.
+func (d Database) WithSource(source string) Database {
+	d.source = source
+	return d
+}
+
+// lineParser returns the parser for an import: d's, or BashParser if it has
+// none. BashParsers detect the layout of each import's timestamps once, so
+// every import gets its own.
+func (d Database) lineParser() LineParser {
+	switch p := d.parser.(type) {
+	case nil:
+		return BashParser{}.stream()
+	case BashParser:
+		return p.stream()
+	}
+	return d.parser
+}
+
+// trimLineNumber returns the DATETIME COMMAND part of a history output line
+// of the following format:
+//
+//	LINENUM DATETIME COMMAND
+//
+// LINENUM may follow spaces and have a * after it, for edited lines. It is
+// the regular expression `^ *[0-9]+\*? +(.*)`, without its cost for every
+// line of an import.
+func trimLineNumber(line string) (string, bool) {
+	i := 0
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	digits := i
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i == digits {
+		return "", false
+	}
+	if i < len(line) && line[i] == '*' {
+		i++
+	}
+	spaces := i
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	if i == spaces {
+		return "", false
+	}
+	return line[i:], true
+}
+
+// A timeLayout is a layout of bash history timestamps: its name, as
+// HISTTIMEFORMAT spells it, and Go's layout, empty for Unix time.
+type timeLayout struct {
+	name, layout string
+}
+
+// timeLayouts are the layouts BashParser detects, in the order it tries
+// them. Times without a zone are local.
+var timeLayouts = []timeLayout{
+	{"%FT%T%z", RFC3339alt}, // what bashistdb -init sets
+	{"%FT%T%:z", time.RFC3339},
+	{"%F %T", "2006-01-02 15:04:05"},
+	{"%s", ""},
+}
+
+// parse decodes the timestamp s starts with and returns the command after it.
+func (l timeLayout) parse(s string) (string, time.Time, bool) {
+	// The timestamp ends at the space after its n words, or with s.
+	n := strings.Count(l.layout, " ") + 1
+	end, spaces := len(s), 0
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' {
+			if spaces++; spaces == n {
+				end = i
+				break
+			}
+		}
+	}
+	if spaces < n-1 {
+		return "", time.Time{}, false
+	}
+	stamp := s[:end]
+	var t time.Time
+	if l.layout == "" {
+		if strings.Trim(stamp, "0123456789") != "" {
+			return "", time.Time{}, false
+		}
+		sec, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil {
+			return "", time.Time{}, false
+		}
+		// Other layouts have four digit years, times past 9999 can't be
+		// written as RFC3339 or JSON.
+		if t = time.Unix(sec, 0); t.Year() > 9999 {
+			return "", time.Time{}, false
+		}
+	} else {
+		var err error
+		if t, err = time.ParseInLocation(l.layout, stamp, time.Local); err != nil {
+			return "", time.Time{}, false
+		}
+	}
+	if end == len(s) {
+		return "", t, true
+	}
+	return strings.TrimLeft(s[end+1:], " "), t, true
+}
+
+// BashParser decodes the output of bash's history command. HISTTIMEFORMAT
+// may be any of timeLayouts, "%FT%T%z " is what bashistdb -init sets.
+type BashParser struct {
+	Layout string // Go time layout of the timestamps, instead of timeLayouts
+}
+
+// layouts returns the layouts p tries.
+func (p BashParser) layouts() []timeLayout {
+	if p.Layout != "" {
+		return []timeLayout{{p.Layout, p.Layout}}
+	}
+	return timeLayouts
+}
+
+// Parse implements LineParser. It tries all layouts for every line.
+func (p BashParser) Parse(line string) (string, time.Time, bool) {
+	if p.Layout == "" {
+		t, cmd, ok := parseHistoryLine(line)
+		return cmd, t, ok
+	}
+	cmd, t, _, ok := parseBash(line, p.layouts())
+	return cmd, t, ok
+}
+
+// parseHistoryLine decodes a line of bash's history output whose timestamp
+// is in any of timeLayouts. Lines may come from the network: it must never
+// panic, and the command it returns is always the end of line.
+func parseHistoryLine(line string) (t time.Time, cmd string, ok bool) {
+	cmd, t, _, ok = parseBash(line, timeLayouts)
+	return t, cmd, ok
+}
+
+// stream returns a parser for the lines of one import, that sticks to the
+// layout of the first line it decodes.
+func (p BashParser) stream() *bashStream {
+	return &bashStream{layouts: p.layouts()}
+}
+
+// parseBash decodes line with the first of layouts that can, and returns it.
+// A line with a newline in it is two lines, none of them is decoded: its
+// command would be cut at the newline silently.
+func parseBash(line string, layouts []timeLayout) (string, time.Time, *timeLayout, bool) {
+	if strings.Contains(line, "\n") {
+		return "", time.Time{}, nil, false
+	}
+	rest, ok := trimLineNumber(line)
+	if !ok {
+		return "", time.Time{}, nil, false
+	}
+	for i := range layouts {
+		if cmd, t, ok := layouts[i].parse(rest); ok {
+			return cmd, t, &layouts[i], true
+		}
+	}
+	return "", time.Time{}, nil, false
+}
+
+// A bashStream is a BashParser for one import. Trying every layout for
+// every line is slow, it detects the layout from the first line that has
+// one and decodes the rest with it.
+type bashStream struct {
+	layouts []timeLayout
+	found   *timeLayout
+}
+
+// Parse implements LineParser.
+func (s *bashStream) Parse(line string) (string, time.Time, bool) {
+	if s.found != nil {
+		cmd, t, _, ok := parseBash(line, []timeLayout{*s.found})
+		return cmd, t, ok
+	}
+	cmd, t, found, ok := parseBash(line, s.layouts)
+	s.found = found
+	return cmd, t, ok
+}
+
+// layout returns the name of the layout s detected, empty if none.
+func (s *bashStream) layout() string {
+	if s.found == nil {
+		return ""
+	}
+	return s.found.name
+}
+
+// Syslog lines have a timestamp, the host and the tag of the program that
+// logged the message (e.g. bash[1234]), followed by the message.
+var (
+	parseSyslogISO = regexp.MustCompile(`^([0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9:.]+(?:Z|[+-][0-9]{2}:?[0-9]{2})) +\S+ +[^\s\[:]+(?:\[[0-9]+\])?: (.*)`)
+	parseSyslogBSD = regexp.MustCompile(`^([A-Z][a-z]{2} +[0-9]{1,2} [0-9]{2}:[0-9]{2}:[0-9]{2}) +\S+ +[^\s\[:]+(?:\[[0-9]+\])?: (.*)`)
+)
+
+// SyslogParser decodes syslog lines whose message is the command, as a
+// shell audit hook logs them. Timestamps may be ISO 8601, as journalctl's
+// short-iso output or rsyslog's file format, or traditional (Oct 12
+// 12:00:40). Traditional ones have no year nor zone, we take them as local
+// time in the last twelve months.
+type SyslogParser struct{}
+
+// Parse implements LineParser.
+func (SyslogParser) Parse(line string) (string, time.Time, bool) {
+	if args := parseSyslogISO.FindStringSubmatch(line); len(args) == 3 {
+		for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05Z0700"} {
+			if t, err := time.Parse(layout, args[1]); err == nil {
+				return args[2], t, true
+			}
+		}
+		return "", time.Time{}, false
+	}
+	args := parseSyslogBSD.FindStringSubmatch(line)
+	if len(args) != 3 {
+		return "", time.Time{}, false
+	}
+	s, err := time.Parse(time.Stamp, args[1])
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	n := now()
+	t := time.Date(n.Year(), s.Month(), s.Day(), s.Hour(), s.Minute(), s.Second(), 0, time.Local)
+	if t.After(n.AddDate(0, 0, 1)) { // a day of slack for clock skew
+		t = t.AddDate(-1, 0, 0)
+	}
+	return args[2], t, true
+}
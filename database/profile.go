@@ -0,0 +1,86 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// DefaultProfile is the profile of history imported without one, and of
+// all history from before profiles.
+const DefaultProfile = conf.DEFAULT_PROFILE
+
+// WithProfile returns a copy of d whose queries see only the history of
+// profile, and whose imports add to it. Profiles keep histories that
+// shouldn't be mixed, e.g. work and personal, in one database. An empty
+// profile is DefaultProfile.
+func (d Database) WithProfile(profile string) Database {
+	d.profile = profile
+	return d
+}
+
+// Profile returns the profile d's queries and imports are limited to.
+func (d Database) Profile() string {
+	if d.profile == "" {
+		return DefaultProfile
+	}
+	return d.profile
+}
+
+// profile returns the row's profile, DefaultProfile if it has none.
+func (r Row) profile() string {
+	if r.Profile == "" {
+		return DefaultProfile
+	}
+	return r.Profile
+}
+
+// ListProfiles returns the profiles with history of users and hosts that
+// match p's, with how many commands each has. It is the one query that
+// isn't limited to d's profile.
+func (d Database) ListProfiles(p conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT profile, count(*) FROM history WHERE user LIKE ? AND host LIKE ?
+                               GROUP BY profile ORDER BY profile`, p.User, p.Host)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var profile string
+		var count int
+		if err = rows.Scan(&profile, &count); err != nil {
+			return []byte{}, err
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s | %d commands", profile, count))
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if out.Len() == 0 {
+		return []byte("No history in any profile."), nil
+	}
+	return out.Bytes(), nil
+}
@@ -24,9 +24,15 @@ package database
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -35,66 +41,431 @@ import (
 	"github.com/andmarios/bashistdb/result"
 )
 
-// TopK returns the k most frequent command lines in history
+// checkKappa returns K of a top-k or last-k query. K must be positive, a
+// K larger than conf.MaxK is clamped to it, so a client can't make us dump
+// the whole history.
+func checkKappa(k int) (int, error) {
+	if k <= 0 {
+		return 0, fmt.Errorf("Invalid K: %d, it must be positive.", k)
+	}
+	if conf.MaxK > 0 && k > conf.MaxK {
+		log.Debug.Printf("K %d is larger than the maximum, using %d.\n", k, conf.MaxK)
+		return conf.MaxK, nil
+	}
+	return k, nil
+}
+
+// checkOffset returns an error if offset, how many results a query skips,
+// is negative. Clients check it, but we can't trust them to.
+func checkOffset(offset int) error {
+	if offset < 0 {
+		return fmt.Errorf("Invalid offset: %d, it must not be negative.", offset)
+	}
+	return nil
+}
+
+// TopK returns the k most frequent command lines in history, of those run
+// since qp.DateFrom if it is set.
 func (d Database) TopK(qp conf.QueryParams) ([]byte, error) {
-	rows, err := d.Query(`SELECT command, count(*) as count FROM history
-                               WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
-                               GROUP BY command ORDER BY count DESC LIMIT ?`,
-		qp.User, qp.Host, qp.Command, qp.Kappa)
+	var err error
+	if qp.Kappa, err = checkKappa(qp.Kappa); err != nil {
+		return []byte{}, err
+	}
+	if err = checkOffset(qp.Offset); err != nil {
+		return []byte{}, err
+	}
+	query := `SELECT command, count(*) as count FROM history
+                  WHERE user LIKE ? AND host LIKE ? AND profile = ? AND ` + commandMatch(qp) + ` AND ` + excludeMatch
+	args := append([]interface{}{qp.User, qp.Host, d.Profile(), commandPattern(qp)}, excludeArgs(qp)...)
+	if !qp.DateFrom.IsZero() {
+		query += ` AND datetime >= ?`
+		args = append(args, qp.DateFrom.Unix())
+	}
+	// Ties are ordered by command, so pages don't overlap.
+	query += ` GROUP BY command ORDER BY count ` + sqlOrder(qp) + `, command ASC LIMIT ? OFFSET ?`
+	args = append(args, qp.Kappa, qp.Offset)
+	rows, err := d.Query(query, args...)
 	if err != nil {
 		return []byte{}, err
 	}
 	defer rows.Close()
 
+	type counted struct {
+		command string
+		count   int
+	}
+	var top []counted
+	max := 0
+	for rows.Next() {
+		var c counted
+		rows.Scan(&c.command, &c.count)
+		top = append(top, c)
+		if c.count > max {
+			max = c.count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+
 	res := result.New("")
+	res.CountWidth(max)
+	for _, c := range top {
+		res.AddCountRow(c.count, c.command)
+	}
+	return res.Formatted(), nil
+}
+
+// sqlOrder returns the SQL direction of qp's sort order, DESC unless it
+// asks for SORT_ASC.
+func sqlOrder(qp conf.QueryParams) string {
+	if qp.SortOrder == conf.SORT_ASC {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// excludeMatch is the SQL condition for rows whose command, user and host
+// don't match qp.ExcludeCommand, qp.ExcludeUser and qp.ExcludeHost, it takes
+// excludeArgs(qp) as arguments. Empty patterns exclude nothing.
+const excludeMatch = `(? = '' OR command NOT LIKE ?) AND (? = '' OR user NOT LIKE ?) AND (? = '' OR host NOT LIKE ?)`
+
+// excludeArgs returns the arguments of excludeMatch for qp.
+func excludeArgs(qp conf.QueryParams) []interface{} {
+	return []interface{}{qp.ExcludeCommand, qp.ExcludeCommand, qp.ExcludeUser, qp.ExcludeUser,
+		qp.ExcludeHost, qp.ExcludeHost}
+}
+
+// commandMatch is the SQL condition for commands that match qp.Command, it
+// takes commandPattern(qp) as argument. LIKE ignores the case of ASCII
+// letters, so for qp.CaseSensitive we use GLOB. SQLite's case_sensitive_like
+// pragma would change LIKE for every query of the connection.
+func commandMatch(qp conf.QueryParams) string {
+	if qp.CaseSensitive {
+		return "command GLOB ?"
+	}
+	return `command LIKE ? ESCAPE '\'`
+}
+
+// commandPattern returns qp.Command, a LIKE pattern, as commandMatch takes
+// it.
+func commandPattern(qp conf.QueryParams) string {
+	if !qp.CaseSensitive {
+		return qp.Command
+	}
+	return likeToGlob(qp.Command)
+}
+
+// likeToGlob converts a LIKE pattern, with \ as escape character, to a GLOB
+// pattern that matches the same text, but case sensitively.
+func likeToGlob(pattern string) string {
+	var glob bytes.Buffer
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			if c == '*' || c == '?' || c == '[' {
+				glob.WriteString("[" + string(c) + "]")
+			} else {
+				glob.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			glob.WriteByte('*')
+		case c == '_':
+			glob.WriteByte('?')
+		case c == '*' || c == '?' || c == '[':
+			glob.WriteString("[" + string(c) + "]")
+		default:
+			glob.WriteRune(c)
+		}
+	}
+	return glob.String()
+}
+
+// sourceMatch is the SQL condition for rows of qp.Source, it takes it as
+// argument twice. An empty source matches every row.
+const sourceMatch = `(? = '' OR source = ?)`
+
+// now is the reference time for queries relative to the present. Tests
+// set it to get stable results.
+var now = time.Now
+
+// GetTopKLast24h is TopK for the commands run in the last 24 hours.
+func (d Database) GetTopKLast24h(qp conf.QueryParams) ([]byte, error) {
+	qp.DateFrom = now().Add(-24 * time.Hour)
+	return d.TopK(qp)
+}
+
+// GetTopKLastWeek is TopK for the commands run in the last 7 days.
+func (d Database) GetTopKLastWeek(qp conf.QueryParams) ([]byte, error) {
+	qp.DateFrom = now().AddDate(0, 0, -7)
+	return d.TopK(qp)
+}
+
+// A CommandCount is a command line, how many times it was run and its score
+// in rankings that weight each use, like TopFrecent.
+type CommandCount struct {
+	Command string
+	Count   int
+	Score   float64
+}
+
+// TopKDecay returns the k command lines in history with the highest
+// recency-weighted score. Every time a command was run adds
+// 2^(-age/qp.HalfLife) to its score, so recent commands rank higher than
+// ones used a lot long ago. Along with the score it returns the plain count.
+func (d Database) TopKDecay(qp conf.QueryParams) ([]byte, error) {
+	ranked, err := d.rankByAge(qp, qp.Kappa, func(age time.Duration) float64 {
+		return math.Exp2(-float64(age) / float64(qp.HalfLife))
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	return formatScores(ranked), nil
+}
+
+// TopFrecent returns the k command lines in history with the highest
+// frecency, like a browser's URL bar. Every time a command was run adds
+// 1/(days+1) to its score, where days is how long ago it was.
+func (d Database) TopFrecent(qp conf.QueryParams, k int) ([]CommandCount, error) {
+	return d.rankByAge(qp, k, func(age time.Duration) float64 {
+		return 1 / (age.Hours()/24 + 1)
+	})
+}
+
+// frecent returns TopFrecent for qp.Kappa, formatted like TopKDecay.
+func (d Database) frecent(qp conf.QueryParams) ([]byte, error) {
+	ranked, err := d.TopFrecent(qp, qp.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	return formatScores(ranked), nil
+}
+
+// rankByAge returns the k command lines in history with the highest score,
+// skipping qp.Offset. Every time a command was run adds weight(age) to its
+// score. Ties are sorted by command.
+func (d Database) rankByAge(qp conf.QueryParams, k int, weight func(age time.Duration) float64) ([]CommandCount, error) {
+	var err error
+	if k, err = checkKappa(k); err != nil {
+		return nil, err
+	}
+	if err = checkOffset(qp.Offset); err != nil {
+		return nil, err
+	}
+	args := append([]interface{}{qp.User, qp.Host, d.Profile(), commandPattern(qp)}, excludeArgs(qp)...)
+	rows, err := d.Query(`SELECT command, datetime FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND `+commandMatch(qp)+` AND `+excludeMatch,
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	commands := make(map[string]*CommandCount)
+	t0 := now()
 	for rows.Next() {
 		var command string
-		var count int
-		rows.Scan(&command, &count)
-		res.AddCountRow(count, command)
+		var t time.Time
+		rows.Scan(&command, epoch{&t})
+		r := commands[command]
+		if r == nil {
+			r = &CommandCount{Command: command}
+			commands[command] = r
+		}
+		// Commands from the future (clock skew) count as run now.
+		age := t0.Sub(t)
+		if age < 0 {
+			age = 0
+		}
+		r.Score += weight(age)
+		r.Count++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sorted := make([]CommandCount, 0, len(commands))
+	for _, r := range commands {
+		sorted = append(sorted, *r)
+	}
+	asc := qp.SortOrder == conf.SORT_ASC
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Score != sorted[j].Score {
+			return (sorted[i].Score > sorted[j].Score) != asc
+		}
+		return sorted[i].Command < sorted[j].Command
+	})
+	if qp.Offset < len(sorted) {
+		sorted = sorted[qp.Offset:]
+	} else {
+		sorted = nil
+	}
+	if k < len(sorted) {
+		sorted = sorted[:k]
+	}
+	return sorted, nil
+}
+
+// formatScores returns one "score | count | command" line per ranked command.
+func formatScores(ranked []CommandCount) []byte {
+	var out bytes.Buffer
+	sw, cw := 0, 0
+	for _, r := range ranked {
+		if w := len(fmt.Sprintf("%.2f", r.Score)); w > sw {
+			sw = w
+		}
+		if d := digits(r.Count); d > cw {
+			cw = d
+		}
 	}
-	return res.Formatted(), err
+	for i, r := range ranked {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%*.2f | %*d | %s", sw, r.Score, cw, r.Count, r.Command))
+	}
+	return out.Bytes()
 }
 
-// LastK returns the k most recent command lines in history
+// LastK returns the k most recent command lines in history, or the k oldest
+// with SORT_ASC.
 func (d Database) LastK(qp conf.QueryParams) ([]byte, error) {
-	var rows *sql.Rows
+	res := result.New(qp.Format)
+	if err := d.lastK(qp, res); err != nil {
+		return []byte{}, err
+	}
+	return res.Formatted(), nil
+}
+
+// lastK adds the k most recent command lines in history to res.
+func (d Database) lastK(qp conf.QueryParams, res *result.Result) error {
+	var rows *Rows
 	var err error
-	switch qp.Unique {
-	case true:
+	if qp.Kappa, err = checkKappa(qp.Kappa); err != nil {
+		return err
+	}
+	if err = checkOffset(qp.Offset); err != nil {
+		return err
+	}
+	// We take the newest k, or the oldest with SORT_ASC, and return them
+	// oldest first.
+	order := sqlOrder(qp)
+	args := append([]interface{}{qp.Source, qp.Source, qp.User, qp.Host, d.Profile(), commandPattern(qp)}, excludeArgs(qp)...)
+	args = append(args, qp.Kappa, qp.Offset)
+	switch {
+	case qp.Distinct:
 		rows, err = d.Query(`SELECT * FROM
-                                      (SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
+                                      (SELECT rowid, user, host, command, max(datetime) AS latest, count(*) FROM history
+                                         WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? AND `+commandMatch(qp)+` AND `+excludeMatch+`
                                          GROUP BY command
-                                         ORDER BY datetime DESC LIMIT ?)
+                                         ORDER BY latest `+order+` LIMIT ? OFFSET ?)
+                                      ORDER BY latest ASC`,
+			args...)
+	case qp.Unique:
+		rows, err = d.Query(`SELECT * FROM
+                                      (SELECT rowid, user, host, command, datetime FROM history
+                                         WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? AND `+commandMatch(qp)+` AND `+excludeMatch+`
+                                         GROUP BY command
+                                         ORDER BY datetime `+order+` LIMIT ? OFFSET ?)
                                       ORDER BY datetime ASC`,
-			qp.User, qp.Host, qp.Command, qp.Kappa)
+			args...)
 	default:
 		rows, err = d.Query(`SELECT * FROM
-                                      (SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'
-                                         ORDER BY datetime DESC LIMIT ?)
+                                      (SELECT rowid, user, host, command, datetime FROM history
+                                         WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? AND `+commandMatch(qp)+` AND `+excludeMatch+`
+                                         ORDER BY datetime `+order+` LIMIT ? OFFSET ?)
                                    ORDER BY datetime ASC`,
-			qp.User, qp.Host, qp.Command, qp.Kappa)
+			args...)
 	}
 	if err != nil {
-		return []byte{}, err
+		return err
 	}
 	defer rows.Close()
+	if qp.Distinct {
+		return d.addDistinctRows(rows, qp, nil, nil, res)
+	}
 
-	res := result.New(qp.Format)
+	notes := d.annotations(qp.User, qp.Host)
 	for rows.Next() {
 		var user, host, command string
 		var t time.Time
 		var row int
-		rows.Scan(&row, &user, &host, &command, &t)
-		res.AddRow(row, user, host, command, t)
+		rows.Scan(&row, &user, &host, &command, epoch{&t})
+		res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
 	}
-	return res.Formatted(), nil
+	return rows.Err()
+}
+
+// addDistinctRows adds the rows of a distinct query, where every row is a
+// command with rowid, user and host of its latest run, the latest run's
+// datetime and the number of runs, to res. If regex isn't nil, only the
+// commands it matches that page takes are added.
+func (d Database) addDistinctRows(rows *Rows, qp conf.QueryParams, regex *regexp.Regexp, page *pager, res *result.Result) error {
+	notes := d.annotations(qp.User, qp.Host)
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		var row, count int
+		rows.Scan(&row, &user, &host, &command, epoch{&t}, &count)
+		if regex != nil && (!regex.MatchString(command) || !page.take()) {
+			continue
+		}
+		res.AddCountedRow(row, user, host, command, t, notes.note(user, host, command), count)
+	}
+	return rows.Err()
+}
+
+// A pager pages the rows of a query: it skips offset rows and takes up to
+// limit rows after them, all if limit is 0.
+type pager struct {
+	offset, limit int
+	taken         int
+}
+
+// sql returns the LIMIT and OFFSET of the page for SQLite, where a
+// negative LIMIT means no limit.
+func (p *pager) sql() (int, int) {
+	if p.limit <= 0 {
+		return -1, p.offset
+	}
+	return p.limit, p.offset
+}
+
+// take reports whether the next row is in the page, for rows we filter
+// ourselves. A nil pager takes every row.
+func (p *pager) take() bool {
+	switch {
+	case p == nil:
+		return true
+	case p.offset > 0:
+		p.offset--
+		return false
+	case p.limit > 0 && p.taken >= p.limit:
+		return false
+	}
+	p.taken++
+	return true
 }
 
 // DefaultQuery returns history within the search criteria in the format requested
 func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
+	res := result.New(qp.Format)
+	if err := d.defaultQuery(qp, res); err != nil {
+		return []byte{}, err
+	}
+	// Return the result without the newline at the end.
+	return res.Formatted(), nil
+}
+
+// defaultQuery adds history within the search criteria to res.
+func (d Database) defaultQuery(qp conf.QueryParams, res *result.Result) error {
+	if err := checkOffset(qp.Offset); err != nil {
+		return err
+	}
 	// SQLite's regexp extension is problematic; most systems don't have it, loading
 	// it is extremely error prone (almost impossible to get right), even we manage
 	// to load it, it doesn't seem to work with our queries. Thus I use go's regexp
@@ -103,82 +474,331 @@ func (d Database) DefaultQuery(qp conf.QueryParams) ([]byte, error) {
 	// to anything but the DefaultQuery
 	var regex *regexp.Regexp
 	var err error
-	commandQuery := "AND command LIKE ?" // This is used for normal searches. Fast.
+	commandQuery := "AND " + commandMatch(qp) // This is used for normal searches. Fast.
 	if qp.Regex {
 		regex, err = regexp.Compile(qp.Command)
 		if err != nil {
-			return []byte{}, err
+			return err
 		}
 		commandQuery = "" // For PCRE we do the search, so we want everything. Slow.
 	}
+	// Searches return everything unless they have a limit. For PCRE we
+	// page the matches ourselves.
+	page := &pager{offset: qp.Offset, limit: qp.Kappa}
+	args := []interface{}{qp.Source, qp.Source, qp.User, qp.Host, d.Profile()}
+	limit, offset := -1, 0
+	if !qp.Regex {
+		args = append(args, commandPattern(qp))
+		limit, offset = page.sql()
+		page = nil
+	}
+	args = append(args, excludeArgs(qp)...)
+	args = append(args, limit, offset)
 
-	var rows *sql.Rows
-	switch qp.Unique {
-	case true:
-		rows, err = d.Query(`SELECT rowid, * FROM history
-                                        WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'
-                                        GROUP BY command ORDER BY DATETIME ASC`,
-			qp.User, qp.Host, qp.Command)
+	var rows *Rows
+	switch {
+	case qp.Distinct:
+		rows, err = d.Query(`SELECT rowid, user, host, command, max(datetime) AS latest, count(*) FROM history
+                                        WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? `+commandQuery+` AND `+excludeMatch+`
+                                        GROUP BY command ORDER BY latest ASC LIMIT ? OFFSET ?`,
+			args...)
+	case qp.Unique:
+		rows, err = d.Query(`SELECT rowid, user, host, command, datetime FROM history
+                                        WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? `+commandQuery+` AND `+excludeMatch+`
+                                        GROUP BY command ORDER BY DATETIME ASC LIMIT ? OFFSET ?`,
+			args...)
 	default:
-		rows, err = d.Query(`SELECT rowid, * FROM history
-                                         WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'`,
-			qp.User, qp.Host, qp.Command)
+		rows, err = d.Query(`SELECT rowid, user, host, command, datetime FROM history
+                                         WHERE `+sourceMatch+` AND user LIKE ? AND host LIKE ? AND profile = ? `+commandQuery+` AND `+excludeMatch+`
+                                         LIMIT ? OFFSET ?`,
+			args...)
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
+	if qp.Distinct {
+		return d.addDistinctRows(rows, qp, regex, page, res)
+	}
 
-	res := result.New(qp.Format)
+	notes := d.annotations(qp.User, qp.Host)
 	for rows.Next() {
 		var user, host, command string
 		var t time.Time
 		var row int
-		rows.Scan(&row, &user, &host, &command, &t)
+		rows.Scan(&row, &user, &host, &command, epoch{&t})
 		switch qp.Regex {
 		case true:
-			if regex.MatchString(command) {
-				res.AddRow(row, user, host, command, t)
+			if regex.MatchString(command) && page.take() {
+				res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
 			}
 		default:
-			res.AddRow(row, user, host, command, t)
+			res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
 		}
 	}
-	// Return the result without the newline at the end.
-	return res.Formatted(), nil
+	return rows.Err()
 }
 
-// RunQuery is a wrapper around various queries.
+// RunQuery is a wrapper around various queries. It returns the result of
+// StreamQuery.
 func (d Database) RunQuery(p conf.QueryParams) ([]byte, error) {
+	var out bytes.Buffer
+	if err := d.StreamQuery(p, &out); err != nil {
+		return []byte{}, err
+	}
+	return out.Bytes(), nil
+}
+
+// StreamQuery runs a query and writes its result to w. Searches and last-k
+// queries, which may return most of the history, are written row by row as
+// they are read, so they are never kept in memory. Other queries return
+// short results, they are written once complete. If p.Explain is set, it
+// writes the SQL the query runs instead, see explain.
+func (d Database) StreamQuery(p conf.QueryParams, w io.Writer) error {
+	p = d.NormalParams(p)
+	if p.Explain {
+		return d.explain(p, w)
+	}
+	if p.IncludeFavorites && p.Format == conf.FORMAT_BASH_HISTORY {
+		p.IncludeFavorites = false
+		cw := &countWriter{Writer: w}
+		if err := d.StreamQuery(p, cw); err != nil {
+			return err
+		}
+		return d.writeFavorites(w, cw.n > 0, p)
+	}
+
+	var res *result.Result
+	var err error
+	switch {
+	case p.Type == conf.QUERY && !p.Fuzzy:
+		res = result.NewStream(p.Format, w)
+		if err = highlight(p, res); err != nil {
+			return err
+		}
+		anonymize(p, res)
+		err = d.defaultQuery(p, res)
+		if err == nil && !res.Written() && fuzzyFallback(p) {
+			var fuzzy []byte
+			if fuzzy, err = d.FuzzyQuery(p); err == nil {
+				_, err = w.Write(append([]byte("No exact matches. "), fuzzy...))
+				return err
+			}
+		}
+	case p.Type == conf.QUERY_LASTK:
+		res = result.NewStream(p.Format, w)
+		if err = highlight(p, res); err != nil {
+			return err
+		}
+		anonymize(p, res)
+		err = d.lastK(p, res)
+	default:
+		var out []byte
+		if out, err = d.bufferedQuery(p); err != nil {
+			return err
+		}
+		_, err = w.Write(out)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	return res.Close()
+}
+
+// A countWriter counts the bytes written through it.
+type countWriter struct {
+	io.Writer
+	n int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += n
+	return n, err
+}
+
+// bufferedQuery runs the queries that StreamQuery doesn't stream.
+func (d Database) bufferedQuery(p conf.QueryParams) ([]byte, error) {
 	switch p.Type {
 	case conf.QUERY:
-		return d.DefaultQuery(p)
-	case conf.QUERY_LASTK:
-		return d.LastK(p)
+		return d.FuzzyQuery(p)
 	case conf.QUERY_TOPK:
+		if p.HalfLife > 0 {
+			return d.TopKDecay(p)
+		}
 		return d.TopK(p)
+	case conf.QUERY_TOPK_24H:
+		return d.GetTopKLast24h(p)
+	case conf.QUERY_FRECENT:
+		return d.frecent(p)
+	case conf.QUERY_TOPK_WEEK:
+		return d.GetTopKLastWeek(p)
 	case conf.QUERY_USERS:
 		return d.Users(p)
+	case conf.QUERY_BY_SOURCE:
+		return d.BySource(p)
 	case conf.QUERY_DEMO:
 		return d.Demo(p)
 	case conf.QUERY_ROW:
 		return d.ReturnRow(p)
+	case conf.QUERY_TAG:
+		return d.GetByTag(p.Tag, p)
+	case conf.QUERY_TAGS:
+		tags, err := d.ListTags(p.User, p.Host)
+		if err != nil {
+			return []byte{}, err
+		}
+		return []byte(strings.Join(tags, "\n")), nil
+	case conf.TAG:
+		if err := d.TagCommand(p.User, p.Host, p.Command, p.Tag); err != nil {
+			return []byte{}, err
+		}
+		return []byte("Tag saved."), nil
+	case conf.QUERY_FAVORITES:
+		return d.GetFavorites(p.User, p.Host)
+	case conf.FAVORITE:
+		if err := d.FavoriteCommand(p.User, p.Host, p.Command); err != nil {
+			return []byte{}, err
+		}
+		return []byte("Favorite saved."), nil
+	case conf.UNFAVORITE:
+		if err := d.UnfavoriteCommand(p.User, p.Host, p.Command); err != nil {
+			return []byte{}, err
+		}
+		return []byte("Favorite removed."), nil
+	case conf.QUERY_ANNOTATIONS:
+		return d.GetAnnotations(p.User, p.Host)
+	case conf.ANNOTATE:
+		if err := d.AnnotateCommand(p.User, p.Host, p.Command, p.Note); err != nil {
+			return []byte{}, err
+		}
+		return []byte("Annotation saved."), nil
 	case conf.DELETE:
 		return d.DeleteRows(p)
+	case conf.UNDO_IMPORT:
+		return d.UndoImport(p)
+	case conf.ARCHIVE:
+		return d.Archive(p)
+	case conf.RENAME_HOST, conf.RENAME_USER:
+		return d.Rename(p)
+	case conf.NORMALIZE_EXISTING:
+		return d.normalizeExisting(p)
+	case conf.QUERY_IMPORTS:
+		return d.ListImports(p)
+	case conf.QUERY_QUERYLOG:
+		return d.QueryLog(p)
+	case conf.QUERY_AUDIT_LOG:
+		return d.GetAuditLog(p.DateFrom, p.Kappa)
+	case conf.QUERY_AUDIT_SUMMARY:
+		return d.GetAuditSummary(p.DateFrom, p.DateTo)
 	case conf.QUERY_CONTENT:
 		return d.ContentQuery(p)
+	case conf.QUERY_AFTER:
+		return d.GetCommandAfter(p.Command, p, p.Window)
+	case conf.QUERY_BEFORE:
+		return d.GetCommandBefore(p.Command, p, p.Window)
+	case conf.QUERY_ON_THIS_DAY:
+		return d.OnThisDay(p)
+	case conf.QUERY_CHAINS:
+		return d.GetCommandChains(p.NGram, p)
+	case conf.QUERY_SUGGEST:
+		commands, err := d.Suggest(p.User, p.Host, p.Command, p.Kappa)
+		if err != nil {
+			return []byte{}, err
+		}
+		return []byte(strings.Join(commands, "\n")), nil
+	case conf.QUERY_STATUS:
+		return d.Status()
+	case conf.QUERY_CHECK:
+		return d.Check()
+	case conf.QUERY_INFO:
+		return d.Info(p)
+	case conf.QUERY_AUDIT:
+		rules, err := AuditRules(p)
+		if err != nil {
+			return []byte{}, err
+		}
+		return d.Audit(p, rules)
+	case conf.QUERY_BACKGROUND_STATS:
+		return d.GetBackgroundCommandStats(p)
+	case conf.QUERY_SUDO_STATS:
+		return d.GetSudoStats(p)
+	case conf.QUERY_PIPELINES:
+		return d.GetCommandsWithPipe(p)
+	case conf.QUERY_REDIRECTIONS:
+		return d.GetCommandsWithRedirection(p)
+	case conf.QUERY_RECENT_HOSTS:
+		return d.GetRecentHosts(p.DateFrom)
+	case conf.QUERY_RECENT_USERS:
+		return d.GetRecentUsers(p.DateFrom)
+	case conf.QUERY_INACTIVE_USERS:
+		return d.GetInactiveUsers(p.DateFrom, p.Format)
+	case conf.QUERY_PROFILES:
+		return d.ListProfiles(p)
+	case conf.QUERY_CD_STATS:
+		return d.GetDirectoryChangeStats(p)
+	case conf.QUERY_EDITOR_STATS:
+		return d.GetEditorUsage(nil, p)
+	case conf.QUERY_GIT_STATS:
+		return d.GetGitStats(p)
+	case conf.QUERY_COMMON_PREFIXES:
+		return d.GetAbruptStops(p, p.PrefixLen)
+	case conf.QUERY_RECURRING:
+		return d.GetRecurringCommands(p, p.MinOccurrences)
+	case conf.QUERY_ALIASES:
+		return d.GetStashableCommands(p, p.MinOccurrences)
+	case conf.QUERY_TREND:
+		return d.Trend(p, p.Bucket)
+	case conf.QUERY_ENV_USAGE:
+		return d.GetEnvVariableUsage(p)
+	case conf.QUERY_SESSIONS:
+		return d.SessionsQuery(p)
+	case conf.QUERY_SESSION_SHOW:
+		return d.SessionShow(p)
 	}
 
 	return []byte{}, errors.New("Unknown query type.")
 }
 
+// noSource is how BySource shows commands imported without a source.
+const noSource = "(no source)"
+
+// BySource returns how many commands within the search criteria were
+// imported with each source, most first.
+func (d Database) BySource(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT ifnull(source, ''), count(*) FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'
+                               GROUP BY source`,
+		qp.User, qp.Host, d.Profile(), qp.Command)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var source string
+		var count int
+		rows.Scan(&source, &count)
+		if source == "" {
+			source = noSource
+		}
+		counts[source] += count
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	return topCounts(counts, 0), nil
+}
+
 // Users returns unique user@host pairs from the database.
 func (d Database) Users(qp conf.QueryParams) (res []byte, e error) {
 	var result bytes.Buffer
 	result.WriteString(fmt.Sprintf("Unique user-hosts pairs:"))
 	rows, e := d.Query(`SELECT distinct(user), host FROM history
-                               WHERE user LIKE ? AND host LIKE ? AND command LIKE ? ESCAPE '\'`,
-		qp.User, qp.Host, qp.Command)
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'`,
+		qp.User, qp.Host, d.Profile(), qp.Command)
 	if e != nil {
 		return result.Bytes(), e
 	}
@@ -198,25 +818,25 @@ func (d Database) Demo(qp conf.QueryParams) (res []byte, e error) {
 	var result bytes.Buffer
 
 	var numUsers int
-	err := d.QueryRow("SELECT count(*) FROM (SELECT distinct(user), host FROM history)").Scan(&numUsers)
+	err := d.QueryRow("SELECT count(*) FROM (SELECT distinct(user), host FROM history WHERE profile = ?)", d.Profile()).Scan(&numUsers)
 	if err != nil {
 		return result.Bytes(), err
 	}
 
 	var numHosts int
-	err = d.QueryRow("SELECT count(distinct(host)) FROM history").Scan(&numHosts)
+	err = d.QueryRow("SELECT count(distinct(host)) FROM history WHERE profile = ?", d.Profile()).Scan(&numHosts)
 	if err != nil {
 		return result.Bytes(), err
 	}
 
 	var numLines int
-	err = d.QueryRow("SELECT count(command) FROM history").Scan(&numLines)
+	err = d.QueryRow("SELECT count(command) FROM history WHERE profile = ?", d.Profile()).Scan(&numLines)
 	if err != nil {
 		return result.Bytes(), err
 	}
 
 	var numUniqueLines int
-	err = d.QueryRow("SELECT count(distinct(command)) FROM history").Scan(&numUniqueLines)
+	err = d.QueryRow("SELECT count(distinct(command)) FROM history WHERE profile = ?", d.Profile()).Scan(&numUniqueLines)
 	if err != nil {
 		return result.Bytes(), err
 	}
@@ -248,7 +868,7 @@ func (d Database) Demo(qp conf.QueryParams) (res []byte, e error) {
 // It is useful to pipe to bash.
 func (d Database) ReturnRow(qp conf.QueryParams) ([]byte, error) {
 	var command string
-	err := d.QueryRow("SELECT command FROM history WHERE rowid = ?", qp.Kappa).Scan(&command)
+	err := d.QueryRow("SELECT command FROM history WHERE rowid = ? AND profile = ?", qp.Kappa, d.Profile()).Scan(&command)
 	if err != nil {
 		return []byte{}, err
 	}
@@ -257,18 +877,21 @@ func (d Database) ReturnRow(qp conf.QueryParams) ([]byte, error) {
 
 // DeleteRows deletes a range of rows.
 func (d Database) DeleteRows(qp conf.QueryParams) ([]byte, error) {
+	if d.readOnly {
+		return []byte{}, ErrReadOnly
+	}
 	tx, err := d.Begin()
 	defer tx.Rollback()
 	if err != nil {
 		return []byte{}, err
 	}
-	stmt, err := tx.Prepare(`DELETE FROM history WHERE rowid=?`)
+	stmt, err := tx.Prepare(`DELETE FROM history WHERE rowid = ? AND profile = ?`)
 	if err != nil {
 		return []byte{}, err
 	}
 
 	for i := len(qp.Rows) - 1; i >= 0; i-- {
-		_, err = stmt.Exec(qp.Rows[i])
+		_, err = stmt.Exec(qp.Rows[i], d.Profile())
 		if err != nil {
 			return []byte{}, err
 		}
@@ -288,7 +911,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	// Using Goland regexp library. Check DefaultQuery() for more info.
 	var regex *regexp.Regexp
 	var err error
-	commandQuery := "AND command LIKE ?" // This is used for normal searches. Fast.
+	commandQuery := "AND " + commandMatch(qp) // This is used for normal searches. Fast.
 	if qp.Regex {
 		regex, err = regexp.Compile(qp.Command)
 		if err != nil {
@@ -298,10 +921,10 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	}
 
 	// Stage 1: find matches and get an array with their datetime
-	var rows *sql.Rows
+	var rows *Rows
 	rows, err = d.Query(`SELECT datetime, command FROM history
-                                         WHERE user LIKE ? AND host LIKE ? `+commandQuery+` ESCAPE '\'`,
-		qp.User, qp.Host, qp.Command)
+                                         WHERE user LIKE ? AND host LIKE ? AND profile = ? `+commandQuery,
+		qp.User, qp.Host, d.Profile(), commandPattern(qp))
 
 	if err != nil {
 		return nil, err
@@ -312,7 +935,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	for rows.Next() {
 		var t time.Time
 		var command string
-		rows.Scan(&t, &command)
+		rows.Scan(epoch{&t}, &command)
 		switch qp.Regex {
 		case true:
 			if regex.MatchString(command) {
@@ -330,10 +953,10 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		// Before query also includes the current command, thus is always run.
 		rows, err = d.Query(`SELECT rowid, datetime FROM
                                       (SELECT rowid, datetime FROM history
-	                                     WHERE datetime <= ? AND user LIKE ? AND host LIKE ? ESCAPE '\'
+	                                     WHERE datetime <= ? AND user LIKE ? AND host LIKE ? ESCAPE '\' AND profile = ?
                                          ORDER BY datetime DESC LIMIT ?)
                                       ORDER BY datetime ASC`,
-			v, qp.User, qp.Host, qp.BeforeContent+1) // Here we include current query to before
+			v.Unix(), qp.User, qp.Host, d.Profile(), qp.BeforeContent+1) // Here we include current query to before
 		if err != nil {
 			return nil, err
 		}
@@ -341,15 +964,15 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		for rows.Next() {
 			var row int
 			var datetime time.Time
-			rows.Scan(&row, &datetime)
+			rows.Scan(&row, epoch{&datetime})
 			content = append(content, row)
 		}
 		// After runs only if needed.
 		if qp.AfterContent > 0 {
 			rows, err = d.Query(`SELECT rowid, datetime FROM history
-	                                         WHERE datetime > ? AND user LIKE ? AND host LIKE ? ESCAPE '\'
+	                                         WHERE datetime > ? AND user LIKE ? AND host LIKE ? ESCAPE '\' AND profile = ?
                                              ORDER BY datetime ASC LIMIT ?`,
-				v, qp.User, qp.Host, qp.AfterContent)
+				v.Unix(), qp.User, qp.Host, d.Profile(), qp.AfterContent)
 			if err != nil {
 				return nil, err
 			}
@@ -357,7 +980,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 			for rows.Next() {
 				var row int
 				var datetime time.Time
-				rows.Scan(&row, &datetime)
+				rows.Scan(&row, epoch{&datetime})
 				content = append(content, row)
 			}
 		}
@@ -380,6 +1003,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	}
 
 	var out bytes.Buffer
+	notes := d.annotations(qp.User, qp.Host)
 
 	// Stage 4: get the tuples for each set's rowids and add them formatted to the result
 	for i := 0; i < len(hitsContent); i++ {
@@ -387,7 +1011,7 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 		for _, v := range hitsContent[i] {
 			rowids = append(rowids, strconv.Itoa(v))
 		}
-		rows, err = d.Query(`SELECT rowid, * FROM history
+		rows, err = d.Query(`SELECT rowid, user, host, command, datetime FROM history
                                   WHERE rowid IN (` + strings.Join(rowids, ",") + `)
                                   ORDER BY datetime ASC`)
 		if err != nil {
@@ -400,8 +1024,8 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 			var user, host, command string
 			var t time.Time
 			var row int
-			rows.Scan(&row, &user, &host, &command, &t)
-			res.AddRow(row, user, host, command, t)
+			rows.Scan(&row, &user, &host, &command, epoch{&t})
+			res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
 		}
 		out.Write(res.Formatted())
 		if i < len(hitsContent)-1 {
@@ -410,3 +1034,1000 @@ func (d Database) ContentQuery(qp conf.QueryParams) ([]byte, error) {
 	}
 	return out.Bytes(), nil
 }
+
+// GetCommandAfter returns the commands that were run right after command by
+// the same user at the same host, within windowSec seconds, along with how
+// many times each one was seen. Think of it as "what do I usually run after
+// git commit?"
+func (d Database) GetCommandAfter(command string, qp conf.QueryParams, windowSec int) ([]byte, error) {
+	return d.commandNeighbours(command, qp, windowSec, true)
+}
+
+// GetCommandBefore is like GetCommandAfter but returns the commands that
+// were run right before command.
+func (d Database) GetCommandBefore(command string, qp conf.QueryParams, windowSec int) ([]byte, error) {
+	return d.commandNeighbours(command, qp, windowSec, false)
+}
+
+// commandNeighbours does the work for GetCommandAfter (after is true) and
+// GetCommandBefore. It works on 3 stages:
+// 1. find the occurrences of command and get their user, host and datetime
+// 2. for each occurrence, get the next (or previous) command of its user@host
+// 3. keep the neighbours that fall within the window and count them
+func (d Database) commandNeighbours(command string, qp conf.QueryParams, windowSec int, after bool) ([]byte, error) {
+	type hit struct {
+		user, host string
+		t          time.Time
+	}
+
+	// Stage 1: find occurrences
+	rows, err := d.Query(`SELECT user, host, datetime FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'`,
+		qp.User, qp.Host, d.Profile(), command)
+	if err != nil {
+		return []byte{}, err
+	}
+	var hits []hit
+	for rows.Next() {
+		var h hit
+		rows.Scan(&h.user, &h.host, epoch{&h.t})
+		hits = append(hits, h)
+	}
+	rows.Close()
+
+	// Stage 2: find neighbours
+	neighbourQuery := `SELECT command, datetime FROM history
+                                WHERE user = ? AND host = ? AND profile = ? AND datetime > ?
+                                ORDER BY datetime ASC LIMIT 1`
+	if !after {
+		neighbourQuery = `SELECT command, datetime FROM history
+                                WHERE user = ? AND host = ? AND profile = ? AND datetime < ?
+                                ORDER BY datetime DESC LIMIT 1`
+	}
+	window := time.Duration(windowSec) * time.Second
+	counts := make(map[string]int)
+	for _, h := range hits {
+		var neighbour string
+		var t time.Time
+		err = d.QueryRow(neighbourQuery, h.user, h.host, d.Profile(), h.t.Unix()).Scan(&neighbour, epoch{&t})
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return []byte{}, err
+		}
+		if dt := t.Sub(h.t); dt <= window && -dt <= window {
+			counts[neighbour]++
+		}
+	}
+
+	// Stage 3: most frequent first
+	return topCounts(counts, 0), nil
+}
+
+// OnThisDay returns the commands run on qp.Day's month and day in previous
+// years, grouped by year and host. Years without activity are omitted.
+// If qp.Day is February 28 of a non-leap year, February 29 is also included,
+// or else leap day commands would never show up.
+func (d Database) OnThisDay(qp conf.QueryParams) ([]byte, error) {
+	day, err := time.Parse("2006-01-02", qp.Day)
+	if err != nil {
+		return []byte{}, errors.New("Bad date for on this day query: " + qp.Day)
+	}
+	monthDay, leapDay := day.Format("01-02"), day.Format("01-02")
+	if monthDay == "02-28" && day.AddDate(0, 0, 1).Month() == time.March {
+		leapDay = "02-29"
+	}
+
+	// Days are local, as the times we show.
+	rows, err := d.Query(`SELECT rowid, user, host, command, datetime, strftime('%Y', datetime, 'unixepoch', 'localtime') AS year FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'
+                               AND strftime('%m-%d', datetime, 'unixepoch', 'localtime') IN (?, ?)
+                               AND year < ?
+                               ORDER BY year ASC, host ASC, datetime ASC`,
+		qp.User, qp.Host, d.Profile(), qp.Command, monthDay, leapDay, day.Format("2006"))
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	var res *result.Result
+	var lastYear, lastHost string
+	notes := d.annotations(qp.User, qp.Host)
+	for rows.Next() {
+		var user, host, command, year string
+		var t time.Time
+		var row int
+		rows.Scan(&row, &user, &host, &command, epoch{&t}, &year)
+		if year != lastYear || host != lastHost {
+			if res != nil {
+				out.Write(res.Formatted())
+				out.WriteString("\n\n")
+			}
+			out.WriteString(fmt.Sprintf("%s @ %s:\n", year, host))
+			res = result.New(qp.Format)
+			lastYear, lastHost = year, host
+		}
+		res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
+	}
+	if res != nil {
+		out.Write(res.Formatted())
+	}
+	return out.Bytes(), nil
+}
+
+// GetCommandChains returns the qp.Kappa most common sequences of n commands
+// run one after the other by the same user at the same host. It fetches the
+// history once, ordered by time, and slides a window of n commands over it.
+func (d Database) GetCommandChains(n int, qp conf.QueryParams) ([]byte, error) {
+	if n < 2 {
+		return []byte{}, errors.New("Command chains need a length of at least 2.")
+	}
+	rows, err := d.Query(`SELECT user, host, command FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY user, host, datetime ASC`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	var window []string
+	var lastUser, lastHost string
+	for rows.Next() {
+		var user, host, command string
+		rows.Scan(&user, &host, &command)
+		if user != lastUser || host != lastHost { // chains don't cross user@host
+			window = window[:0]
+			lastUser, lastHost = user, host
+		}
+		window = append(window, command)
+		if len(window) > n {
+			window = window[1:]
+		}
+		if len(window) == n {
+			counts[strings.Join(window, " -> ")]++
+		}
+	}
+
+	return topCounts(counts, qp.Kappa), nil
+}
+
+// abruptStopsMinVariants is the least distinct commands a prefix needs for
+// GetAbruptStops to return it.
+const abruptStopsMinVariants = 3
+
+// GetAbruptStops returns the qp.Kappa command prefixes of prefixLen
+// characters with the most distinct commands starting with them, if they
+// have at least abruptStopsMinVariants. These are commands you start typing
+// often and finish differently, so they may call for an alias.
+func (d Database) GetAbruptStops(qp conf.QueryParams, prefixLen int) ([]byte, error) {
+	if prefixLen < 1 {
+		return []byte{}, errors.New("Command prefixes need a length of at least 1.")
+	}
+	rows, err := d.Query(`SELECT substr(command, 1, ?) AS prefix, count(DISTINCT command) AS variants FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               GROUP BY prefix HAVING variants >= ?
+                               ORDER BY variants DESC, prefix ASC LIMIT ?`,
+		prefixLen, qp.User, qp.Host, d.Profile(), abruptStopsMinVariants, qp.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	res := result.New("")
+	for rows.Next() {
+		var prefix string
+		var variants int
+		rows.Scan(&prefix, &variants)
+		res.AddCountRow(variants, prefix)
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	return res.Formatted(), nil
+}
+
+// topCounts returns a count result with the k most frequent entries of
+// counts, most frequent first and alphabetically on ties. If k < 1, all
+// entries are returned.
+func topCounts(counts map[string]int, k int) []byte {
+	var keys []string
+	for c := range counts {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	if k > 0 && len(keys) > k {
+		keys = keys[:k]
+	}
+
+	res := result.New("")
+	for _, c := range keys {
+		res.AddCountRow(counts[c], c)
+	}
+	return res.Formatted()
+}
+
+// Span returns the datetime of the earliest and latest command and the
+// number of commands within the search criteria. It uses a single query
+// that is backed by the datetime index. If nothing matches, it returns
+// zero times and count 0.
+func (d Database) Span(p conf.QueryParams) (min, max time.Time, count int, err error) {
+	err = d.QueryRow(`SELECT min(datetime), max(datetime), count(*) FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'`,
+		p.User, p.Host, d.Profile(), p.Command).Scan(epoch{&min}, epoch{&max}, &count)
+	if err != nil || count == 0 {
+		return time.Time{}, time.Time{}, 0, err
+	}
+	return min, max, count, nil
+}
+
+// Info returns the result of Span formatted for printing.
+func (d Database) Info(qp conf.QueryParams) ([]byte, error) {
+	min, max, count, err := d.Span(qp)
+	if err != nil {
+		return []byte{}, err
+	}
+	if count == 0 {
+		return []byte("No commands found."), nil
+	}
+	return []byte(fmt.Sprintf("Commands: %d\nEarliest: %s\nLatest  : %s",
+		count, min.Format(RFC3339alt), max.Format(RFC3339alt))), nil
+}
+
+// Suggest returns up to k distinct commands of user@host that start with
+// prefix, most likely first. Commands are ranked by how many times they
+// were run divided by 1 + the days since they were last run, so both
+// frequent and recent commands rank high.
+// It is called on every keystroke, so it has to be fast. SQLite's LIKE is
+// case insensitive and can't use the primary key (profile, user, command,
+// datetime) index, but a range on command after an exact profile and user
+// can.
+func (d Database) Suggest(user, host, prefix string, k int) ([]string, error) {
+	query := `SELECT command FROM history
+                  WHERE profile = ? AND user = ? AND host = ? AND command >= ?`
+	args := []interface{}{d.Profile(), user, host, prefix}
+	if upper, ok := prefixUpperBound(prefix); ok {
+		query += ` AND command < ?`
+		args = append(args, upper)
+	}
+	query += ` GROUP BY command
+                   ORDER BY count(*) / (1 + (? - max(datetime)) / 86400.0) DESC, command ASC
+                   LIMIT ?`
+	args = append(args, now().Unix(), k)
+
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var commands []string
+	for rows.Next() {
+		var command string
+		rows.Scan(&command)
+		commands = append(commands, command)
+	}
+	return commands, rows.Err()
+}
+
+// prefixUpperBound returns the smallest string greater than all strings
+// starting with prefix. If there is none (prefix is empty or all 0xff) it
+// returns false.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// Status returns the database file, its size, schema version, journal mode
+// and how many rows it holds. It always reports the whole database, not
+// just the search criteria.
+func (d Database) Status() ([]byte, error) {
+	var size int64
+	if fi, err := os.Stat(d.path); err == nil {
+		size = fi.Size()
+	}
+
+	var version, journal string
+	err := d.QueryRow(`SELECT value FROM admin WHERE key LIKE "version"`).Scan(&version)
+	if err != nil {
+		return []byte{}, err
+	}
+	if err = d.QueryRow(`PRAGMA journal_mode`).Scan(&journal); err != nil {
+		return []byte{}, err
+	}
+	wal := "off"
+	if strings.ToLower(journal) == "wal" {
+		wal = "on"
+	}
+
+	min, max, count, err := d.Span(conf.QueryParams{User: "%", Host: "%", Command: "%"})
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var out bytes.Buffer
+	out.WriteString(fmt.Sprintf("Database: %s\n", d.path))
+	out.WriteString(fmt.Sprintf("Size    : %d bytes\n", size))
+	out.WriteString(fmt.Sprintf("Schema  : %s\n", version))
+	out.WriteString(fmt.Sprintf("Journal : %s (WAL %s)\n", journal, wal))
+	out.WriteString(fmt.Sprintf("Rows    : %d", count))
+	if count > 0 {
+		out.WriteString(fmt.Sprintf("\nEarliest: %s\nLatest  : %s",
+			min.Format(RFC3339alt), max.Format(RFC3339alt)))
+	}
+	return out.Bytes(), nil
+}
+
+// sudoArgOptions are sudo's options that take an argument, so we can skip
+// them when we look for the program run with sudo.
+var sudoArgOptions = map[string]bool{"-u": true, "-g": true, "-h": true, "-p": true,
+	"-C": true, "-D": true, "-r": true, "-t": true, "-U": true}
+
+// GetSudoStats returns the qp.Kappa most frequent command lines that start
+// with sudo and the number of distinct programs that were run with sudo.
+func (d Database) GetSudoStats(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT command, count(*) as count FROM history
+                               WHERE command LIKE 'sudo %' AND user LIKE ? AND host LIKE ? AND profile = ?
+                               GROUP BY command ORDER BY count DESC, command ASC LIMIT ?`,
+		qp.User, qp.Host, d.Profile(), qp.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	res := result.New("")
+	for rows.Next() {
+		var command string
+		var count int
+		rows.Scan(&command, &count)
+		res.AddCountRow(count, command)
+	}
+	rows.Close()
+
+	rows, err = d.Query(`SELECT DISTINCT command FROM history
+                               WHERE command LIKE 'sudo %' AND user LIKE ? AND host LIKE ? AND profile = ?`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	programs := make(map[string]bool)
+	for rows.Next() {
+		var command string
+		rows.Scan(&command)
+		if p := sudoProgram(command); p != "" {
+			programs[p] = true
+		}
+	}
+
+	var out bytes.Buffer
+	out.WriteString(fmt.Sprintf("Top-%d sudo command lines:\n", qp.Kappa))
+	out.Write(res.Formatted())
+	out.WriteString(fmt.Sprintf("\n\nDistinct programs run with sudo: %d", len(programs)))
+	return out.Bytes(), nil
+}
+
+// sudoProgram returns the first word after sudo and its options.
+func sudoProgram(command string) string {
+	words := strings.Fields(command)
+	for i := 1; i < len(words); i++ {
+		switch {
+		case sudoArgOptions[words[i]]:
+			i++
+		case strings.HasPrefix(words[i], "-"):
+		default:
+			return words[i]
+		}
+	}
+	return ""
+}
+
+// gitArgOptions are git's global options that take an argument. We skip
+// them when we look for the subcommand.
+var gitArgOptions = map[string]bool{"-C": true, "-c": true, "--git-dir": true, "--work-tree": true,
+	"--namespace": true}
+
+// A gitStatJSON is a subcommand's count, to use with json.Marshal.
+type gitStatJSON struct {
+	Subcommand string `json:"subcommand"`
+	Count      int    `json:"count"`
+}
+
+// GetGitStats returns how many times every git subcommand was run, most
+// used first. Commands of hub and gh (GitHub's clients) are counted along
+// with git's. In JSON format it returns a list of subcommand and count
+// objects.
+func (d Database) GetGitStats(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT command, count(*) FROM history
+                               WHERE (command LIKE 'git %' OR command LIKE 'hub %' OR command LIKE 'gh %')
+                                   AND user LIKE ? AND host LIKE ? AND profile = ?
+                               GROUP BY command`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var command string
+		var count int
+		rows.Scan(&command, &count)
+		if sub := gitSubcommand(command); sub != "" {
+			counts[sub] += count
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	if qp.Format != conf.FORMAT_JSON {
+		return topCounts(counts, 0), nil
+	}
+	var subcommands []string
+	for sub := range counts {
+		subcommands = append(subcommands, sub)
+	}
+	sort.Slice(subcommands, func(i, j int) bool {
+		if counts[subcommands[i]] != counts[subcommands[j]] {
+			return counts[subcommands[i]] > counts[subcommands[j]]
+		}
+		return subcommands[i] < subcommands[j]
+	})
+	var out bytes.Buffer
+	out.WriteString("[")
+	for i, sub := range subcommands {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		b, _ := json.Marshal(gitStatJSON{sub, counts[sub]})
+		out.WriteString("\n")
+		out.Write(b)
+	}
+	out.WriteString("\n]")
+	return out.Bytes(), nil
+}
+
+// gitSubcommand returns the first word after git (or hub, gh) and its
+// global options.
+func gitSubcommand(command string) string {
+	words := strings.Fields(command)
+	for i := 1; i < len(words); i++ {
+		switch {
+		case gitArgOptions[words[i]]:
+			i++
+		case strings.HasPrefix(words[i], "-"):
+		default:
+			return strings.TrimRight(words[i], ";&|")
+		}
+	}
+	return ""
+}
+
+// GetBackgroundCommandStats returns the programs that were run in the
+// background (with a trailing &) and how many times each one was.
+func (d Database) GetBackgroundCommandStats(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT command FROM history
+                               WHERE (command LIKE '%&' OR command LIKE '% & %') AND user LIKE ? AND host LIKE ? AND profile = ?`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var command string
+		rows.Scan(&command)
+		for _, p := range backgroundPrograms(command) {
+			counts[p]++
+		}
+	}
+	return topCounts(counts, 0), nil
+}
+
+// GetCommandsWithPipe returns the qp.Kappa command lines within the search
+// criteria that are pipelines, those with the most pipes first. || counts as
+// two pipes, we don't parse the command lines.
+func (d Database) GetCommandsWithPipe(params conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT rowid, user, host, command, datetime FROM history
+                               WHERE command LIKE '%|%' AND `+commandMatch(params)+` AND user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY length(command) - length(replace(command, '|', '')) DESC, datetime DESC LIMIT ?`,
+		commandPattern(params), params.User, params.Host, d.Profile(), params.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+	return d.annotatedRows(rows, params)
+}
+
+// GetCommandsWithRedirection returns the qp.Kappa most recent command lines
+// within the search criteria that redirect input or output (>, >> or <).
+// Comparisons (>= and <=), as in test or awk expressions, don't count.
+func (d Database) GetCommandsWithRedirection(params conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT rowid, user, host, command, datetime FROM history
+                               WHERE (replace(replace(command, '>=', ''), '<=', '') LIKE '%>%'
+                                      OR replace(replace(command, '>=', ''), '<=', '') LIKE '%<%')
+                               AND `+commandMatch(params)+` AND user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY datetime DESC LIMIT ?`,
+		commandPattern(params), params.User, params.Host, d.Profile(), params.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+	return d.annotatedRows(rows, params)
+}
+
+// GetRecentHosts returns the hosts that ran commands since since, most
+// recently seen first, with how many commands they ran since then and when
+// they were last seen.
+func (d Database) GetRecentHosts(since time.Time) ([]byte, error) {
+	return d.recentlySeen("host", "hosts", since)
+}
+
+// GetRecentUsers returns the users that ran commands since since, most
+// recently seen first, with how many commands they ran since then and when
+// they were last seen.
+func (d Database) GetRecentUsers(since time.Time) ([]byte, error) {
+	return d.recentlySeen("user", "users", since)
+}
+
+// recentlySeen returns the values of column, user or host, that ran
+// commands since since, for GetRecentHosts and GetRecentUsers. what is
+// what they are called when there are none.
+func (d Database) recentlySeen(column, what string, since time.Time) ([]byte, error) {
+	rows, err := d.Query(`SELECT `+column+`, count(*), max(datetime) AS latest FROM history
+                               WHERE datetime >= ? AND profile = ?
+                               GROUP BY `+column+` ORDER BY latest DESC`,
+		since.Unix(), d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var seen string
+		var count int
+		var latest time.Time
+		if err = rows.Scan(&seen, &count, epoch{&latest}); err != nil {
+			return []byte{}, err
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s | %d commands | last seen %s",
+			seen, count, latest.UTC().Format(time.RFC3339)))
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if out.Len() == 0 {
+		return []byte("No " + what + " ran commands since " + since.Format(time.RFC3339) + "."), nil
+	}
+	return out.Bytes(), nil
+}
+
+// An inactiveUserJSON is a user and when they were last seen, to use with
+// json.Marshal.
+type inactiveUserJSON struct {
+	User     string    `json:"user"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// GetInactiveUsers returns the users that ran no commands since
+// inactiveSince, least recently seen first, with when they were last seen.
+// It is meant to find dormant accounts. The result is JSON if format is
+// FORMAT_JSON.
+func (d Database) GetInactiveUsers(inactiveSince time.Time, format string) ([]byte, error) {
+	rows, err := d.Query(`SELECT user, max(datetime) AS last_seen FROM history WHERE profile = ?
+                               GROUP BY user HAVING last_seen < ? ORDER BY last_seen ASC, user ASC`,
+		d.Profile(), inactiveSince.Unix())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var users []inactiveUserJSON
+	for rows.Next() {
+		var u inactiveUserJSON
+		if err = rows.Scan(&u.User, epoch{&u.LastSeen}); err != nil {
+			return []byte{}, err
+		}
+		u.LastSeen = u.LastSeen.UTC()
+		users = append(users, u)
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+
+	var out bytes.Buffer
+	if format == conf.FORMAT_JSON {
+		out.WriteString("[")
+		for i, u := range users {
+			if i > 0 {
+				out.WriteString(",")
+			}
+			b, _ := json.Marshal(u)
+			out.WriteString("\n")
+			out.Write(b)
+		}
+		out.WriteString("\n]")
+		return out.Bytes(), nil
+	}
+	if len(users) == 0 {
+		return []byte("No users inactive since " + inactiveSince.Format(time.RFC3339) + "."), nil
+	}
+	for i, u := range users {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s | last seen %s", u.User, u.LastSeen.Format(time.RFC3339)))
+	}
+	return out.Bytes(), nil
+}
+
+// annotatedRows returns rows of rowid, user, host, command and datetime in
+// params.Format, with their commands' notes.
+func (d Database) annotatedRows(rows *Rows, params conf.QueryParams) ([]byte, error) {
+	res := result.New(params.Format)
+	notes := d.annotations(params.User, params.Host)
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		var row int
+		if err := rows.Scan(&row, &user, &host, &command, epoch{&t}); err != nil {
+			return []byte{}, err
+		}
+		res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
+	}
+	return res.Formatted(), rows.Err()
+}
+
+// GetDirectoryChangeStats returns the qp.Kappa directories changed to with
+// cd the most. Directories under the user's home are written with ~. We
+// replay the cd commands of every user@host in order, so relative paths
+// (and cd -) can be resolved against the previous directory when it is
+// known. Relative paths we can't resolve are counted as they are.
+func (d Database) GetDirectoryChangeStats(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT user, host, command FROM history
+                               WHERE (command = 'cd' OR command LIKE 'cd %') AND user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY user, host, datetime ASC`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	var cwd, prev, lastUser, lastHost string
+	for rows.Next() {
+		var user, host, command string
+		rows.Scan(&user, &host, &command)
+		if user != lastUser || host != lastHost {
+			cwd, prev = "", ""
+			lastUser, lastHost = user, host
+		}
+		dir := cdTarget(command, user, cwd, prev)
+		if dir == "" {
+			continue
+		}
+		counts[dir]++
+		if path.IsAbs(dir) || strings.HasPrefix(dir, "~") {
+			cwd, prev = dir, cwd
+		} else {
+			cwd, prev = "", cwd
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	return topCounts(counts, qp.Kappa), nil
+}
+
+// cdTarget returns the directory command (a cd) changes to, given the
+// current and previous directories if known. It returns "" if the
+// directory can't be told, as for cd - without a previous directory.
+func cdTarget(command, user, cwd, prev string) string {
+	words := strings.Fields(command)
+	arg := ""
+	for _, w := range words[1:] {
+		if w == "&&" || w == "||" || w == ";" || w == "|" {
+			break
+		}
+		if strings.HasPrefix(w, "-") && w != "-" { // -P, -L
+			continue
+		}
+		arg = strings.Trim(strings.TrimRight(w, ";"), `"'`)
+		break
+	}
+
+	home := "/home/" + user
+	if user == "root" {
+		home = "/root"
+	}
+	switch {
+	case arg == "" || arg == "~" || arg == "$HOME":
+		return "~"
+	case arg == "-":
+		return prev
+	case strings.HasPrefix(arg, "~"): // ~/dir, ~user
+		arg = path.Clean(arg)
+	case strings.HasPrefix(arg, "$HOME/"):
+		arg = path.Clean("~" + strings.TrimPrefix(arg, "$HOME"))
+	case path.IsAbs(arg):
+		arg = path.Clean(arg)
+		if arg == home || strings.HasPrefix(arg, home+"/") {
+			arg = "~" + strings.TrimPrefix(arg, home)
+		}
+	case cwd != "":
+		arg = path.Join(cwd, arg)
+	default:
+		return path.Clean(arg)
+	}
+	return arg
+}
+
+// defaultEditors are the editors GetEditorUsage looks for if none are given.
+var defaultEditors = []string{"vim", "vi", "nano", "emacs", "code", "gedit"}
+
+// redirection matches a word that redirects input or output, like 2>err.
+var redirection = regexp.MustCompile(`^[0-9&]*[<>]`)
+
+// GetEditorUsage returns how many times each of editors was run, most used
+// first, and the qp.Kappa files edited the most. Editors run through sudo
+// or by their path (/usr/bin/vim) count too. Files are counted as they
+// were typed, they aren't resolved against the working directory. If
+// editors is empty, defaultEditors are used.
+func (d Database) GetEditorUsage(editors []string, qp conf.QueryParams) ([]byte, error) {
+	if len(editors) == 0 {
+		editors = defaultEditors
+	}
+	isEditor := make(map[string]bool)
+	var filter []string
+	args := []interface{}{qp.User, qp.Host, d.Profile()}
+	for _, e := range editors {
+		isEditor[e] = true
+		filter = append(filter, `command LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+escapeLike(e)+"%")
+	}
+
+	rows, err := d.Query(`SELECT command FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND (`+strings.Join(filter, " OR ")+`)`,
+		args...)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	runs := make(map[string]int)
+	files := make(map[string]int)
+	for rows.Next() {
+		var command string
+		rows.Scan(&command)
+		editorRuns(command, isEditor, func(editor string, args []string) {
+			runs[editor]++
+			for _, f := range args {
+				files[f]++
+			}
+		})
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if len(runs) == 0 {
+		return []byte("No editor commands found."), nil
+	}
+
+	var out bytes.Buffer
+	out.WriteString("Editor runs:\n")
+	out.Write(topCounts(runs, 0))
+	out.WriteString(fmt.Sprintf("\n\nTop-%d edited files:\n", qp.Kappa))
+	out.Write(topCounts(files, qp.Kappa))
+	return bytes.TrimRight(out.Bytes(), "\n"), nil
+}
+
+// editorRuns calls f for every job in command that runs one of editors,
+// with the editor's name and the files given to it. Options (-R, +42) and
+// redirections aren't files.
+func editorRuns(command string, editors map[string]bool, f func(editor string, files []string)) {
+	var job []string
+	run := func() {
+		words := job
+		job = nil
+		for len(words) > 0 && envAssignment.MatchString(words[0]) {
+			words = words[1:]
+		}
+		if len(words) > 0 && words[0] == "sudo" {
+			words = words[1:]
+			for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+				if sudoArgOptions[words[0]] && len(words) > 1 {
+					words = words[1:]
+				}
+				words = words[1:]
+			}
+		}
+		if len(words) == 0 || !editors[path.Base(words[0])] {
+			return
+		}
+		var files []string
+		for _, w := range words[1:] {
+			w = strings.Trim(w, `"'`)
+			if w == "" || strings.HasPrefix(w, "-") || strings.HasPrefix(w, "+") || redirection.MatchString(w) {
+				continue
+			}
+			files = append(files, w)
+		}
+		f(path.Base(words[0]), files)
+	}
+	for _, w := range strings.Fields(command) {
+		switch {
+		case w == "&&" || w == "||" || w == "|" || w == ";" || w == "&":
+			run()
+		case strings.HasSuffix(w, ";"):
+			job = append(job, strings.TrimSuffix(w, ";"))
+			run()
+		default:
+			job = append(job, w)
+		}
+	}
+	run()
+}
+
+// backgroundPrograms returns the base program of every job that is sent
+// to the background in command, e.g. [sleep make] for "sleep 5 & make &".
+func backgroundPrograms(command string) []string {
+	var programs []string
+	var job []string
+	for _, w := range strings.Fields(command) {
+		switch {
+		case strings.HasSuffix(w, ";") || w == "&&" || w == "||":
+			job = nil
+			continue
+		case w == "&" || (strings.HasSuffix(w, "&") && !strings.HasSuffix(w, "&&") && !strings.HasSuffix(w, ">&")):
+			if w = strings.TrimSuffix(w, "&"); w != "" {
+				job = append(job, w)
+			}
+			for _, j := range job {
+				if envAssignment.FindString(j) == "" {
+					programs = append(programs, j)
+					break
+				}
+			}
+			job = nil
+			continue
+		}
+		job = append(job, w)
+	}
+	return programs
+}
+
+// trendBarWidth is the width of the peak's bar in Trend's chart.
+const trendBarWidth = 40
+
+// Trend returns how many times commands within the search criteria were run
+// per bucket (month or week) as a text bar chart. Buckets without commands
+// between the first and the last one are shown with zero count. The peak
+// bucket is marked.
+func (d Database) Trend(p conf.QueryParams, bucket string) ([]byte, error) {
+	// start returns the start of the bucket t belongs to, next the start of
+	// the following bucket and label a bucket's name.
+	var start func(t time.Time) time.Time
+	var next func(t time.Time) time.Time
+	var label func(t time.Time) string
+	switch bucket {
+	case conf.BUCKET_MONTH, "":
+		start = func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) }
+		next = func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }
+		label = func(t time.Time) string { return t.Format("2006-01") }
+	case conf.BUCKET_WEEK:
+		start = func(t time.Time) time.Time {
+			wd := (int(t.Weekday()) + 6) % 7 // Monday is the first day of ISO weeks
+			return time.Date(t.Year(), t.Month(), t.Day()-wd, 0, 0, 0, 0, time.UTC)
+		}
+		next = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+		label = func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%04d-W%02d", y, w)
+		}
+	default:
+		return []byte{}, errors.New("Unknown trend bucket: " + bucket)
+	}
+
+	rows, err := d.Query(`SELECT datetime FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE ? ESCAPE '\'`,
+		p.User, p.Host, d.Profile(), p.Command)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[time.Time]int)
+	var first, last time.Time
+	for rows.Next() {
+		var t time.Time
+		rows.Scan(epoch{&t})
+		b := start(t)
+		counts[b]++
+		if first.IsZero() || b.Before(first) {
+			first = b
+		}
+		if b.After(last) {
+			last = b
+		}
+	}
+	if len(counts) == 0 {
+		return []byte("No commands found."), nil
+	}
+
+	var peak time.Time
+	for b, c := range counts {
+		if c > counts[peak] || (c == counts[peak] && b.Before(peak)) {
+			peak = b
+		}
+	}
+	width := digits(counts[peak])
+
+	var out bytes.Buffer
+	for b := first; !b.After(last); b = next(b) {
+		if b != first {
+			out.WriteByte('\n')
+		}
+		c := counts[b]
+		line := fmt.Sprintf("%s | %*d | %s", label(b), width, c,
+			strings.Repeat("#", c*trendBarWidth/counts[peak]))
+		if b == peak {
+			line += " <- peak"
+		}
+		out.WriteString(strings.TrimRight(line, " "))
+	}
+	return out.Bytes(), nil
+}
+
+// digits returns the number of decimal digits of n.
+func digits(n int) int {
+	return len(strconv.Itoa(n))
+}
+
+// envAssignment matches a word that sets an environment variable.
+var envAssignment = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*=`)
+
+// GetEnvVariableUsage returns the environment variables that were set inline
+// in commands (e.g. GOPATH=/tmp/test go build) and how many times each one
+// was set.
+func (d Database) GetEnvVariableUsage(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT command FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ? AND command LIKE '%=%'`,
+		qp.User, qp.Host, d.Profile())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var command string
+		rows.Scan(&command)
+		// Many variables may be set before the command: A=1 B=2 cmd
+		for _, w := range strings.Fields(command) {
+			m := envAssignment.FindString(w)
+			if m == "" {
+				break
+			}
+			counts[strings.TrimSuffix(m, "=")]++
+		}
+	}
+	return topCounts(counts, 0), nil
+}
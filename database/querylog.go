@@ -0,0 +1,79 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// A QueryLogEntry is a query a server served, for the query log.
+type QueryLogEntry struct {
+	Datetime   time.Time
+	Remote     string // the client's address
+	User       string // the user the client claimed
+	Type       string // the message type
+	Params     conf.QueryParams
+	Rows       int // lines of the result
+	DurationMs int64
+}
+
+// LogQuery queues e to be written to the query log. It doesn't wait for
+// the write, errors writing it are only logged.
+func (d Database) LogQuery(e QueryLogEntry) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	return d.w.enqueueEntry(e)
+}
+
+// QueryLog returns the qp.Kappa most recent query log entries, one per line.
+func (d Database) QueryLog(qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT datetime, remote, user, type, params, rows, duration_ms FROM querylog
+                               ORDER BY datetime DESC LIMIT ?`, qp.Kappa)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var out bytes.Buffer
+	for rows.Next() {
+		var datetime time.Time
+		var remote, user, typ, params string
+		var n int
+		var duration int64
+		if err = rows.Scan(&datetime, &remote, &user, &typ, &params, &n, &duration); err != nil {
+			return []byte{}, err
+		}
+		if out.Len() > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%s | %s | %s | %s | %d rows | %dms | %s",
+			datetime.Local().Format(time.RFC3339), remote, user, typ, n, duration, params))
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if out.Len() == 0 {
+		return []byte("No queries logged."), nil
+	}
+	return out.Bytes(), nil
+}
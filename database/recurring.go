@@ -0,0 +1,135 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// recurringMaxVariation is the largest coefficient of variation (standard
+// deviation over mean) of the intervals between runs of a command that we
+// still consider a regular schedule.
+const recurringMaxVariation = 0.25
+
+// A recurring is a command run at regular intervals by a user at a host.
+type recurring struct {
+	user, host, command string
+	count               int
+	mean, stddev        time.Duration
+}
+
+// GetRecurringCommands returns the command lines within the search criteria
+// run at least minOccurrences times at regular intervals, most regular
+// first. SQLite lacks a standard deviation, so we fetch the run times of
+// every user, host and command group and compute the intervals here.
+func (d Database) GetRecurringCommands(params conf.QueryParams, minOccurrences int) ([]byte, error) {
+	if minOccurrences < 3 {
+		return []byte{}, errors.New("Recurring commands need at least 3 occurrences.")
+	}
+	rows, err := d.Query(`SELECT user, host, command, count(*) AS count, group_concat(datetime) FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               GROUP BY user, host, command HAVING count >= ?`,
+		params.User, params.Host, d.Profile(), minOccurrences)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	var found []recurring
+	for rows.Next() {
+		var r recurring
+		var datetimes string
+		rows.Scan(&r.user, &r.host, &r.command, &r.count, &datetimes)
+		var times []time.Time
+		for _, s := range strings.Split(datetimes, ",") {
+			t, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return []byte{}, err
+			}
+			times = append(times, time.Unix(t, 0))
+		}
+		r.mean, r.stddev = intervalStats(times)
+		if r.mean > 0 && float64(r.stddev) <= recurringMaxVariation*float64(r.mean) {
+			found = append(found, r)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return []byte{}, err
+	}
+	if len(found) == 0 {
+		return []byte("No recurring commands found."), nil
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		vi := float64(found[i].stddev) / float64(found[i].mean)
+		vj := float64(found[j].stddev) / float64(found[j].mean)
+		if vi != vj {
+			return vi < vj
+		}
+		if found[i].count != found[j].count {
+			return found[i].count > found[j].count
+		}
+		return found[i].command < found[j].command
+	})
+
+	width := 0
+	for _, r := range found {
+		if w := digits(r.count); w > width {
+			width = w
+		}
+	}
+	var out bytes.Buffer
+	for i, r := range found {
+		if i > 0 {
+			out.WriteString("\n")
+		}
+		out.WriteString(fmt.Sprintf("%*d runs | every %s ± %s | %s@%s | %s", width, r.count,
+			r.mean.Round(time.Second), r.stddev.Round(time.Second), r.user, r.host, r.command))
+	}
+	return out.Bytes(), nil
+}
+
+// intervalStats returns the mean and standard deviation of the intervals
+// between consecutive times, which need not be sorted.
+func intervalStats(times []time.Time) (mean, stddev time.Duration) {
+	if len(times) < 2 {
+		return 0, 0
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	var sum float64
+	intervals := make([]float64, len(times)-1)
+	for i := range intervals {
+		intervals[i] = float64(times[i+1].Sub(times[i]))
+		sum += intervals[i]
+	}
+	m := sum / float64(len(intervals))
+	var squares float64
+	for _, v := range intervals {
+		squares += (v - m) * (v - m)
+	}
+	return time.Duration(m), time.Duration(math.Sqrt(squares / float64(len(intervals))))
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"fmt"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// Tables with user and host columns, that a rename changes. Commands are
+// in history, the rest are about them.
+var renamedTables = []string{"history", "imports", "annotations", "tags", "favorites"}
+
+// Rename renames the host or user p asks for and says how many commands
+// it changed, or would change if p.DryRun is set.
+func (d Database) Rename(p conf.QueryParams) ([]byte, error) {
+	column := "host"
+	if p.Type == conf.RENAME_USER {
+		column = "user"
+	}
+	updated, merged, err := d.rename(column, p.RenameFrom, p.RenameTo, p.DryRun)
+	if err != nil {
+		return []byte{}, err
+	}
+	if p.DryRun {
+		return []byte(fmt.Sprintf("Renaming %s %s to %s would update %d commands and merge %d into ones %s has.",
+			column, p.RenameFrom, p.RenameTo, updated, merged, p.RenameTo)), nil
+	}
+	return []byte(fmt.Sprintf("Renamed %s %s to %s, updated %d commands and merged %d into ones %s had.",
+		column, p.RenameFrom, p.RenameTo, updated, merged, p.RenameTo)), nil
+}
+
+// RenameHost renames host from to to, e.g. after the machine was renamed,
+// so its history isn't split between the two. Commands that to has
+// already, the same by the primary key, are merged into them. It returns
+// how many commands were updated and how many were merged. If dryRun is
+// set, nothing changes, the counts are what a rename would do. Every
+// profile is renamed, with the annotations, tags and favorites of from.
+func (d Database) RenameHost(from, to string, dryRun bool) (updated, merged int, err error) {
+	return d.rename("host", from, to, dryRun)
+}
+
+// RenameUser is RenameHost for users.
+func (d Database) RenameUser(from, to string, dryRun bool) (updated, merged int, err error) {
+	return d.rename("user", from, to, dryRun)
+}
+
+// rename renames column, user or host, from from to to in one transaction,
+// for RenameHost and RenameUser.
+func (d Database) rename(column, from, to string, dryRun bool) (updated, merged int, err error) {
+	if d.readOnly {
+		return 0, 0, ErrReadOnly
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if updated, merged, err = renameTx(tx, column, from, to); err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		return updated, merged, nil
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	log.Info.Printf("Renamed %s %s to %s, updated %d commands and merged %d.\n", column, from, to, updated, merged)
+	return updated, merged, nil
+}
+
+// renameTx renames column from from to to in tx, which it leaves open to
+// commit. Rows an UPDATE OR IGNORE leaves behind would collide with one of
+// to, we drop them. The counts are of history rows.
+func renameTx(tx *sql.Tx, column, from, to string) (updated, merged int, err error) {
+	for _, table := range renamedTables {
+		res, err := tx.Exec(`UPDATE OR IGNORE `+table+` SET `+column+` = ? WHERE `+column+` = ?`, to, from)
+		if err != nil {
+			return 0, 0, err
+		}
+		n, _ := res.RowsAffected()
+		if res, err = tx.Exec(`DELETE FROM `+table+` WHERE `+column+` = ?`, from); err != nil {
+			return 0, 0, err
+		}
+		m, _ := res.RowsAffected()
+		if table == "history" {
+			updated, merged = int(n), int(m)
+		}
+	}
+	return updated, merged, nil
+}
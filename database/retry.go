@@ -0,0 +1,56 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Limits for retryBusy. The wait between tries starts at busyMinBackoff and
+// doubles up to busyMaxBackoff.
+const (
+	busyDeadline   = 30 * time.Second
+	busyMinBackoff = 10 * time.Millisecond
+	busyMaxBackoff = time.Second
+)
+
+// retryBusy runs f until it doesn't fail because the database is busy,
+// busyDeadline passes or ctx is done. Waits have jitter, so writers that
+// collided don't retry in lockstep.
+func retryBusy(ctx context.Context, f func() error) error {
+	deadline := time.Now().Add(busyDeadline)
+	backoff := busyMinBackoff
+	for {
+		err := f()
+		if !isBusy(err) || time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		log.Debug.Printf("Database is busy, retrying in %v.\n", wait)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > busyMaxBackoff {
+			backoff = busyMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+
+	"github.com/andmarios/crypto/nacl/saltsecret"
+)
+
+// encryptedColumn is a column whose values are stored encrypted.
+type encryptedColumn struct {
+	table, column string
+}
+
+// encryptedColumns are the columns RotateEncryptionKey re-encrypts. None
+// are encrypted yet, rlookup and connlog keep their addresses in plaintext
+// until at-rest encryption lands and adds them here.
+var encryptedColumns []encryptedColumn
+
+// RotateEncryptionKey re-encrypts the encrypted columns of rlookup and
+// connlog with newKey. All of them change in one transaction, or none do, so
+// a value that oldKey doesn't decrypt leaves the database as it was. While
+// no columns are encrypted it changes nothing.
+func (d Database) RotateEncryptionKey(oldKey, newKey []byte) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if len(oldKey) == 0 || len(newKey) == 0 {
+		return errors.New("Key rotation without a key.")
+	}
+	if bytes.Equal(oldKey, newKey) {
+		return errors.New("Key rotation to the same key.")
+	}
+
+	var tx *sql.Tx
+	if err := retryBusy(d.context(), func() (err error) {
+		tx, err = d.Begin()
+		return err
+	}); err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range encryptedColumns {
+		if err := reencryptColumn(tx, c, oldKey, newKey); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reencryptColumn decrypts every value of c with oldKey and stores it
+// encrypted with newKey.
+func reencryptColumn(tx *sql.Tx, c encryptedColumn, oldKey, newKey []byte) error {
+	rows, err := tx.Query(`SELECT rowid, ` + c.column + ` FROM ` + c.table +
+		` WHERE ` + c.column + ` IS NOT NULL`)
+	if err != nil {
+		return err
+	}
+	values := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var v []byte
+		if err = rows.Scan(&id, &v); err != nil {
+			rows.Close()
+			return err
+		}
+		values[id] = v
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for id, v := range values {
+		plain, err := decryptValue(v, oldKey)
+		if err != nil {
+			return errors.New("Can't decrypt " + c.table + "." + c.column + " with the old key: " + err.Error())
+		}
+		if v, err = encryptValue(plain, newKey); err != nil {
+			return err
+		}
+		if _, err = tx.Exec(`UPDATE `+c.table+` SET `+c.column+` = ? WHERE rowid = ?`, v, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptValue encrypts a column's value with key.
+func encryptValue(plain, key []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := saltsecret.NewWriter(&b, key, saltsecret.ENCRYPT, false)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(plain); err != nil {
+		return nil, err
+	}
+	if err = w.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// decryptValue decrypts a column's value encrypted with key.
+func decryptValue(v, key []byte) ([]byte, error) {
+	r, err := saltsecret.NewReader(bytes.NewReader(v), key, saltsecret.DECRYPT, false)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// A Session is a summary of consecutive commands of a user at a host
+// without long gaps between them.
+type Session struct {
+	User, Host  string
+	Start, End  time.Time
+	Commands    int
+	First, Last string
+}
+
+// Sessions returns the sessions within the search criteria, ordered by
+// their start. Consecutive commands of the same user@host belong to the
+// same session if there is less than gap between them. Rows are streamed
+// ordered by datetime, we only keep an open session per user@host.
+func (d Database) Sessions(p conf.QueryParams, gap time.Duration) ([]Session, error) {
+	rows, err := d.Query(`SELECT user, host, command, datetime FROM history
+                               WHERE user LIKE ? AND host LIKE ? AND profile = ?
+                               ORDER BY datetime ASC`,
+		p.User, p.Host, d.Profile())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	open := make(map[string]*Session)
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		rows.Scan(&user, &host, &command, epoch{&t})
+		key := user + "@" + host
+		s := open[key]
+		if s != nil && t.Sub(s.End) >= gap {
+			sessions = append(sessions, *s)
+			s = nil
+		}
+		if s == nil {
+			s = &Session{User: user, Host: host, Start: t, First: command}
+			open[key] = s
+		}
+		s.End, s.Last = t, command
+		s.Commands++
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, s := range open {
+		sessions = append(sessions, *s)
+	}
+
+	sort.SliceStable(sessions, func(i, j int) bool {
+		if !sessions[i].Start.Equal(sessions[j].Start) {
+			return sessions[i].Start.Before(sessions[j].Start)
+		}
+		return sessions[i].User+"@"+sessions[i].Host < sessions[j].User+"@"+sessions[j].Host
+	})
+	return sessions, nil
+}
+
+// SessionsQuery returns the sessions within the search criteria, numbered
+// starting from 1, one per line.
+func (d Database) SessionsQuery(qp conf.QueryParams) ([]byte, error) {
+	sessions, err := d.Sessions(qp, time.Duration(qp.Gap)*time.Minute)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	var out bytes.Buffer
+	w := digits(len(sessions))
+	for i, s := range sessions {
+		if i > 0 {
+			out.WriteByte('\n')
+		}
+		out.WriteString(fmt.Sprintf("%*d | %s@%s | %s | %s | %d commands | %s ... %s",
+			w, i+1, s.User, s.Host, s.Start.Format(RFC3339alt), s.End.Sub(s.Start),
+			s.Commands, s.First, s.Last))
+	}
+	return out.Bytes(), nil
+}
+
+// SessionShow returns the commands of session qp.Kappa (as numbered by
+// SessionsQuery) in the requested format.
+func (d Database) SessionShow(qp conf.QueryParams) ([]byte, error) {
+	sessions, err := d.Sessions(qp, time.Duration(qp.Gap)*time.Minute)
+	if err != nil {
+		return []byte{}, err
+	}
+	if qp.Kappa < 1 || qp.Kappa > len(sessions) {
+		return []byte{}, errors.New(fmt.Sprintf("No such session: %d. There are %d sessions.", qp.Kappa, len(sessions)))
+	}
+	s := sessions[qp.Kappa-1]
+
+	rows, err := d.Query(`SELECT rowid, user, host, command, datetime FROM history
+                               WHERE user = ? AND host = ? AND profile = ? AND datetime >= ? AND datetime <= ?
+                               ORDER BY datetime ASC`,
+		s.User, s.Host, d.Profile(), s.Start.Unix(), s.End.Unix())
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	res := result.New(qp.Format)
+	notes := d.annotations(qp.User, qp.Host)
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		var row int
+		rows.Scan(&row, &user, &host, &command, epoch{&t})
+		res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
+	}
+	return res.Formatted(), nil
+}
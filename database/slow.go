@@ -0,0 +1,109 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// defaultSlowQuery is the slow statement threshold when SlowQuery isn't
+// given.
+const defaultSlowQuery = 250 * time.Millisecond
+
+// maxLoggedArg is how much of a string parameter slow statements are logged
+// with, command patterns can be long.
+const maxLoggedArg = 64
+
+// Rows is sql.Rows that logs its statement when it is closed, if it ran
+// slow. SQLite does most of its work as rows are read, so this is when we
+// know how long a query took.
+type Rows struct {
+	*sql.Rows
+	done func()
+}
+
+// Close is sql.Rows' Close.
+func (r *Rows) Close() error {
+	err := r.Rows.Close()
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+	return err
+}
+
+// SingleRow is sql.Row that logs its statement when it is scanned, if it ran
+// slow.
+type SingleRow struct {
+	*sql.Row
+	done func()
+}
+
+// Scan is sql.Row's Scan.
+func (r *SingleRow) Scan(dest ...interface{}) error {
+	err := r.Row.Scan(dest...)
+	if r.done != nil {
+		r.done()
+		r.done = nil
+	}
+	return err
+}
+
+// timeQuery starts timing query. The func it returns logs query and args
+// if it is called later than d's slow statement threshold.
+func (d Database) timeQuery(query string, args []interface{}) func() {
+	if d.slowQuery <= 0 {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		if took := time.Since(start); took >= d.slowQuery {
+			log.Warn.Printf("Slow statement, %s: %s\n", took.Round(time.Millisecond), loggedQuery(query, args))
+		}
+	}
+}
+
+// loggedQuery returns query on one line, with its parameters. Long string
+// parameters are cut.
+func loggedQuery(query string, args []interface{}) string {
+	s := strings.Join(strings.Fields(query), " ")
+	for i, a := range args {
+		switch v := a.(type) {
+		case string:
+			if len(v) > maxLoggedArg {
+				a = v[:maxLoggedArg] + "..."
+			}
+		case []byte:
+			if len(v) > maxLoggedArg {
+				a = string(v[:maxLoggedArg]) + "..."
+			}
+		}
+		if i == 0 {
+			s += " ["
+		} else {
+			s += ", "
+		}
+		s += quoteArg(a)
+	}
+	if len(args) > 0 {
+		s += "]"
+	}
+	return s
+}
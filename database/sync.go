@@ -0,0 +1,71 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"bytes"
+	"database/sql"
+	"time"
+)
+
+// SyncMargin is how much older than the server's latest command, history
+// lines are still sent by a sync. Shells write their history when they
+// exit, so lines of a long lived shell may come after newer ones.
+const SyncMargin = time.Hour
+
+// LastEntryTime returns the datetime of the latest command of user at host,
+// or the zero time if there are none.
+func (d Database) LastEntryTime(user, host string) (time.Time, error) {
+	var last time.Time
+	err := d.QueryRow(`SELECT datetime FROM history WHERE user = ? AND host = ? AND profile = ?
+                           ORDER BY datetime DESC LIMIT 1`,
+		user, host, d.Profile()).Scan(epoch{&last})
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return last, err
+}
+
+// HistorySince returns the lines of history that p decodes as run at most
+// SyncMargin before last, along with the lines it can't decode (they may be
+// of the export format, the importer deals with them). It reports false if
+// no line was run exactly at last, then we can't be sure last came from this
+// history (it was rotated, the host's clock jumped, etc), or if last is in
+// the future, then the host's clock was ahead and what it runs now looks
+// older. All of history should be sent instead.
+func HistorySince(history []byte, p LineParser, last time.Time) ([]byte, bool) {
+	if last.After(now()) {
+		return history, false
+	}
+	var out bytes.Buffer
+	found := false
+	since := last.Add(-SyncMargin)
+	for _, line := range bytes.SplitAfter(history, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		_, t, ok := p.Parse(string(bytes.TrimSuffix(line, []byte("\n"))))
+		if ok && t.Equal(last) {
+			found = true
+		}
+		if !ok || !t.Before(since) {
+			out.Write(line)
+		}
+	}
+	return out.Bytes(), found
+}
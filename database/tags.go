@@ -0,0 +1,87 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/result"
+)
+
+// TagCommand labels command of user@host with tag. A command may have
+// many tags.
+func (d Database) TagCommand(user, host, command, tag string) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+	if tag = strings.TrimSpace(tag); tag == "" {
+		return errors.New("Tag name can not be empty.")
+	}
+	_, err := d.Exec(`INSERT OR IGNORE INTO tags(user, host, command, tag) VALUES(?, ?, ?, ?)`,
+		user, host, command, tag)
+	return err
+}
+
+// GetByTag returns history within the search criteria whose command is
+// tagged with tag by the user@host who ran it, in the format requested.
+func (d Database) GetByTag(tag string, qp conf.QueryParams) ([]byte, error) {
+	rows, err := d.Query(`SELECT h.rowid, h.user, h.host, h.command, h.datetime FROM history AS h
+                               JOIN tags AS t ON h.user = t.user AND h.host = t.host AND h.command = t.command
+                               WHERE t.tag = ? AND h.user LIKE ? AND h.host LIKE ? AND h.profile = ? AND h.command LIKE ? ESCAPE '\'
+                               ORDER BY h.datetime ASC`,
+		tag, qp.User, qp.Host, d.Profile(), qp.Command)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer rows.Close()
+
+	res := result.New(qp.Format)
+	notes := d.annotations(qp.User, qp.Host)
+	for rows.Next() {
+		var user, host, command string
+		var t time.Time
+		var row int
+		rows.Scan(&row, &user, &host, &command, epoch{&t})
+		res.AddAnnotatedRow(row, user, host, command, t, notes.note(user, host, command))
+	}
+	return res.Formatted(), nil
+}
+
+// ListTags returns the tags of users and hosts matching user and host (they
+// may contain wildcards), sorted.
+func (d Database) ListTags(user, host string) ([]string, error) {
+	rows, err := d.Query(`SELECT DISTINCT tag FROM tags
+                               WHERE user LIKE ? AND host LIKE ?
+                               ORDER BY tag`,
+		user, host)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		rows.Scan(&tag)
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,365 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Limits for the writer's batches. A batch takes the rows queued while the
+// previous one was written, up to writeBatchRows rows or what arrives within
+// writeBatchWait of its first row, so an idle writer doesn't delay rows. An
+// import queues rows faster than they are written, so it commits about once
+// per writeBatchRows rows.
+const (
+	writeBatchRows = 10000
+	writeBatchWait = 5 * time.Millisecond
+)
+
+// insertRows is how many rows the writer inserts with one statement, when
+// they are queued one after the other. 7 parameters a row must stay below
+// SQLite's oldest limit of 999. 1 inserts every row on its own.
+// Rows of one import share all but their command and datetime, which
+// insertShared binds once per statement.
+var insertRows = 100
+
+// ErrClosed is returned by methods that write to the database after it was
+// closed.
+var ErrClosed = errors.New("Database is closed.")
+
+// A writer inserts history rows for all users of a Database from a single
+// goroutine. Rows are queued and written in batches, one transaction each, so
+// many small concurrent imports don't compete for SQLite's write lock. It
+// also writes the query log, so logging a query never waits for the lock.
+type writer struct {
+	db           *sql.DB
+	insert       *sql.Stmt
+	insertMany   *sql.Stmt // inserts insertRows rows
+	insertShared *sql.Stmt // inserts insertRows rows of one user, host, source, import and profile
+	logInsert    *sql.Stmt
+	retention    time.Duration // how long query log entries are kept, 0 is forever
+	slow         time.Duration // batches that take longer are logged, 0 logs none
+	jobs         chan writeJob
+	done         chan struct{}
+	committed    func([]Row)
+
+	sync.RWMutex // guards closed, so we never send on a closed jobs
+	closed       bool
+}
+
+// A writeJob is a row to insert and who waits for it, if anyone, or a query
+// log entry if entry isn't nil, or an audit log entry if audit isn't nil.
+type writeJob struct {
+	row     Row
+	pending *pending
+	entry   *QueryLogEntry
+	audit   *AuditEntry
+}
+
+// A pending tracks the queued rows of a caller, it may Wait for them to be
+// written.
+type pending struct {
+	sync.WaitGroup
+	sync.Mutex
+	duplicates int
+	err        error
+}
+
+func newWriter(db *sql.DB, insert, insertMany, insertShared, logInsert *sql.Stmt, retention, slow time.Duration) *writer {
+	w := &writer{db: db, insert: insert, insertMany: insertMany, insertShared: insertShared, logInsert: logInsert, retention: retention, slow: slow,
+		jobs: make(chan writeJob, writeBatchRows), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+// enqueue queues row to be written. If p isn't nil, it is updated once it
+// is.
+func (w *writer) enqueue(row Row, p *pending) error {
+	w.RLock()
+	defer w.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if p != nil {
+		p.Add(1)
+	}
+	w.jobs <- writeJob{row: row, pending: p}
+	return nil
+}
+
+// enqueueEntry queues e to be written to the query log.
+func (w *writer) enqueueEntry(e QueryLogEntry) error {
+	w.RLock()
+	defer w.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.jobs <- writeJob{entry: &e}
+	return nil
+}
+
+// enqueueAudit queues e to be written to the audit log.
+func (w *writer) enqueueAudit(e AuditEntry) error {
+	w.RLock()
+	defer w.RUnlock()
+	if w.closed {
+		return ErrClosed
+	}
+	w.jobs <- writeJob{audit: &e}
+	return nil
+}
+
+// close writes what is queued and stops the writer. It is safe to call it
+// many times.
+func (w *writer) close() {
+	w.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.jobs)
+	}
+	w.Unlock()
+	<-w.done
+}
+
+func (w *writer) run() {
+	defer close(w.done)
+	// write is done with a batch when it returns, so its slice is reused.
+	batch := make([]writeJob, 0, writeBatchRows)
+	for job := range w.jobs {
+		batch = append(batch[:0], job)
+		timeout := time.After(writeBatchWait)
+	collect:
+		for len(batch) < writeBatchRows {
+			select {
+			case job, ok := <-w.jobs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, job)
+			case <-timeout:
+				break collect
+			default:
+				break collect
+			}
+		}
+		w.write(batch)
+	}
+}
+
+// write inserts batch in a transaction and reports to whoever waits for its
+// rows. Duplicate rows are skipped. Other errors fail only their row, unless
+// the transaction fails. If the batch has query or audit log entries,
+// entries older than the retention are dropped too. Rows go insertRows at
+// a time until a statement has a duplicate, which fails it whole: the rest
+// of the batch, likely a re-import, goes one row at a time.
+func (w *writer) write(batch []writeJob) {
+	start := time.Now()
+	errs := make([]error, len(batch))
+	inserted := make([]Row, 0, len(batch))
+	var logged bool
+	var tx *sql.Tx
+	err := retryBusy(context.Background(), func() (err error) {
+		tx, err = w.db.Begin()
+		return err
+	})
+	if err == nil {
+		stmt, many, shared := tx.Stmt(w.insert), tx.Stmt(w.insertMany), tx.Stmt(w.insertShared)
+		duplicates := false
+		for i := 0; i < len(batch); i++ {
+			if insertRows > 1 && !duplicates && rowJobs(batch[i:]) == insertRows {
+				chunk := batch[i : i+insertRows]
+				e := insertChunk(many, shared, chunk)
+				if !isDuplicate(e) {
+					for j := range chunk {
+						if errs[i+j] = e; e == nil {
+							inserted = append(inserted, chunk[j].row)
+						}
+					}
+					i += insertRows - 1
+					continue
+				}
+				duplicates = true
+			}
+			if e := batch[i].entry; e != nil {
+				errs[i] = w.writeEntry(tx, e)
+				logged = true
+				continue
+			}
+			if e := batch[i].audit; e != nil {
+				errs[i] = writeAudit(tx, e)
+				logged = true
+				continue
+			}
+			row := &batch[i].row
+			var res sql.Result
+			errs[i] = retryBusy(context.Background(), func() (err error) {
+				res, err = stmt.Exec(row.User, row.Host, row.Command, row.Datetime.Unix(), nullString(row.Source), nullInt(row.ImportID), row.profile())
+				return err
+			})
+			if errs[i] == nil {
+				id, _ := res.LastInsertId()
+				row.ID = int(id)
+				inserted = append(inserted, *row)
+			}
+		}
+		if logged && w.retention > 0 {
+			cutoff := time.Now().Add(-w.retention).UTC()
+			if _, e := tx.Exec(`DELETE FROM querylog WHERE datetime < ?`, cutoff); e != nil {
+				log.Warn.Println("Couldn't prune the query log:", e)
+			}
+			if _, e := tx.Exec(`DELETE FROM audit_log WHERE datetime < ?`, cutoff.Format(auditTime)); e != nil {
+				log.Warn.Println("Couldn't prune the audit log:", e)
+			}
+		}
+		err = tx.Commit()
+	}
+	if took := time.Since(start); w.slow > 0 && took >= w.slow {
+		log.Warn.Printf("Slow write, %s: a batch of %d rows.\n", took.Round(time.Millisecond), len(batch))
+	}
+	if err == nil && w.committed != nil && len(inserted) > 0 {
+		w.committed(inserted)
+	}
+
+	for i, job := range batch {
+		if err != nil {
+			errs[i] = err
+		}
+		if job.pending == nil {
+			switch {
+			case errs[i] == nil:
+			case job.entry != nil:
+				log.Warn.Println("Couldn't write query log entry:", errs[i])
+			case job.audit != nil:
+				log.Warn.Println("Couldn't write audit log entry:", errs[i])
+			case !isDuplicate(errs[i]):
+				log.Warn.Println("Couldn't write history row:", errs[i])
+			}
+			continue
+		}
+		job.pending.Lock()
+		switch {
+		case errs[i] == nil:
+		case isDuplicate(errs[i]):
+			// We expect for ease of use, the user to resubmit the whole
+			// history from time to time.
+			log.Debug.Println("Duplicate entry. Ignoring.", job.row.User, job.row.Host, job.row.Command, job.row.Datetime)
+			job.pending.duplicates++
+		case job.pending.err == nil:
+			job.pending.err = errs[i]
+		}
+		job.pending.Unlock()
+		job.pending.Done()
+	}
+}
+
+// rowJobs returns how many of the jobs batch starts with are rows, up to
+// insertRows.
+func rowJobs(batch []writeJob) int {
+	n := 0
+	for n < len(batch) && n < insertRows && batch[n].entry == nil && batch[n].audit == nil {
+		n++
+	}
+	return n
+}
+
+// insertChunk inserts the rows of chunk with many, which inserts as many, or
+// with shared if they only differ in command and datetime. The rows get
+// consecutive rowids: history has no INTEGER PRIMARY KEY, so SQLite gives
+// each new row the largest rowid plus one.
+func insertChunk(many, shared *sql.Stmt, chunk []writeJob) error {
+	stmt, args := shared, sharedArgs(chunk)
+	if args == nil {
+		stmt, args = many, make([]interface{}, 0, 7*len(chunk))
+		for _, job := range chunk {
+			row := &job.row
+			args = append(args, row.User, row.Host, row.Command, row.Datetime.Unix(), nullString(row.Source), nullInt(row.ImportID), row.profile())
+		}
+	}
+	var res sql.Result
+	err := retryBusy(context.Background(), func() (err error) {
+		res, err = stmt.Exec(args...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	last, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for j := range chunk {
+		chunk[j].row.ID = int(last) - len(chunk) + 1 + j
+	}
+	return nil
+}
+
+// sharedArgs returns the arguments of insertShared for the rows of chunk, or
+// nil if they differ in more than command and datetime.
+func sharedArgs(chunk []writeJob) []interface{} {
+	first := &chunk[0].row
+	for _, job := range chunk {
+		row := &job.row
+		if row.User != first.User || row.Host != first.Host || row.Source != first.Source || row.ImportID != first.ImportID || row.Profile != first.Profile {
+			return nil
+		}
+	}
+	args := make([]interface{}, 0, 5+2*len(chunk))
+	args = append(args, first.User, first.Host, nullString(first.Source), nullInt(first.ImportID), first.profile())
+	for _, job := range chunk {
+		args = append(args, job.row.Command, job.row.Datetime.Unix())
+	}
+	return args
+}
+
+// writeEntry inserts e into the query log within tx.
+func (w *writer) writeEntry(tx *sql.Tx, e *QueryLogEntry) error {
+	params, err := json.Marshal(e.Params)
+	if err != nil {
+		return err
+	}
+	return retryBusy(context.Background(), func() error {
+		_, err := tx.Stmt(w.logInsert).Exec(e.Datetime.UTC(), e.Remote, e.User, e.Type,
+			string(params), e.Rows, e.DurationMs)
+		return err
+	})
+}
+
+// writeAudit inserts e into the audit log within tx.
+func writeAudit(tx *sql.Tx, e *AuditEntry) error {
+	return retryBusy(context.Background(), func() error {
+		_, err := tx.Exec(`INSERT INTO audit_log(datetime, user, host, operation, status, rows_affected)
+                               VALUES(?, ?, ?, ?, ?, ?)`, e.Datetime.UTC().Format(auditTime), e.User, e.Host,
+			e.Operation, e.Status, e.RowsAffected)
+		return err
+	})
+}
+
+// nullInt returns i for SQL, NULL if it is 0.
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
+
+// nullString returns s for SQL, NULL if it is empty.
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -107,6 +107,10 @@ Environment variables:
     $ export BASHISTDB_KEY=<PASSPHRASE>
     $ bashistdb -verbose 1
 
+Your user and hostname are read from $USER (or the system's user database) and
+the system. In containers these are often missing or random, so BASHISTDB_USER
+and BASHISTDB_HOST override them. Run with -verbose 2 to see which one was used.
+
 Configuration file (~/.bashistdb.conf) is better. You can create it and update
 it with bashistdb:
 
@@ -126,8 +130,9 @@ may get a listen address configuration option in the future.
 ### Knobs ###
 
 Run `bashistdb -h` to get a glimpse of available options. They are easy to understand.
-Currently the most useful command not covered until here is `-g`. G stands for global
-and makes your query to search for commands from all users at any host.
+Queries search for commands from all users at any host by default. Use
+`-query-user` and `-query-host` (or `-user` and `-host`) to narrow them down.
+`-g` stands for global and resets both to any user at any host.
 
 License
 -------
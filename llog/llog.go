@@ -22,58 +22,152 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"log/syslog"
 	"os"
 )
 
-// Levels for verbosity.
+// Levels for verbosity. Errors and warnings are always shown, apart from
+// warnings in SILENT level.
 const (
-	SILENT = iota // SILENT discards everything (apart those sent to the unnamed logger)
-	INFO          // INFO shows only informational messages
-	DEBUG         // DEBUG shows both info and debug messages, adding filename and linenumber
+	SILENT = iota // SILENT discards everything apart from errors (and those sent to the unnamed logger)
+	INFO          // INFO shows warnings and informational messages
+	DEBUG         // DEBUG shows also debug messages, adding filename and linenumber
+	TRACE         // TRACE shows also trace messages (very verbose)
+)
+
+// Names of the levels, as used in JSON output.
+const (
+	LEVEL_FATAL = "fatal"
+	LEVEL_ERROR = "error"
+	LEVEL_WARN  = "warn"
+	LEVEL_INFO  = "info"
+	LEVEL_DEBUG = "debug"
+	LEVEL_TRACE = "trace"
 )
 
 // A Logger offers an unnamed logger for logging critical events,
-// an info loffer for logging informational messages and a debug
-// logger for logging debug information.
+// an error logger for errors we can recover from, a warn logger for
+// things the user should know about, an info logger for logging
+// informational messages, a debug logger for logging debug information
+// and a trace logger for really verbose output.
 type Logger struct {
 	*log.Logger
+	Error *log.Logger
+	Warn  *log.Logger
 	Info  *log.Logger
 	Debug *log.Logger
+	Trace *log.Logger
+
+	file *reopenFile    // nil unless logging to a file
+	sys  *syslog.Writer // nil unless logging to syslog
+}
+
+// Options set where and how a Logger writes. The zero value logs
+// plain text to stderr.
+type Options struct {
+	File   string // If set, log to this file (append). It is reopened on SIGHUP.
+	JSON   bool   // Write one JSON object per line instead of plain text.
+	Syslog bool   // Also send logs to the local syslog daemon (facility daemon).
 }
 
-// New creates a new Logger of verbosity level.
+// New creates a new Logger of verbosity level that logs to stderr.
 func New(verbosity int) *Logger {
-	var deb, inf *log.Logger
-	var debOut, infOut io.Writer
-	debMod := log.Ldate | log.Ltime
-	infMod := log.Ldate | log.Ltime
+	l, _ := NewWithOptions(verbosity, Options{})
+	return l
+}
+
+// NewWithOptions creates a new Logger of verbosity level with the given
+// destination options. If the log file or syslog can not be opened, it
+// returns a Logger that writes to stderr along with the error.
+func NewWithOptions(verbosity int, o Options) (*Logger, error) {
+	var out io.Writer = os.Stderr
+	var err error
+	var f *reopenFile
+	if o.File != "" {
+		if f, err = openLogFile(o.File); err == nil {
+			out = f
+		}
+	}
+	var sys *syslog.Writer
+	if o.Syslog && err == nil {
+		sys, err = syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "bashistdb")
+	}
+
+	var warnOut, infOut, debOut, trcOut io.Writer
+	mod := log.Ldate | log.Ltime
 
 	switch verbosity {
 	case SILENT:
+		warnOut = ioutil.Discard
 		infOut = ioutil.Discard
 		debOut = ioutil.Discard
+		trcOut = ioutil.Discard
 	case INFO:
-		infOut = os.Stderr
+		warnOut, infOut = out, out
 		debOut = ioutil.Discard
+		trcOut = ioutil.Discard
 	case DEBUG:
-		infOut = os.Stderr
-		debOut = os.Stderr
-		debMod = log.Ldate | log.Ltime | log.Lshortfile
-		infMod = log.Ldate | log.Ltime | log.Lshortfile
+		warnOut, infOut, debOut = out, out, out
+		trcOut = ioutil.Discard
+		mod = log.Ldate | log.Ltime | log.Lshortfile
+	case TRACE:
+		warnOut, infOut, debOut, trcOut = out, out, out, out
+		mod = log.Ldate | log.Ltime | log.Lshortfile
 	default:
-		infOut = os.Stderr
+		warnOut, infOut = out, out
 		debOut = ioutil.Discard
+		trcOut = ioutil.Discard
 	}
 
-	// std is used for logging fatal errors
-	std := log.New(os.Stderr, "", log.Ldate|log.Ltime|log.Lshortfile)
+	fatalOut, errOut := out, out
+	if sys != nil {
+		fatalOut = withSyslog(fatalOut, sys, LEVEL_FATAL)
+		errOut = withSyslog(errOut, sys, LEVEL_ERROR)
+		warnOut = withSyslog(warnOut, sys, LEVEL_WARN)
+		infOut = withSyslog(infOut, sys, LEVEL_INFO)
+		debOut = withSyslog(debOut, sys, LEVEL_DEBUG)
+		trcOut = withSyslog(trcOut, sys, LEVEL_TRACE)
+	}
 
-	// inf is used for logging info messages
-	inf = log.New(infOut, "", infMod)
+	l := &Logger{
+		// std is used for logging fatal errors
+		Logger: newLevel(fatalOut, LEVEL_FATAL, "", log.Ldate|log.Ltime|log.Lshortfile, o.JSON),
+		Error:  newLevel(errOut, LEVEL_ERROR, "ERROR: ", mod, o.JSON),
+		Warn:   newLevel(warnOut, LEVEL_WARN, "WARN: ", mod, o.JSON),
+		Info:   newLevel(infOut, LEVEL_INFO, "", mod, o.JSON),
+		Debug:  newLevel(debOut, LEVEL_DEBUG, "", mod, o.JSON),
+		Trace:  newLevel(trcOut, LEVEL_TRACE, "TRACE: ", mod, o.JSON),
+		file:   f,
+		sys:    sys,
+	}
+	l.Debug.Println("Debug enabled.")
+
+	return l, err
+}
 
-	// std is used for logging debug messages
-	deb = log.New(debOut, "", debMod)
-	deb.Println("Debug enabled.")
+// Close closes the log file and syslog connection of l, if it has them,
+// and stops reopening the file on SIGHUP. l shouldn't be used after it.
+func (l *Logger) Close() error {
+	var err error
+	if l.file != nil {
+		err = l.file.Close()
+	}
+	if l.sys != nil {
+		if e := l.sys.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
 
-	return &Logger{std, inf, deb}
+// newLevel returns a log.Logger for a level. In JSON mode the timestamp and
+// level are added by the jsonWriter, so we only keep the filename flag.
+func newLevel(out io.Writer, level, prefix string, flags int, json bool) *log.Logger {
+	if out == ioutil.Discard {
+		return log.New(out, "", 0)
+	}
+	if json {
+		return log.New(jsonWriter{level, out}, "", flags&log.Lshortfile)
+	}
+	return log.New(out, prefix, flags)
 }
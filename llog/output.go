@@ -0,0 +1,159 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package llog
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A jsonLine is a single log entry in JSON output mode.
+type jsonLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+// A jsonWriter wraps each log line it receives into a JSON object.
+// log.Logger calls Write once per message, so each call is one line.
+type jsonWriter struct {
+	level string
+	out   io.Writer
+}
+
+func (j jsonWriter) Write(p []byte) (int, error) {
+	b, err := json.Marshal(jsonLine{
+		Time:    time.Now().Format(time.RFC3339),
+		Level:   j.level,
+		Message: strings.TrimSuffix(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err = j.out.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// A syslogWriter sends each log line it receives to syslog with the
+// severity that matches its level.
+type syslogWriter struct {
+	level string
+	w     *syslog.Writer
+}
+
+func (s syslogWriter) Write(p []byte) (int, error) {
+	m := strings.TrimSuffix(string(p), "\n")
+	var err error
+	switch s.level {
+	case LEVEL_FATAL:
+		err = s.w.Crit(m)
+	case LEVEL_ERROR:
+		err = s.w.Err(m)
+	case LEVEL_WARN:
+		err = s.w.Warning(m)
+	case LEVEL_INFO:
+		err = s.w.Info(m)
+	default: // debug and trace
+		err = s.w.Debug(m)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// withSyslog adds syslog as a destination to out for the given level.
+// Levels that are discarded stay discarded.
+func withSyslog(out io.Writer, w *syslog.Writer, level string) io.Writer {
+	if out == ioutil.Discard {
+		return out
+	}
+	return io.MultiWriter(out, syslogWriter{level, w})
+}
+
+// A reopenFile is a log file opened in append mode. It is reopened when
+// the process receives SIGHUP, so it plays well with logrotate.
+type reopenFile struct {
+	sync.Mutex
+	name string
+	f    *os.File
+	hup  chan os.Signal
+	done chan struct{}
+}
+
+func openLogFile(name string) (*reopenFile, error) {
+	r := &reopenFile{name: name, hup: make(chan os.Signal, 1), done: make(chan struct{})}
+	if err := r.Reopen(); err != nil {
+		return nil, err
+	}
+
+	signal.Notify(r.hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-r.hup:
+				if err := r.Reopen(); err != nil {
+					os.Stderr.WriteString("Could not reopen log file: " + err.Error() + "\n")
+				}
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r, nil
+}
+
+// Reopen closes (if open) and opens again the log file.
+func (r *reopenFile) Reopen() error {
+	f, err := os.OpenFile(r.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.f != nil {
+		_ = r.f.Close()
+	}
+	r.f = f
+	return nil
+}
+
+func (r *reopenFile) Write(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Write(p)
+}
+
+// Close stops reopening the log file on SIGHUP and closes it.
+func (r *reopenFile) Close() error {
+	signal.Stop(r.hup)
+	close(r.done)
+	r.Lock()
+	defer r.Unlock()
+	return r.f.Close()
+}
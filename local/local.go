@@ -20,9 +20,11 @@ package local
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
 
 	conf "github.com/andmarios/bashistdb/configuration"
 	"github.com/andmarios/bashistdb/database"
@@ -33,31 +35,77 @@ var log *llog.Logger
 
 // Run is the local process of bashistdb.
 func Run() error {
-	db, err := database.New()
+	log = conf.Log
+
+	// Queries that don't write open the database read-only, so a wrong
+	// -db fails instead of creating an empty database. Rebuilding the key
+	// needs to write, whatever we run after.
+	opts := []database.Option{database.RejectsFile(conf.RejectsFile), database.SlowQuery(conf.SlowQuery)}
+	readOnly := conf.Operation == conf.OP_QUERY && !conf.QParams.Writes() && !conf.KeyIncludesHost
+	if conf.ReadOnly || readOnly {
+		opts = append(opts, database.ReadOnly())
+	}
+	if conf.KeyIncludesHost {
+		opts = append(opts, database.KeyIncludesHost())
+	}
+	if conf.NormalizeNames {
+		opts = append(opts, database.NormalizeNames(conf.StripDomains))
+	}
+	db, err := database.Open(conf.Database, conf.Log, opts...)
 	if err != nil {
 		return errors.New("Failed to load database: " + err.Error())
 	}
 	defer db.Close()
 
-	log = conf.Log
+	// On SIGINT cancel what we are doing, so we return and close the
+	// database cleanly. A second SIGINT kills us as usual.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			signal.Stop(interrupt)
+			log.Info.Println("Interrupted, canceling.")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	db = db.WithContext(ctx).WithSource(conf.Source).WithProfile(conf.Profile)
 
 	switch conf.Operation {
 	case conf.OP_IMPORT:
-		r := bufio.NewReader(os.Stdin)
-		stats, err := db.AddFromBuffer(r, conf.User, conf.Hostname)
+		r, err := database.Decompress(bufio.NewReader(os.Stdin), conf.Gzip)
 		if err != nil {
 			return errors.New("Error while processing stdin: " +
 				err.Error())
 		}
-		// We print to log because we usually want this to be quiet
-		// as we may run it every time we hit ENTER in a bash prompt.
-		log.Info.Println(stats)
-	case conf.OP_QUERY:
-		res, err := db.RunQuery(conf.QParams)
+		parser, _ := database.ParserFor(conf.Format, conf.TimeLayout)
+		stats, err := db.WithParser(parser).Import(r, conf.User, conf.Hostname)
 		if err != nil {
+			return errors.New("Error while processing stdin: " +
+				err.Error())
+		}
+		return database.ReportImport(stats, conf.QParams.Format, os.Stdout)
+	case conf.OP_RECORD:
+		switch err := db.AddRecord(conf.User, conf.Hostname, conf.Record, conf.RecordTime); {
+		case errors.Is(err, database.ErrDuplicate):
+			log.Info.Println(err)
+		case err != nil:
+			return errors.New("Error while recording command: " + err.Error())
+		default:
+			log.Info.Println("Command recorded.")
+		}
+	case conf.OP_QUERY:
+		// Stream to stdout, big results never have to fit in memory.
+		w := bufio.NewWriter(os.Stdout)
+		defer w.Flush()
+		if err := db.StreamQuery(conf.QParams, w); err != nil {
 			return err
 		}
-		fmt.Println(string(res))
+		fmt.Fprintln(w)
 	}
 	return nil
 }
@@ -0,0 +1,120 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// cacheEntries is how many results a queryCache keeps at most.
+const cacheEntries = 1024
+
+// A queryCache keeps query results for a while, so the same query from
+// clients doesn't hit the database again. A zero ttl disables it.
+type queryCache struct {
+	ttl time.Duration
+	max int // cacheEntries if zero
+
+	mu sync.Mutex
+	m  map[[sha256.Size]byte]cacheEntry // by cacheKey(profile, qp)
+}
+
+type cacheEntry struct {
+	result  []byte
+	expires time.Time
+}
+
+// cacheKey returns the key for the results of qp in profile.
+func cacheKey(profile string, qp conf.QueryParams) [sha256.Size]byte {
+	b, _ := json.Marshal(struct {
+		Profile string
+		QParams conf.QueryParams
+	}{profile, qp})
+	return sha256.Sum256(b)
+}
+
+// get returns the cached result of qp in profile, if it hasn't expired.
+func (c *queryCache) get(profile string, qp conf.QueryParams) ([]byte, bool) {
+	if c.ttl == 0 {
+		return nil, false
+	}
+	key := cacheKey(profile, qp)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.m[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.m, key)
+		return nil, false
+	}
+	return e.result, true
+}
+
+// put caches result as the result of qp in profile. It drops the expired
+// results, so they don't pile up on servers that are only queried, and if
+// the cache is still full, the one that expires first.
+func (c *queryCache) put(profile string, qp conf.QueryParams, result []byte) {
+	if c.ttl == 0 {
+		return
+	}
+	key := cacheKey(profile, qp)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m == nil {
+		c.m = make(map[[sha256.Size]byte]cacheEntry)
+	}
+	var first [sha256.Size]byte
+	var firstExpires time.Time
+	for k, e := range c.m {
+		if now.After(e.expires) {
+			delete(c.m, k)
+		} else if firstExpires.IsZero() || e.expires.Before(firstExpires) {
+			first, firstExpires = k, e.expires
+		}
+	}
+	max := c.max
+	if max == 0 {
+		max = cacheEntries
+	}
+	if _, ok := c.m[key]; !ok && len(c.m) >= max {
+		delete(c.m, first)
+	}
+	c.m[key] = cacheEntry{result, now.Add(c.ttl)}
+}
+
+// len returns how many results are cached, expired or not.
+func (c *queryCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.m)
+}
+
+// flush drops all cached results. It is called when the history changes.
+func (c *queryCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.m = nil
+}
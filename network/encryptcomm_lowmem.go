@@ -22,6 +22,8 @@ package network
 import (
 	"bytes"
 	"encoding/gob"
+	"errors"
+	"io"
 	"net"
 	"runtime/debug"
 
@@ -34,15 +36,25 @@ func init() {
 	conf.Log.Debug.Println("Lowmem build.")
 }
 
-func encryptDispatch(conn net.Conn, m Message) error {
+// encryptDispatch encrypts m with key, or signs it if signed is set, and sends
+// it.
+func encryptDispatch(conn net.Conn, m Message, key []byte, signed bool) error {
 	// We want to sent encrypted data.
 	// In order to encrypt, we need to first serialize the message.
 	// In order to sent/receive hassle free, we need to serialize the encrypted message
 	// So: msg -> [GOB] -> [ENCRYPT] -> [GOB] -> (dispatch)
+	// Signed messages skip [ENCRYPT], their tag is appended instead.
+	if signed {
+		tagged, err := sign(m, key)
+		if err != nil {
+			return err
+		}
+		return gob.NewEncoder(conn).Encode(tagged)
+	}
 
 	// Create encrypter
 	var encMsg bytes.Buffer
-	encrypter, err := saltsecret.NewWriter(&encMsg, conf.Key, saltsecret.ENCRYPT, true)
+	encrypter, err := saltsecret.NewWriter(&encMsg, key, saltsecret.ENCRYPT, true)
 	if err != nil {
 		return err
 	}
@@ -67,7 +79,12 @@ func encryptDispatch(conn net.Conn, m Message) error {
 	return nil
 }
 
-func receiveDecrypt(conn net.Conn) (Message, error) {
+// receiveDecrypt receives a message and tries each of keys until one
+// decrypts it, or verifies it if signed is set. It returns the index of the key that succeeded, so we can
+// reply with the same key during key rotation.
+// Pass the same buffered reader to receive many messages from conn, a
+// new reader may consume more than one message.
+func receiveDecrypt(conn io.Reader, keys [][]byte, signed bool) (Message, int, error) {
 	// Our work is:
 	// (receive) -> [de-GOB] -> [DECRYPT] -> [de-GOB] -> msg
 
@@ -75,12 +92,30 @@ func receiveDecrypt(conn net.Conn) (Message, error) {
 	encMsg := new([]byte)
 	receive := gob.NewDecoder(conn)
 	if err := receive.Decode(encMsg); err != nil {
-		return Message{}, err
+		return Message{}, -1, err
 	}
 
+	err := errors.New("No keys to decrypt message.")
+	for i, key := range keys {
+		var msg Message
+		if signed {
+			msg, err = verify(*encMsg, key)
+		} else {
+			msg, err = decrypt(*encMsg, key)
+		}
+		if err == nil {
+			log.Debug.Printf("Decrypted message with key %d.\n", i)
+			return msg, i, nil
+		}
+	}
+	return Message{}, -1, err
+}
+
+// decrypt decrypts and de-serializes an encrypted message with key.
+func decrypt(encMsg []byte, key []byte) (Message, error) {
 	// Create decrypter and pass it the encrypted message
-	r := bytes.NewReader(*encMsg)
-	decrypter, err := saltsecret.NewReader(r, conf.Key, saltsecret.DECRYPT, false)
+	r := bytes.NewReader(encMsg)
+	decrypter, err := saltsecret.NewReader(r, key, saltsecret.DECRYPT, false)
 	if err != nil {
 		return Message{}, err
 	}
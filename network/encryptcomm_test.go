@@ -0,0 +1,101 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+func TestKeyRotation(t *testing.T) {
+	defer func(mode string) { conf.AuthMode = mode }(conf.AuthMode)
+	for _, mode := range []string{conf.AUTH_ENCRYPT, conf.AUTH_SIGN} {
+		conf.AuthMode = mode
+		testKeyRotation(t)
+	}
+}
+
+func testKeyRotation(t *testing.T) {
+	newKey, oldKey := []byte("new passphrase"), []byte("old passphrase")
+
+	tests := []struct {
+		client []byte
+		server [][]byte
+		index  int
+		test   string
+	}{
+		{newKey, [][]byte{newKey, oldKey}, 0, "primary key"},
+		{oldKey, [][]byte{newKey, oldKey}, 1, "old key"},
+		{oldKey, [][]byte{newKey}, -1, "unknown key"},
+	}
+	for _, v := range tests {
+		client, server := net.Pipe()
+		sent := Message{Type: QUERY, User: "user1", Hostname: "host1"}
+		go func() {
+			encryptDispatch(client, sent, v.client, false)
+			client.Close()
+		}()
+
+		msg, index, err := receiveDecrypt(server, v.server, false)
+		server.Close()
+		if v.index == -1 {
+			if err == nil {
+				t.Fatalf("Test '%s': message decrypted with a key the server doesn't have.", v.test)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test '%s': %s", v.test, err.Error())
+		}
+		if index != v.index {
+			t.Fatalf("Test '%s': decrypted with key %d, wanted %d.", v.test, index, v.index)
+		}
+		if msg.Type != sent.Type || msg.User != sent.User || msg.Hostname != sent.Hostname {
+			t.Fatalf("Test '%s': received %+v, sent %+v.", v.test, msg, sent)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	key := []byte("passphrase")
+	sent := Message{Type: QUERY, User: "user1", Hostname: "host1"}
+	signed, err := sign(sent, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Signed messages aren't encrypted.
+	if !bytes.Contains(signed, []byte("host1")) {
+		t.Fatal("Signed message should be readable.")
+	}
+	if msg, err := verify(signed, key); err != nil || msg.User != sent.User {
+		t.Fatalf("Verify failed: %+v (%v)", msg, err)
+	}
+	if _, err = verify(signed, []byte("other passphrase")); err == nil {
+		t.Fatal("Verify with another key should fail.")
+	}
+	if _, err = verify(signed[:10], key); err == nil {
+		t.Fatal("Verify of a truncated message should fail.")
+	}
+	signed[len(signed)/2] ^= 1
+	if _, err = verify(signed, key); err == nil {
+		t.Fatal("Verify of a changed message should fail.")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+	"github.com/andmarios/bashistdb/result"
+	"github.com/andmarios/bashistdb/version"
+)
+
+// subscriberBuffer is how many imports a subscriber may fall behind before
+// we start dropping rows for it.
+const subscriberBuffer = 16
+
+// heartbeatInterval is how often we send a follower a HEARTBEAT. A
+// follower that doesn't read one within an interval is dropped, a server
+// that misses heartbeatMisses is taken to be gone. Tests shorten it.
+var heartbeatInterval = 30 * time.Second
+
+// heartbeatMisses is how many heartbeats a follower waits for before it
+// gives up on the server.
+const heartbeatMisses = 3
+
+// A subscriber is a client following new history rows that match its
+// search criteria.
+type subscriber struct {
+	rows                chan []database.Row
+	profile             string
+	user, host, command *regexp.Regexp
+}
+
+// match reports whether row is within the subscriber's search criteria.
+func (s *subscriber) match(row database.Row) bool {
+	return row.Profile == s.profile && s.user.MatchString(row.User) && s.host.MatchString(row.Host) &&
+		s.command.MatchString(row.Command)
+}
+
+// A broker fans out committed rows to subscribers. Publishing never blocks
+// on slow or gone subscribers, so imports aren't held back by them.
+type broker struct {
+	sync.Mutex
+	subs map[*subscriber]bool
+}
+
+func newBroker() *broker {
+	return &broker{subs: make(map[*subscriber]bool)}
+}
+
+// subscribe adds a subscriber for rows of profile within qp's search
+// criteria. An empty profile is the default one.
+func (b *broker) subscribe(qp conf.QueryParams, profile string) (*subscriber, error) {
+	if profile == "" {
+		profile = database.DefaultProfile
+	}
+	s := &subscriber{rows: make(chan []database.Row, subscriberBuffer), profile: profile}
+	var err error
+	if s.user, err = likeRegexp(qp.User); err != nil {
+		return nil, err
+	}
+	if s.host, err = likeRegexp(qp.Host); err != nil {
+		return nil, err
+	}
+	switch qp.Regex {
+	case true:
+		s.command, err = regexp.Compile(qp.Command)
+	default:
+		s.command, err = likeRegexp(qp.Command)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b.Lock()
+	b.subs[s] = true
+	b.Unlock()
+	return s, nil
+}
+
+// unsubscribe removes s, it won't receive rows anymore.
+func (b *broker) unsubscribe(s *subscriber) {
+	b.Lock()
+	delete(b.subs, s)
+	b.Unlock()
+}
+
+// publish sends rows to the subscribers they match. It is meant to be set
+// with Database.OnCommit.
+func (b *broker) publish(rows []database.Row) {
+	b.Lock()
+	defer b.Unlock()
+	for s := range b.subs {
+		var matched []database.Row
+		for _, r := range rows {
+			if s.match(r) {
+				matched = append(matched, r)
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		select {
+		case s.rows <- matched:
+		default:
+			log.Warn.Printf("Subscriber is too slow, dropped %d rows.\n", len(matched))
+		}
+	}
+}
+
+// likeRegexp converts a SQL LIKE pattern (with \ as escape character) to a
+// regular expression. As SQLite's LIKE, it is case insensitive.
+func likeRegexp(pattern string) (*regexp.Regexp, error) {
+	var re bytes.Buffer
+	re.WriteString("(?is)^")
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			re.WriteString(".*")
+		case c == '_':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// serveFollow sends the client the rows that match its search criteria as
+// they are imported, until ctx is done (the client disconnected) or the
+// client stops reading. In between rows it sends heartbeats, so clients gone
+// without closing the connection are noticed too. It returns the status to
+// log for the connection.
+func (srv *server) serveFollow(ctx context.Context, conn net.Conn, msg Message, key []byte) string {
+	s, err := srv.subscribers.subscribe(srv.db.NormalParams(msg.QParams), msg.Profile)
+	if err != nil {
+		log.Error.Println(err.Error())
+		encryptDispatch(conn, Message{Type: RESULT, Payload: []byte(err.Error()), Version: version.Version}, key, srv.signed)
+		return "error"
+	}
+	defer srv.subscribers.unsubscribe(s)
+
+	// Let the client know we are ready, so nothing imported from now on
+	// is missed.
+	// Writes that take longer than a heartbeat are from clients that don't
+	// read anymore.
+	send := func(m Message) error {
+		conn.SetWriteDeadline(time.Now().Add(heartbeatInterval))
+		return encryptDispatch(conn, m, key, srv.signed)
+	}
+	ack := Message{Type: LOGINFO, Payload: []byte("Following new history."), Version: version.Version,
+		Protocol: protocolVersion}
+	if err = send(ack); err != nil {
+		return "reply_failed"
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return "ok"
+		case <-heartbeat.C:
+			// Older clients ignore message types they don't know.
+			if err = send(Message{Type: HEARTBEAT, Version: version.Version}); err != nil {
+				log.Debug.Println("Follower missed a heartbeat:", err.Error())
+				return "heartbeat_failed"
+			}
+		case rows := <-s.rows:
+			res := result.New(msg.QParams.Format)
+			for _, r := range rows {
+				res.AddRow(r.ID, r.User, r.Host, r.Command, r.Datetime)
+			}
+			reply := Message{Type: RESULT, Payload: res.Formatted(), Version: version.Version}
+			if err = send(reply); err != nil {
+				log.Debug.Println("Follower gone:", err.Error())
+				return "ok"
+			}
+		}
+	}
+}
+
+// clientFollow writes the rows the server sends to w until it disconnects.
+// Servers of protocolVersion 3 or later send heartbeats, if they miss
+// heartbeatMisses of them we take them to be gone. If we follow a profile
+// other than the default, servers older than profiles are refused.
+func clientFollow(conn net.Conn, key []byte, signed, profiled bool, w io.Writer) error {
+	r := bufio.NewReader(conn)
+	beats := false
+	for {
+		if beats {
+			conn.SetReadDeadline(time.Now().Add(heartbeatMisses * heartbeatInterval))
+		}
+		reply, _, err := receiveDecrypt(r, [][]byte{key}, signed)
+		if err == io.EOF {
+			return nil
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return errors.New("The server stopped sending heartbeats, it is gone.")
+		}
+		if err != nil {
+			return err
+		}
+		switch reply.Type {
+		case RESULT:
+			if _, err = fmt.Fprintln(w, string(reply.Payload)); err != nil {
+				return err
+			}
+		case LOGINFO:
+			if profiled && reply.Protocol < 4 {
+				return errProfiles
+			}
+			log.Info.Println("Received:", string(reply.Payload))
+			beats = reply.Protocol >= 3
+		case HEARTBEAT:
+			log.Trace.Println("Received heartbeat.")
+		case ERROR:
+			return replyErr(reply)
+		}
+	}
+}
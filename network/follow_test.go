@@ -0,0 +1,190 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+)
+
+func TestFollow(t *testing.T) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Database = f.Name()
+	f.Close()
+	os.Remove(conf.Database)
+	defer os.Remove(conf.Database)
+
+	db, err := database.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := []byte("passphrase")
+	s := newServer(db, [][]byte{key})
+
+	// Subscriber
+	follower, server := net.Pipe()
+	defer follower.Close()
+	go s.handleConn(server)
+	sub := Message{Type: SUBSCRIBE, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%git%", Format: conf.FORMAT_LOG}}
+	if err = encryptDispatch(follower, sub, key, false); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(follower)
+	ack, _, err := receiveDecrypt(r, s.keys, false)
+	if err != nil || ack.Type != LOGINFO {
+		t.Fatalf("Subscription wasn't acknowledged: %v %v", ack, err)
+	}
+
+	// Another connection imports history
+	importer, server2 := net.Pipe()
+	defer importer.Close()
+	go s.handleConn(server2)
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 git status\n")}
+	if err = encryptDispatch(importer, history, key, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = receiveDecrypt(importer, s.keys, false); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, _, err := receiveDecrypt(r, s.keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2015-10-12T12:00:41+0000 user1@host1 git status"
+	if msg.Type != RESULT || string(msg.Payload) != want {
+		t.Fatalf("Subscriber received wrong rows.\nWanted: %s\nGot   : %s", want, string(msg.Payload))
+	}
+}
+
+func TestLikeRegexp(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"%", "anything", true},
+		{"%git%", "sudo git push", true},
+		{"git%", "sudo git push", false},
+		{"l_", "ls", true},
+		{"l_", "lsof", false},
+		{"LS", "ls", true},
+		{"100\\%", "100%", true},
+		{"100\\%", "1000", false},
+		{"a.b", "axb", false},
+	}
+	for _, v := range tests {
+		re, err := likeRegexp(v.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re.MatchString(v.s) != v.match {
+			t.Fatalf("Pattern '%s' on '%s': wanted match %v.", v.pattern, v.s, v.match)
+		}
+	}
+}
+
+func TestFollowHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 20 * time.Millisecond
+
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Database = f.Name()
+	f.Close()
+	os.Remove(conf.Database)
+	defer os.Remove(conf.Database)
+
+	db, err := database.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := []byte("passphrase")
+	s := newServer(db, [][]byte{key})
+
+	follower, server := net.Pipe()
+	defer follower.Close()
+	go s.handleConn(server)
+	sub := Message{Type: SUBSCRIBE, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%", Format: conf.FORMAT_LOG}, Protocol: protocolVersion}
+	if err = encryptDispatch(follower, sub, key, false); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(follower)
+	ack, _, err := receiveDecrypt(r, s.keys, false)
+	if err != nil || ack.Type != LOGINFO || ack.Protocol < 3 {
+		t.Fatalf("Subscription wasn't acknowledged: %v %v", ack, err)
+	}
+	msg, _, err := receiveDecrypt(r, s.keys, false)
+	if err != nil || msg.Type != HEARTBEAT {
+		t.Fatalf("Subscriber didn't receive a heartbeat: %v %v", msg, err)
+	}
+
+	// A follower that stops reading is dropped.
+	for i := 0; ; i++ {
+		s.subscribers.Lock()
+		n := len(s.subscribers.subs)
+		s.subscribers.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Follower that stopped reading wasn't dropped.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientFollowHeartbeat(t *testing.T) {
+	defer func(d time.Duration) { heartbeatInterval = d }(heartbeatInterval)
+	heartbeatInterval = 20 * time.Millisecond
+	key := []byte("passphrase")
+
+	// A server that acknowledges and then goes silent.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go encryptDispatch(server, Message{Type: LOGINFO, Payload: []byte("Following new history."),
+		Protocol: protocolVersion}, key, false)
+
+	done := make(chan error)
+	go func() { done <- clientFollow(client, key, false, false, ioutil.Discard) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("Client following a silent server should fail.")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Client kept following a silent server.")
+	}
+}
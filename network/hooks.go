@@ -0,0 +1,239 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andmarios/bashistdb/database"
+)
+
+// Hooks are actions the server takes when it imports commands that match a
+// watchlist. They are read from a file of lines like these, # starts a
+// comment:
+//
+//	match [@HOST] REGEXP   the actions below are for imported commands that
+//	                       match REGEXP, run at hosts matching the LIKE
+//	                       pattern HOST if it is set
+//	exec PROGRAM [ARG...]  run PROGRAM, {user}, {host}, {command}, {datetime}
+//	                       and {row} in ARGs are replaced with the row's
+//	post URL               POST the row as JSON to URL
+//
+// Arguments are split at spaces, there is no quoting. Actions run in the
+// background, one at a time and at most hookRate a minute, the rest are
+// dropped. Their failures are logged, imports never wait for them.
+type Hooks struct {
+	rules []hookRule
+	jobs  chan hookJob
+}
+
+// A hookRule is a match line and its actions.
+type hookRule struct {
+	pattern string         // the REGEXP, as written
+	host    *regexp.Regexp // nil matches any host
+	command *regexp.Regexp
+	actions []hookAction
+}
+
+// A hookAction is an exec or post line.
+type hookAction struct {
+	argv []string // to exec, if set
+	url  string   // to post to, if argv isn't set
+}
+
+// A hookJob is an action to take for a row.
+type hookJob struct {
+	action  hookAction
+	row     database.Row
+	pattern string
+}
+
+const (
+	hookRate    = 30               // actions a minute, at most
+	hookQueue   = 64               // actions waiting to run, more are dropped
+	hookTimeout = 30 * time.Second // how long an action may take
+)
+
+// LoadHooks reads hooks from r and starts the goroutine that runs their
+// actions.
+func LoadHooks(r io.Reader) (*Hooks, error) {
+	h := &Hooks{jobs: make(chan hookJob, hookQueue)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.Fields(line)[0]
+		rest := strings.TrimSpace(line[len(entry):])
+		if entry != "match" && len(h.rules) == 0 {
+			return nil, fmt.Errorf("Hooks line %d: %s before any match.", n, entry)
+		}
+		switch entry {
+		case "match":
+			var rule hookRule
+			if strings.HasPrefix(rest, "@") {
+				host := strings.Fields(rest)[0]
+				var err error
+				if rule.host, err = likeRegexp(host[1:]); err != nil {
+					return nil, fmt.Errorf("Hooks line %d: %s", n, err.Error())
+				}
+				rest = strings.TrimSpace(rest[len(host):])
+			}
+			if rest == "" {
+				return nil, fmt.Errorf("Hooks line %d: match needs a regular expression.", n)
+			}
+			var err error
+			if rule.command, err = regexp.Compile(rest); err != nil {
+				return nil, fmt.Errorf("Hooks line %d: %s", n, err.Error())
+			}
+			rule.pattern = rest
+			h.rules = append(h.rules, rule)
+		case "exec":
+			if rest == "" {
+				return nil, fmt.Errorf("Hooks line %d: exec needs a program.", n)
+			}
+			h.addAction(hookAction{argv: strings.Fields(rest)})
+		case "post":
+			if !strings.HasPrefix(rest, "http://") && !strings.HasPrefix(rest, "https://") {
+				return nil, fmt.Errorf("Hooks line %d: post needs an http or https URL.", n)
+			}
+			h.addAction(hookAction{url: rest})
+		default:
+			return nil, fmt.Errorf("Hooks line %d: unknown entry '%s'.", n, entry)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	for _, rule := range h.rules {
+		if len(rule.actions) == 0 {
+			return nil, fmt.Errorf("Hooks: match %s has no actions.", rule.pattern)
+		}
+	}
+	go h.work()
+	return h, nil
+}
+
+// addAction adds a to the last match.
+func (h *Hooks) addAction(a hookAction) {
+	rule := &h.rules[len(h.rules)-1]
+	rule.actions = append(rule.actions, a)
+}
+
+// queue queues the actions of the rules rows match. It is meant to be called
+// from Database.OnCommit, so it doesn't block: if too many actions wait
+// already, the new ones are dropped.
+func (h *Hooks) queue(rows []database.Row) {
+	dropped := 0
+	for _, row := range rows {
+		for _, rule := range h.rules {
+			if (rule.host != nil && !rule.host.MatchString(row.Host)) || !rule.command.MatchString(row.Command) {
+				continue
+			}
+			for _, a := range rule.actions {
+				select {
+				case h.jobs <- hookJob{a, row, rule.pattern}:
+				default:
+					dropped++
+				}
+			}
+		}
+	}
+	if dropped > 0 {
+		log.Warn.Printf("Too many hook actions waiting, dropped %d.\n", dropped)
+	}
+}
+
+// work runs the queued actions, one at a time, never more than hookRate a
+// minute.
+func (h *Hooks) work() {
+	var start time.Time
+	var ran, dropped int
+	for job := range h.jobs {
+		if time.Since(start) > time.Minute {
+			if dropped > 0 {
+				log.Warn.Printf("Hooks ran over %d actions a minute, dropped %d.\n", hookRate, dropped)
+			}
+			start, ran, dropped = time.Now(), 0, 0
+		}
+		if ran >= hookRate {
+			dropped++
+			continue
+		}
+		ran++
+		if err := job.run(); err != nil {
+			log.Warn.Printf("Hook for '%s' failed on row %d: %s\n", job.pattern, job.row.ID, err.Error())
+		}
+	}
+}
+
+// run takes the job's action for its row.
+func (j hookJob) run() error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	if j.action.argv != nil {
+		r := strings.NewReplacer("{user}", j.row.User, "{host}", j.row.Host, "{command}", j.row.Command,
+			"{datetime}", j.row.Datetime.Format(time.RFC3339), "{row}", strconv.Itoa(j.row.ID))
+		argv := make([]string, len(j.action.argv))
+		for i, a := range j.action.argv {
+			argv[i] = r.Replace(a)
+		}
+		out, err := exec.CommandContext(ctx, argv[0], argv[1:]...).CombinedOutput()
+		if err != nil && len(out) > 0 {
+			return fmt.Errorf("%s: %s", err.Error(), bytes.TrimSpace(out))
+		}
+		return err
+	}
+
+	body, err := json.Marshal(struct {
+		Row                 int
+		Datetime            time.Time
+		User, Host, Command string
+		Source, Match       string `json:",omitempty"`
+	}{j.row.ID, j.row.Datetime, j.row.User, j.row.Host, j.row.Command, j.row.Source, j.pattern})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", j.action.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("%s replied %s", j.action.url, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadHooks(t *testing.T) {
+	for _, bad := range []string{
+		"exec echo before any match\n",
+		"match\nexec echo no regexp\n",
+		"match userdel\n",
+		"match (unclosed\nexec echo\n",
+		"match userdel\npost ftp://example.com\n",
+		"match userdel\nmail root\n",
+	} {
+		if _, err := LoadHooks(strings.NewReader(bad)); err == nil {
+			t.Errorf("Hooks '%s' should get an error.", bad)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	db, _ := newTestDB(t)
+	dir, err := ioutil.TempDir("", "test-bashistdb-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	posted := make(chan map[string]interface{}, 10)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var row map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&row)
+		posted <- row
+	}))
+	defer web.Close()
+
+	hooks, err := LoadHooks(strings.NewReader(`# alerts
+match @prod% \buserdel\b
+post ` + web.URL + `
+match ^iptables\s+-F
+exec touch ` + dir + `/{user}-{host}
+`))
+	if err != nil {
+		t.Fatal("Loading hooks failed: " + err.Error())
+	}
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key}, WithHooks(hooks))
+
+	history := Message{Type: HISTORY, User: "alice", Hostname: "ignored",
+		Payload: []byte(`alice dev1 2015-10-12T12:00:40+0000 userdel bob
+alice prod1 2015-10-12T12:00:41+0000 sudo userdel carol
+alice prod1 2015-10-12T12:00:42+0000 iptables -F
+alice prod1 2015-10-12T12:00:43+0000 ls
+`)}
+	if err := Request(l.Addr().String(), key, history, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+
+	select {
+	case row := <-posted:
+		if row["Command"] != "sudo userdel carol" || row["Host"] != "prod1" {
+			t.Fatalf("Hook posted the wrong row: %v", row)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hook didn't post the matching row.")
+	}
+	for i := 0; ; i++ {
+		if _, err = os.Stat(filepath.Join(dir, "alice-prod1")); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Hook didn't run its program for the matching row.")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case row := <-posted:
+		t.Fatalf("Hook posted a row it shouldn't: %v", row)
+	default:
+	}
+}
@@ -21,11 +21,16 @@ package network
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	conf "github.com/andmarios/bashistdb/configuration"
 	"github.com/andmarios/bashistdb/database"
@@ -35,10 +40,21 @@ import (
 
 // Message Types
 const (
-	RESULT  = "result"  // (query) results that should be printed
-	HISTORY = "history" // history to import
-	QUERY   = "query"   // query to run
-	LOGINFO = "info"    // results that should go to log.Info
+	RESULT       = "result"      // (query) results that should be printed
+	PART         = "part"        // part of a result, more messages follow
+	HISTORY      = "history"     // history to import
+	QUERY        = "query"       // query to run
+	LOGINFO      = "info"        // results that should go to log.Info
+	SUBSCRIBE    = "subscribe"   // follow new history rows
+	SUGGEST      = "suggest"     // complete a command prefix, sent on every keystroke
+	FLUSH_CACHE  = "flushcache"  // drop the server's cached query results
+	MULTI_QUERY  = "multiquery"  // many queries to run, results come in one reply
+	MULTI_RESULT = "multiresult" // results of a MULTI_QUERY, in the same order
+	RECORD       = "record"      // a single command to add, as it is run
+	SYNCINFO     = "syncinfo"    // ask for, or reply with, the latest datetime of user@host
+	ERROR        = "error"       // the request was refused, the payload says why
+	HEARTBEAT    = "heartbeat"   // keeps a SUBSCRIBE connection alive, nothing to print
+	KEY_ROTATION = "keyrotation" // make the payload the server's primary key, admin keys only
 )
 
 // A Message is the communication unit between server and client.
@@ -49,10 +65,84 @@ type Message struct {
 	Hostname string
 	QParams  conf.QueryParams
 	Version  string
+	Queries  []conf.QueryParams    // MULTI_QUERY queries
+	Results  [][]byte              // MULTI_RESULT results, one per query
+	Datetime time.Time             // when the RECORD command was run, or the SYNCINFO reply
+	Protocol int                   // the sender's protocolVersion, older clients send 0
+	Stats    *database.ImportStats // HISTORY import statistics, for clients of protocolVersion 1 or later
+	Source   string                // label of the HISTORY or RECORD command lines
+	Profile  string                // the history to read and write, the default profile if empty
+	Code     string                // of ERROR replies, which of errorCodes the error is, if any
+	// Forwarded is set on HISTORY a server forwards to its Upstream, which
+	// doesn't forward it again, so servers that forward to each other
+	// don't loop.
+	Forwarded bool
 }
 
+// protocolVersion is the version of the messages we understand. Servers
+// reply to HISTORY with Stats from version 1 on, older clients get the
+// statistics in a sentence. From version 2 on, refused requests get an
+// ERROR reply instead of a RESULT. From version 3 on, servers send
+// followers a HEARTBEAT when quiet, so followers notice if they are gone.
+// From version 4 on, servers keep the Profile of messages apart and say
+// so in the Protocol of their replies.
+const protocolVersion = 4
+
+// errProfiles is returned to clients of a profile other than the default
+// when the server replies without protocolVersion 4: it doesn't know
+// profiles, it used its whole history.
+var errProfiles = errors.New("The server is too old for profiles, it used the default one.")
+
+// ErrUnauthorized is what requests the server refuses for the client's key
+// fail with, see errors.Is.
+var ErrUnauthorized = errors.New("The server refused the request for your key.")
+
+// A replyError is an error with the message of an ERROR reply, that is one
+// of errorCodes, so clients can tell it apart with errors.Is.
+type replyError struct {
+	msg string
+	err error // nil if it is none of errorCodes
+}
+
+func (e replyError) Error() string { return e.msg }
+func (e replyError) Unwrap() error { return e.err }
+
+// errorCodes are the errors ERROR replies name in their Code.
+var errorCodes = map[string]error{
+	"unauthorized": ErrUnauthorized,
+	"read_only":    database.ErrReadOnly,
+}
+
+// errorCode returns the code of err, empty if it is none of errorCodes.
+func errorCode(err error) string {
+	for code, e := range errorCodes {
+		if errors.Is(err, e) {
+			return code
+		}
+	}
+	return ""
+}
+
+// replyErr returns the error of an ERROR reply.
+func replyErr(reply Message) error {
+	return replyError{string(reply.Payload), errorCodes[reply.Code]}
+}
+
+// profiled reports whether msg is for a profile other than the default.
+func profiled(msg Message) bool {
+	return msg.Profile != "" && msg.Profile != conf.DEFAULT_PROFILE
+}
+
+// frameSize is how much of a query's result the server buffers before it
+// sends it as a PART message. Every message costs a key derivation, so
+// frames are big.
+const frameSize = 1 << 20
+
+// requestTimeout is how long the server works on a request before it
+// gives up. Follow requests don't time out.
+const requestTimeout = 5 * time.Minute
+
 var log *llog.Logger
-var db database.Database
 
 func init() {
 	log = conf.Log
@@ -60,126 +150,723 @@ func init() {
 
 // ServerMode is the server process of bashistdb.
 func ServerMode() error {
-	var err error
-	db, err = database.New()
+	opts := []database.Option{database.RejectsFile(conf.RejectsFile), database.MaxCommandBytes(conf.MaxCommandBytes),
+		database.QueryLogRetention(conf.QueryLogKeep), database.SlowQuery(conf.SlowQuery)}
+	if conf.ReadOnly {
+		opts = append(opts, database.ReadOnly())
+	}
+	if conf.KeyIncludesHost {
+		opts = append(opts, database.KeyIncludesHost())
+	}
+	if conf.NormalizeNames {
+		opts = append(opts, database.NormalizeNames(conf.StripDomains))
+	}
+	db, err := database.Open(conf.Database, conf.Log, opts...)
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	s, err := net.Listen("tcp", conf.Address)
+	l, err := net.Listen("tcp", conf.Address)
 	if err != nil {
 		return err
 	}
+	var policy *Policy
+	if conf.PolicyFile != "" {
+		f, err := os.Open(conf.PolicyFile)
+		if err != nil {
+			return err
+		}
+		policy, err = LoadPolicy(f, conf.Keys)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		log.Info.Println("Loaded access policy from:", conf.PolicyFile)
+	}
+	var hooks *Hooks
+	if conf.HooksFile != "" {
+		f, err := os.Open(conf.HooksFile)
+		if err != nil {
+			return err
+		}
+		hooks, err = LoadHooks(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		log.Info.Println("Loaded hooks from:", conf.HooksFile)
+	}
+
 	log.Info.Println("Started listening on:", conf.Address)
+	if conf.ReadOnly {
+		log.Info.Println("Serving read-only: imports and changes are refused, connections aren't logged.")
+	}
+	var upstream *Upstream
+	if conf.Upstream != "" {
+		upstream = &Upstream{Address: conf.Upstream, Key: conf.Key}
+		log.Info.Println("Forwarding imported history to:", conf.Upstream)
+	}
+	return Serve(l, db, conf.Keys, KeyUsers(conf.KeyUsers), WithPolicy(policy), WithHooks(hooks),
+		WithUpstream(upstream), CacheTTL(conf.CacheTTL), KeyRotationGrace(conf.KeyRotationGracePeriod))
+}
+
+// A server serves clients from a database.
+type server struct {
+	db          database.Database
+	mu          sync.RWMutex // guards keys and access, KEY_ROTATION replaces them
+	keys        [][]byte     // the first one is the primary
+	access      []access     // access[i] is what keys[i] grants
+	policy      *Policy      // nil if the server has none
+	subscribers *broker
+	cache       *queryCache
+	upstream    *Upstream     // nil if the server has none
+	signed      bool          // whether messages are signed instead of encrypted
+	grace       time.Duration // how long KEY_ROTATION keeps accepting the old key
+}
+
+func newServer(db database.Database, keys [][]byte, opts ...ServerOption) *server {
+	o := serverOptions{grace: defaultKeyRotationGrace, signed: signing()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	policy, hooks := o.policy, o.hooks
+	s := &server{db: db, policy: policy, subscribers: newBroker(), cache: &queryCache{ttl: o.cacheTTL}, upstream: o.upstream,
+		signed: o.signed, grace: o.grace}
+	for i, k := range keys {
+		var a access
+		switch {
+		case i < len(o.users) && o.users[i] != "":
+			a.user = o.users[i]
+		case policy != nil:
+			a.claimed = true
+		default:
+			a.admin = true
+		}
+		s.keys = append(s.keys, k)
+		s.access = append(s.access, a)
+	}
+	if policy != nil {
+		s.keys = append(s.keys, policy.keys...)
+		s.access = append(s.access, policy.access...)
+	}
+	db.OnCommit(func(rows []database.Row) {
+		s.cache.flush()
+		s.subscribers.publish(rows)
+		if hooks != nil {
+			hooks.queue(rows)
+		}
+	})
+	return s
+}
+
+// Serve accepts connections on l and serves them from db. Clients may
+// encrypt their messages with any of keys, replies are encrypted with the
+// key the client used. Without opts, every key has full access and query
+// results aren't cached. It returns when l is closed.
+func Serve(l net.Listener, db database.Database, keys [][]byte, opts ...ServerOption) error {
+	return newServer(db, keys, opts...).serve(l)
+}
+
+// serve accepts connections on l and serves them, until l is closed.
+func (s *server) serve(l net.Listener) error {
 	for {
-		conn, err := s.Accept()
-		if err != nil {
-			log.Info.Println("ERROR:", err.Error())
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
 		}
-		log.Info.Printf("Connection from %s.\n", conn.RemoteAddr())
-		err = db.LogConn(conn.RemoteAddr())
 		if err != nil {
-			log.Info.Println("ERROR:", err.Error())
+			log.Error.Println(err.Error())
+			continue
 		}
-		go handleConn(conn)
+		log.Debug.Printf("Connection from %s.\n", conn.RemoteAddr())
+		go s.handleConn(conn)
 	}
-	//	return nil // go vet doesn't like this...
 }
 
 // ClientMode is the client process fo bashistdb.
 func ClientMode() error {
-	log.Debug.Println("Connecting to: ", conf.Address)
-	conn, err := net.Dial("tcp", conf.Address)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
 	var msg Message
 
 	switch conf.Operation {
 	case conf.OP_IMPORT: // If Operation == OP_IMPORT, attempt to read from Stdin
-		r := bufio.NewReader(os.Stdin)
+		// We decompress here so the server gets plain history.
+		r, err := database.Decompress(bufio.NewReader(os.Stdin), conf.Gzip)
+		if err != nil {
+			return err
+		}
 		history, err := ioutil.ReadAll(r)
 		if err != nil {
 			return err
 		}
 
+		// The server needs the format, and layout, to decode history with.
 		msg = Message{Type: HISTORY, Payload: history, User: conf.User,
-			Hostname: conf.Hostname}
-
-		log.Info.Println("Sent history.")
+			Hostname: conf.Hostname, QParams: conf.QueryParams{Format: conf.Format, TimeLayout: conf.TimeLayout}, Source: conf.Source}
+		if conf.Sync {
+			parser, _ := database.ParserFor(conf.Format, conf.TimeLayout)
+			msg.Payload = syncHistory(conf.Address, conf.Key, msg, parser)
+			if len(msg.Payload) == 0 {
+				log.Info.Println("Nothing new to import.")
+				return nil
+			}
+		}
+		// The server's sentence goes to the log, the statistics are printed
+		// as JSON too with -format json.
+		stats, err := RequestImport(conf.Address, conf.Key, msg)
+		if err != nil {
+			return err
+		}
+		if stats == nil {
+			// Older servers reply with a sentence only.
+			if conf.QParams.Format == conf.FORMAT_JSON {
+				log.Warn.Println("Server doesn't send import statistics, can't print them as JSON.")
+			}
+			return nil
+		}
+		if conf.QParams.Format != conf.FORMAT_JSON {
+			return stats.Err()
+		}
+		return database.ReportImport(*stats, conf.QParams.Format, os.Stdout)
 	case conf.OP_QUERY:
 		msg = Message{Type: QUERY, User: conf.User, Hostname: conf.Hostname, QParams: conf.QParams}
+		if conf.QParams.Type == conf.QUERY_SUGGEST {
+			msg = Message{Type: SUGGEST, Payload: []byte(conf.QParams.Command), User: conf.User,
+				Hostname: conf.Hostname, QParams: conf.QueryParams{Kappa: conf.QParams.Kappa}}
+		}
+	case conf.OP_FOLLOW:
+		msg = Message{Type: SUBSCRIBE, User: conf.User, Hostname: conf.Hostname, QParams: conf.QParams}
+	case conf.OP_FLUSH_CACHE:
+		msg = Message{Type: FLUSH_CACHE, User: conf.User, Hostname: conf.Hostname}
+	case conf.OP_ROTATE_KEY:
+		msg = Message{Type: KEY_ROTATION, Payload: conf.NewKey, User: conf.User, Hostname: conf.Hostname}
+	case conf.OP_RECORD:
+		msg = Message{Type: RECORD, Payload: []byte(conf.Record), User: conf.User,
+			Hostname: conf.Hostname, Datetime: conf.RecordTime, Source: conf.Source}
+	case conf.OP_MULTI_QUERY:
+		msg = Message{Type: MULTI_QUERY, User: conf.User, Hostname: conf.Hostname, Queries: conf.Queries}
 	default:
 		return errors.New("unknown function")
 	}
+	msg.Profile = conf.Profile
+
+	if conf.Watch > 0 {
+		return watch(context.Background(), conf.Address, conf.Key, msg, conf.Watch, !conf.NoClear, os.Stdout)
+	}
+	return Request(conf.Address, conf.Key, msg, os.Stdout)
+}
+
+// Request sends msg to the server at address, encrypted with key, and
+// writes the results the server replies with to w. The results of a
+// MULTI_QUERY are written in order, with an empty line between them.
+// Informational replies, such as import statistics, go to the log. For
+// SUBSCRIBE messages it keeps writing rows until the server disconnects.
+func Request(address string, key []byte, msg Message, w io.Writer) error {
+	reply, err := request(address, key, signing(), msg, w)
+	if err == nil && reply.Stats != nil {
+		err = reply.Stats.Err()
+	}
+	return err
+}
+
+// RequestImport sends msg, a HISTORY message, to the server at address and
+// returns the import statistics it replies with. The sentence the server
+// replies with too goes to the log. Servers older than protocolVersion 1
+// only send the sentence, the statistics are nil.
+func RequestImport(address string, key []byte, msg Message) (*database.ImportStats, error) {
+	reply, err := request(address, key, signing(), msg, ioutil.Discard)
+	return reply.Stats, err
+}
+
+// request is Request, it returns the server's final reply. Messages are
+// signed instead of encrypted if signed is set.
+func request(address string, key []byte, signed bool, msg Message, w io.Writer) (Message, error) {
+	log.Debug.Println("Connecting to: ", address)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return Message{}, err
+	}
+	defer conn.Close()
 
 	msg.Version = version.Version
+	if msg.Protocol == 0 {
+		msg.Protocol = protocolVersion
+	}
 
-	if err := encryptDispatch(conn, msg); err != nil {
-		return err
+	if err := encryptDispatch(conn, msg, key, signed); err != nil {
+		return Message{}, err
+	}
+	log.Debug.Println("Sent request.")
+
+	if msg.Type == SUBSCRIBE {
+		return Message{}, clientFollow(conn, key, signed, profiled(msg), w)
 	}
-	log.Info.Println("Sent request.")
 
-	reply, err := receiveDecrypt(conn)
+	// Big results come in parts, we write them as they arrive.
+	r := bufio.NewReader(conn)
+	reply, _, err := receiveDecrypt(r, [][]byte{key}, signed)
+	for err == nil && reply.Type == PART {
+		if _, err = w.Write(reply.Payload); err != nil {
+			return Message{}, err
+		}
+		reply, _, err = receiveDecrypt(r, [][]byte{key}, signed)
+	}
 	if err != nil {
-		return err
+		return Message{}, err
 	}
 
 	if reply.Version != version.Version {
-		log.Info.Println("Server runs different bashistdb version from client:", reply.Version)
+		log.Warn.Println("Server runs different bashistdb version from client:", reply.Version)
+	}
+	if profiled(msg) && reply.Protocol < 4 && reply.Type != ERROR {
+		return reply, errProfiles
 	}
 
 	switch reply.Type {
 	case RESULT:
-		fmt.Println(string(reply.Payload))
+		_, err = fmt.Fprintln(w, string(reply.Payload))
+	case MULTI_RESULT:
+		for i, res := range reply.Results {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if _, err = fmt.Fprintln(w, string(res)); err != nil {
+				return reply, err
+			}
+		}
 	case LOGINFO:
-		log.Info.Println("Received:", string(reply.Payload))
+		// Servers may send statistics without their sentence.
+		if len(reply.Payload) == 0 && reply.Stats != nil {
+			log.Info.Println("Received:", reply.Stats)
+		} else {
+			log.Info.Println("Received:", string(reply.Payload))
+		}
+	case ERROR:
+		err = replyErr(reply)
 	}
-	return nil
+	return reply, err
 }
 
 // handleConn is the server code that handles clients (reads message type and performs relevant operation)
-func handleConn(conn net.Conn) {
+func (s *server) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	msg, err := receiveDecrypt(conn)
+	// Keys may be rotated while we serve, we stick to the ones we had.
+	s.mu.RLock()
+	keys, access := s.keys, s.access
+	s.mu.RUnlock()
+
+	msg, key, err := receiveDecrypt(conn, keys, s.signed)
+	// Suggestions come on every keystroke, keep them out of the connection
+	// log. Read-only servers have none.
+	if (err != nil || msg.Type != SUGGEST) && !s.db.ReadOnly() {
+		if err := s.db.LogConn(conn.RemoteAddr()); err != nil {
+			log.Error.Println(err.Error())
+		}
+	}
 	if err != nil {
-		log.Info.Println(err, "["+conn.RemoteAddr().String()+"]")
+		log.Warn.Println(err, "["+conn.RemoteAddr().String()+"]")
+		logAccess(conn, msg, "decrypt_failed")
 		return
 	}
 	if msg.Version != version.Version {
-		log.Info.Println("Client runs different bashistdb version from server:", msg.Version)
+		log.Warn.Println("Client runs different bashistdb version from server:", msg.Version)
+	}
+	a := access[key]
+	claimed, start := msg.User, time.Now()
+	if err = s.policy.authorize(&msg, a, conn.RemoteAddr()); err != nil {
+		log.Warn.Println(err, "["+conn.RemoteAddr().String()+"]")
+		reply := Message{Type: RESULT, Payload: []byte(err.Error()), Version: version.Version}
+		if msg.Protocol >= 2 {
+			reply.Type, reply.Code = ERROR, errorCode(err)
+		}
+		encryptDispatch(conn, reply, keys[key], s.signed)
+		logAccess(conn, msg, "denied")
+		s.audit(msg, "denied", 0)
+		return
 	}
+	if s.db.ReadOnly() && writes(msg) {
+		reply := Message{Type: RESULT, Payload: []byte(errReadOnly.Error()), Version: version.Version}
+		if msg.Protocol >= 2 {
+			reply.Type, reply.Code = ERROR, errorCode(errReadOnly)
+		}
+		encryptDispatch(conn, reply, keys[key], s.signed)
+		logAccess(conn, msg, "read_only")
+		return
+	}
+	// Clients may spell their user and host differently than the names we
+	// store, SYNCINFO and SUGGEST look them up as they are.
+	msg.User, msg.Hostname = s.db.NormalUser(msg.User), s.db.NormalHost(msg.Hostname)
+	// Limited keys import only as their user and host.
+	var user, host string
+	if !a.admin {
+		user, host = msg.User, a.host
+	}
+	log.Trace.Printf("Received %s message with %d bytes payload.\n", msg.Type, len(msg.Payload))
+
+	// The client doesn't send anything else, reading returns when it is
+	// gone, so a dropped client cancels its request.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		cancel()
+	}()
+
+	if msg.Type == SUBSCRIBE {
+		status := s.serveFollow(ctx, conn, msg, keys[key])
+		logAccess(conn, msg, status)
+		s.audit(msg, status, 0)
+		return
+	}
+
+	ctx, cancelTimeout := context.WithTimeout(ctx, requestTimeout)
+	defer cancelTimeout()
+	db := s.db.WithContext(ctx).WithProfile(msg.Profile)
 
 	var result []byte
+	var results [][]byte            // for MULTI_QUERY
+	var stats *database.ImportStats // for HISTORY
+	var last time.Time              // for SYNCINFO
+	var served []servedQuery        // for the query log
+	var imported int                // for the audit log
+	status := "ok"
 	switch msg.Type {
 	case HISTORY:
+		// Older clients don't send a format, they only have bash's.
+		parser, ok := database.ParserFor(msg.QParams.Format, msg.QParams.TimeLayout)
+		if !ok && msg.QParams.Format != "" {
+			err = errors.New("Unknown import format: " + msg.QParams.Format)
+			log.Error.Println(err.Error())
+			result = []byte(err.Error())
+			status = "error"
+			break
+		}
 		r := bufio.NewReader(bytes.NewReader(msg.Payload))
-		res, err := db.AddFromBuffer(r, msg.User, msg.Hostname)
+		res, err := db.WithParser(parser).ForUser(user).ForHost(host).WithSource(msg.Source).Import(r, msg.User, msg.Hostname)
+		switch {
+		case err != nil:
+			log.Error.Println(err.Error())
+			result = []byte(err.Error())
+			status = "error"
+		case msg.Protocol >= 1:
+			stats = &res
+			fallthrough
+		default:
+			// The sentence is for people, and for clients before protocol
+			// version 1.
+			result = []byte(res.String())
+		}
+		imported = res.Added
+		log.Debug.Println("Client sent history: ", res)
+		if err == nil && s.upstream != nil && !msg.Forwarded {
+			go s.upstream.forward(msg, host, s.signed)
+		}
+	case RECORD:
+		if len(msg.Payload) == 0 || msg.Datetime.IsZero() {
+			err = errors.New("Record without command or datetime.")
+		} else {
+			err = db.WithSource(msg.Source).AddRecord(msg.User, msg.Hostname, string(msg.Payload), msg.Datetime)
+		}
+		switch {
+		case errors.Is(err, database.ErrDuplicate):
+			result = []byte(err.Error())
+		case err != nil:
+			log.Error.Println(err.Error())
+			result = []byte(err.Error())
+			status = "error"
+		default:
+			result = []byte("Command recorded.")
+			imported = 1
+		}
+		log.Debug.Println("Client sent command: ", string(msg.Payload))
+	case SYNCINFO:
+		if last, err = db.LastEntryTime(msg.User, msg.Hostname); err != nil {
+			log.Error.Println(err.Error())
+			result = []byte(err.Error())
+			status = "error"
+		}
+	case SUGGEST:
+		var commands []string
+		commands, err = db.Suggest(msg.User, msg.Hostname, string(msg.Payload), msg.QParams.Kappa)
 		if err != nil {
+			log.Error.Println(err.Error())
 			result = []byte(err.Error())
+			status = "error"
 		} else {
-			result = []byte(res)
+			result = []byte(strings.Join(commands, "\n"))
 		}
-		log.Info.Println("Client sent history: ", res)
 	case QUERY:
-		result, err = db.RunQuery(msg.QParams)
-		if err != nil {
-			log.Info.Println("ERROR:", err.Error())
+		if cached, ok := s.cache.get(msg.Profile, msg.QParams); ok {
+			log.Debug.Println("Query result served from cache.")
+			result = cached
+			served = append(served, servedQuery{msg.QParams, countLines(cached)})
+			break
+		}
+		frames := &frameWriter{conn: conn, key: keys[key], signed: s.signed}
+		lines := &lineCounter{Writer: frames}
+		err = db.StreamQuery(msg.QParams, lines)
+		result = frames.buf.Bytes()
+		served = append(served, servedQuery{msg.QParams, lines.lines()})
+		switch {
+		case err != nil:
+			log.Error.Println(err.Error())
 			result = []byte(err.Error())
+			status = "error"
+		case msg.QParams.Writes():
+			s.cache.flush()
+		case !frames.sent: // Results sent in parts are too big to keep.
+			s.cache.put(msg.Profile, msg.QParams, result)
 		}
-		log.Info.Printf("Client sent %s query for '%s' as '%s'@'%s', '%s' format.\n",
+		log.Debug.Printf("Client sent %s query for '%s' as '%s'@'%s', '%s' format.\n",
 			msg.Type, msg.QParams.User, msg.QParams.Host, msg.QParams.Command, msg.QParams.Format)
+	case MULTI_QUERY:
+		results = make([][]byte, len(msg.Queries))
+		for i, qp := range msg.Queries {
+			if cached, ok := s.cache.get(msg.Profile, qp); ok {
+				results[i] = cached
+				served = append(served, servedQuery{qp, countLines(cached)})
+				continue
+			}
+			var buf bytes.Buffer
+			if err = db.StreamQuery(qp, &buf); err != nil {
+				log.Error.Println(err.Error())
+				results[i] = []byte(err.Error())
+				status = "error"
+				continue
+			}
+			results[i] = buf.Bytes()
+			served = append(served, servedQuery{qp, countLines(results[i])})
+			if qp.Writes() {
+				s.cache.flush()
+			} else {
+				s.cache.put(msg.Profile, qp, results[i])
+			}
+		}
+		log.Debug.Printf("Client sent %s with %d queries.\n", msg.Type, len(msg.Queries))
+	case FLUSH_CACHE:
+		s.cache.flush()
+		result = []byte("Query cache flushed.")
+	case KEY_ROTATION:
+		grace := s.grace
+		if err = s.rotateKey(msg.Payload, grace); err != nil {
+			log.Error.Println(err.Error())
+			result = []byte(err.Error())
+			status = "error"
+			break
+		}
+		log.Info.Printf("Key rotated by %s, the old one is accepted for %s more.\n", conn.RemoteAddr(), grace)
+		result = []byte(fmt.Sprintf("Server key rotated, the old one is accepted for %s more.", grace))
 	}
 
 	reply := Message{Type: RESULT, Payload: result, Version: version.Version}
-	if msg.Type == HISTORY {
+	if msg.Type == MULTI_QUERY {
+		reply = Message{Type: MULTI_RESULT, Results: results, Version: version.Version}
+	}
+	if msg.Type == SYNCINFO && status == "ok" {
+		reply = Message{Type: SYNCINFO, Datetime: last, Version: version.Version}
+	}
+	reply.Protocol = protocolVersion
+	if msg.Type == HISTORY || msg.Type == RECORD || msg.Type == FLUSH_CACHE || msg.Type == KEY_ROTATION {
 		reply.Type = LOGINFO
+		reply.Stats = stats
+	}
+	// Clients that know KEY_ROTATION know ERROR, they mustn't switch keys
+	// if it failed.
+	if msg.Type == KEY_ROTATION && status != "ok" {
+		reply.Type = ERROR
+	}
+	// Reply with the key the client used, it may not know the primary yet.
+	if err := encryptDispatch(conn, reply, keys[key], s.signed); err != nil {
+		log.Warn.Println(err)
+		status = "reply_failed"
+	}
+	logAccess(conn, msg, status)
+	s.audit(msg, status, imported)
+	s.logQueries(conn.RemoteAddr(), claimed, msg.Type, served, time.Since(start))
+}
+
+// rotateKey makes key the server's primary key, with the access of the
+// current primary, which is still accepted for grace and dropped after it.
+func (s *server) rotateKey(key []byte, grace time.Duration) error {
+	if s.signed {
+		return errors.New("Keys can't be rotated when messages are signed, they aren't encrypted.")
+	}
+	if len(key) == 0 {
+		return errors.New("Key rotation without a key.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The first key that decrypts a message is the one we take, a key
+	// used already would get the primary's access.
+	for _, k := range s.keys {
+		if bytes.Equal(k, key) {
+			return errors.New("Key rotation to a key the server has already.")
+		}
+	}
+	// Connections being served hold the old slices, we make new ones.
+	old := s.keys[0]
+	s.keys = append([][]byte{key}, s.keys...)
+	s.access = append([]access{s.access[0]}, s.access...)
+	time.AfterFunc(grace, func() { s.dropKey(old) })
+	return nil
+}
+
+// dropKey stops accepting key, unless it is the primary.
+func (s *server) dropKey(key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys [][]byte
+	var access []access
+	for i, k := range s.keys {
+		if i > 0 && bytes.Equal(k, key) {
+			continue
+		}
+		keys = append(keys, k)
+		access = append(access, s.access[i])
+	}
+	s.keys, s.access = keys, access
+	log.Info.Println("Old key dropped after its rotation.")
+}
+
+// errReadOnly is the reply to messages that would change the database of a
+// read-only server.
+var errReadOnly error = replyError{"This server is read-only, it only answers queries.", database.ErrReadOnly}
+
+// writes reports whether msg would change the database.
+func writes(msg Message) bool {
+	switch msg.Type {
+	case HISTORY, RECORD:
+		return true
+	case QUERY:
+		return msg.QParams.Writes()
+	}
+	for _, qp := range msg.Queries {
+		if qp.Writes() {
+			return true
+		}
+	}
+	return false
+}
+
+// A servedQuery is a query handleConn served and the lines of its result.
+type servedQuery struct {
+	qp    conf.QueryParams
+	lines int
+}
+
+// logQueries adds the queries served to a client at remote, who claimed to
+// be user, to the query log. The database writes them in the background.
+func (s *server) logQueries(remote net.Addr, user, typ string, served []servedQuery, took time.Duration) {
+	for _, q := range served {
+		// The salt is what keeps anonymized names from being reversed.
+		if q.qp.AnonymizeSalt != "" {
+			q.qp.AnonymizeSalt = "-"
+		}
+		err := s.db.LogQuery(database.QueryLogEntry{Datetime: time.Now(), Remote: remote.String(), User: user,
+			Type: typ, Params: q.qp, Rows: q.lines, DurationMs: took.Nanoseconds() / 1e6})
+		if err != nil && err != database.ErrReadOnly {
+			log.Warn.Println("Couldn't log query:", err)
+		}
+	}
+}
+
+// A lineCounter counts the lines written through it, a last line without a
+// newline counts too.
+type lineCounter struct {
+	io.Writer
+	n    int
+	last byte
+}
+
+func (w *lineCounter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += bytes.Count(p[:n], []byte("\n"))
+	if n > 0 {
+		w.last = p[n-1]
+	}
+	return n, err
+}
+
+func (w *lineCounter) lines() int {
+	if w.last != 0 && w.last != '\n' {
+		return w.n + 1
+	}
+	return w.n
+}
+
+// countLines returns the lines of result.
+func countLines(result []byte) int {
+	w := &lineCounter{Writer: ioutil.Discard}
+	w.Write(result)
+	return w.lines()
+}
+
+// A frameWriter sends what is written to it to the client in PART messages
+// of frameSize. What is left in buf when writing ends, should be sent as the
+// final RESULT message.
+type frameWriter struct {
+	conn   net.Conn
+	key    []byte
+	signed bool
+	buf    bytes.Buffer
+	sent   bool // whether any PART was sent
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= frameSize {
+		part := Message{Type: PART, Payload: w.buf.Next(frameSize), Version: version.Version}
+		if err := encryptDispatch(w.conn, part, w.key, w.signed); err != nil {
+			return 0, err
+		}
+		w.sent = true
+	}
+	return len(p), nil
+}
+
+// logAccess logs a single structured line per served connection, so tools
+// like fail2ban can parse it.
+func logAccess(conn net.Conn, msg Message, status string) {
+	op, query := operation(msg)
+	log.Info.Printf("access remote=%s op=%s query=%s user=%q host=%q status=%s\n",
+		conn.RemoteAddr(), op, query, msg.User, msg.Hostname, status)
+}
+
+// operation returns msg's type, unknown if it has none, and the types of
+// its queries, - if it has none.
+func operation(msg Message) (op, query string) {
+	op, query = msg.Type, "-"
+	if op == "" {
+		op = "unknown"
+	}
+	switch msg.Type {
+	case QUERY:
+		query = msg.QParams.Type
+	case MULTI_QUERY:
+		var types []string
+		for _, qp := range msg.Queries {
+			types = append(types, qp.Type)
+		}
+		query = strings.Join(types, ",")
+	}
+	return op, query
+}
+
+// audit adds what the server did for msg to the audit log, with its status
+// and how many commands it imported. Suggestions come on every keystroke,
+// they are left out.
+func (s *server) audit(msg Message, status string, imported int) {
+	if msg.Type == SUGGEST {
+		return
+	}
+	op, query := operation(msg)
+	if query != "-" {
+		op += " " + query
 	}
-	if err := encryptDispatch(conn, reply); err != nil {
-		log.Println(err)
+	err := s.db.LogAudit(database.AuditEntry{Datetime: time.Now(), User: msg.User, Host: msg.Hostname,
+		Operation: op, Status: status, RowsAffected: imported})
+	if err != nil && err != database.ErrReadOnly {
+		log.Warn.Println("Couldn't log operation:", err)
 	}
 }
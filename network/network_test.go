@@ -0,0 +1,830 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/database"
+)
+
+// newTestDB opens a new database, removed when the test ends. It returns
+// the database and its path.
+func newTestDB(t *testing.T) (database.Database, string) {
+	f, err := ioutil.TempFile("", "test-bashistdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := f.Name()
+	f.Close()
+	os.Remove(path)
+	t.Cleanup(func() { os.Remove(path) })
+
+	db, err := database.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+// newTestServer serves db with keys and opts on a local port, until the
+// test ends or its listener is closed.
+func newTestServer(t *testing.T, db database.Database, keys [][]byte, opts ...ServerOption) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, db, keys, opts...)
+	return l
+}
+
+func TestServeRequest(t *testing.T) {
+	db, _ := newTestDB(t)
+	// Serve's own listener, we check what it returns when it closes.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("passphrase")
+	served := make(chan error)
+	go func() { served <- Serve(l, db, [][]byte{key}) }()
+
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 git status\n")}
+	var out bytes.Buffer
+	if err = Request(l.Addr().String(), key, history, &out); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Import statistics should go to the log, got: %s", out.String())
+	}
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%git%", Format: conf.FORMAT_COMMAND_LINE}}
+	if err = Request(l.Addr().String(), key, query, &out); err != nil {
+		t.Fatal("Query request failed: " + err.Error())
+	}
+	if want := "2 git status\n"; out.String() != want {
+		t.Fatalf("Query request.\nWanted: %s\nGot   : %s", want, out.String())
+	}
+
+	if err = Request(l.Addr().String(), []byte("wrong"), query, &out); err == nil {
+		t.Fatal("Request with a wrong key should fail.")
+	}
+
+	l.Close()
+	if err = <-served; err != nil {
+		t.Fatal("Serve should return nil when its listener closes, got: " + err.Error())
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key}, CacheTTL(time.Minute))
+
+	request := func(msg Message) string {
+		var out bytes.Buffer
+		if err := Request(l.Addr().String(), key, msg, &out); err != nil {
+			t.Fatal("Request failed: " + err.Error())
+		}
+		return out.String()
+	}
+	history := func(line string) Message {
+		return Message{Type: HISTORY, User: "user1", Hostname: "host1", Payload: []byte(line)}
+	}
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%git%", Format: conf.FORMAT_COMMAND_LINE}}
+
+	request(history("1 2015-10-12T12:00:40+0000 git status\n"))
+	if got, want := request(query), "1 git status\n"; got != want {
+		t.Fatalf("Query request.\nWanted: %s\nGot   : %s", want, got)
+	}
+
+	// Changes that bypass the server don't flush the cache.
+	if _, err := db.Exec("DELETE FROM history"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := request(query), "1 git status\n"; got != want {
+		t.Fatalf("Cached query request.\nWanted: %s\nGot   : %s", want, got)
+	}
+
+	request(Message{Type: FLUSH_CACHE})
+	if got, want := request(query), "No exact matches. No fuzzy matches for 'git'.\n"; got != want {
+		t.Fatalf("Query request after flush.\nWanted: %s\nGot   : %s", want, got)
+	}
+
+	// Imports flush the cache.
+	request(history("2 2015-10-12T12:00:41+0000 git diff\n"))
+	if got, want := request(query), "1 git diff\n"; got != want {
+		t.Fatalf("Query request after import.\nWanted: %s\nGot   : %s", want, got)
+	}
+}
+
+func TestQueryCacheLimits(t *testing.T) {
+	c := &queryCache{ttl: 50 * time.Millisecond, max: 3}
+	qp := func(k int) conf.QueryParams { return conf.QueryParams{Type: conf.QUERY_TOPK, Kappa: k} }
+
+	for k := 1; k <= 3; k++ {
+		c.put("", qp(k), []byte{byte(k)})
+	}
+	// A full cache makes room by dropping the result that expires first.
+	c.put("", qp(4), []byte{4})
+	if n := c.len(); n != 3 {
+		t.Errorf("Full cache has %d results, wanted 3.", n)
+	}
+	if _, ok := c.get("", qp(1)); ok {
+		t.Error("The oldest result should be dropped from a full cache.")
+	}
+	if r, ok := c.get("", qp(4)); !ok || r[0] != 4 {
+		t.Error("The newest result should be cached.")
+	}
+
+	// Without writes to flush it, expired results go when new ones come,
+	// full or not.
+	c.flush()
+	c.put("", qp(1), []byte{1})
+	c.put("", qp(2), []byte{2})
+	time.Sleep(60 * time.Millisecond)
+	c.put("", qp(3), []byte{3})
+	if n := c.len(); n != 1 {
+		t.Errorf("Cache has %d results after they expired, wanted 1.", n)
+	}
+}
+
+func TestMultiQuery(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 git status\n")}
+	var out bytes.Buffer
+	if err := Request(l.Addr().String(), key, history, &out); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+
+	multi := Message{Type: MULTI_QUERY, Queries: []conf.QueryParams{
+		{Type: conf.QUERY, User: "%", Host: "%", Command: "%git%", Format: conf.FORMAT_COMMAND_LINE},
+		{Type: conf.QUERY_LASTK, Kappa: 1, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+		{Type: "nosuchquery", User: "%", Host: "%", Command: "%%"},
+	}}
+	if err := Request(l.Addr().String(), key, multi, &out); err != nil {
+		t.Fatal("Multi query request failed: " + err.Error())
+	}
+	// Results come in order, a failed query doesn't fail the rest.
+	want := "2 git status\n\n2 git status\n\nUnknown query type.\n"
+	if got := out.String(); got != want {
+		t.Fatalf("Multi query request.\nWanted: %s\nGot   : %s", want, got)
+	}
+
+	// A dashboard's top, last and count in one reply, in the order asked.
+	dashboard := []conf.QueryParams{
+		{Type: conf.QUERY_TOPK, Kappa: 5, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+		{Type: conf.QUERY_LASTK, Kappa: 5, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_COMMAND_LINE},
+		{Type: conf.QUERY_INFO, User: "%", Host: "%", Command: "%%"},
+	}
+	reply, err := request(l.Addr().String(), key, false, Message{Type: MULTI_QUERY, Queries: dashboard}, ioutil.Discard)
+	if err != nil {
+		t.Fatal("Multi query request failed: " + err.Error())
+	}
+	if reply.Type != MULTI_RESULT || len(reply.Results) != len(dashboard) {
+		t.Fatalf("Multi query wanted %d results, got %d in a %s reply.", len(dashboard), len(reply.Results), reply.Type)
+	}
+	for i, qp := range dashboard {
+		want, err := db.RunQuery(qp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply.Results[i]) != string(want) {
+			t.Fatalf("Multi query result %d (%s).\nWanted: %s\nGot   : %s", i, qp.Type, want, reply.Results[i])
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_INFO, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_COMMAND_LINE}}
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+	if err := watch(ctx, l.Addr().String(), key, query, 100*time.Millisecond, true, &out); err != nil {
+		t.Fatal("Watch failed: " + err.Error())
+	}
+	if runs := strings.Count(out.String(), clearScreen+"Every 100ms: "); runs < 2 {
+		t.Fatalf("Watch should re-run the query after the interval, ran %d times:\n%q", runs, out.String())
+	}
+
+	// Runs go on when the server is gone.
+	l.Close()
+	out.Reset()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := watch(ctx, l.Addr().String(), key, query, 100*time.Millisecond, false, &out); err != nil {
+		t.Fatal("Watch failed: " + err.Error())
+	}
+	if got := out.String(); strings.Contains(got, clearScreen) || !strings.Contains(got, "Request failed:") {
+		t.Fatalf("Watch should show failed requests without clearing the screen, got:\n%q", got)
+	}
+}
+
+func TestRecord(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	record := Message{Type: RECORD, User: "user1", Hostname: "host1", Payload: []byte("make"),
+		Datetime: time.Date(2015, 10, 12, 12, 0, 40, 0, time.UTC)}
+	var out bytes.Buffer
+	for i := 0; i < 2; i++ { // The second is a duplicate, ignored.
+		if err := Request(l.Addr().String(), key, record, &out); err != nil {
+			t.Fatal("Record request failed: " + err.Error())
+		}
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Record replies should go to the log, got: %s", out.String())
+	}
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_EXPORT}}
+	if err := Request(l.Addr().String(), key, query, &out); err != nil {
+		t.Fatal("Query request failed: " + err.Error())
+	}
+	if want := "user1 host1 2015-10-12T12:00:40+0000 make\n"; out.String() != want {
+		t.Fatalf("Query request after record.\nWanted: %s\nGot   : %s", want, out.String())
+	}
+}
+
+func TestImportStats(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 git status\nnot history\n")}
+	stats, err := RequestImport(l.Addr().String(), key, history)
+	if err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	want := database.ImportStats{Total: 3, Added: 2, Malformed: 1, Layout: "%FT%T%z"}
+	if stats == nil {
+		t.Fatal("Import statistics missing from the reply.")
+	}
+	stats.DurationMs = 0
+	if *stats != want {
+		t.Fatalf("Import statistics.\nWanted: %+v\nGot   : %+v", want, *stats)
+	}
+
+	// The sentence comes with them, for people.
+	history.Payload = []byte("3 2015-10-12T12:00:42+0000 make\n")
+	reply, err := request(l.Addr().String(), key, false, history, ioutil.Discard)
+	if err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	if reply.Stats == nil || reply.Stats.Added != 1 {
+		t.Fatalf("Import statistics of the second import: %+v", reply.Stats)
+	}
+	if want := "Processed 1 entries, successful 1, failed 0 (duplicates 0, rejected 0)."; string(reply.Payload) != want {
+		t.Fatalf("Import sentence.\nWanted: %s\nGot   : %s", want, reply.Payload)
+	}
+	history.Payload = []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 git status\nnot history\n")
+
+	// Clients before protocol version 1 get a sentence.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := encryptDispatch(conn, history, key, false); err != nil {
+		t.Fatal(err)
+	}
+	reply, _, err = receiveDecrypt(conn, [][]byte{key}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Stats != nil {
+		t.Fatal("Old clients shouldn't get import statistics.")
+	}
+	if want := "Processed 3 entries, successful 0, failed 3 (duplicates 2, rejected 1)."; string(reply.Payload) != want {
+		t.Fatalf("Import reply for old clients.\nWanted: %s\nGot   : %s", want, reply.Payload)
+	}
+
+	// Nothing added and mostly malformed lines fail the import.
+	history.Payload = []byte("not history\nnot history either\n")
+	if err := Request(l.Addr().String(), key, history, ioutil.Discard); err == nil {
+		t.Fatal("Import of malformed history should fail.")
+	}
+}
+
+func TestSync(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	old := "1 2010-10-12T12:00:40+0000 ls\n"
+	synced := "2 2015-10-12T12:00:40+0000 make\n"
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1", Payload: []byte(old + synced)}
+
+	// Nothing synced yet, all history is sent.
+	if got := syncHistory(l.Addr().String(), key, history, database.BashParser{}); string(got) != old+synced {
+		t.Fatalf("Sync of a new user.\nWanted: %s\nGot   : %s", old+synced, got)
+	}
+	if err := Request(l.Addr().String(), key, history, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+
+	history.Payload = []byte(old + synced + "3 2015-10-12T12:00:41+0000 git status\n")
+	want := synced + "3 2015-10-12T12:00:41+0000 git status\n"
+	if got := syncHistory(l.Addr().String(), key, history, database.BashParser{}); string(got) != want {
+		t.Fatalf("Sync.\nWanted: %s\nGot   : %s", want, got)
+	}
+
+	// Other hosts of the user have their own.
+	history.Hostname = "host2"
+	if got := syncHistory(l.Addr().String(), key, history, database.BashParser{}); string(got) != string(history.Payload) {
+		t.Fatalf("Sync of another host.\nWanted: %s\nGot   : %s", history.Payload, got)
+	}
+}
+
+func TestUserKeys(t *testing.T) {
+	db, _ := newTestDB(t)
+	admin, alice := []byte("passphrase"), []byte("alice's passphrase")
+	l := newTestServer(t, db, [][]byte{admin, alice}, KeyUsers([]string{"", "alice"}))
+
+	// Whatever user alice's key sets, even in export format lines, it is alice.
+	imports := []struct {
+		key []byte
+		msg Message
+	}{
+		{admin, Message{Type: HISTORY, User: "bob", Hostname: "host1", Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n")}},
+		{alice, Message{Type: HISTORY, User: "bob", Hostname: "host1", Payload: []byte("1 2015-10-12T12:00:41+0000 make\n")}},
+		{alice, Message{Type: HISTORY, User: "alice", Hostname: "host1",
+			Payload: []byte("bob host1 2015-10-12T12:00:42+0000 htop\n")}},
+	}
+	for _, i := range imports {
+		if err := Request(l.Addr().String(), i.key, i.msg, ioutil.Discard); err != nil {
+			t.Fatal("History request failed: " + err.Error())
+		}
+	}
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_EXPORT}}
+	tests := []struct {
+		key  []byte
+		want string
+	}{
+		{alice, "alice host1 2015-10-12T12:00:41+0000 make\nalice host1 2015-10-12T12:00:42+0000 htop\n"},
+		{admin, "bob host1 2015-10-12T12:00:40+0000 ls\nalice host1 2015-10-12T12:00:41+0000 make\nalice host1 2015-10-12T12:00:42+0000 htop\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := Request(l.Addr().String(), test.key, query, &out); err != nil {
+			t.Fatal("Query request failed: " + err.Error())
+		}
+		if out.String() != test.want {
+			t.Errorf("Query with key '%s'.\nWanted: %s\nGot   : %s", test.key, test.want, out.String())
+		}
+	}
+
+	// Queries that aren't limited to a user are refused, clients before
+	// protocol version 2 get the error as a result.
+	row := Message{Type: MULTI_QUERY, Queries: []conf.QueryParams{{Type: conf.QUERY_INFO}, {Type: conf.QUERY_ROW, Kappa: 1}}}
+	if err := Request(l.Addr().String(), alice, row, ioutil.Discard); !errors.Is(err, ErrUnauthorized) || err.Error() != errUnscoped.Error() {
+		t.Fatalf("Row query with a user's key.\nWanted: %v\nGot   : %v", errUnscoped, err)
+	}
+	var out bytes.Buffer
+	row.Protocol = 1
+	if err := Request(l.Addr().String(), alice, row, &out); err != nil {
+		t.Fatal("Multi query request failed: " + err.Error())
+	}
+	if want := errUnscoped.Error() + "\n"; out.String() != want {
+		t.Fatalf("Row query with a user's key.\nWanted: %s\nGot   : %s", want, out.String())
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	db, _ := newTestDB(t)
+	shared := []byte("passphrase")
+	policy, err := LoadPolicy(strings.NewReader(`# team server
+admin the admin's passphrase
+key carol@laptop carol's passphrase
+claim 127.0.0.0/8
+`), [][]byte{shared})
+	if err != nil {
+		t.Fatal("Loading policy failed: " + err.Error())
+	}
+	l := newTestServer(t, db, [][]byte{shared}, WithPolicy(policy))
+	admin, carol := []byte("the admin's passphrase"), []byte("carol's passphrase")
+
+	imports := []struct {
+		key []byte
+		msg Message
+	}{
+		{admin, Message{Type: HISTORY, User: "bob", Hostname: "host1", Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n")}},
+		{shared, Message{Type: HISTORY, User: "alice", Hostname: "host1", Payload: []byte("1 2015-10-12T12:00:41+0000 make\n")}},
+		{carol, Message{Type: HISTORY, User: "bob", Hostname: "host1",
+			Payload: []byte("bob host2 2015-10-12T12:00:42+0000 htop\n")}},
+	}
+	for _, i := range imports {
+		if err := Request(l.Addr().String(), i.key, i.msg, ioutil.Discard); err != nil {
+			t.Fatal("History request failed: " + err.Error())
+		}
+	}
+
+	query := Message{Type: QUERY, User: "alice", QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_EXPORT}}
+	tests := []struct {
+		key  []byte
+		want string
+	}{
+		{shared, "alice host1 2015-10-12T12:00:41+0000 make\n"},
+		{carol, "carol laptop 2015-10-12T12:00:42+0000 htop\n"},
+		{admin, "bob host1 2015-10-12T12:00:40+0000 ls\nalice host1 2015-10-12T12:00:41+0000 make\ncarol laptop 2015-10-12T12:00:42+0000 htop\n"},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := Request(l.Addr().String(), test.key, query, &out); err != nil {
+			t.Fatal("Query request failed: " + err.Error())
+		}
+		if out.String() != test.want {
+			t.Errorf("Query with key '%s'.\nWanted: %s\nGot   : %s", test.key, test.want, out.String())
+		}
+	}
+
+	// The shared key needs a user without wildcards, and stats are for
+	// admins.
+	denied := []struct {
+		key  []byte
+		msg  Message
+		want error
+	}{
+		{shared, Message{Type: QUERY, User: "%", QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10}}, errClaim},
+		{carol, Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_STATUS}}, errUnscoped},
+	}
+	for _, d := range denied {
+		if err := Request(l.Addr().String(), d.key, d.msg, ioutil.Discard); err == nil || err.Error() != d.want.Error() {
+			t.Errorf("Request with key '%s'.\nWanted: %v\nGot   : %v", d.key, d.want, err)
+		}
+	}
+	if err := Request(l.Addr().String(), admin, Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_STATUS}}, ioutil.Discard); err != nil {
+		t.Error("Status with the admin key: " + err.Error())
+	}
+
+	// Clients outside the claim networks can't use the shared key.
+	outside, err := LoadPolicy(strings.NewReader("claim 10.0.0.0/8\n"), [][]byte{shared})
+	if err != nil {
+		t.Fatal("Loading policy failed: " + err.Error())
+	}
+	msg := query
+	if err := outside.authorize(&msg, access{claimed: true}, l.Addr()); err != errAddress {
+		t.Errorf("Shared key from outside the claim networks.\nWanted: %v\nGot   : %v", errAddress, err)
+	}
+
+	for _, bad := range []string{
+		"admin\n",
+		"key carol\n",
+		"key c%rol pass\n",
+		"key carol passphrase\n",
+		"claim 10.0.0.0\n",
+		"grant all\n",
+	} {
+		if _, err = LoadPolicy(strings.NewReader(bad), [][]byte{shared}); err == nil {
+			t.Errorf("Policy '%s' should get an error.", strings.TrimSpace(bad))
+		}
+	}
+}
+
+func TestQueryLog(t *testing.T) {
+	db, _ := newTestDB(t)
+	admin, alice := []byte("passphrase"), []byte("alice's passphrase")
+	l := newTestServer(t, db, [][]byte{admin, alice}, KeyUsers([]string{"", "alice"}))
+
+	history := Message{Type: HISTORY, User: "alice", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n")}
+	if err := Request(l.Addr().String(), alice, history, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	query := Message{Type: QUERY, User: "claimed", QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10,
+		User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_EXPORT}}
+	if err := Request(l.Addr().String(), alice, query, ioutil.Discard); err != nil {
+		t.Fatal("Query request failed: " + err.Error())
+	}
+
+	// Only full access keys may read the query log.
+	querylog := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_QUERYLOG, Kappa: 10}}
+	if err := Request(l.Addr().String(), alice, querylog, ioutil.Discard); err == nil || err.Error() != errUnscoped.Error() {
+		t.Fatalf("Query log with a user's key.\nWanted: %v\nGot   : %v", errUnscoped, err)
+	}
+
+	// The server logs queries after it replies, give it a moment.
+	want := " | claimed | query | 2 rows | "
+	var out bytes.Buffer
+	for i := 0; i < 100 && !strings.Contains(out.String(), want); i++ {
+		time.Sleep(10 * time.Millisecond)
+		out.Reset()
+		if err := Request(l.Addr().String(), admin, querylog, &out); err != nil {
+			t.Fatal("Query log request failed: " + err.Error())
+		}
+	}
+	if !strings.Contains(out.String(), want) || !strings.Contains(out.String(), `"Type":"lastk"`) {
+		t.Fatalf("Query log.\nWanted: ...%s...\nGot   : %s", want, out.String())
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	db, _ := newTestDB(t)
+	admin, alice := []byte("passphrase"), []byte("alice's passphrase")
+	l := newTestServer(t, db, [][]byte{admin, alice}, KeyUsers([]string{"", "alice"}))
+
+	history := Message{Type: HISTORY, User: "claimed", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n2 2015-10-12T12:00:41+0000 make\n")}
+	if err := Request(l.Addr().String(), alice, history, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	querylog := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_QUERYLOG, Kappa: 10}}
+	if err := Request(l.Addr().String(), alice, querylog, ioutil.Discard); err == nil {
+		t.Fatal("Query log with a user's key should fail.")
+	}
+
+	// The server logs operations after it replies, give it a moment.
+	wanted := []string{" | alice@ | query querylog | denied | 0 rows", " | alice@host1 | history | ok | 2 rows"}
+	var res []byte
+	for i := 0; i < 100; i++ {
+		var err error
+		if res, err = db.GetAuditLog(time.Time{}, 10); err != nil {
+			t.Fatal("GetAuditLog failed: " + err.Error())
+		}
+		if strings.Count(string(res), "\n") == len(wanted)-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	lines := strings.Split(string(res), "\n")
+	if len(lines) != len(wanted) {
+		t.Fatalf("Expected %d audit log entries, got:\n%s", len(wanted), res)
+	}
+	for i, w := range wanted {
+		if !strings.HasSuffix(lines[i], w) {
+			t.Errorf("Audit log entry %d.\nWanted: ...%s\nGot   : %s", i, w, lines[i])
+		}
+	}
+}
+
+func TestReadOnlyServer(t *testing.T) {
+	db, path := newTestDB(t)
+	if _, err := db.AddFromBuffer(bufio.NewReader(strings.NewReader("1 2015-10-12T12:00:40+0000 ls\n")), "user1", "host1"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err := database.Open(path, nil, database.ReadOnly())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	refused := []Message{
+		{Type: HISTORY, User: "user1", Hostname: "host1", Payload: []byte("1 2015-10-12T12:00:41+0000 make\n")},
+		{Type: RECORD, User: "user1", Hostname: "host1", Payload: []byte("make"), Datetime: time.Now()},
+		{Type: QUERY, QParams: conf.QueryParams{Type: conf.DELETE, Rows: []int{1}}},
+		{Type: MULTI_QUERY, Queries: []conf.QueryParams{{Type: conf.QUERY_INFO}, {Type: conf.DELETE, Rows: []int{1}}}},
+	}
+	for _, msg := range refused {
+		if err := Request(l.Addr().String(), key, msg, ioutil.Discard); !errors.Is(err, database.ErrReadOnly) || err.Error() != errReadOnly.Error() {
+			t.Errorf("%s message to a read-only server.\nWanted: %v\nGot   : %v", msg.Type, errReadOnly, err)
+		}
+	}
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_EXPORT}}
+	var out bytes.Buffer
+	if err := Request(l.Addr().String(), key, query, &out); err != nil {
+		t.Fatal("Query request failed: " + err.Error())
+	}
+	if want := "user1 host1 2015-10-12T12:00:40+0000 ls\n"; out.String() != want {
+		t.Errorf("Query to a read-only server.\nWanted: %s\nGot   : %s", want, out.String())
+	}
+}
+
+// partWriter counts the writes of a streamed reply.
+type partWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestNDJSONStream(t *testing.T) {
+	db, _ := newTestDB(t)
+
+	const n = 100000
+	var history bytes.Buffer
+	start := time.Date(2015, 10, 12, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&history, "%d %s cmd %d\n", i+1, start.Add(time.Duration(i)*time.Second).Format("2006-01-02T15:04:05-0700"), i)
+	}
+	if _, err := db.AddFromBuffer(bufio.NewReader(&history), "user1", "host1"); err != nil {
+		t.Fatal("AddFromBuffer failed: " + err.Error())
+	}
+
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key})
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%cmd%", Format: conf.FORMAT_NDJSON}}
+	var out partWriter
+	if err := Request(l.Addr().String(), key, query, &out); err != nil {
+		t.Fatal("Query request failed: " + err.Error())
+	}
+	if out.writes < 2 {
+		t.Errorf("NDJSON result came in %d writes, it should be streamed in parts.", out.writes)
+	}
+
+	s := bufio.NewScanner(&out)
+	i := 0
+	for ; s.Scan(); i++ {
+		var row struct {
+			User, Host, Command, Datetime string
+			Count                         int
+		}
+		if err := json.Unmarshal(s.Bytes(), &row); err != nil {
+			t.Fatalf("Line %d isn't JSON: %s", i, s.Text())
+		}
+		if want := fmt.Sprintf("cmd %d", i); row.Command != want || row.User != "user1" || row.Count != 1 {
+			t.Fatalf("Line %d.\nWanted: %s\nGot   : %s", i, want, s.Text())
+		}
+	}
+	if i != n {
+		t.Fatalf("Client got %d rows, wanted %d.", i, n)
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	l := newTestServer(t, db, [][]byte{key}, CacheTTL(time.Minute))
+
+	request := func(msg Message) string {
+		var out bytes.Buffer
+		if err := Request(l.Addr().String(), key, msg, &out); err != nil {
+			t.Fatal("Request failed: " + err.Error())
+		}
+		return out.String()
+	}
+	request(Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 git status\n")})
+	request(Message{Type: HISTORY, User: "user1", Hostname: "host1", Profile: "work",
+		Payload: []byte("1 2015-10-12T12:00:41+0000 git push\n")})
+
+	// The cache keeps the profiles apart too.
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY, User: "%", Host: "%",
+		Command: "%git%", Format: conf.FORMAT_COMMAND_LINE}}
+	for _, c := range []struct{ profile, want string }{
+		{"", "1 git status\n"},
+		{"work", "2 git push\n"},
+		{conf.DEFAULT_PROFILE, "1 git status\n"},
+	} {
+		query.Profile = c.profile
+		if got := request(query); got != c.want {
+			t.Errorf("Query of profile '%s'.\nWanted: %s\nGot   : %s", c.profile, c.want, got)
+		}
+	}
+}
+
+func TestUpstream(t *testing.T) {
+	// Each server's address must be known before the other one starts, so
+	// they get their listeners here.
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		return l
+	}
+	key := []byte("passphrase")
+	office, _ := newTestDB(t)
+	central, _ := newTestDB(t)
+	officeL, centralL := listen(), listen()
+	// They forward to each other, forwarded history must not come back.
+	go Serve(officeL, office, [][]byte{key}, WithUpstream(&Upstream{Address: centralL.Addr().String(), Key: key}))
+	go Serve(centralL, central, [][]byte{key}, WithUpstream(&Upstream{Address: officeL.Addr().String(), Key: key}))
+
+	forwarded := Message{Type: HISTORY, User: "user1", Hostname: "host1", Forwarded: true,
+		Payload: []byte("1 2015-10-12T12:00:39+0000 pwd\n")}
+	if err := Request(centralL.Addr().String(), key, forwarded, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n")}
+	if err := Request(officeL.Addr().String(), key, history, ioutil.Discard); err != nil {
+		t.Fatal("History request failed: " + err.Error())
+	}
+
+	query := conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%", Command: "%%", Format: conf.FORMAT_LOG}
+	var got []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var err error
+		if got, err = central.RunQuery(query); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(got), "ls") {
+			break
+		}
+	}
+	if !strings.Contains(string(got), "user1") || !strings.Contains(string(got), "host1") || !strings.Contains(string(got), "ls") {
+		t.Fatalf("History imported to the office server isn't on the central one, it has:\n%s", got)
+	}
+	if got, err := office.RunQuery(query); err != nil || strings.Contains(string(got), "pwd") {
+		t.Errorf("Forwarded history was forwarded again (%v):\n%s", err, got)
+	}
+}
+
+func TestSignMode(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("passphrase")
+	// SignMessages sets the auth mode on our server only, so servers of
+	// other tests keep theirs.
+	l := newTestServer(t, db, [][]byte{key}, SignMessages())
+
+	history := Message{Type: HISTORY, User: "user1", Hostname: "host1",
+		Payload: []byte("1 2015-10-12T12:00:40+0000 ls\n")}
+	reply, err := request(l.Addr().String(), key, true, history, ioutil.Discard)
+	if err != nil || reply.Stats == nil || reply.Stats.Added != 1 {
+		t.Fatalf("Signed history request failed: %+v (%v)", reply.Stats, err)
+	}
+	if _, err = request(l.Addr().String(), key, false, history, ioutil.Discard); err == nil {
+		t.Fatal("Encrypted request to a server that signs should fail.")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	db, _ := newTestDB(t)
+	oldKey, newKey, alice := []byte("old passphrase"), []byte("new passphrase"), []byte("alice's passphrase")
+	l := newTestServer(t, db, [][]byte{oldKey, alice}, KeyUsers([]string{"", "alice"}), KeyRotationGrace(200*time.Millisecond))
+
+	query := Message{Type: QUERY, QParams: conf.QueryParams{Type: conf.QUERY_LASTK, Kappa: 10, User: "%", Host: "%",
+		Command: "%%", Format: conf.FORMAT_COMMAND_LINE}}
+	if err := Request(l.Addr().String(), alice, Message{Type: KEY_ROTATION, Payload: newKey}, ioutil.Discard); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Key rotation with a user's key.\nWanted: %v\nGot   : %v", ErrUnauthorized, err)
+	}
+	if err := Request(l.Addr().String(), oldKey, Message{Type: KEY_ROTATION, Payload: alice}, ioutil.Discard); err == nil {
+		t.Fatal("Key rotation to a key the server has already should fail.")
+	}
+	if err := Request(l.Addr().String(), oldKey, Message{Type: KEY_ROTATION, Payload: newKey}, ioutil.Discard); err != nil {
+		t.Fatal("Key rotation failed: " + err.Error())
+	}
+	for _, key := range [][]byte{newKey, oldKey, alice} {
+		if err := Request(l.Addr().String(), key, query, ioutil.Discard); err != nil {
+			t.Fatalf("Query with key '%s' during the grace period failed: %s", key, err.Error())
+		}
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if err := Request(l.Addr().String(), oldKey, query, ioutil.Discard); err == nil {
+		t.Fatal("Query with the old key after the grace period should fail.")
+	}
+	for _, key := range [][]byte{newKey, alice} {
+		if err := Request(l.Addr().String(), key, query, ioutil.Discard); err != nil {
+			t.Fatalf("Query with key '%s' after the grace period failed: %s", key, err.Error())
+		}
+	}
+}
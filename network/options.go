@@ -0,0 +1,77 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import "time"
+
+// A ServerOption changes how Serve serves its clients.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	users    []string
+	policy   *Policy
+	hooks    *Hooks
+	upstream *Upstream
+	cacheTTL time.Duration
+	grace    time.Duration
+	signed   bool
+}
+
+// KeyUsers limits the keys to users: messages encrypted with keys[i]
+// import and query only the history of users[i], if it is set.
+func KeyUsers(users []string) ServerOption {
+	return func(o *serverOptions) { o.users = users }
+}
+
+// WithPolicy accepts the keys of p too and limits what the clients of each
+// key may access.
+func WithPolicy(p *Policy) ServerOption {
+	return func(o *serverOptions) { o.policy = p }
+}
+
+// WithHooks runs h for the commands imported.
+func WithHooks(h *Hooks) ServerOption {
+	return func(o *serverOptions) { o.hooks = h }
+}
+
+// WithUpstream forwards the history imported to u.
+func WithUpstream(u *Upstream) ServerOption {
+	return func(o *serverOptions) { o.upstream = u }
+}
+
+// CacheTTL caches query results for d, or until history changes. 0, the
+// default, disables the cache.
+func CacheTTL(d time.Duration) ServerOption {
+	return func(o *serverOptions) { o.cacheTTL = d }
+}
+
+// defaultKeyRotationGrace is the grace period when KeyRotationGrace isn't
+// given.
+const defaultKeyRotationGrace = 24 * time.Hour
+
+// KeyRotationGrace sets how long the old primary key is accepted after a
+// KEY_ROTATION.
+func KeyRotationGrace(d time.Duration) ServerOption {
+	return func(o *serverOptions) { o.grace = d }
+}
+
+// SignMessages signs and verifies messages with the keys, instead of
+// encrypting them, like -auth-mode sign does for every server and client.
+func SignMessages() ServerOption {
+	return func(o *serverOptions) { o.signed = true }
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// A Policy says whose history the clients of a server may access. It is
+// read from a file of lines like these, # starts a comment:
+//
+//	admin PASSPHRASE             clients with this key access everything
+//	key USER[@HOST] PASSPHRASE   clients with this key act as USER (at HOST)
+//	claim CIDR                   clients from CIDR with the server's keys act
+//	                             as the user they claim
+//
+// Under a policy the server's keys (-key and -old-key) are no longer
+// global, they only work from the claim networks.
+type Policy struct {
+	keys   [][]byte     // the admin and key entries' keys
+	access []access     // access[i] is what keys[i] grants
+	claims []*net.IPNet // where the server's keys may be used from
+}
+
+// An access is what a key grants to its clients.
+type access struct {
+	admin   bool   // everything, no limits
+	claimed bool   // the user the client claims, only from the claim networks
+	user    string // the only user it may act as
+	host    string // the only host it may act as, any if empty
+}
+
+// errAddress is the reply to clients that use the server's keys from an
+// address the policy doesn't allow them to.
+var errAddress error = replyError{"Your address isn't allowed to use this key.", ErrUnauthorized}
+
+// errClaim is the reply to clients that use the server's keys under a
+// policy without claiming a user, or with wildcards in the claimed user.
+var errClaim error = replyError{"This key needs a user, without % or _.", ErrUnauthorized}
+
+// LoadPolicy reads a policy from r. Its passphrases' keys, derived as the
+// server's with conf.DeriveKey, may not be any of keys, the server's keys,
+// nor repeat, as the first key that decrypts a message is the one we take.
+func LoadPolicy(r io.Reader, keys [][]byte) (*Policy, error) {
+	p := &Policy{}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		seen[string(k)] = true
+	}
+	addKey := func(n int, passphrase string, a access) error {
+		key, err := conf.DeriveKey(passphrase)
+		if err != nil {
+			return err
+		}
+		if seen[string(key)] {
+			return fmt.Errorf("Policy line %d: passphrase used by another key.", n)
+		}
+		seen[string(key)] = true
+		p.keys = append(p.keys, key)
+		p.access = append(p.access, a)
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.Fields(line)[0]
+		rest := strings.TrimSpace(line[len(entry):])
+		switch entry {
+		case "admin":
+			if rest == "" {
+				return nil, fmt.Errorf("Policy line %d: admin needs a passphrase.", n)
+			}
+			if err := addKey(n, rest, access{admin: true}); err != nil {
+				return nil, err
+			}
+		case "key":
+			f := strings.Fields(rest)
+			if len(f) < 2 {
+				return nil, fmt.Errorf("Policy line %d: use key USER[@HOST] PASSPHRASE.", n)
+			}
+			a := access{user: f[0]}
+			if i := strings.Index(f[0], "@"); i >= 0 {
+				a.user, a.host = f[0][:i], f[0][i+1:]
+			}
+			passphrase := strings.TrimSpace(rest[len(f[0]):])
+			// Queries match users and hosts with LIKE, wildcards would
+			// widen the scope.
+			if a.user == "" || strings.ContainsAny(a.user+a.host, "%_") {
+				return nil, fmt.Errorf("Policy line %d: USER is needed and USER and HOST can't have %% or _.", n)
+			}
+			if err := addKey(n, passphrase, a); err != nil {
+				return nil, err
+			}
+		case "claim":
+			_, network, err := net.ParseCIDR(rest)
+			if err != nil {
+				return nil, fmt.Errorf("Policy line %d: %s", n, err.Error())
+			}
+			p.claims = append(p.claims, network)
+		default:
+			return nil, fmt.Errorf("Policy line %d: unknown entry '%s'.", n, entry)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// claimFrom reports whether clients from addr may use the server's keys.
+func (p *Policy) claimFrom(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range p.claims {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize limits msg, from a client at addr, to what a grants. It
+// returns an error if the client may not send msg at all.
+func (p *Policy) authorize(msg *Message, a access, addr net.Addr) error {
+	switch {
+	case a.admin:
+		return nil
+	case a.claimed:
+		if !p.claimFrom(addr) {
+			return errAddress
+		}
+		if msg.User == "" || strings.ContainsAny(msg.User, "%_") {
+			return errClaim
+		}
+		return scope(msg, msg.User, "")
+	}
+	return scope(msg, a.user, a.host)
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// unscoped are the query types that aren't limited to the user of the
+// query, keys of a single user can't run them.
+var unscoped = map[string]bool{
+	conf.DELETE:              true,
+	conf.QUERY_ROW:           true,
+	conf.QUERY_STATUS:        true,
+	conf.QUERY_CHECK:         true,
+	conf.QUERY_DEMO:          true,
+	conf.QUERY_QUERYLOG:      true,
+	conf.QUERY_AUDIT_LOG:     true,
+	conf.QUERY_AUDIT_SUMMARY: true,
+	// Writes to a file of the server.
+	conf.ARCHIVE: true,
+	// Change the history of every user.
+	conf.RENAME_HOST:        true,
+	conf.RENAME_USER:        true,
+	conf.NORMALIZE_EXISTING: true,
+	// List the hosts and users of every user.
+	conf.QUERY_RECENT_HOSTS:   true,
+	conf.QUERY_RECENT_USERS:   true,
+	conf.QUERY_INACTIVE_USERS: true,
+}
+
+// errUnscoped is the reply to queries of unscoped types from keys of a
+// single user.
+var errUnscoped error = replyError{"This query isn't allowed with your key.", ErrUnauthorized}
+
+// scope limits msg, encrypted with a key of user, to user's history:
+// whatever user msg sets is replaced by user. If host is set, so is the
+// host. It returns errUnscoped for queries that can't be limited to a user.
+func scope(msg *Message, user, host string) error {
+	msg.User = user
+	msg.QParams.User = user
+	if host != "" {
+		msg.Hostname = host
+		msg.QParams.Host = host
+	}
+	if msg.Type == KEY_ROTATION || (msg.Type == QUERY && unscoped[msg.QParams.Type]) {
+		return errUnscoped
+	}
+	for i := range msg.Queries {
+		msg.Queries[i].User = user
+		if host != "" {
+			msg.Queries[i].Host = host
+		}
+		if unscoped[msg.Queries[i].Type] {
+			return errUnscoped
+		}
+	}
+	return nil
+}
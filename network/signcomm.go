@@ -0,0 +1,67 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// With conf.AUTH_SIGN messages aren't encrypted, they are GOB serialized
+// and followed by their HMAC-SHA256 tag with the key. It is much cheaper
+// than scrypt and NaCl, for networks that are encrypted already (a VPN,
+// stunnel) where authenticity is all we need.
+
+// signing reports whether messages are signed instead of encrypted.
+func signing() bool {
+	return conf.AuthMode == conf.AUTH_SIGN
+}
+
+// sign serializes m and appends its tag with key.
+func sign(m Message, key []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf.Bytes())
+	return mac.Sum(buf.Bytes()), nil
+}
+
+// verify checks the tag of a signed message with key and de-serializes it.
+func verify(signed []byte, key []byte) (Message, error) {
+	if len(signed) < sha256.Size {
+		return Message{}, errors.New("Signed message is too short.")
+	}
+	payload, tag := signed[:len(signed)-sha256.Size], signed[len(signed)-sha256.Size:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(tag, mac.Sum(nil)) {
+		return Message{}, errors.New("Message signature doesn't match.")
+	}
+	msg := new(Message)
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(msg); err != nil {
+		return Message{}, err
+	}
+	return *msg, nil
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"io/ioutil"
+
+	"github.com/andmarios/bashistdb/database"
+)
+
+// syncHistory returns the history of msg, a HISTORY message, that the
+// server at address doesn't have yet, decoding it with p. When the server
+// can't tell us what it has, or we can't be sure, it returns all of it:
+// duplicates are cheaper than lost history.
+func syncHistory(address string, key []byte, msg Message, p database.LineParser) []byte {
+	reply, err := request(address, key, signing(), Message{Type: SYNCINFO, User: msg.User, Hostname: msg.Hostname, Profile: msg.Profile}, ioutil.Discard)
+	switch {
+	case err != nil:
+		log.Warn.Println("Sync failed, sending all history:", err)
+		return msg.Payload
+	case reply.Type != SYNCINFO: // Older servers don't know it.
+		log.Warn.Println("Server can't sync, sending all history.")
+		return msg.Payload
+	case reply.Datetime.IsZero(): // Nothing from us yet.
+		return msg.Payload
+	}
+	history, ok := database.HistorySince(msg.Payload, p, reply.Datetime)
+	if !ok {
+		log.Warn.Println("Server's latest command isn't in our history, sending all of it.")
+		return msg.Payload
+	}
+	log.Debug.Printf("Sync sends %d of %d bytes of history.\n", len(history), len(msg.Payload))
+	return history
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"io/ioutil"
+
+	conf "github.com/andmarios/bashistdb/configuration"
+)
+
+// An Upstream is a server that a server forwards the history it imports
+// to, e.g. a central server of many office ones. Forwarding is best
+// effort: failures are logged, the history isn't sent again.
+type Upstream struct {
+	Address string // the upstream server's address
+	Key     []byte // the key to encrypt forwarded messages with
+}
+
+// forward sends msg, a HISTORY message the server imported, to u as a
+// client would, signing it instead of encrypting it if signed is set. If host
+// is set, it is the host the client's key imports as.
+func (u *Upstream) forward(msg Message, host string, signed bool) {
+	fwd := Message{Type: HISTORY, Payload: msg.Payload, User: msg.User, Hostname: msg.Hostname,
+		QParams: conf.QueryParams{Format: msg.QParams.Format}, Source: msg.Source, Profile: msg.Profile, Forwarded: true}
+	if host != "" {
+		fwd.Hostname = host
+	}
+	reply, err := request(u.Address, u.Key, signed, fwd, ioutil.Discard)
+	stats := reply.Stats
+	if err == nil && stats != nil {
+		err = stats.Err()
+	}
+	if err != nil {
+		log.Warn.Printf("Couldn't forward history of %s@%s to %s: %s\n", fwd.User, fwd.Hostname, u.Address, err.Error())
+		return
+	}
+	log.Debug.Printf("Forwarded history of %s@%s to %s: %v\n", fwd.User, fwd.Hostname, u.Address, stats)
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+//      Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+//      Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+//      You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// clearScreen moves the cursor home and clears the terminal.
+const clearScreen = "\033[H\033[2J"
+
+// watch sends msg to the server every interval, like watch(1), and writes
+// each result to w, after clearing the screen if clear is set. A failed
+// request is shown in place of the result and we keep trying. It returns
+// when ctx is done.
+func watch(ctx context.Context, address string, key []byte, msg Message, every time.Duration, clear bool, w io.Writer) error {
+	for {
+		var res bytes.Buffer
+		if err := Request(address, key, msg, &res); err != nil {
+			fmt.Fprintln(&res, "Request failed:", err)
+		}
+		// We write a run at once, so the screen doesn't flicker.
+		var out bytes.Buffer
+		if clear {
+			out.WriteString(clearScreen)
+		}
+		fmt.Fprintf(&out, "Every %s: %s\n\n", every, time.Now().Format("2006-01-02 15:04:05"))
+		out.Write(res.Bytes())
+		if _, err := w.Write(out.Bytes()); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(every):
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2015, Marios Andreopoulos.
+//
+// This file is part of bashistdb.
+//
+// 	Bashistdb is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// 	Bashistdb is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// 	You should have received a copy of the GNU General Public License
+// along with bashistdb.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package output has helpers for output meant for terminals.
+package output
+
+import "fmt"
+
+// An ANSIColor is the SGR code of a terminal foreground color.
+type ANSIColor int
+
+// Colors we use
+const (
+	Red     ANSIColor = 31
+	Green   ANSIColor = 32
+	Yellow  ANSIColor = 33
+	Blue    ANSIColor = 34
+	Magenta ANSIColor = 35
+	Cyan    ANSIColor = 36
+	White   ANSIColor = 37
+)
+
+// reset turns colors off.
+const reset = "\033[0m"
+
+// Colorize returns s wrapped in the escape sequences that show it in color.
+func Colorize(s string, color ANSIColor) string {
+	return fmt.Sprintf("\033[%dm%s%s", color, s, reset)
+}
@@ -22,9 +22,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"regexp"
 	"time"
 
 	conf "github.com/andmarios/bashistdb/configuration"
+	"github.com/andmarios/bashistdb/output"
 )
 
 // Format Strings
@@ -37,6 +40,8 @@ const (
 	FORMAT_JSON_S         = "" // We use encoding/json for JSON
 	FORMAT_EXPORT_S       = "%s %s %s %s"
 	FORMAT_ROWS_S         = "%d"
+	FORMAT_NOTE_S         = "  # %s"
+	FORMAT_TIMES_S        = " (%d times)"
 )
 
 // A Result is used to store the formatted output of a query.
@@ -47,6 +52,19 @@ type Result struct {
 	written *bool // we use this to work around json not accepting a trailing comma
 	format  string
 	digits  *int // we use this to set the width of the count column to that of the first result (max)
+	w       io.Writer
+	err     *error     // first error writing to w
+	marks   *highlight // what to mark in restore format commands, if set
+	rewrite RowRewriter
+}
+
+// A RowRewriter changes what a row shows, e.g. to anonymize it.
+type RowRewriter func(user, host, command, note string) (string, string, string, string)
+
+// A highlight marks what re matches in commands with open and close.
+type highlight struct {
+	re          *regexp.Regexp
+	open, close string
 }
 
 // Golang's RFC3339 does not comply with all RFC3339 representations
@@ -60,18 +78,107 @@ func New(format string) *Result {
 	}
 	w := false
 	d := 0
-	return &Result{out: &out, written: &w, format: format, digits: &d}
+	var err error
+	return &Result{out: &out, written: &w, format: format, digits: &d, err: &err}
+}
+
+// NewStream returns a new Result that writes rows to w as they are added,
+// instead of keeping them. Call Close after the last row.
+func NewStream(format string, w io.Writer) *Result {
+	r := New(format)
+	r.w = w
+	r.flush()
+	return r
+}
+
+// Highlight wraps what re matches in the commands of the restore format
+// between open and close, to review a restore before sourcing it. Call it
+// before adding rows.
+func (r *Result) Highlight(re *regexp.Regexp, open, close string) {
+	r.marks = &highlight{re, open, close}
+}
+
+// Rewrite sets f to change every row before it is formatted. Call it before
+// adding rows.
+func (r *Result) Rewrite(f RowRewriter) {
+	r.rewrite = f
+}
+
+// mark returns command with the matches of r's highlight marked.
+func (r Result) mark(command string) string {
+	if r.marks == nil {
+		return command
+	}
+	return r.marks.re.ReplaceAllStringFunc(command, func(m string) string {
+		if m == "" {
+			return m
+		}
+		return r.marks.open + m + r.marks.close
+	})
+}
+
+// flush writes what is buffered to w, for streaming results.
+func (r Result) flush() {
+	if r.w == nil || *r.err != nil {
+		return
+	}
+	_, *r.err = r.w.Write(r.out.Bytes())
+	r.out.Reset()
+}
+
+// Close finishes a streaming result and returns the first error writing to
+// its writer.
+func (r Result) Close() error {
+	if r.format == conf.FORMAT_JSON {
+		r.out.WriteString("\n]")
+	}
+	r.flush()
+	return *r.err
+}
+
+// Written reports whether any row was added.
+func (r Result) Written() bool {
+	return *r.written
 }
 
 // A rowJSON is an internal struct to use with json.Marshal
 type rowJSON struct {
 	Row                           int
 	Datetime, User, Host, Command string
+	Note                          string `json:",omitempty"`
+	Count                         int    `json:",omitempty"`
+}
+
+// A rowNDJSON is a line of the ndjson format.
+type rowNDJSON struct {
+	User     string `json:"user"`
+	Host     string `json:"host"`
+	Command  string `json:"command"`
+	Datetime string `json:"datetime"`
+	Count    int    `json:"count"`
 }
 
 // AddRow adds a query row to a Result struct. This function is not thread safe!
 func (r Result) AddRow(row int, user, host string, command string, datetime time.Time) {
+	r.AddAnnotatedRow(row, user, host, command, datetime, "")
+}
+
+// AddAnnotatedRow adds a query row with the note attached to its command.
+// The note is omitted from formats meant to be imported again or piped.
+// This function is not thread safe!
+func (r Result) AddAnnotatedRow(row int, user, host string, command string, datetime time.Time, note string) {
+	r.AddCountedRow(row, user, host, command, datetime, note, 0)
+}
+
+// AddCountedRow adds a query row that stands for count runs of its command,
+// datetime being the latest. Text formats show counts above 1. As notes,
+// counts are omitted from formats meant to be imported again or piped.
+// This function is not thread safe!
+func (r Result) AddCountedRow(row int, user, host string, command string, datetime time.Time, note string, count int) {
 	var f string
+	if r.rewrite != nil {
+		user, host, command, note = r.rewrite(user, host, command, note)
+	}
 
 	switch *r.written {
 	case true:
@@ -89,15 +196,23 @@ func (r Result) AddRow(row int, user, host string, command string, datetime time
 
 	switch r.format {
 	case conf.FORMAT_ALL:
-		f = fmt.Sprintf(FORMAT_ALL_S, row, datetime, user, host, command)
+		f = fmt.Sprintf(FORMAT_ALL_S, row, colorize(displayTime(datetime), output.Cyan), user, host, colorize(command, output.White))
 	case conf.FORMAT_BASH_HISTORY:
-		f = fmt.Sprintf(FORMAT_BASH_HISTORY_S, datetime.Unix(), command)
+		f = fmt.Sprintf(FORMAT_BASH_HISTORY_S, datetime.Unix(), r.mark(command))
 	case conf.FORMAT_TIMESTAMP:
-		f = fmt.Sprintf(FORMAT_TIMESTAMP_S, datetime, command)
+		f = fmt.Sprintf(FORMAT_TIMESTAMP_S, colorize(displayTime(datetime), output.Cyan), colorize(command, output.White))
 	case conf.FORMAT_LOG:
-		f = fmt.Sprintf(FORMAT_LOG_S, datetime.Format(RFC3339alt), user, host, command)
+		f = fmt.Sprintf(FORMAT_LOG_S, colorize(datetime.Format(RFC3339alt), output.Cyan), user, host, colorize(command, output.White))
 	case conf.FORMAT_JSON:
-		b, _ := json.Marshal(rowJSON{row, datetime.Format(RFC3339alt), user, host, command})
+		b, _ := json.Marshal(rowJSON{row, datetime.Format(RFC3339alt), user, host, command, note, count})
+		_, _ = r.out.Write(b)
+		f = ""
+	case conf.FORMAT_NDJSON:
+		// A row we didn't count is a single run.
+		if count == 0 {
+			count = 1
+		}
+		b, _ := json.Marshal(rowNDJSON{user, host, command, datetime.Format(RFC3339alt), count})
 		_, _ = r.out.Write(b)
 		f = ""
 	case conf.FORMAT_EXPORT:
@@ -107,10 +222,44 @@ func (r Result) AddRow(row int, user, host string, command string, datetime time
 	case conf.FORMAT_COMMAND_LINE:
 		fallthrough
 	default:
-		f = fmt.Sprintf(FORMAT_COMMAND_LINE_S, row, command)
+		f = fmt.Sprintf(FORMAT_COMMAND_LINE_S, row, colorize(command, output.White))
 
 	}
 	r.out.WriteString(f)
+
+	switch r.format {
+	case conf.FORMAT_JSON, conf.FORMAT_NDJSON, conf.FORMAT_BASH_HISTORY, conf.FORMAT_EXPORT, conf.FORMAT_ROWS:
+	default:
+		if count > 1 {
+			r.out.WriteString(fmt.Sprintf(FORMAT_TIMES_S, count))
+		}
+		if note != "" {
+			r.out.WriteString(fmt.Sprintf(FORMAT_NOTE_S, note))
+		}
+	}
+	r.flush()
+}
+
+// colorize returns s in color if conf.ColorOutput is set. Only formats
+// meant to be read by people use it.
+func colorize(s string, color output.ANSIColor) string {
+	if !conf.ColorOutput {
+		return s
+	}
+	return output.Colorize(s, color)
+}
+
+// displayTime returns t as conf.DisplayTZ and conf.DisplayFormat say, for
+// formats meant to be read by people.
+func displayTime(t time.Time) string {
+	loc, layout := conf.DisplayTZ, conf.DisplayFormat
+	if loc == nil {
+		loc = time.Local
+	}
+	if layout == "" {
+		layout = "2006-01-02 15:04:05"
+	}
+	return t.In(loc).Format(layout)
 }
 
 // Formatted returns the result in the desired format after performing any necessary adjustment.
@@ -131,12 +280,22 @@ func (r Result) AddCountRow(count int, command string) {
 		_, _ = r.out.WriteString("\n")
 	default:
 		*r.written = true
-		*r.digits = digits(count)
+		if *r.digits == 0 {
+			*r.digits = digits(count)
+		}
 	}
 
-	f = fmt.Sprintf("%[2]*.[1]d | %[3]s", count, *r.digits, command)
+	n := fmt.Sprintf("%[2]*.[1]d", count, *r.digits)
+	f = fmt.Sprintf("%s | %s", colorize(n, output.Yellow), colorize(command, output.White))
 
 	r.out.WriteString(f)
+	r.flush()
+}
+
+// CountWidth sets the width of the count column to that of max, for count
+// rows that don't come largest first.
+func (r Result) CountWidth(max int) {
+	*r.digits = digits(max)
 }
 
 func digits(n int) int {